@@ -0,0 +1,229 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// AlertWindow is how long an AlertLogWriter coalesces similar records after
+// posting one, before posting a count of them.
+var AlertWindow = 5 * time.Minute
+
+// AlertLogWriter posts CRITICAL records to a Slack-compatible incoming
+// webhook, as {"text": ...}.  So that a burst of failures doesn't flood the
+// channel, the first record from a source is posted straight away, and
+// similar ones in the next AlertWindow are only counted, then summed up in
+// one message such as "17 similar messages in the last 5 minutes".  Records
+// are similar if they are at the same level and were logged from the same
+// source, or have the same message if they have no source.
+type AlertLogWriter struct {
+	// Records dropped because the queue was full (accessed atomically; first
+	// for alignment)
+	dropped uint64
+
+	records   chan *LogRecord
+	queue     *queueTracker
+	completed chan int
+
+	url    string
+	client *http.Client
+	enc    Encoder
+	level  Level
+	window time.Duration
+
+	// Records being coalesced, by what makes them similar
+	bursts map[string]*alertBurst
+}
+
+// Similar records since the last post about them
+type alertBurst struct {
+	start time.Time
+	count int
+	last  *LogRecord
+}
+
+// NewAlertLogWriter creates a LogWriter which posts CRITICAL records to the
+// webhook at url.
+func NewAlertLogWriter(url string) *AlertLogWriter {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		fmt.Fprintf(os.Stderr, "NewAlertLogWriter(%q): Invalid URL\n", url)
+		return nil
+	}
+
+	w := &AlertLogWriter{
+		records:   make(chan *LogRecord, LogBufferLength),
+		queue:     newQueueTracker(),
+		completed: make(chan int),
+		url:       url,
+		client:    &http.Client{Timeout: HTTPTimeout},
+		enc:       NewFormatEncoder(FORMAT_ABBREV),
+		level:     CRITICAL,
+		window:    AlertWindow,
+		bursts:    make(map[string]*alertBurst),
+	}
+	go w.run()
+	return w
+}
+
+// SetLevel sets the lowest level posted, CRITICAL by default (chainable).
+// Must be called before the first log message is written.
+func (w *AlertLogWriter) SetLevel(lvl Level) *AlertLogWriter {
+	w.level = lvl
+	return w
+}
+
+// SetFormat sets the format of the records posted, FORMAT_ABBREV by default
+// (chainable).  Must be called before the first log message is written.
+func (w *AlertLogWriter) SetFormat(format string) *AlertLogWriter {
+	w.enc = NewFormatEncoder(format)
+	return w
+}
+
+// SetEncoder sets how the records posted are written, in place of a format
+// (chainable).  Must be called before the first log message is written.
+func (w *AlertLogWriter) SetEncoder(enc Encoder) *AlertLogWriter {
+	w.enc = enc
+	return w
+}
+
+// SetWindow sets how long similar records are coalesced, in place of
+// AlertWindow (chainable).  Must be called before the first log message is
+// written.
+func (w *AlertLogWriter) SetWindow(window time.Duration) *AlertLogWriter {
+	w.window = window
+	return w
+}
+
+// This is the AlertLogWriter's output method
+func (w *AlertLogWriter) LogWrite(rec *LogRecord) {
+	if rec.Level < w.level {
+		return
+	}
+	token := w.queue.push(time.Now())
+	select {
+	case w.records <- rec:
+	default:
+		w.queue.unpush(token)
+		atomic.AddUint64(&w.dropped, 1)
+	}
+}
+
+// QueueStats reports on the records waiting to be posted.
+func (w *AlertLogWriter) QueueStats() QueueStats {
+	return QueueStats{
+		Length:    len(w.records),
+		Capacity:  cap(w.records),
+		OldestAge: w.queue.oldestAge(time.Now()),
+	}
+}
+
+// DroppedRecords returns how many records have been dropped because the
+// queue was full.
+func (w *AlertLogWriter) DroppedRecords() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
+
+// Close posts the counts of any records being coalesced.
+func (w *AlertLogWriter) Close() {
+	close(w.records)
+	<-w.completed
+}
+
+func (w *AlertLogWriter) run() {
+	defer close(w.completed)
+
+	// Settings take effect with the first record
+	rec, ok := <-w.records
+	if !ok {
+		return
+	}
+	w.queue.pop()
+	w.coalesce(rec, time.Now())
+
+	ticker := time.NewTicker(w.window / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case rec, ok := <-w.records:
+			if !ok {
+				w.summarize(time.Now(), true)
+				return
+			}
+			w.queue.pop()
+			w.coalesce(rec, time.Now())
+		case now := <-ticker.C:
+			w.summarize(now, false)
+		}
+	}
+}
+
+// Post a record, unless a similar one was posted within the window
+func (w *AlertLogWriter) coalesce(rec *LogRecord, now time.Time) {
+	key := rec.Level.String() + " " + rec.Source
+	if len(rec.Source) == 0 {
+		key += rec.Message
+	}
+	if burst, ok := w.bursts[key]; ok {
+		burst.count++
+		burst.last = rec
+		return
+	}
+	w.bursts[key] = &alertBurst{start: now}
+	w.post(strings.TrimRight(encodeText(w.enc, rec), "\n"))
+}
+
+// Post counts of the bursts whose windows have ended, or all of them
+func (w *AlertLogWriter) summarize(now time.Time, all bool) {
+	for key, burst := range w.bursts {
+		if !all && now.Sub(burst.start) < w.window {
+			continue
+		}
+		if burst.count == 0 {
+			delete(w.bursts, key)
+			continue
+		}
+
+		// Keep coalescing until a window passes without similar records
+		text := fmt.Sprintf("%d similar message(s) in the last %s, most recently:\n%s", burst.count, alertDuration(now.Sub(burst.start)), strings.TrimRight(encodeText(w.enc, burst.last), "\n"))
+		w.bursts[key] = &alertBurst{start: now}
+		w.post(text)
+	}
+}
+
+// Describe a duration as people would, to the second
+func alertDuration(d time.Duration) string {
+	switch d = d.Round(time.Second); {
+	case d >= time.Hour && d%time.Hour == 0:
+		return fmt.Sprintf("%d hour(s)", d/time.Hour)
+	case d >= time.Minute && d%time.Minute == 0:
+		return fmt.Sprintf("%d minute(s)", d/time.Minute)
+	case d <= time.Second:
+		return "second"
+	}
+	return d.String()
+}
+
+// Post a message to the webhook
+func (w *AlertLogWriter) post(text string) {
+	body, _ := json.Marshal(map[string]string{"text": text})
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "AlertLogWriter(%q): %s\n", w.url, err)
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		fmt.Fprintf(os.Stderr, "AlertLogWriter(%q): %s\n", w.url, resp.Status)
+	}
+}
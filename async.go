@@ -0,0 +1,104 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// AsyncLogWriter moves a slow writer off the caller's path: records wait in
+// its own bounded queue, and are handed to the wrapped writer on another
+// goroutine.  What happens when the queue is full is up to its
+// OverflowPolicy.
+type AsyncLogWriter struct {
+	// Records dropped because the queue was full (accessed atomically; first
+	// for alignment)
+	dropped uint64
+
+	records   chan *LogRecord
+	queue     *queueTracker
+	completed chan int
+
+	inner  LogWriter
+	policy OverflowPolicy
+}
+
+// NewAsyncLogWriter creates a LogWriter which queues up to queueLen records
+// for inner, applying policy to records logged while the queue is full.
+func NewAsyncLogWriter(inner LogWriter, queueLen int, policy OverflowPolicy) *AsyncLogWriter {
+	if queueLen < 1 {
+		queueLen = 1
+	}
+	w := &AsyncLogWriter{
+		records:   make(chan *LogRecord, queueLen),
+		queue:     newQueueTracker(),
+		completed: make(chan int),
+		inner:     inner,
+		policy:    policy,
+	}
+	go w.run()
+	return w
+}
+
+// This is the AsyncLogWriter's output method
+func (w *AsyncLogWriter) LogWrite(rec *LogRecord) {
+	token := w.queue.push(time.Now())
+
+	switch w.policy {
+	case OverflowDropNewest:
+		select {
+		case w.records <- rec:
+		default:
+			w.queue.unpush(token)
+			atomic.AddUint64(&w.dropped, 1)
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case w.records <- rec:
+				return
+			default:
+			}
+			select {
+			case <-w.records:
+				w.queue.pop()
+				atomic.AddUint64(&w.dropped, 1)
+			default:
+			}
+		}
+	default:
+		w.records <- rec
+	}
+}
+
+// QueueStats reports on the records waiting to be handed to the wrapped
+// writer.
+func (w *AsyncLogWriter) QueueStats() QueueStats {
+	return QueueStats{
+		Length:    len(w.records),
+		Capacity:  cap(w.records),
+		OldestAge: w.queue.oldestAge(time.Now()),
+	}
+}
+
+// DroppedRecords returns how many records have been dropped because the queue
+// was full.
+func (w *AsyncLogWriter) DroppedRecords() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
+
+// Close hands any queued records to the wrapped writer, then closes it.
+func (w *AsyncLogWriter) Close() {
+	close(w.records)
+	<-w.completed
+	w.inner.Close()
+}
+
+func (w *AsyncLogWriter) run() {
+	defer close(w.completed)
+	for rec := range w.records {
+		w.queue.pop()
+		w.inner.LogWrite(rec)
+	}
+}
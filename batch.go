@@ -0,0 +1,220 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// BatchMaxRecords is the most records a batching writer, such as
+	// HTTPLogWriter, sends together.
+	BatchMaxRecords = 100
+
+	// BatchFlushInterval is the longest a batching writer holds a record
+	// before sending the batch it is in.
+	BatchFlushInterval = time.Second
+
+	// BatchMaxInFlight is how many batches a batching writer sends at once.
+	BatchMaxInFlight = 2
+
+	// BatchRetries is how many times a batching writer tries a batch again
+	// after the first attempt fails.  The wait before each retry starts at
+	// BatchRetryMin and doubles up to BatchRetryMax.
+	BatchRetries  = 3
+	BatchRetryMin = 500 * time.Millisecond
+	BatchRetryMax = 30 * time.Second
+)
+
+// BatchStats counts what a batching writer has sent since it was created.
+type BatchStats struct {
+	Batches uint64 // Batches sent
+	Records uint64 // Records in the batches sent
+	Retries uint64 // Attempts to send a batch again after a failure
+	Dropped uint64 // Records in batches which couldn't be sent
+}
+
+// The counters behind BatchStats (accessed atomically)
+type batchCounters struct {
+	batches uint64
+	records uint64
+	retries uint64
+	dropped uint64
+}
+
+// An error which trying again won't fix, such as a request being refused
+type permanentError struct {
+	error
+}
+
+// A failure of only some of a batch: the records worth sending again, and
+// how many others were refused for good.  The rest were sent.
+type partialError struct {
+	error
+	retry   []*LogRecord
+	refused int
+}
+
+// The queueing, batching and retrying shared by writers which send records
+// in batches.  send is called with each batch, on as many goroutines at once
+// as maxInFlight allows.
+type batchWriter struct {
+	// Counters reported by Stats (first for alignment)
+	counters batchCounters
+
+	records   chan *LogRecord
+	queue     *queueTracker
+	completed chan int
+
+	// How the writer is named in error messages
+	name string
+	send func(batch []*LogRecord) error
+
+	maxRecords    int
+	flushInterval time.Duration
+	maxInFlight   int
+
+	retries            int
+	retryMin, retryMax time.Duration
+}
+
+func newBatchWriter(name string, send func(batch []*LogRecord) error) *batchWriter {
+	w := &batchWriter{
+		records:       make(chan *LogRecord, LogBufferLength),
+		queue:         newQueueTracker(),
+		completed:     make(chan int),
+		name:          name,
+		send:          send,
+		maxRecords:    BatchMaxRecords,
+		flushInterval: BatchFlushInterval,
+		maxInFlight:   BatchMaxInFlight,
+		retries:       BatchRetries,
+		retryMin:      BatchRetryMin,
+		retryMax:      BatchRetryMax,
+	}
+	go w.run()
+	return w
+}
+
+// This is the writer's output method
+func (w *batchWriter) LogWrite(rec *LogRecord) {
+	w.queue.push(time.Now())
+	w.records <- rec
+}
+
+// QueueStats reports on the records waiting to be batched.
+func (w *batchWriter) QueueStats() QueueStats {
+	return QueueStats{
+		Length:    len(w.records),
+		Capacity:  cap(w.records),
+		OldestAge: w.queue.oldestAge(time.Now()),
+	}
+}
+
+// Stats returns the writer's counters.
+func (w *batchWriter) Stats() BatchStats {
+	return BatchStats{
+		Batches: atomic.LoadUint64(&w.counters.batches),
+		Records: atomic.LoadUint64(&w.counters.records),
+		Retries: atomic.LoadUint64(&w.counters.retries),
+		Dropped: atomic.LoadUint64(&w.counters.dropped),
+	}
+}
+
+// Close sends any queued records, waiting for batches being sent or retried.
+func (w *batchWriter) Close() {
+	close(w.records)
+	<-w.completed
+}
+
+func (w *batchWriter) run() {
+	defer close(w.completed)
+
+	// Settings take effect with the first record
+	rec, ok := <-w.records
+	if !ok {
+		return
+	}
+	w.queue.pop()
+	batch := []*LogRecord{rec}
+
+	var inFlight sync.WaitGroup
+	slots := make(chan bool, w.maxInFlight)
+	dispatch := func() {
+		if len(batch) == 0 {
+			return
+		}
+		slots <- true
+		inFlight.Add(1)
+		go func(batch []*LogRecord) {
+			defer inFlight.Done()
+			w.sendWithRetry(batch)
+			<-slots
+		}(batch)
+		batch = make([]*LogRecord, 0, w.maxRecords)
+	}
+	defer inFlight.Wait()
+
+	// The batch is sent when it's full, or flushInterval after its first
+	// record arrived
+	timer := time.NewTimer(w.flushInterval)
+	defer timer.Stop()
+	for {
+		if len(batch) >= w.maxRecords {
+			dispatch()
+		}
+		select {
+		case rec, ok := <-w.records:
+			if !ok {
+				dispatch()
+				return
+			}
+			w.queue.pop()
+			if len(batch) == 0 {
+				timer.Reset(w.flushInterval)
+			}
+			batch = append(batch, rec)
+		case <-timer.C:
+			dispatch()
+		}
+	}
+}
+
+// Send a batch, trying again with growing waits while it fails
+func (w *batchWriter) sendWithRetry(batch []*LogRecord) {
+	wait := w.retryMin
+	for attempt := 0; ; attempt++ {
+		err := w.send(batch)
+		if partial, ok := err.(partialError); ok {
+			sent := len(batch) - len(partial.retry) - partial.refused
+			atomic.AddUint64(&w.counters.records, uint64(sent))
+			if partial.refused > 0 {
+				atomic.AddUint64(&w.counters.dropped, uint64(partial.refused))
+				fmt.Fprintf(os.Stderr, "%s: Dropped %d record(s): %s\n", w.name, partial.refused, partial.error)
+			}
+			if batch = partial.retry; len(batch) == 0 {
+				atomic.AddUint64(&w.counters.batches, 1)
+				return
+			}
+		} else if err == nil {
+			atomic.AddUint64(&w.counters.batches, 1)
+			atomic.AddUint64(&w.counters.records, uint64(len(batch)))
+			return
+		}
+		if _, permanent := err.(permanentError); permanent || attempt >= w.retries {
+			atomic.AddUint64(&w.counters.dropped, uint64(len(batch)))
+			fmt.Fprintf(os.Stderr, "%s: Dropped %d record(s): %s\n", w.name, len(batch), err)
+			return
+		}
+
+		atomic.AddUint64(&w.counters.retries, 1)
+		time.Sleep(wait)
+		if wait *= 2; wait > w.retryMax {
+			wait = w.retryMax
+		}
+	}
+}
@@ -0,0 +1,339 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+// log4go-cat pretty-prints logs written with the JSON or logfmt encoders.
+//
+// Usage:
+//
+//	log4go-cat [-f] [-level LEVEL] [-field key=value]... [-color=false] [file...]
+//
+// With no files, standard input is read.  Lines which are neither JSON nor
+// logfmt are printed unchanged.  With -f, the files are followed as they grow,
+// and reopened if they are rotated or truncated.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	l4g "github.com/scalingdata/log4go"
+)
+
+var (
+	follow   = flag.Bool("f", false, "follow the files as they grow")
+	minLevel = flag.String("level", "FINEST", "only show records at or above this level")
+	color    = flag.Bool("color", true, "colorize output by level")
+	fields   fieldFilters
+)
+
+func init() {
+	flag.Var(&fields, "field", "only show records with the field key=value (repeatable)")
+}
+
+// fieldFilters collects the -field flags
+type fieldFilters map[string]string
+
+func (f *fieldFilters) String() string {
+	return fmt.Sprint(map[string]string(*f))
+}
+
+func (f *fieldFilters) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i <= 0 {
+		return fmt.Errorf("expected key=value, got %q", value)
+	}
+	if *f == nil {
+		*f = make(fieldFilters)
+	}
+	(*f)[value[:i]] = value[i+1:]
+	return nil
+}
+
+// ANSI colors for each level
+var levelColors = map[l4g.Level]string{
+	l4g.FINEST:   "\x1b[90m",
+	l4g.FINE:     "\x1b[90m",
+	l4g.TRACE:    "\x1b[36m",
+	l4g.DEBUG:    "\x1b[36m",
+	l4g.INFO:     "\x1b[32m",
+	l4g.WARNING:  "\x1b[33m",
+	l4g.ERROR:    "\x1b[31m",
+	l4g.CRITICAL: "\x1b[1;31m",
+}
+
+const colorReset = "\x1b[0m"
+
+// A parsed line
+type entry struct {
+	level   l4g.Level
+	time    time.Time
+	source  string
+	message string
+	fields  map[string]string
+}
+
+func main() {
+	flag.Parse()
+
+	min, ok := l4g.ParseLevel(strings.ToUpper(*minLevel))
+	if !ok {
+		fmt.Fprintf(os.Stderr, "log4go-cat: unknown level %q\n", *minLevel)
+		os.Exit(2)
+	}
+	if *follow && flag.NArg() > 1 {
+		fmt.Fprintf(os.Stderr, "log4go-cat: -f follows a single file\n")
+		os.Exit(2)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	show := func(line []byte) {
+		render(out, line, min)
+		if *follow {
+			out.Flush()
+		}
+	}
+
+	if flag.NArg() == 0 {
+		if err := scan(os.Stdin, show); err != nil {
+			fmt.Fprintf(os.Stderr, "log4go-cat: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	failed := false
+	for _, name := range flag.Args() {
+		var err error
+		if *follow {
+			err = followFile(name, show, nil)
+		} else {
+			err = catFile(name, show)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "log4go-cat: %s\n", err)
+			failed = true
+		}
+	}
+	if failed {
+		out.Flush()
+		os.Exit(1)
+	}
+}
+
+func catFile(name string, show func([]byte)) error {
+	fd, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return scan(fd, show)
+}
+
+func scan(r io.Reader, show func([]byte)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		show(scanner.Bytes())
+	}
+	return scanner.Err()
+}
+
+// How often a followed file is checked for more lines
+var followInterval = 250 * time.Millisecond
+
+// Follow a file as it grows, reopening it when it is rotated or truncated,
+// until stop is closed
+func followFile(name string, show func([]byte), stop <-chan struct{}) error {
+	fd, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer func() { fd.Close() }()
+
+	reader := bufio.NewReader(fd)
+	var partial []byte
+
+	// Show the lines up to the end of the file as it stands
+	drain := func() error {
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err != nil {
+				partial = append(partial, line...)
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+			show(bytes.TrimRight(append(partial, line...), "\r\n"))
+			partial = partial[:0]
+		}
+	}
+
+	for {
+		if err := drain(); err != nil {
+			return err
+		}
+
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(followInterval):
+		}
+
+		// Reopen if the file was replaced or truncated
+		current, statErr := os.Stat(name)
+		if statErr != nil {
+			continue
+		}
+		opened, _ := fd.Stat()
+		pos, _ := fd.Seek(0, io.SeekCurrent)
+		if opened == nil || !os.SameFile(current, opened) || current.Size() < pos {
+			if replacement, err := os.Open(name); err == nil {
+				// Finish what was written to the old file before it was
+				// replaced, including a last line without a newline
+				if err := drain(); err != nil {
+					replacement.Close()
+					return err
+				}
+				if len(partial) > 0 {
+					show(bytes.TrimRight(partial, "\r\n"))
+				}
+				fd.Close()
+				fd = replacement
+				reader.Reset(fd)
+				partial = partial[:0]
+			}
+		}
+	}
+}
+
+func render(out *bufio.Writer, line []byte, min l4g.Level) {
+	e, ok := parse(line)
+	if !ok {
+		out.Write(line)
+		out.WriteByte('\n')
+		return
+	}
+	if e.level < min {
+		return
+	}
+	for k, v := range fields {
+		if e.fields[k] != v {
+			return
+		}
+	}
+
+	if *color {
+		out.WriteString(levelColors[e.level])
+	}
+	if !e.time.IsZero() {
+		out.WriteString(e.time.Format("2006-01-02 15:04:05.000 "))
+	}
+	out.WriteString(e.level.String())
+	if *color {
+		out.WriteString(colorReset)
+	}
+	if len(e.source) > 0 {
+		out.WriteString(" (" + e.source + ")")
+	}
+	out.WriteString(" " + e.message)
+
+	keys := make([]string, 0, len(e.fields))
+	for k := range e.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if *color {
+			out.WriteString(" \x1b[2m" + k + "=" + colorReset + e.fields[k])
+		} else {
+			out.WriteString(" " + k + "=" + e.fields[k])
+		}
+	}
+	out.WriteByte('\n')
+}
+
+func parse(line []byte) (entry, bool) {
+	trimmed := bytes.TrimSpace(line)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		return parseJSON(trimmed)
+	}
+	return parseLogfmt(string(trimmed))
+}
+
+func parseJSON(line []byte) (entry, bool) {
+	var rec struct {
+		Level   string                 `json:"level"`
+		Time    time.Time              `json:"time"`
+		Source  string                 `json:"source"`
+		Message string                 `json:"message"`
+		Fields  map[string]interface{} `json:"fields"`
+	}
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return entry{}, false
+	}
+	lvl, ok := l4g.ParseLevel(rec.Level)
+	if !ok {
+		return entry{}, false
+	}
+	e := entry{level: lvl, time: rec.Time, source: rec.Source, message: rec.Message, fields: make(map[string]string)}
+	for k, v := range rec.Fields {
+		e.fields[k] = fmt.Sprint(v)
+	}
+	return e, true
+}
+
+func parseLogfmt(line string) (entry, bool) {
+	e := entry{fields: make(map[string]string)}
+	sawLevel := false
+	for len(line) > 0 {
+		eq := strings.IndexByte(line, '=')
+		if eq <= 0 || strings.ContainsAny(line[:eq], " \"") {
+			return entry{}, false
+		}
+		key := line[:eq]
+		line = line[eq+1:]
+
+		var value string
+		if strings.HasPrefix(line, "\"") {
+			quoted, err := strconv.QuotedPrefix(line)
+			if err != nil {
+				return entry{}, false
+			}
+			value, _ = strconv.Unquote(quoted)
+			line = line[len(quoted):]
+		} else if sp := strings.IndexByte(line, ' '); sp >= 0 {
+			value, line = line[:sp], line[sp:]
+		} else {
+			value, line = line, ""
+		}
+		line = strings.TrimLeft(line, " ")
+
+		switch key {
+		case "time":
+			e.time, _ = time.Parse(time.RFC3339Nano, value)
+		case "level":
+			lvl, ok := l4g.ParseLevel(value)
+			if !ok {
+				return entry{}, false
+			}
+			e.level, sawLevel = lvl, true
+		case "source":
+			e.source = value
+		case "msg":
+			e.message = value
+		default:
+			e.fields[key] = value
+		}
+	}
+	return e, sawLevel
+}
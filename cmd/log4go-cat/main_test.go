@@ -0,0 +1,134 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	l4g "github.com/scalingdata/log4go"
+)
+
+func TestParse(t *testing.T) {
+	tests := map[string]struct {
+		ok      bool
+		level   l4g.Level
+		message string
+		fields  map[string]string
+	}{
+		`{"level":"EROR","time":"2024-01-02T03:04:05Z","source":"main.go:10","message":"failed","fields":{"user":"bob","n":3}}`: {
+			true, l4g.ERROR, "failed", map[string]string{"user": "bob", "n": "3"},
+		},
+		`time=2024-01-02T03:04:05Z level=INFO source=main.go:10 msg="hello there" user=bob`: {
+			true, l4g.INFO, "hello there", map[string]string{"user": "bob"},
+		},
+		`plain text`:                     {ok: false},
+		`{"level":"NOPE","message":"x"}`: {ok: false},
+		`key=value without a level`:      {ok: false},
+	}
+	for line, want := range tests {
+		e, ok := parse([]byte(line))
+		if ok != want.ok {
+			t.Errorf("%s: parsed = %v, want %v", line, ok, want.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if e.level != want.level || e.message != want.message {
+			t.Errorf("%s: got %s %q, want %s %q", line, e.level, e.message, want.level, want.message)
+		}
+		if len(e.fields) != len(want.fields) {
+			t.Errorf("%s: got fields %v, want %v", line, e.fields, want.fields)
+		}
+		for k, v := range want.fields {
+			if e.fields[k] != v {
+				t.Errorf("%s: got fields %v, want %v", line, e.fields, want.fields)
+			}
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	defer func(c bool, f fieldFilters) { *color, fields = c, f }(*color, fields)
+	*color, fields = false, fieldFilters{"user": "bob"}
+
+	var buf bytes.Buffer
+	out := bufio.NewWriter(&buf)
+	for _, line := range []string{
+		`level=DEBG msg="too low" user=bob`,
+		`level=WARN msg="someone else" user=alice`,
+		`level=WARN msg=shown user=bob`,
+		`not a record`,
+	} {
+		render(out, []byte(line), l4g.INFO)
+	}
+	out.Flush()
+
+	if got, want := buf.String(), "WARN shown user=bob\nnot a record\n"; got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+}
+
+func TestFollowFileRotation(t *testing.T) {
+	defer func(interval time.Duration) { followInterval = interval }(followInterval)
+	followInterval = 10 * time.Millisecond
+
+	dir, err := ioutil.TempDir("", "follow")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "app.log")
+	if err := ioutil.WriteFile(name, []byte("first\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+
+	lines := make(chan string, 10)
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- followFile(name, func(line []byte) { lines <- string(line) }, stop)
+	}()
+	next := func() string {
+		select {
+		case line := <-lines:
+			return line
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for a line")
+			return ""
+		}
+	}
+	if got := next(); got != "first" {
+		t.Fatalf("Got %q, want %q", got, "first")
+	}
+
+	// Lines written just before the file is replaced are still shown
+	fd, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile: %s", err)
+	}
+	fd.WriteString("last\nunterminated")
+	fd.Close()
+	if err := os.Rename(name, name+".1"); err != nil {
+		t.Fatalf("Rename: %s", err)
+	}
+	if err := ioutil.WriteFile(name, []byte("after\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+
+	for _, want := range []string{"last", "unterminated", "after"} {
+		if got := next(); got != want {
+			t.Errorf("Got %q, want %q", got, want)
+		}
+	}
+	close(stop)
+	if err := <-done; err != nil {
+		t.Errorf("followFile: %s", err)
+	}
+}
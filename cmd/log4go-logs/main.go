@@ -0,0 +1,413 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+// log4go-logs merges, verifies and splits log files, including rotated files
+// which have been compressed with gzip or zip.
+//
+// Usage:
+//
+//	log4go-logs merge [-o file] file...
+//	log4go-logs verify [-footer text] file...
+//	log4go-logs split [-from time] [-to time] [-level LEVEL] [-by level|day -dir dir] file...
+//
+// Records may be in any of the formats understood by log4go.LogReader.  Lines
+// which continue a record (such as the rest of a multi-line message) stay with
+// the record before them.
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	l4g "github.com/scalingdata/log4go"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage:\n")
+	fmt.Fprintf(os.Stderr, "  log4go-logs merge [-o file] file...\n")
+	fmt.Fprintf(os.Stderr, "  log4go-logs verify [-footer text] file...\n")
+	fmt.Fprintf(os.Stderr, "  log4go-logs split [-from time] [-to time] [-level LEVEL] [-by level|day -dir dir] file...\n")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "merge":
+		err = merge(args)
+	case "verify":
+		err = verify(args)
+	case "split":
+		err = split(args)
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "log4go-logs: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+/****** Records ******/
+
+// A record as found in a file: its raw lines, plus what was parsed from them
+type record struct {
+	lines []byte
+	line  int
+	time  time.Time
+	level l4g.Level
+}
+
+// Reads the records from a (possibly compressed) file
+type recordReader struct {
+	name string
+	*l4g.LogReader
+}
+
+func openRecords(name string) (*recordReader, error) {
+	r, err := l4g.OpenLogFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return &recordReader{name, r}, nil
+}
+
+// Return the next record, or nil at the end of the file or on error
+func (r *recordReader) next() *record {
+	if !r.Next() {
+		return nil
+	}
+	rec := r.Record()
+	return &record{lines: r.Raw(), line: r.Line(), time: rec.Created, level: rec.Level}
+}
+
+func (r *recordReader) err() error {
+	if err := r.Err(); err != nil {
+		return fmt.Errorf("%s: %s", r.name, err)
+	}
+	return nil
+}
+
+// Open all of the named files, closing any already opened on failure
+func openAll(names []string) ([]*recordReader, error) {
+	if len(names) == 0 {
+		return nil, errors.New("no files given")
+	}
+	var readers []*recordReader
+	for _, name := range names {
+		r, err := openRecords(name)
+		if err != nil {
+			for _, r := range readers {
+				r.Close()
+			}
+			return nil, err
+		}
+		readers = append(readers, r)
+	}
+	return readers, nil
+}
+
+/****** merge ******/
+
+// A heap of the next record from each file, earliest first
+type mergeHeap []*mergeItem
+
+type mergeItem struct {
+	rec    *record
+	reader *recordReader
+	order  int
+}
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if !h[i].rec.time.Equal(h[j].rec.time) {
+		return h[i].rec.time.Before(h[j].rec.time)
+	}
+	return h[i].order < h[j].order
+}
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(*mergeItem)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// Merge the records from several files, calling emit on each in time order
+func mergeRecords(readers []*recordReader, emit func(*record) error) error {
+	h := &mergeHeap{}
+	for i, r := range readers {
+		if rec := r.next(); rec != nil {
+			heap.Push(h, &mergeItem{rec, r, i})
+		} else if err := r.err(); err != nil {
+			return err
+		}
+	}
+	for h.Len() > 0 {
+		item := (*h)[0]
+		if err := emit(item.rec); err != nil {
+			return err
+		}
+		if item.rec = item.reader.next(); item.rec != nil {
+			heap.Fix(h, 0)
+		} else {
+			if err := item.reader.err(); err != nil {
+				return err
+			}
+			heap.Pop(h)
+		}
+	}
+	return nil
+}
+
+func merge(args []string) error {
+	flags := flag.NewFlagSet("merge", flag.ExitOnError)
+	output := flags.String("o", "", "write the merged log to this file instead of standard output")
+	flags.Parse(args)
+
+	readers, err := openAll(flags.Args())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, r := range readers {
+			r.Close()
+		}
+	}()
+
+	var out io.Writer = os.Stdout
+	if len(*output) > 0 {
+		fd, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+		out = fd
+	}
+	buf := bufio.NewWriter(out)
+	if err := mergeRecords(readers, func(rec *record) error {
+		_, err := buf.Write(rec.lines)
+		return err
+	}); err != nil {
+		return err
+	}
+	return buf.Flush()
+}
+
+/****** verify ******/
+
+// Check that each file can be read in full, which for compressed files checks
+// their checksums, and that its records are readable and in time order.  With
+// -footer, each file must also end with the footer it was written with, as
+// given to FileLogWriter.SetHeadFoot, showing that it was closed cleanly
+// rather than cut short.  Records carry no checksums or signatures of their
+// own, so a record altered in place can't be detected.
+func verify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	footer := flags.String("footer", "", "require each file to end with this footer (format codes match any text)")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		return errors.New("no files given")
+	}
+
+	bad := 0
+	for _, name := range flags.Args() {
+		problems := verifyFile(name, *footer)
+		if len(problems) == 0 {
+			fmt.Printf("%s: OK\n", name)
+			continue
+		}
+		bad++
+		for _, p := range problems {
+			fmt.Printf("%s: %s\n", name, p)
+		}
+	}
+	if bad > 0 {
+		return fmt.Errorf("%d of %d files failed verification", bad, flags.NArg())
+	}
+	return nil
+}
+
+// Maximum problems reported per file
+const maxProblems = 10
+
+func verifyFile(name, footer string) (problems []string) {
+	r, err := openRecords(name)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	defer r.Close()
+	r.SetHeadFoot("", footer)
+
+	var last time.Time
+	records, skipped := 0, 0
+	for rec := r.next(); rec != nil; rec = r.next() {
+		// Only a header may come before the first record
+		if records > 0 && r.Skipped() > skipped {
+			problems = append(problems, fmt.Sprintf("line %d: %d unrecognized lines before this record", rec.line, r.Skipped()-skipped))
+		}
+		skipped = r.Skipped()
+
+		if rec.time.Before(last) {
+			problems = append(problems, fmt.Sprintf("line %d: record at %s is earlier than the one before it (%s)",
+				rec.line, rec.time.Format(time.RFC3339Nano), last.Format(time.RFC3339Nano)))
+		}
+		if !rec.time.IsZero() {
+			last = rec.time
+		}
+		records++
+
+		if len(problems) >= maxProblems {
+			return append(problems, "too many problems, giving up")
+		}
+	}
+	if err := r.err(); err != nil {
+		problems = append(problems, err.Error())
+	} else if records == 0 {
+		problems = append(problems, "no records found")
+	} else if len(footer) > 0 && !r.EndsWithFooter() {
+		problems = append(problems, "missing footer; the file may have been cut short")
+	}
+	return problems
+}
+
+/****** split ******/
+
+// Layouts of the date and time in the text formats, also accepted on the
+// command line
+var textLayouts = []string{
+	"2006/01/02 15:04:05 MST",
+	"2006/01/02 15:04:05.000",
+}
+
+// Parse a time given on the command line, as RFC3339 or in the text layouts
+func parseTimeFlag(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range append([]string{"2006-01-02 15:04:05", "2006-01-02"}, textLayouts...) {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("can't parse time %q", value)
+}
+
+func split(args []string) error {
+	flags := flag.NewFlagSet("split", flag.ExitOnError)
+	from := flags.String("from", "", "only include records at or after this time")
+	to := flags.String("to", "", "only include records before this time")
+	minLevel := flags.String("level", "", "only include records at or above this level")
+	by := flags.String("by", "", "write records to a file per \"level\" or per \"day\"")
+	dir := flags.String("dir", ".", "directory for the files written by -by")
+	flags.Parse(args)
+
+	var start, end time.Time
+	var err error
+	if len(*from) > 0 {
+		if start, err = parseTimeFlag(*from); err != nil {
+			return err
+		}
+	}
+	if len(*to) > 0 {
+		if end, err = parseTimeFlag(*to); err != nil {
+			return err
+		}
+	}
+	min := l4g.FINEST
+	if len(*minLevel) > 0 {
+		var ok bool
+		if min, ok = l4g.ParseLevel(strings.ToUpper(*minLevel)); !ok {
+			return fmt.Errorf("unknown level %q", *minLevel)
+		}
+	}
+
+	var bucket func(rec *record) string
+	switch *by {
+	case "":
+	case "level":
+		bucket = func(rec *record) string { return strings.ToLower(rec.level.String()) }
+	case "day":
+		bucket = func(rec *record) string { return rec.time.Format("2006-01-02") }
+	default:
+		return fmt.Errorf("can't split by %q", *by)
+	}
+	if bucket != nil {
+		if err := os.MkdirAll(*dir, l4g.LogDirectoryMode); err != nil {
+			return err
+		}
+	}
+
+	readers, err := openAll(flags.Args())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, r := range readers {
+			r.Close()
+		}
+	}()
+
+	// Output files are named after the first input, e.g. app.log gives
+	// app.eror.log or app.2010-01-02.log
+	base := filepath.Base(flags.Arg(0))
+	for _, ext := range []string{".gz", ".zip"} {
+		base = strings.TrimSuffix(base, ext)
+	}
+	ext := filepath.Ext(base)
+	base = strings.TrimSuffix(base, ext)
+
+	outputs := make(map[string]*bufio.Writer)
+	var files []*os.File
+	defer func() {
+		for _, fd := range files {
+			fd.Close()
+		}
+	}()
+	stdout := bufio.NewWriter(os.Stdout)
+
+	err = mergeRecords(readers, func(rec *record) error {
+		if rec.level < min || (!start.IsZero() && rec.time.Before(start)) || (!end.IsZero() && !rec.time.Before(end)) {
+			return nil
+		}
+		if bucket == nil {
+			_, err := stdout.Write(rec.lines)
+			return err
+		}
+
+		key := bucket(rec)
+		out, ok := outputs[key]
+		if !ok {
+			fd, err := os.Create(filepath.Join(*dir, base+"."+key+ext))
+			if err != nil {
+				return err
+			}
+			files = append(files, fd)
+			out = bufio.NewWriter(fd)
+			outputs[key] = out
+		}
+		_, err := out.Write(rec.lines)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, out := range outputs {
+		if err := out.Flush(); err != nil {
+			return err
+		}
+	}
+	return stdout.Flush()
+}
@@ -0,0 +1,151 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	l4g "github.com/scalingdata/log4go"
+)
+
+var base = time.Date(2010, 1, 2, 23, 59, 58, 0, time.UTC)
+
+// A record in the default text format, seconds after base
+func line(seconds int, lvl l4g.Level, msg string) string {
+	rec := &l4g.LogRecord{Level: lvl, Created: base.Add(time.Duration(seconds) * time.Second), Source: "src", Message: msg}
+	return l4g.FormatLogRecord(l4g.FORMAT_DEFAULT, rec)
+}
+
+// Write each of contents to a file in dir, returning their names
+func writeLogs(t *testing.T, dir string, contents ...string) []string {
+	var names []string
+	for i, content := range contents {
+		name := filepath.Join(dir, string(rune('a'+i))+".log")
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatalf("WriteFile: %s", err)
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name   string
+		inputs []string
+		want   string
+	}{
+		{
+			"interleaved",
+			[]string{line(0, l4g.INFO, "a1") + line(2, l4g.INFO, "a2"), line(1, l4g.INFO, "b1") + line(3, l4g.INFO, "b2")},
+			line(0, l4g.INFO, "a1") + line(1, l4g.INFO, "b1") + line(2, l4g.INFO, "a2") + line(3, l4g.INFO, "b2"),
+		},
+		{
+			"ties in file order",
+			[]string{line(0, l4g.INFO, "a1"), line(0, l4g.INFO, "b1")},
+			line(0, l4g.INFO, "a1") + line(0, l4g.INFO, "b1"),
+		},
+		{
+			"continuation lines stay with their record",
+			[]string{line(0, l4g.ERROR, "a1") + "  at main.go:10\n" + line(2, l4g.INFO, "a2"), line(1, l4g.INFO, "b1")},
+			line(0, l4g.ERROR, "a1") + "  at main.go:10\n" + line(1, l4g.INFO, "b1") + line(2, l4g.INFO, "a2"),
+		},
+	}
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "merge")
+		if err != nil {
+			t.Fatalf("TempDir: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		out := filepath.Join(dir, "merged")
+		if err := merge(append([]string{"-o", out}, writeLogs(t, dir, test.inputs...)...)); err != nil {
+			t.Errorf("%s: merge: %s", test.name, err)
+			continue
+		}
+		if got, _ := ioutil.ReadFile(out); string(got) != test.want {
+			t.Errorf("%s: merged\n%s\nwant\n%s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	input := line(0, l4g.INFO, "one") + line(1, l4g.ERROR, "two") + "  continued\n" + line(3, l4g.INFO, "three")
+	tests := []struct {
+		by   string
+		want map[string]string
+	}{
+		{"level", map[string]string{
+			"a.info.log": line(0, l4g.INFO, "one") + line(3, l4g.INFO, "three"),
+			"a.eror.log": line(1, l4g.ERROR, "two") + "  continued\n",
+		}},
+		{"day", map[string]string{
+			"a.2010-01-02.log": line(0, l4g.INFO, "one") + line(1, l4g.ERROR, "two") + "  continued\n",
+			"a.2010-01-03.log": line(3, l4g.INFO, "three"),
+		}},
+	}
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "split")
+		if err != nil {
+			t.Fatalf("TempDir: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		// The output directory is created if need be
+		out := filepath.Join(dir, "out")
+		if err := split(append([]string{"-by", test.by, "-dir", out}, writeLogs(t, dir, input)...)); err != nil {
+			t.Errorf("by %s: split: %s", test.by, err)
+			continue
+		}
+		written, _ := filepath.Glob(filepath.Join(out, "*"))
+		if len(written) != len(test.want) {
+			t.Errorf("by %s: wrote %v, want %d files", test.by, written, len(test.want))
+		}
+		for name, want := range test.want {
+			if got, err := ioutil.ReadFile(filepath.Join(out, name)); string(got) != want {
+				t.Errorf("by %s: %s holds %q (%v), want %q", test.by, name, got, err, want)
+			}
+		}
+	}
+}
+
+func TestVerifyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	footer := "== closed %D %T =="
+	closed := l4g.FormatLogRecord(footer, &l4g.LogRecord{Created: base})
+	tests := []struct {
+		name     string
+		content  string
+		footer   string
+		problems []string
+	}{
+		{"in order", line(0, l4g.INFO, "one") + line(1, l4g.INFO, "two"), "", nil},
+		{"out of order", line(1, l4g.INFO, "one") + line(0, l4g.INFO, "two"), "", []string{"is earlier than"}},
+		{"empty", "", "", []string{"no records found"}},
+		{"with footer", line(0, l4g.INFO, "one") + closed, footer, nil},
+		{"missing footer", line(0, l4g.INFO, "one"), footer, []string{"missing footer"}},
+	}
+	for _, test := range tests {
+		names := writeLogs(t, dir, test.content)
+		problems := verifyFile(names[0], test.footer)
+		if len(problems) != len(test.problems) {
+			t.Errorf("%s: got problems %q, want %q", test.name, problems, test.problems)
+			continue
+		}
+		for i, want := range test.problems {
+			if !strings.Contains(problems[i], want) {
+				t.Errorf("%s: got problem %q, want one mentioning %q", test.name, problems[i], want)
+			}
+		}
+	}
+}
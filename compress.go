@@ -0,0 +1,293 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// A compressor is a stream compressor which can be flushed so the receiver can
+// decode everything written so far.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// Create a compressor for the given method writing to w
+func newCompressor(w io.Writer, method CompressionMethod) (compressor, error) {
+	switch method {
+	case COMPRESSION_GZIP:
+		return gzip.NewWriter(w), nil
+	case COMPRESSION_SNAPPY:
+		return newSnappyWriter(w), nil
+	}
+	return nil, fmt.Errorf("unsupported compression method %q", method)
+}
+
+// Compress buf as a complete, self-contained stream
+func compressBytes(buf []byte, method CompressionMethod) ([]byte, error) {
+	var out bytes.Buffer
+	c, err := newCompressor(&out, method)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.Write(buf); err != nil {
+		return nil, err
+	}
+	if err := c.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+/****** Rotated files ******/
+
+// A Compressor compresses rotated log files.  Implementations wrapping other
+// codecs, such as zstd, lz4 or snappy, can be given to a FileLogWriter with
+// SetRotationCompressor.
+type Compressor interface {
+	// Extension is appended to the rotated file's name, without a leading
+	// dot, e.g. "zst".
+	Extension() string
+
+	// NewWriter returns a writer which compresses what is written to it into
+	// dst.  Closing it must flush everything to dst, but not close dst.  name
+	// is the base name of the file being compressed, for formats which record
+	// it.
+	NewWriter(dst io.Writer, name string) (io.WriteCloser, error)
+}
+
+// GzipCompressor compresses rotated files with gzip at the given level; the
+// zero value uses gzip.DefaultCompression.
+type GzipCompressor struct {
+	Level int
+}
+
+// Extension returns "gz".
+func (c GzipCompressor) Extension() string {
+	return "gz"
+}
+
+// NewWriter returns a gzip writer on dst.
+func (c GzipCompressor) NewWriter(dst io.Writer, name string) (io.WriteCloser, error) {
+	level := c.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	zw, err := gzip.NewWriterLevel(dst, level)
+	if err != nil {
+		return nil, err
+	}
+	zw.Name = name
+	return zw, nil
+}
+
+// ZipCompressor stores rotated files as the single entry of a zip archive.
+type ZipCompressor struct{}
+
+// Extension returns "zip".
+func (c ZipCompressor) Extension() string {
+	return "zip"
+}
+
+// NewWriter returns a writer for a zip entry called name within dst.
+func (c ZipCompressor) NewWriter(dst io.Writer, name string) (io.WriteCloser, error) {
+	zw := zip.NewWriter(dst)
+	entry, err := zw.Create(name)
+	if err != nil {
+		zw.Close()
+		return nil, err
+	}
+	return zipEntryWriter{entry, zw}, nil
+}
+
+// Closes the whole archive when the entry is closed
+type zipEntryWriter struct {
+	io.Writer
+	archive *zip.Writer
+}
+
+func (z zipEntryWriter) Close() error {
+	return z.archive.Close()
+}
+
+// SnappyCompressor compresses rotated files in the snappy framing format.
+type SnappyCompressor struct{}
+
+// Extension returns "sz".
+func (c SnappyCompressor) Extension() string {
+	return "sz"
+}
+
+// NewWriter returns a snappy writer on dst.
+func (c SnappyCompressor) NewWriter(dst io.Writer, name string) (io.WriteCloser, error) {
+	return newSnappyWriter(dst), nil
+}
+
+// The built-in compressor for a compression method, or nil if there is none
+func compressorFor(method CompressionMethod) Compressor {
+	switch method {
+	case COMPRESSION_GZIP:
+		return GzipCompressor{}
+	case COMPRESSION_ZIP:
+		return ZipCompressor{}
+	case COMPRESSION_SNAPPY:
+		return SnappyCompressor{}
+	}
+	return nil
+}
+
+/****** Snappy ******/
+
+// The snappy framing format (https://github.com/google/snappy), which allows a
+// stream of compressed chunks each holding up to 64KiB of data
+const (
+	snappyMaxChunk       = 65536
+	snappyChunkData      = 0x00
+	snappyChunkUncomp    = 0x01
+	snappyStreamIdentity = "\xff\x06\x00\x00sNaPpY"
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// snappyWriter buffers data and writes it in the snappy framing format when
+// flushed (or when a full chunk has accumulated).
+type snappyWriter struct {
+	w          io.Writer
+	buf        []byte
+	wroteIdent bool
+}
+
+func newSnappyWriter(w io.Writer) *snappyWriter {
+	return &snappyWriter{w: w, buf: make([]byte, 0, snappyMaxChunk)}
+}
+
+func (s *snappyWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		room := snappyMaxChunk - len(s.buf)
+		if room > len(p) {
+			room = len(p)
+		}
+		s.buf = append(s.buf, p[:room]...)
+		p = p[room:]
+		n += room
+		if len(s.buf) == snappyMaxChunk {
+			if err := s.Flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Flush writes any buffered data as a chunk.
+func (s *snappyWriter) Flush() error {
+	if !s.wroteIdent {
+		if _, err := io.WriteString(s.w, snappyStreamIdentity); err != nil {
+			return err
+		}
+		s.wroteIdent = true
+	}
+	if len(s.buf) == 0 {
+		return nil
+	}
+
+	chunkType := byte(snappyChunkData)
+	body := snappyEncodeBlock(nil, s.buf)
+	if len(body) >= len(s.buf) {
+		chunkType, body = snappyChunkUncomp, s.buf
+	}
+
+	crc := crc32.Checksum(s.buf, crc32c)
+	masked := ((crc >> 15) | (crc << 17)) + 0xa282ead8
+
+	header := make([]byte, 8)
+	size := len(body) + 4
+	header[0] = chunkType
+	header[1], header[2], header[3] = byte(size), byte(size>>8), byte(size>>16)
+	binary.LittleEndian.PutUint32(header[4:], masked)
+
+	s.buf = s.buf[:0]
+	if _, err := s.w.Write(header); err != nil {
+		return err
+	}
+	_, err := s.w.Write(body)
+	return err
+}
+
+// Close flushes any buffered data.  The underlying writer is not closed.
+func (s *snappyWriter) Close() error {
+	return s.Flush()
+}
+
+// Compress src as a single snappy block, using a simple greedy matcher
+func snappyEncodeBlock(dst, src []byte) []byte {
+	dst = appendUvarint(dst, uint64(len(src)))
+
+	const tableBits = 14
+	var table [1 << tableBits]int32
+	load32 := func(i int) uint32 {
+		return binary.LittleEndian.Uint32(src[i:])
+	}
+	hash := func(u uint32) uint32 {
+		return (u * 0x1e35a7bd) >> (32 - tableBits)
+	}
+
+	lit := 0
+	for i := 0; i+4 <= len(src); {
+		cur := load32(i)
+		h := hash(cur)
+		cand := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if cand < 0 || i-cand > 65535 || load32(cand) != cur {
+			i++
+			continue
+		}
+
+		dst = snappyEmitLiteral(dst, src[lit:i])
+		length := 4
+		for i+length < len(src) && src[cand+length] == src[i+length] {
+			length++
+		}
+		dst = snappyEmitCopy(dst, i-cand, length)
+		i += length
+		lit = i
+	}
+	return snappyEmitLiteral(dst, src[lit:])
+}
+
+func snappyEmitLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	n := len(lit) - 1
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2)
+	case n < 1<<8:
+		dst = append(dst, 60<<2, byte(n))
+	default:
+		dst = append(dst, 61<<2, byte(n), byte(n>>8))
+	}
+	return append(dst, lit...)
+}
+
+// Emit copies with 2-byte offsets, each covering up to 64 bytes
+func snappyEmitCopy(dst []byte, offset, length int) []byte {
+	for length > 0 {
+		n := length
+		if n > 64 {
+			n = 64
+		}
+		dst = append(dst, byte(n-1)<<2|2, byte(offset), byte(offset>>8))
+		length -= n
+	}
+	return dst
+}
@@ -4,12 +4,16 @@ package log4go
 
 import (
 	"bytes"
+	"crypto/tls"
+	"database/sql"
 	"encoding/xml"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/user"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type xmlProperty struct {
@@ -17,16 +21,31 @@ type xmlProperty struct {
 	Value string `xml:",chardata"`
 }
 
+type xmlQuiet struct {
+	Schedule string `xml:"schedule,attr"`
+	Duration string `xml:"duration,attr"`
+	Level    string `xml:",chardata"`
+}
+
 type xmlFilter struct {
-	Enabled  string        `xml:"enabled,attr"`
-	Tag      string        `xml:"tag"`
-	Level    string        `xml:"level"`
-	Type     string        `xml:"type"`
+	Enabled    string         `xml:"enabled,attr"`
+	Tag        string         `xml:"tag"`
+	Level      string         `xml:"level"`
+	Type       string         `xml:"type"`
+	Property   []xmlProperty  `xml:"property"`
+	Quiet      []xmlQuiet     `xml:"quiet"`
+	Transform  []xmlProcessor `xml:"transform"`
+	Middleware []xmlProcessor `xml:"middleware"`
+}
+
+type xmlProcessor struct {
+	Type     string        `xml:"type,attr"`
 	Property []xmlProperty `xml:"property"`
 }
 
 type xmlLoggerConfig struct {
-	Filter []xmlFilter `xml:"filter"`
+	Filter    []xmlFilter    `xml:"filter"`
+	Processor []xmlProcessor `xml:"processor"`
 }
 
 // Load XML configuration; see examples/example.xml for documentation
@@ -52,6 +71,20 @@ func (log Logger) LoadConfiguration(filename string) {
 		os.Exit(1)
 	}
 
+	// Build the processor chain, if one is configured
+	if len(xc.Processor) > 0 {
+		var processors []Processor
+		for _, xmlproc := range xc.Processor {
+			proc, good := xmlToProcessor(filename, xmlproc)
+			if !good {
+				os.Exit(1)
+			}
+			processors = append(processors, proc)
+		}
+		log.SetProcessors(processors...)
+	}
+
+	tags := make(map[string]bool)
 	for _, xmlfilt := range xc.Filter {
 		var filt LogWriter
 		var lvl Level
@@ -67,7 +100,11 @@ func (log Logger) LoadConfiguration(filename string) {
 		if len(xmlfilt.Tag) == 0 {
 			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required child <%s> for filter missing in %s\n", "tag", filename)
 			bad = true
+		} else if tags[xmlfilt.Tag] {
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Duplicate filter tag %q in %s\n", xmlfilt.Tag, filename)
+			bad = true
 		}
+		tags[xmlfilt.Tag] = true
 		if len(xmlfilt.Type) == 0 {
 			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required child <%s> for filter missing in %s\n", "type", filename)
 			bad = true
@@ -77,24 +114,9 @@ func (log Logger) LoadConfiguration(filename string) {
 			bad = true
 		}
 
-		switch xmlfilt.Level {
-		case "FINEST":
-			lvl = FINEST
-		case "FINE":
-			lvl = FINE
-		case "DEBUG":
-			lvl = DEBUG
-		case "TRACE":
-			lvl = TRACE
-		case "INFO":
-			lvl = INFO
-		case "WARNING":
-			lvl = WARNING
-		case "ERROR":
-			lvl = ERROR
-		case "CRITICAL":
-			lvl = CRITICAL
-		default:
+		if l, ok := levelFromString(xmlfilt.Level); ok {
+			lvl = l
+		} else {
 			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required child <%s> for filter has unknown value in %s: %s\n", "level", filename, xmlfilt.Level)
 			bad = true
 		}
@@ -111,12 +133,44 @@ func (log Logger) LoadConfiguration(filename string) {
 		switch xmlfilt.Type {
 		case "console":
 			filt, good = xmlToConsoleLogWriter(filename, xmlfilt.Property, enabled)
+		case "discard":
+			filt, good = xmlToDiscardLogWriter(filename, xmlfilt.Property, enabled)
+		case "ring":
+			filt, good = xmlToRingBufferLogWriter(filename, xmlfilt.Property, enabled)
 		case "file":
 			filt, good = xmlToFileLogWriter(filename, xmlfilt.Property, enabled)
 		case "xml":
 			filt, good = xmlToXMLLogWriter(filename, xmlfilt.Property, enabled)
+		case "binary":
+			filt, good = xmlToBinaryLogWriter(filename, xmlfilt.Property, enabled)
 		case "socket":
 			filt, good = xmlToSocketLogWriter(filename, xmlfilt.Property, enabled)
+		case "http":
+			filt, good = xmlToHTTPLogWriter(filename, xmlfilt.Property, enabled)
+		case "elasticsearch":
+			filt, good = xmlToElasticLogWriter(filename, xmlfilt.Property, enabled)
+		case "amqp":
+			filt, good = xmlToAMQPLogWriter(filename, xmlfilt.Property, enabled)
+		case "nats":
+			filt, good = xmlToNATSLogWriter(filename, xmlfilt.Property, enabled)
+		case "grpc":
+			filt, good = xmlToGRPCLogWriter(filename, xmlfilt.Property, enabled)
+		case "redis":
+			filt, good = xmlToRedisLogWriter(filename, xmlfilt.Property, enabled)
+		case "sqlite":
+			filt, good = xmlToSQLiteLogWriter(filename, xmlfilt.Property, enabled)
+		case "sql":
+			filt, good = xmlToDBLogWriter(filename, xmlfilt.Property, enabled)
+		case "smtp":
+			filt, good = xmlToSMTPLogWriter(filename, xmlfilt.Property, enabled)
+		case "alert":
+			filt, good = xmlToAlertLogWriter(filename, xmlfilt.Property, enabled)
+		case "sentry":
+			filt, good = xmlToSentryLogWriter(filename, xmlfilt.Property, enabled)
+		case "syslog":
+			filt, good = xmlToSyslogLogWriter(filename, xmlfilt.Property, enabled)
+		case "perlevel":
+			filt, good = xmlToPerLevelLogWriter(filename, xmlfilt.Property, lvl, enabled)
 		default:
 			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Could not load XML configuration in %s: unknown filter type \"%s\"\n", filename, xmlfilt.Type)
 			os.Exit(1)
@@ -127,15 +181,78 @@ func (log Logger) LoadConfiguration(filename string) {
 			os.Exit(1)
 		}
 
+		// Wrap the writer in its transforms, if any
+		if len(xmlfilt.Transform) > 0 {
+			var transforms []Processor
+			for _, xmltrans := range xmlfilt.Transform {
+				trans, good := xmlToProcessor(filename, xmltrans)
+				if !good {
+					os.Exit(1)
+				}
+				transforms = append(transforms, trans)
+			}
+			if enabled {
+				filt = NewTransformLogWriter(filt, transforms...)
+			}
+		}
+
+		// Wrap the writer in any quiet-hours windows
+		for _, quiet := range xmlfilt.Quiet {
+			if filt, good = xmlToQuietHoursLogWriter(filename, quiet, filt, enabled); !good {
+				os.Exit(1)
+			}
+		}
+
+		// Decorate the writer with its middleware, if any
+		if len(xmlfilt.Middleware) > 0 {
+			var middlewares []WriterMiddleware
+			for _, xmlmw := range xmlfilt.Middleware {
+				mw, good := xmlToMiddleware(filename, xmlmw, enabled)
+				if !good {
+					os.Exit(1)
+				}
+				middlewares = append(middlewares, mw)
+			}
+			if enabled {
+				filt = Chain(filt, middlewares...)
+			}
+		}
+
 		// If we're disabled (syntax and correctness checks only), don't add to logger
 		if !enabled {
 			continue
 		}
 
-		log[xmlfilt.Tag] = &Filter{lvl, filt}
+		log.AddFilter(xmlfilt.Tag, lvl, filt)
 	}
 }
 
+// Level names as used in configuration files
+var levelNames = [...]string{"FINEST", "FINE", "TRACE", "DEBUG", "INFO", "WARNING", "ERROR", "CRITICAL"}
+
+// Convert a level name as used in configuration files into a Level
+func levelFromString(str string) (Level, bool) {
+	switch str {
+	case "FINEST":
+		return FINEST, true
+	case "FINE":
+		return FINE, true
+	case "DEBUG":
+		return DEBUG, true
+	case "TRACE":
+		return TRACE, true
+	case "INFO":
+		return INFO, true
+	case "WARNING":
+		return WARNING, true
+	case "ERROR":
+		return ERROR, true
+	case "CRITICAL":
+		return CRITICAL, true
+	}
+	return 0, false
+}
+
 /*
    Replace all instances of `${var}` in the string with the value of the environment variable `var`.
    The literals `$` and `\` may be escaped with a backslash. Examples:
@@ -191,20 +308,98 @@ func substituteEnv(prop string) string {
 }
 
 func xmlToConsoleLogWriter(filename string, props []xmlProperty, enabled bool) (ConsoleLogWriter, bool) {
+	format := ""
+	encoding := ""
+	color := false
+	var palette ConsolePalette
+
 	// Parse properties
 	for _, prop := range props {
+		value := strings.Trim(prop.Value, " \r\n")
 		switch prop.Name {
+		case "format":
+			format = value
+		case "encoding":
+			encoding = value
+		case "color":
+			color = value != "false"
+		case "palette":
+			var err error
+			if palette, err = ParseConsolePalette(value); err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid palette \"%s\" for console filter in %s: %s\n", prop.Value, filename, err)
+				return nil, false
+			}
 		default:
 			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for console filter in %s\n", prop.Name, filename)
 		}
 	}
 
+	// Check properties
+	var encoder Encoder
+	if len(format) > 0 || len(encoding) > 0 {
+		var ok bool
+		if encoder, ok = encoderFromString(encoding, format); !ok {
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Unknown encoding \"%s\" for console filter in %s\n", encoding, filename)
+			return nil, false
+		}
+	}
+
+	// If it's disabled, we're just checking syntax
+	if !enabled {
+		return nil, true
+	}
+
+	if color {
+		return NewColorConsoleLogWriter(encoder, palette), true
+	}
+	return NewConsoleLogWriterWithEncoder(encoder), true
+}
+
+func xmlToDiscardLogWriter(filename string, props []xmlProperty, enabled bool) (*DiscardLogWriter, bool) {
+	// Parse properties
+	for _, prop := range props {
+		switch prop.Name {
+		default:
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for discard filter in %s\n", prop.Name, filename)
+		}
+	}
+
+	// If it's disabled, we're just checking syntax
+	if !enabled {
+		return nil, true
+	}
+
+	return NewDiscardLogWriter(), true
+}
+
+func xmlToRingBufferLogWriter(filename string, props []xmlProperty, enabled bool) (*RingBufferLogWriter, bool) {
+	size := 0
+	format := FORMAT_DEFAULT
+
+	// Parse properties
+	for _, prop := range props {
+		switch prop.Name {
+		case "size":
+			size = strToNumSuffix(strings.Trim(prop.Value, " \r\n"), 1000)
+		case "format":
+			format = strings.Trim(prop.Value, " \r\n")
+		default:
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for ring filter in %s\n", prop.Name, filename)
+		}
+	}
+
+	// Check properties
+	if size < 1 {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required property \"%s\" for ring filter missing in %s\n", "size", filename)
+		return nil, false
+	}
+
 	// If it's disabled, we're just checking syntax
 	if !enabled {
 		return nil, true
 	}
 
-	return NewConsoleLogWriter(), true
+	return NewRingBufferLogWriter(size).SetFormat(format), true
 }
 
 // Parse a number with K/M/G suffixes based on thousands (1000) or 2^10 (1024)
@@ -226,15 +421,90 @@ func strToNumSuffix(str string, mult int) int {
 	parsed, _ := strconv.Atoi(str)
 	return parsed * num
 }
+
+// Look up a numeric user or group id, which may also be given by name
+func lookupID(name string, group bool) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	id := ""
+	if group {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return -1, err
+		}
+		id = g.Gid
+	} else {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return -1, err
+		}
+		id = u.Uid
+	}
+	return strconv.Atoi(id)
+}
+
+// Parse a duration, which may also be given in whole days, as in "30d"
+func parseAge(str string) (time.Duration, error) {
+	if strings.HasSuffix(str, "d") {
+		days, err := strconv.Atoi(str[:len(str)-1])
+		if err != nil {
+			return 0, fmt.Errorf("invalid number of days %q", str)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(str)
+}
+
 func xmlToFileLogWriter(filename string, props []xmlProperty, enabled bool) (*FileLogWriter, bool) {
 	file := ""
 	format := "[%D %T] [%L] (%S) %M"
 	maxlines := 0
-	maxsize := 0
+	maxsize := int64(0)
 	daily := false
+	rotateAt := ""
+	timezone := ""
+	hourly := false
+	utc := false
+	interval := ""
 	rotate := false
 	rotateOnStartup := true
+	rotateStale := true
 	dateSuffix := false
+	dateSuffixFormat := ""
+	preserveExt := false
+	rotationMetadata := false
+	compressRotated := false
+	maxBackups := -1
+	var maxAge time.Duration
+	var maxFileAge time.Duration
+	maxTotalSize := int64(0)
+	flushSchedule := ""
+	rotateSchedule := ""
+	var detectInterval time.Duration
+	minFreeSpace := int64(0)
+	lowSpacePolicy := LowSpaceDrop
+	emergencyFile := ""
+	archiveDir := ""
+	symlink := ""
+	nameTemplate := ""
+	seqWidth, seqMax := 3, 999
+	seqRecycle := false
+	stateFile := ""
+	bufferSize := int64(0)
+	flushInterval := time.Second
+	var syncPolicies []SyncPolicy
+	overflow := OverflowBlock
+	queueLength := LogBufferLength
+	flushLevel, flushOnLevel := Level(0), false
+	fallbackFile := ""
+	shared := false
+	copyTruncate := false
+	encoding := ""
+	jsonKeys := ""
+	csvFields := []string(nil)
+	dirMode := LogDirectoryMode
+	uid, gid := -1, -1
 
 	// Parse properties
 	for _, prop := range props {
@@ -246,15 +516,184 @@ func xmlToFileLogWriter(filename string, props []xmlProperty, enabled bool) (*Fi
 		case "maxlines":
 			maxlines = strToNumSuffix(strings.Trim(prop.Value, " \r\n"), 1000)
 		case "maxsize":
-			maxsize = strToNumSuffix(strings.Trim(prop.Value, " \r\n"), 1024)
+			var err error
+			if maxsize, err = parseSize(strings.Trim(prop.Value, " \r\n")); err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid maxsize \"%s\" for file filter in %s: %s\n", prop.Value, filename, err)
+				return nil, false
+			}
 		case "daily":
 			daily = strings.Trim(prop.Value, " \r\n") != "false"
+		case "rotateat":
+			rotateAt = strings.Trim(prop.Value, " \r\n")
+		case "timezone":
+			timezone = strings.Trim(prop.Value, " \r\n")
+		case "hourly":
+			hourly = strings.Trim(prop.Value, " \r\n") != "false"
+		case "utc":
+			utc = strings.Trim(prop.Value, " \r\n") != "false"
+		case "interval":
+			interval = strings.Trim(prop.Value, " \r\n")
 		case "rotate":
 			rotate = strings.Trim(prop.Value, " \r\n") != "false"
 		case "datesuffix":
 			dateSuffix = strings.Trim(prop.Value, " \r\n") != "false"
+		case "datesuffixformat":
+			dateSuffixFormat = strings.Trim(prop.Value, " \r\n")
+		case "preserveextension":
+			preserveExt = strings.Trim(prop.Value, " \r\n") != "false"
+		case "rotationmetadata":
+			rotationMetadata = strings.Trim(prop.Value, " \r\n") != "false"
+		case "compressrotated":
+			compressRotated = strings.Trim(prop.Value, " \r\n") != "false"
+		case "maxbackups":
+			n, err := strconv.Atoi(strings.Trim(prop.Value, " \r\n"))
+			if err != nil || n < 0 {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid maxbackups \"%s\" for file filter in %s\n", prop.Value, filename)
+				return nil, false
+			}
+			maxBackups = n
+		case "maxtotalsize":
+			var err error
+			if maxTotalSize, err = parseSize(strings.Trim(prop.Value, " \r\n")); err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid maxtotalsize \"%s\" for file filter in %s: %s\n", prop.Value, filename, err)
+				return nil, false
+			}
+		case "maxage":
+			var err error
+			if maxAge, err = parseAge(strings.Trim(prop.Value, " \r\n")); err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid maxage \"%s\" for file filter in %s: %s\n", prop.Value, filename, err)
+				return nil, false
+			}
+		case "maxfileage":
+			var err error
+			if maxFileAge, err = parseAge(strings.Trim(prop.Value, " \r\n")); err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid maxfileage \"%s\" for file filter in %s: %s\n", prop.Value, filename, err)
+				return nil, false
+			}
 		case "rotateonstartup":
 			rotateOnStartup = strings.Trim(prop.Value, " \r\n") != "false"
+		case "rotatestale":
+			rotateStale = strings.Trim(prop.Value, " \r\n") != "false"
+		case "flushschedule":
+			flushSchedule = strings.Trim(prop.Value, " \r\n")
+		case "rotateschedule":
+			rotateSchedule = strings.Trim(prop.Value, " \r\n")
+		case "detectrotation":
+			var err error
+			if detectInterval, err = time.ParseDuration(strings.Trim(prop.Value, " \r\n")); err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid detectrotation \"%s\" for file filter in %s: %s\n", prop.Value, filename, err)
+				return nil, false
+			}
+		case "minfreespace":
+			var err error
+			if minFreeSpace, err = parseSize(strings.Trim(prop.Value, " \r\n")); err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid minfreespace \"%s\" for file filter in %s: %s\n", prop.Value, filename, err)
+				return nil, false
+			}
+		case "lowspace":
+			var ok bool
+			if lowSpacePolicy, ok = ParseLowSpacePolicy(strings.Trim(prop.Value, " \r\n")); !ok {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Unknown lowspace policy \"%s\" for file filter in %s\n", prop.Value, filename)
+				return nil, false
+			}
+		case "shared":
+			shared = strings.Trim(prop.Value, " \r\n") != "false"
+		case "copytruncate":
+			copyTruncate = strings.Trim(prop.Value, " \r\n") != "false"
+		case "fallbackfile":
+			fallbackFile = strings.Trim(prop.Value, " \r\n")
+		case "emergencyfile":
+			emergencyFile = strings.Trim(prop.Value, " \r\n")
+		case "rotationname":
+			nameTemplate = strings.Trim(prop.Value, " \r\n")
+		case "sequencewidth":
+			var err error
+			if seqWidth, err = strconv.Atoi(strings.Trim(prop.Value, " \r\n")); err != nil || seqWidth < 1 {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid sequencewidth \"%s\" for file filter in %s: should be a positive number\n", prop.Value, filename)
+				return nil, false
+			}
+		case "sequencemax":
+			var err error
+			if seqMax, err = strconv.Atoi(strings.Trim(prop.Value, " \r\n")); err != nil || seqMax < 1 {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid sequencemax \"%s\" for file filter in %s: should be a positive number\n", prop.Value, filename)
+				return nil, false
+			}
+		case "sequencerecycle":
+			seqRecycle = strings.Trim(prop.Value, " \r\n") != "false"
+		case "statefile":
+			stateFile = strings.Trim(prop.Value, " \r\n")
+		case "buffersize":
+			var err error
+			if bufferSize, err = parseSize(strings.Trim(prop.Value, " \r\n")); err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid buffersize \"%s\" for file filter in %s: %s\n", prop.Value, filename, err)
+				return nil, false
+			}
+		case "queuelength":
+			var err error
+			if queueLength, err = strconv.Atoi(strings.Trim(prop.Value, " \r\n")); err != nil || queueLength < 0 {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid queuelength \"%s\" for file filter in %s: should be a number of records\n", prop.Value, filename)
+				return nil, false
+			}
+		case "overflow":
+			var ok bool
+			if overflow, ok = ParseOverflowPolicy(strings.Trim(prop.Value, " \r\n")); !ok {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Unknown overflow policy \"%s\" for file filter in %s\n", prop.Value, filename)
+				return nil, false
+			}
+		case "sync":
+			var err error
+			if syncPolicies, err = parseSyncPolicies(strings.Trim(prop.Value, " \r\n")); err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid sync \"%s\" for file filter in %s: %s\n", prop.Value, filename, err)
+				return nil, false
+			}
+		case "flushlevel":
+			if flushLevel, flushOnLevel = levelFromString(strings.Trim(prop.Value, " \r\n")); !flushOnLevel {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Unknown flushlevel \"%s\" for file filter in %s\n", prop.Value, filename)
+				return nil, false
+			}
+		case "flushinterval":
+			var err error
+			if flushInterval, err = time.ParseDuration(strings.Trim(prop.Value, " \r\n")); err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid flushinterval \"%s\" for file filter in %s: %s\n", prop.Value, filename, err)
+				return nil, false
+			}
+		case "symlink":
+			symlink = strings.Trim(prop.Value, " \r\n")
+		case "archivedir":
+			archiveDir = strings.Trim(prop.Value, " \r\n")
+		case "encoding":
+			encoding = strings.Trim(prop.Value, " \r\n")
+		case "jsonkeys":
+			jsonKeys = strings.Trim(prop.Value, " \r\n")
+			if _, err := ParseJSONKeys(jsonKeys); err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid jsonkeys \"%s\" for file filter in %s: %s\n", prop.Value, filename, err)
+				return nil, false
+			}
+		case "csvfields":
+			for _, field := range strings.Split(prop.Value, ",") {
+				if field = strings.TrimSpace(field); len(field) > 0 {
+					csvFields = append(csvFields, field)
+				}
+			}
+		case "dirmode":
+			mode, err := strconv.ParseUint(strings.Trim(prop.Value, " \r\n"), 8, 32)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid dirmode \"%s\" for file filter in %s: %s\n", prop.Value, filename, err)
+				return nil, false
+			}
+			dirMode = os.FileMode(mode)
+		case "owner":
+			var err error
+			if uid, err = lookupID(strings.Trim(prop.Value, " \r\n"), false); err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid owner \"%s\" for file filter in %s: %s\n", prop.Value, filename, err)
+				return nil, false
+			}
+		case "group":
+			var err error
+			if gid, err = lookupID(strings.Trim(prop.Value, " \r\n"), true); err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid group \"%s\" for file filter in %s: %s\n", prop.Value, filename, err)
+				return nil, false
+			}
 		default:
 			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for file filter in %s\n", prop.Name, filename)
 		}
@@ -265,29 +704,142 @@ func xmlToFileLogWriter(filename string, props []xmlProperty, enabled bool) (*Fi
 		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required property \"%s\" for file filter missing in %s\n", "filename", filename)
 		return nil, false
 	}
+	encoder, ok := encoderFromString(encoding, format)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Unknown encoding \"%s\" for file filter in %s\n", encoding, filename)
+		return nil, false
+	}
+	if len(jsonKeys) > 0 {
+		if _, ok := encoder.(JSONEncoder); !ok {
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Property \"jsonkeys\" for file filter needs the json encoding in %s\n", filename)
+			return nil, false
+		}
+		encoder, _ = ParseJSONKeys(jsonKeys)
+	}
+	if len(csvFields) > 0 {
+		if _, ok := encoder.(*CSVEncoder); !ok {
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Property \"csvfields\" for file filter needs the csv encoding in %s\n", filename)
+			return nil, false
+		}
+		encoder = NewCSVEncoder(csvFields...)
+	}
+	rotateInterval, ok := ParseRotateInterval(interval)
+	if len(interval) > 0 && !ok {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Unknown interval \"%s\" for file filter in %s\n", interval, filename)
+		return nil, false
+	}
+	var rotateAtTime time.Time
+	if len(rotateAt) > 0 {
+		var err error
+		if rotateAtTime, err = time.Parse("15:04", rotateAt); err != nil {
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid rotateat \"%s\" for file filter in %s: %s\n", rotateAt, filename, err)
+			return nil, false
+		}
+	}
+	loc := time.Local
+	if len(timezone) > 0 {
+		var err error
+		if loc, err = time.LoadLocation(timezone); err != nil {
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid timezone \"%s\" for file filter in %s: %s\n", timezone, filename, err)
+			return nil, false
+		}
+	}
 
 	// If it's disabled, we're just checking syntax
 	if !enabled {
 		return nil, true
 	}
 
-	flw := NewFileLogWriter(file, rotate, false)
+	// The writer creates the file's directory as it starts
+	if err := makeDirectory(file, dirMode); err != nil {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Could not create directory for %s: %s\n", file, err)
+		return nil, false
+	}
+	flw := NewFileLogWriterBuffered(file, rotate, false, queueLength)
 	if flw == nil {
 		return nil, false
 	}
+	flw.SetDirectoryMode(dirMode)
+	if uid >= 0 || gid >= 0 {
+		flw.SetOwner(uid, gid)
+	}
 	flw.SetFormat(format)
+	flw.SetEncoder(encoder)
 	flw.SetRotateLines(maxlines)
-	flw.SetRotateSize(maxsize)
+	flw.setRotateSize(maxsize)
 	flw.SetRotateDaily(daily)
+	if len(rotateAt) > 0 {
+		flw.SetRotateAt(rotateAtTime.Hour(), rotateAtTime.Minute(), loc)
+	}
+	flw.SetRotateHourly(hourly)
+	flw.SetUseUTC(utc)
+	if len(interval) > 0 {
+		flw.SetRotateInterval(rotateInterval)
+	}
 	flw.SetRotateDateSuffix(dateSuffix)
+	if len(dateSuffixFormat) > 0 {
+		flw.SetDateSuffixFormat(dateSuffixFormat)
+	}
+	flw.SetPreserveExtension(preserveExt)
+	flw.SetRotationMetadata(rotationMetadata)
+	flw.SetCompressRotated(compressRotated)
+	if maxBackups >= 0 {
+		flw.SetMaxBackups(maxBackups)
+	}
+	flw.SetMaxAge(maxAge)
+	flw.SetRotateMaxFileAge(maxFileAge)
+	flw.SetMaxTotalSize(maxTotalSize)
 	flw.SetRotateOnStartup(rotateOnStartup)
+	flw.SetRotateStaleOnStartup(rotateStale)
+	if len(flushSchedule) > 0 {
+		flw.SetFlushSchedule(flushSchedule)
+	}
+	if len(archiveDir) > 0 {
+		flw.SetArchiveDirectory(archiveDir)
+	}
+	if len(nameTemplate) > 0 {
+		flw.SetRotationNameTemplate(nameTemplate)
+	}
+	flw.SetRotationSequence(seqWidth, seqMax).SetRecycleRotationSequence(seqRecycle)
+	if len(stateFile) > 0 {
+		flw.SetRotationStateFile(stateFile)
+	}
+	flw.SetFlushInterval(flushInterval).SetBufferSize(int(bufferSize))
+	if flushOnLevel {
+		flw.SetFlushOnLevel(flushLevel)
+	}
+	flw.SetSyncPolicy(syncPolicies...)
+	flw.SetOverflowPolicy(overflow)
+	if len(symlink) > 0 {
+		flw.SetSymlink(symlink)
+	}
+	flw.SetDetectExternalRotation(detectInterval)
+	if len(fallbackFile) > 0 {
+		flw.SetFallbackFilename(fallbackFile)
+	}
+	if shared {
+		flw.SetSharedFile(true)
+	}
+	if copyTruncate {
+		flw.SetRotateCopyTruncate(true)
+	}
+	if minFreeSpace > 0 {
+		flw.SetLowSpacePolicy(lowSpacePolicy, emergencyFile).SetMinFreeSpace(uint64(minFreeSpace))
+	}
+	if len(rotateSchedule) > 0 {
+		flw.SetRotateSchedule(rotateSchedule)
+	}
+	// CSV files start with a row naming the columns
+	if enc, ok := encoder.(*CSVEncoder); ok {
+		flw.SetHeadFoot(enc.Header(), "")
+	}
 	return flw, true
 }
 
 func xmlToXMLLogWriter(filename string, props []xmlProperty, enabled bool) (*FileLogWriter, bool) {
 	file := ""
 	maxrecords := 0
-	maxsize := 0
+	maxsize := int64(0)
 	daily := false
 	rotate := false
 
@@ -299,7 +851,11 @@ func xmlToXMLLogWriter(filename string, props []xmlProperty, enabled bool) (*Fil
 		case "maxrecords":
 			maxrecords = strToNumSuffix(strings.Trim(prop.Value, " \r\n"), 1000)
 		case "maxsize":
-			maxsize = strToNumSuffix(strings.Trim(prop.Value, " \r\n"), 1024)
+			var err error
+			if maxsize, err = parseSize(strings.Trim(prop.Value, " \r\n")); err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid maxsize \"%s\" for xml filter in %s: %s\n", prop.Value, filename, err)
+				return nil, false
+			}
 		case "daily":
 			daily = strings.Trim(prop.Value, " \r\n") != "false"
 		case "rotate":
@@ -324,15 +880,72 @@ func xmlToXMLLogWriter(filename string, props []xmlProperty, enabled bool) (*Fil
 	if xlw == nil {
 		return nil, false
 	}
-	xlw.SetRotateLines(maxrecords)
-	xlw.SetRotateSize(maxsize)
+	xlw.SetRotateLines(maxrecords * xmlRecordLines)
+	xlw.setRotateSize(maxsize)
 	xlw.SetRotateDaily(daily)
 	return xlw, true
 }
 
-func xmlToSocketLogWriter(filename string, props []xmlProperty, enabled bool) (SocketLogWriter, bool) {
+func xmlToBinaryLogWriter(filename string, props []xmlProperty, enabled bool) (*FileLogWriter, bool) {
+	file := ""
+	maxrecords := 0
+	maxsize := int64(0)
+	daily := false
+	rotate := false
+
+	// Parse properties
+	for _, prop := range props {
+		switch prop.Name {
+		case "filename":
+			file = strings.Trim(prop.Value, " \r\n")
+		case "maxrecords":
+			maxrecords = strToNumSuffix(strings.Trim(prop.Value, " \r\n"), 1000)
+		case "maxsize":
+			var err error
+			if maxsize, err = parseSize(strings.Trim(prop.Value, " \r\n")); err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid maxsize \"%s\" for binary filter in %s: %s\n", prop.Value, filename, err)
+				return nil, false
+			}
+		case "daily":
+			daily = strings.Trim(prop.Value, " \r\n") != "false"
+		case "rotate":
+			rotate = strings.Trim(prop.Value, " \r\n") != "false"
+		default:
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for binary filter in %s\n", prop.Name, filename)
+		}
+	}
+
+	// Check properties
+	if len(file) == 0 {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required property \"%s\" for binary filter missing in %s\n", "filename", filename)
+		return nil, false
+	}
+
+	// If it's disabled, we're just checking syntax
+	if !enabled {
+		return nil, true
+	}
+
+	blw := NewBinaryLogWriter(file, rotate)
+	if blw == nil {
+		return nil, false
+	}
+	blw.SetRotateLines(maxrecords)
+	blw.setRotateSize(maxsize)
+	blw.SetRotateDaily(daily)
+	return blw, true
+}
+
+func xmlToSocketLogWriter(filename string, props []xmlProperty, enabled bool) (*SocketLogWriterImp, bool) {
 	endpoint := ""
 	protocol := "udp"
+	encoding := ""
+	compression := ""
+	keepalive := time.Duration(0)
+	reconnectMax := SocketReconnectMax
+	datagramSize := SocketMaxDatagramSize
+	datagramPolicy := DatagramSplit
+	replayLength := SocketReplayLength
 
 	// Parse properties
 	for _, prop := range props {
@@ -341,6 +954,41 @@ func xmlToSocketLogWriter(filename string, props []xmlProperty, enabled bool) (S
 			endpoint = strings.Trim(prop.Value, " \r\n")
 		case "protocol":
 			protocol = strings.Trim(prop.Value, " \r\n")
+		case "encoding":
+			encoding = strings.Trim(prop.Value, " \r\n")
+		case "compression":
+			compression = strings.Trim(prop.Value, " \r\n")
+		case "keepalive":
+			var err error
+			if keepalive, err = time.ParseDuration(strings.Trim(prop.Value, " \r\n")); err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid keepalive \"%s\" for socket filter in %s: %s\n", prop.Value, filename, err)
+				return nil, false
+			}
+		case "datagramsize":
+			size, err := parseSize(strings.Trim(prop.Value, " \r\n"))
+			if err != nil || size <= chunkHeaderSize {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid datagramsize \"%s\" for socket filter in %s: should be a size in bytes\n", prop.Value, filename)
+				return nil, false
+			}
+			datagramSize = int(size)
+		case "oversize":
+			var ok bool
+			if datagramPolicy, ok = ParseDatagramPolicy(strings.Trim(prop.Value, " \r\n")); !ok {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Unknown oversize policy \"%s\" for socket filter in %s\n", prop.Value, filename)
+				return nil, false
+			}
+		case "reconnectmax":
+			var err error
+			if reconnectMax, err = time.ParseDuration(strings.Trim(prop.Value, " \r\n")); err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid reconnectmax \"%s\" for socket filter in %s: %s\n", prop.Value, filename, err)
+				return nil, false
+			}
+		case "replaylength":
+			var err error
+			if replayLength, err = strconv.Atoi(strings.Trim(prop.Value, " \r\n")); err != nil || replayLength < 0 {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid replaylength \"%s\" for socket filter in %s: should be a number of records\n", prop.Value, filename)
+				return nil, false
+			}
 		default:
 			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for file filter in %s\n", prop.Name, filename)
 		}
@@ -352,10 +1000,1055 @@ func xmlToSocketLogWriter(filename string, props []xmlProperty, enabled bool) (S
 		return nil, false
 	}
 
+	switch CompressionMethod(compression) {
+	case "", COMPRESSION_GZIP, COMPRESSION_SNAPPY:
+	default:
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Unknown compression \"%s\" for socket filter in %s\n", compression, filename)
+		return nil, false
+	}
+
+	var encoder Encoder
+	if len(encoding) > 0 {
+		var ok bool
+		if encoder, ok = encoderFromString(encoding, FORMAT_DEFAULT); !ok {
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Unknown encoding \"%s\" for socket filter in %s\n", encoding, filename)
+			return nil, false
+		}
+	}
+
+	// If it's disabled, we're just checking syntax
+	if !enabled {
+		return nil, true
+	}
+
+	slw := NewSocketLogWriterCompressed(protocol, endpoint, encoder, CompressionMethod(compression))
+	if slw != nil && keepalive > 0 {
+		slw.SetKeepAlive(keepalive)
+	}
+	if slw != nil {
+		slw.SetReconnect(SocketReconnectMin, reconnectMax, replayLength)
+		slw.SetDatagramSize(datagramSize, datagramPolicy)
+	}
+	return slw, true
+}
+
+func xmlToSyslogLogWriter(filename string, props []xmlProperty, enabled bool) (*SyslogLogWriter, bool) {
+	endpoint := ""
+	protocol := ""
+	facility := SyslogUser
+	appName := ""
+	format := ""
+	hostname := ""
+	syslogFormat := SyslogRFC5424
+	caFile, certFile, keyFile, serverName := "", "", "", ""
+
+	// Parse properties
+	for _, prop := range props {
+		switch prop.Name {
+		case "endpoint":
+			endpoint = strings.Trim(prop.Value, " \r\n")
+		case "protocol":
+			protocol = strings.Trim(prop.Value, " \r\n")
+		case "facility":
+			var ok bool
+			if facility, ok = ParseSyslogFacility(strings.Trim(prop.Value, " \r\n")); !ok {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Unknown facility \"%s\" for syslog filter in %s\n", prop.Value, filename)
+				return nil, false
+			}
+		case "appname":
+			appName = strings.Trim(prop.Value, " \r\n")
+		case "format":
+			format = strings.Trim(prop.Value, " \r\n")
+		case "hostname":
+			hostname = strings.Trim(prop.Value, " \r\n")
+		case "cafile":
+			caFile = strings.Trim(prop.Value, " \r\n")
+		case "certfile":
+			certFile = strings.Trim(prop.Value, " \r\n")
+		case "keyfile":
+			keyFile = strings.Trim(prop.Value, " \r\n")
+		case "servername":
+			serverName = strings.Trim(prop.Value, " \r\n")
+		case "rfc":
+			switch strings.Trim(prop.Value, " \r\n") {
+			case "5424":
+				syslogFormat = SyslogRFC5424
+			case "3164":
+				syslogFormat = SyslogRFC3164
+			default:
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Unknown rfc \"%s\" for syslog filter in %s: should be 5424 or 3164\n", prop.Value, filename)
+				return nil, false
+			}
+		default:
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for syslog filter in %s\n", prop.Name, filename)
+		}
+	}
+
+	// Check properties
+	if len(protocol) > 0 && len(endpoint) == 0 {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required property \"%s\" for syslog filter missing in %s\n", "endpoint", filename)
+		return nil, false
+	}
+
+	if (len(certFile) > 0) != (len(keyFile) > 0) {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Properties \"certfile\" and \"keyfile\" for syslog filter must be given together in %s\n", filename)
+		return nil, false
+	}
+
+	// If it's disabled, we're just checking syntax
+	if !enabled {
+		return nil, true
+	}
+
+	var slw *SyslogLogWriter
+	if protocol == "tls" {
+		config, err := loadTLSConfig(caFile, certFile, keyFile, serverName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid TLS settings for syslog filter in %s: %s\n", filename, err)
+			return nil, false
+		}
+		slw = NewSyslogLogWriterTLS(endpoint, config, facility, appName)
+	} else {
+		slw = NewSyslogLogWriter(protocol, endpoint, facility, appName)
+	}
+	if slw == nil {
+		return nil, false
+	}
+	slw.SetSyslogFormat(syslogFormat)
+	if len(format) > 0 {
+		slw.SetFormat(format)
+	}
+	if len(hostname) > 0 {
+		slw.SetHostname(hostname)
+	}
+	return slw, true
+}
+
+func xmlToHTTPLogWriter(filename string, props []xmlProperty, enabled bool) (*HTTPLogWriter, bool) {
+	endpoint := ""
+	encoding := ""
+	format := FORMAT_DEFAULT
+	array := false
+	var headers [][2]string
+	timeout := HTTPTimeout
+	maxRecords, flushInterval, maxInFlight := BatchMaxRecords, BatchFlushInterval, BatchMaxInFlight
+	retries := BatchRetries
+
+	// Parse properties
+	for _, prop := range props {
+		value := strings.Trim(prop.Value, " \r\n")
+		var err error
+		switch prop.Name {
+		case "endpoint":
+			endpoint = value
+		case "encoding":
+			encoding = value
+		case "format":
+			format = value
+		case "array":
+			array = value != "false"
+		case "header":
+			colon := strings.Index(value, ":")
+			if colon <= 0 {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid header \"%s\" for http filter in %s: should be Name: value\n", prop.Value, filename)
+				return nil, false
+			}
+			headers = append(headers, [2]string{strings.TrimSpace(value[:colon]), strings.TrimSpace(value[colon+1:])})
+		case "timeout":
+			if timeout, err = time.ParseDuration(value); err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid timeout \"%s\" for http filter in %s: %s\n", prop.Value, filename, err)
+				return nil, false
+			}
+		case "flushinterval":
+			if flushInterval, err = time.ParseDuration(value); err != nil || flushInterval <= 0 {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid flushinterval \"%s\" for http filter in %s: should be a positive duration\n", prop.Value, filename)
+				return nil, false
+			}
+		case "batchsize":
+			if maxRecords, err = strconv.Atoi(value); err != nil || maxRecords < 1 {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid batchsize \"%s\" for http filter in %s: should be a positive number\n", prop.Value, filename)
+				return nil, false
+			}
+		case "inflight":
+			if maxInFlight, err = strconv.Atoi(value); err != nil || maxInFlight < 1 {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid inflight \"%s\" for http filter in %s: should be a positive number\n", prop.Value, filename)
+				return nil, false
+			}
+		case "retries":
+			if retries, err = strconv.Atoi(value); err != nil || retries < 0 {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid retries \"%s\" for http filter in %s: should be a number\n", prop.Value, filename)
+				return nil, false
+			}
+		default:
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for http filter in %s\n", prop.Name, filename)
+		}
+	}
+
+	// Check properties
+	if len(endpoint) == 0 {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required property \"%s\" for http filter missing in %s\n", "endpoint", filename)
+		return nil, false
+	}
+	var encoder Encoder = JSONEncoder{}
+	if len(encoding) > 0 {
+		var ok bool
+		if encoder, ok = encoderFromString(encoding, format); !ok {
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Unknown encoding \"%s\" for http filter in %s\n", encoding, filename)
+			return nil, false
+		}
+	}
+
+	// If it's disabled, we're just checking syntax
+	if !enabled {
+		return nil, true
+	}
+
+	hlw := NewHTTPLogWriter(endpoint)
+	if hlw == nil {
+		return nil, false
+	}
+	hlw.SetEncoder(encoder).SetJSONArray(array).SetTimeout(timeout)
+	hlw.SetBatching(maxRecords, flushInterval, maxInFlight).SetRetry(retries, BatchRetryMin, BatchRetryMax)
+	for _, header := range headers {
+		hlw.SetHeader(header[0], header[1])
+	}
+	return hlw, true
+}
+
+func xmlToElasticLogWriter(filename string, props []xmlProperty, enabled bool) (*ElasticLogWriter, bool) {
+	endpoint := ""
+	index := ""
+	dateFormat := ElasticIndexDateFormat
+	var headers [][2]string
+	timeout := HTTPTimeout
+	maxRecords, flushInterval, maxInFlight := BatchMaxRecords, BatchFlushInterval, BatchMaxInFlight
+	retries := BatchRetries
+
+	// Parse properties
+	for _, prop := range props {
+		value := strings.Trim(prop.Value, " \r\n")
+		var err error
+		switch prop.Name {
+		case "endpoint":
+			endpoint = value
+		case "index":
+			index = value
+		case "indexdate":
+			dateFormat = value
+		case "header":
+			colon := strings.Index(value, ":")
+			if colon <= 0 {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid header \"%s\" for elasticsearch filter in %s: should be Name: value\n", prop.Value, filename)
+				return nil, false
+			}
+			headers = append(headers, [2]string{strings.TrimSpace(value[:colon]), strings.TrimSpace(value[colon+1:])})
+		case "timeout":
+			if timeout, err = time.ParseDuration(value); err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid timeout \"%s\" for elasticsearch filter in %s: %s\n", prop.Value, filename, err)
+				return nil, false
+			}
+		case "flushinterval":
+			if flushInterval, err = time.ParseDuration(value); err != nil || flushInterval <= 0 {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid flushinterval \"%s\" for elasticsearch filter in %s: should be a positive duration\n", prop.Value, filename)
+				return nil, false
+			}
+		case "batchsize":
+			if maxRecords, err = strconv.Atoi(value); err != nil || maxRecords < 1 {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid batchsize \"%s\" for elasticsearch filter in %s: should be a positive number\n", prop.Value, filename)
+				return nil, false
+			}
+		case "inflight":
+			if maxInFlight, err = strconv.Atoi(value); err != nil || maxInFlight < 1 {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid inflight \"%s\" for elasticsearch filter in %s: should be a positive number\n", prop.Value, filename)
+				return nil, false
+			}
+		case "retries":
+			if retries, err = strconv.Atoi(value); err != nil || retries < 0 {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid retries \"%s\" for elasticsearch filter in %s: should be a number\n", prop.Value, filename)
+				return nil, false
+			}
+		default:
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for elasticsearch filter in %s\n", prop.Name, filename)
+		}
+	}
+
+	// Check properties
+	if len(endpoint) == 0 {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required property \"%s\" for elasticsearch filter missing in %s\n", "endpoint", filename)
+		return nil, false
+	}
+	if len(index) == 0 {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required property \"%s\" for elasticsearch filter missing in %s\n", "index", filename)
+		return nil, false
+	}
+
 	// If it's disabled, we're just checking syntax
 	if !enabled {
 		return nil, true
 	}
 
-	return NewSocketLogWriter(protocol, endpoint), true
+	elw := NewElasticLogWriter(endpoint, index)
+	if elw == nil {
+		return nil, false
+	}
+	elw.SetIndexDateFormat(dateFormat).SetTimeout(timeout)
+	elw.SetBatching(maxRecords, flushInterval, maxInFlight).SetRetry(retries, BatchRetryMin, BatchRetryMax)
+	for _, header := range headers {
+		elw.SetHeader(header[0], header[1])
+	}
+	return elw, true
+}
+
+func xmlToDBLogWriter(filename string, props []xmlProperty, enabled bool) (*DBLogWriter, bool) {
+	driverName := ""
+	dsn := ""
+	table := ""
+	columns := DefaultDBColumns
+	placeholder := DBQuestion
+	maxRecords, flushInterval := BatchMaxRecords, BatchFlushInterval
+	retries := BatchRetries
+
+	// Parse properties
+	for _, prop := range props {
+		value := strings.Trim(prop.Value, " \r\n")
+		var err error
+		switch prop.Name {
+		case "driver":
+			driverName = value
+		case "dsn":
+			dsn = value
+		case "table":
+			table = value
+		case "timecolumn":
+			columns.Time = value
+		case "levelcolumn":
+			columns.Level = value
+		case "sourcecolumn":
+			columns.Source = value
+		case "messagecolumn":
+			columns.Message = value
+		case "fieldscolumn":
+			columns.Fields = value
+		case "placeholder":
+			var ok bool
+			if placeholder, ok = ParseDBPlaceholder(value); !ok {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid placeholder \"%s\" for sql filter in %s: should be question, dollar, colon or at\n", prop.Value, filename)
+				return nil, false
+			}
+		case "flushinterval":
+			if flushInterval, err = time.ParseDuration(value); err != nil || flushInterval <= 0 {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid flushinterval \"%s\" for sql filter in %s: should be a positive duration\n", prop.Value, filename)
+				return nil, false
+			}
+		case "batchsize":
+			if maxRecords, err = strconv.Atoi(value); err != nil || maxRecords < 1 {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid batchsize \"%s\" for sql filter in %s: should be a positive number\n", prop.Value, filename)
+				return nil, false
+			}
+		case "retries":
+			if retries, err = strconv.Atoi(value); err != nil || retries < 0 {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid retries \"%s\" for sql filter in %s: should be a number\n", prop.Value, filename)
+				return nil, false
+			}
+		default:
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for sql filter in %s\n", prop.Name, filename)
+		}
+	}
+
+	// Check properties
+	if len(driverName) == 0 {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required property \"%s\" for sql filter missing in %s\n", "driver", filename)
+		return nil, false
+	}
+	if len(table) == 0 {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required property \"%s\" for sql filter missing in %s\n", "table", filename)
+		return nil, false
+	}
+
+	// If it's disabled, we're just checking syntax
+	if !enabled {
+		return nil, true
+	}
+
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Could not open database for sql filter in %s: %s\n", filename, err)
+		return nil, false
+	}
+	dlw := NewDBLogWriter(db, table)
+	if dlw == nil {
+		db.Close()
+		return nil, false
+	}
+	dlw.closeDB = true
+	dlw.SetColumns(columns).SetPlaceholder(placeholder)
+	return dlw.SetBatching(maxRecords, flushInterval, BatchMaxInFlight).SetRetry(retries, BatchRetryMin, BatchRetryMax), true
+}
+
+func xmlToSQLiteLogWriter(filename string, props []xmlProperty, enabled bool) (*SQLiteLogWriter, bool) {
+	file := ""
+	var maxSize int64
+	maxRecords, flushInterval := BatchMaxRecords, BatchFlushInterval
+
+	// Parse properties
+	for _, prop := range props {
+		value := strings.Trim(prop.Value, " \r\n")
+		var err error
+		switch prop.Name {
+		case "filename":
+			file = value
+		case "maxsize":
+			if maxSize, err = parseSize(value); err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid maxsize \"%s\" for sqlite filter in %s: %s\n", prop.Value, filename, err)
+				return nil, false
+			}
+		case "flushinterval":
+			if flushInterval, err = time.ParseDuration(value); err != nil || flushInterval <= 0 {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid flushinterval \"%s\" for sqlite filter in %s: should be a positive duration\n", prop.Value, filename)
+				return nil, false
+			}
+		case "batchsize":
+			if maxRecords, err = strconv.Atoi(value); err != nil || maxRecords < 1 {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid batchsize \"%s\" for sqlite filter in %s: should be a positive number\n", prop.Value, filename)
+				return nil, false
+			}
+		default:
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for sqlite filter in %s\n", prop.Name, filename)
+		}
+	}
+
+	// Check properties
+	if len(file) == 0 {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required property \"%s\" for sqlite filter missing in %s\n", "filename", filename)
+		return nil, false
+	}
+
+	// If it's disabled, we're just checking syntax
+	if !enabled {
+		return nil, true
+	}
+
+	slw := NewSQLiteLogWriter(file)
+	if slw == nil {
+		return nil, false
+	}
+	slw.SetBatching(maxRecords, flushInterval, 1)
+	return slw.SetMaxSize(maxSize), true
+}
+
+func xmlToSMTPLogWriter(filename string, props []xmlProperty, enabled bool) (*SMTPLogWriter, bool) {
+	server := ""
+	from := ""
+	var to []string
+	lvl := ERROR
+	format := FORMAT_DEFAULT
+	subject := ""
+	var digest time.Duration
+	username, password := "", ""
+	tlsMode := SMTPStartTLS
+	caFile, certFile, keyFile, serverName := "", "", "", ""
+
+	// Parse properties
+	for _, prop := range props {
+		value := strings.Trim(prop.Value, " \r\n")
+		var err error
+		switch prop.Name {
+		case "server":
+			server = value
+		case "from":
+			from = value
+		case "to":
+			for _, addr := range strings.Split(value, ",") {
+				if addr = strings.TrimSpace(addr); len(addr) > 0 {
+					to = append(to, addr)
+				}
+			}
+		case "level":
+			var ok bool
+			if lvl, ok = levelFromString(value); !ok {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid level \"%s\" for smtp filter in %s\n", prop.Value, filename)
+				return nil, false
+			}
+		case "format":
+			format = value
+		case "subject":
+			subject = value
+		case "digest":
+			if digest, err = time.ParseDuration(value); err != nil || digest < 0 {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid digest \"%s\" for smtp filter in %s: should be a duration\n", prop.Value, filename)
+				return nil, false
+			}
+		case "username":
+			username = value
+		case "password":
+			password = value
+		case "tls":
+			var ok bool
+			if tlsMode, ok = ParseSMTPTLSMode(value); !ok {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid tls \"%s\" for smtp filter in %s: should be starttls, tls or none\n", prop.Value, filename)
+				return nil, false
+			}
+		case "cafile":
+			caFile = value
+		case "certfile":
+			certFile = value
+		case "keyfile":
+			keyFile = value
+		case "servername":
+			serverName = value
+		default:
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for smtp filter in %s\n", prop.Name, filename)
+		}
+	}
+
+	// Check properties
+	if len(server) == 0 {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required property \"%s\" for smtp filter missing in %s\n", "server", filename)
+		return nil, false
+	}
+	if len(from) == 0 {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required property \"%s\" for smtp filter missing in %s\n", "from", filename)
+		return nil, false
+	}
+	if len(to) == 0 {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required property \"%s\" for smtp filter missing in %s\n", "to", filename)
+		return nil, false
+	}
+	if (len(certFile) > 0) != (len(keyFile) > 0) {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Properties \"certfile\" and \"keyfile\" for smtp filter must be given together in %s\n", filename)
+		return nil, false
+	}
+
+	// If it's disabled, we're just checking syntax
+	if !enabled {
+		return nil, true
+	}
+
+	var config *tls.Config
+	if len(caFile) > 0 || len(certFile) > 0 || len(serverName) > 0 {
+		var err error
+		if config, err = loadTLSConfig(caFile, certFile, keyFile, serverName); err != nil {
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid TLS settings for smtp filter in %s: %s\n", filename, err)
+			return nil, false
+		}
+	}
+
+	slw := NewSMTPLogWriter(server, from, to)
+	if slw == nil {
+		return nil, false
+	}
+	slw.SetLevel(lvl).SetFormat(format).SetDigest(digest).SetTLS(tlsMode, config)
+	if len(subject) > 0 {
+		slw.SetSubject(subject)
+	}
+	if len(username) > 0 {
+		slw.SetAuth(username, password)
+	}
+	return slw, true
+}
+
+func xmlToAlertLogWriter(filename string, props []xmlProperty, enabled bool) (*AlertLogWriter, bool) {
+	webhook := ""
+	lvl := CRITICAL
+	format := FORMAT_ABBREV
+	window := AlertWindow
+
+	// Parse properties
+	for _, prop := range props {
+		value := strings.Trim(prop.Value, " \r\n")
+		var err error
+		switch prop.Name {
+		case "url":
+			webhook = value
+		case "level":
+			var ok bool
+			if lvl, ok = levelFromString(value); !ok {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid level \"%s\" for alert filter in %s\n", prop.Value, filename)
+				return nil, false
+			}
+		case "format":
+			format = value
+		case "window":
+			if window, err = time.ParseDuration(value); err != nil || window <= 0 {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid window \"%s\" for alert filter in %s: should be a positive duration\n", prop.Value, filename)
+				return nil, false
+			}
+		default:
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for alert filter in %s\n", prop.Name, filename)
+		}
+	}
+
+	// Check properties
+	if len(webhook) == 0 {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required property \"%s\" for alert filter missing in %s\n", "url", filename)
+		return nil, false
+	}
+
+	// If it's disabled, we're just checking syntax
+	if !enabled {
+		return nil, true
+	}
+
+	alw := NewAlertLogWriter(webhook)
+	if alw == nil {
+		return nil, false
+	}
+	return alw.SetLevel(lvl).SetFormat(format).SetWindow(window), true
+}
+
+func xmlToSentryLogWriter(filename string, props []xmlProperty, enabled bool) (*SentryLogWriter, bool) {
+	dsn := ""
+	stackTrace := false
+	sampleRate := 1.0
+	maxEvents, rateInterval := SentryMaxEvents, SentryRateInterval
+	timeout := HTTPTimeout
+
+	// Parse properties
+	for _, prop := range props {
+		value := strings.Trim(prop.Value, " \r\n")
+		var err error
+		switch prop.Name {
+		case "dsn":
+			dsn = value
+		case "stacktrace":
+			stackTrace = value != "false"
+		case "samplerate":
+			if sampleRate, err = strconv.ParseFloat(value, 64); err != nil || sampleRate < 0 || sampleRate > 1 {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid samplerate \"%s\" for sentry filter in %s: should be from 0 to 1\n", prop.Value, filename)
+				return nil, false
+			}
+		case "maxevents":
+			if maxEvents, err = strconv.Atoi(value); err != nil || maxEvents < 0 {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid maxevents \"%s\" for sentry filter in %s: should be a number\n", prop.Value, filename)
+				return nil, false
+			}
+		case "rateinterval":
+			if rateInterval, err = time.ParseDuration(value); err != nil || rateInterval <= 0 {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid rateinterval \"%s\" for sentry filter in %s: should be a positive duration\n", prop.Value, filename)
+				return nil, false
+			}
+		case "timeout":
+			if timeout, err = time.ParseDuration(value); err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid timeout \"%s\" for sentry filter in %s: %s\n", prop.Value, filename, err)
+				return nil, false
+			}
+		default:
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for sentry filter in %s\n", prop.Name, filename)
+		}
+	}
+
+	// Check properties
+	if len(dsn) == 0 {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required property \"%s\" for sentry filter missing in %s\n", "dsn", filename)
+		return nil, false
+	}
+
+	// If it's disabled, we're just checking syntax
+	if !enabled {
+		return nil, true
+	}
+
+	slw := NewSentryLogWriter(dsn)
+	if slw == nil {
+		return nil, false
+	}
+	slw.SetStackTrace(stackTrace).SetSampleRate(sampleRate).SetRateLimit(maxEvents, rateInterval)
+	return slw.SetTimeout(timeout), true
+}
+
+func xmlToAMQPLogWriter(filename string, props []xmlProperty, enabled bool) (*AMQPLogWriter, bool) {
+	amqpURL := ""
+	exchange := ""
+	routingKey := ""
+	persistent := true
+	encoding := ""
+	format := FORMAT_DEFAULT
+
+	// Parse properties
+	for _, prop := range props {
+		switch prop.Name {
+		case "url":
+			amqpURL = strings.Trim(prop.Value, " \r\n")
+		case "exchange":
+			exchange = strings.Trim(prop.Value, " \r\n")
+		case "routingkey":
+			routingKey = strings.Trim(prop.Value, " \r\n")
+		case "persistent":
+			persistent = strings.Trim(prop.Value, " \r\n") != "false"
+		case "encoding":
+			encoding = strings.Trim(prop.Value, " \r\n")
+		case "format":
+			format = strings.Trim(prop.Value, " \r\n")
+		default:
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for amqp filter in %s\n", prop.Name, filename)
+		}
+	}
+
+	// Check properties
+	if len(amqpURL) == 0 {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required property \"%s\" for amqp filter missing in %s\n", "url", filename)
+		return nil, false
+	}
+	var encoder Encoder = JSONEncoder{}
+	if len(encoding) > 0 {
+		var ok bool
+		if encoder, ok = encoderFromString(encoding, format); !ok {
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Unknown encoding \"%s\" for amqp filter in %s\n", encoding, filename)
+			return nil, false
+		}
+	}
+
+	// If it's disabled, we're just checking syntax
+	if !enabled {
+		return nil, true
+	}
+
+	alw := NewAMQPLogWriter(amqpURL, exchange, routingKey)
+	if alw == nil {
+		return nil, false
+	}
+	return alw.SetPersistent(persistent).SetEncoder(encoder), true
+}
+
+func xmlToNATSLogWriter(filename string, props []xmlProperty, enabled bool) (*NATSLogWriter, bool) {
+	natsURL := ""
+	subject := ""
+	encoding := ""
+	format := FORMAT_DEFAULT
+	flushInterval := NATSFlushInterval
+
+	// Parse properties
+	for _, prop := range props {
+		value := strings.Trim(prop.Value, " \r\n")
+		var err error
+		switch prop.Name {
+		case "url":
+			natsURL = value
+		case "subject":
+			subject = value
+		case "encoding":
+			encoding = value
+		case "format":
+			format = value
+		case "flushinterval":
+			if flushInterval, err = time.ParseDuration(value); err != nil || flushInterval <= 0 {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid flushinterval \"%s\" for nats filter in %s: should be a positive duration\n", prop.Value, filename)
+				return nil, false
+			}
+		default:
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for nats filter in %s\n", prop.Name, filename)
+		}
+	}
+
+	// Check properties
+	if len(natsURL) == 0 {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required property \"%s\" for nats filter missing in %s\n", "url", filename)
+		return nil, false
+	}
+	if len(subject) == 0 {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required property \"%s\" for nats filter missing in %s\n", "subject", filename)
+		return nil, false
+	}
+	var encoder Encoder = JSONEncoder{}
+	if len(encoding) > 0 {
+		var ok bool
+		if encoder, ok = encoderFromString(encoding, format); !ok {
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Unknown encoding \"%s\" for nats filter in %s\n", encoding, filename)
+			return nil, false
+		}
+	}
+
+	// If it's disabled, we're just checking syntax
+	if !enabled {
+		return nil, true
+	}
+
+	nlw := NewNATSLogWriter(natsURL, subject)
+	if nlw == nil {
+		return nil, false
+	}
+	return nlw.SetEncoder(encoder).SetFlushInterval(flushInterval), true
+}
+
+func xmlToGRPCLogWriter(filename string, props []xmlProperty, enabled bool) (*GRPCLogWriter, bool) {
+	endpoint := ""
+	caFile, certFile, keyFile, serverName := "", "", "", ""
+
+	// Parse properties
+	for _, prop := range props {
+		value := strings.Trim(prop.Value, " \r\n")
+		switch prop.Name {
+		case "endpoint":
+			endpoint = value
+		case "cafile":
+			caFile = value
+		case "certfile":
+			certFile = value
+		case "keyfile":
+			keyFile = value
+		case "servername":
+			serverName = value
+		default:
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for grpc filter in %s\n", prop.Name, filename)
+		}
+	}
+
+	// Check properties
+	if len(endpoint) == 0 {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required property \"%s\" for grpc filter missing in %s\n", "endpoint", filename)
+		return nil, false
+	}
+	if (len(certFile) > 0) != (len(keyFile) > 0) {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Properties \"certfile\" and \"keyfile\" for grpc filter must be given together in %s\n", filename)
+		return nil, false
+	}
+
+	// If it's disabled, we're just checking syntax
+	if !enabled {
+		return nil, true
+	}
+
+	glw := NewGRPCLogWriter(endpoint)
+	if glw == nil {
+		return nil, false
+	}
+	if len(caFile) > 0 || len(certFile) > 0 || len(serverName) > 0 {
+		config, err := loadTLSConfig(caFile, certFile, keyFile, serverName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid TLS settings for grpc filter in %s: %s\n", filename, err)
+			glw.Close()
+			return nil, false
+		}
+		glw.SetTLS(config)
+	}
+	return glw, true
+}
+
+func xmlToRedisLogWriter(filename string, props []xmlProperty, enabled bool) (*RedisLogWriter, bool) {
+	endpoint := ""
+	key := ""
+	list := false
+	maxLen := 0
+	password := ""
+	db := 0
+	encoding := ""
+	format := FORMAT_DEFAULT
+	maxRecords, flushInterval := BatchMaxRecords, BatchFlushInterval
+	retries := BatchRetries
+
+	// Parse properties
+	for _, prop := range props {
+		value := strings.Trim(prop.Value, " \r\n")
+		var err error
+		switch prop.Name {
+		case "endpoint":
+			endpoint = value
+		case "key":
+			key = value
+		case "type":
+			switch value {
+			case "stream":
+				list = false
+			case "list":
+				list = true
+			default:
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid type \"%s\" for redis filter in %s: should be stream or list\n", prop.Value, filename)
+				return nil, false
+			}
+		case "maxlen":
+			if maxLen, err = strconv.Atoi(value); err != nil || maxLen < 0 {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid maxlen \"%s\" for redis filter in %s: should be a number\n", prop.Value, filename)
+				return nil, false
+			}
+		case "password":
+			password = value
+		case "db":
+			if db, err = strconv.Atoi(value); err != nil || db < 0 {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid db \"%s\" for redis filter in %s: should be a number\n", prop.Value, filename)
+				return nil, false
+			}
+		case "encoding":
+			encoding = value
+		case "format":
+			format = value
+		case "flushinterval":
+			if flushInterval, err = time.ParseDuration(value); err != nil || flushInterval <= 0 {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid flushinterval \"%s\" for redis filter in %s: should be a positive duration\n", prop.Value, filename)
+				return nil, false
+			}
+		case "batchsize":
+			if maxRecords, err = strconv.Atoi(value); err != nil || maxRecords < 1 {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid batchsize \"%s\" for redis filter in %s: should be a positive number\n", prop.Value, filename)
+				return nil, false
+			}
+		case "retries":
+			if retries, err = strconv.Atoi(value); err != nil || retries < 0 {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid retries \"%s\" for redis filter in %s: should be a number\n", prop.Value, filename)
+				return nil, false
+			}
+		default:
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for redis filter in %s\n", prop.Name, filename)
+		}
+	}
+
+	// Check properties
+	if len(endpoint) == 0 {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required property \"%s\" for redis filter missing in %s\n", "endpoint", filename)
+		return nil, false
+	}
+	if len(key) == 0 {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required property \"%s\" for redis filter missing in %s\n", "key", filename)
+		return nil, false
+	}
+	var encoder Encoder = JSONEncoder{}
+	if len(encoding) > 0 {
+		var ok bool
+		if encoder, ok = encoderFromString(encoding, format); !ok {
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Unknown encoding \"%s\" for redis filter in %s\n", encoding, filename)
+			return nil, false
+		}
+	}
+
+	// If it's disabled, we're just checking syntax
+	if !enabled {
+		return nil, true
+	}
+
+	rlw := NewRedisLogWriter(endpoint, key)
+	if rlw == nil {
+		return nil, false
+	}
+	if len(password) > 0 || db != 0 {
+		rlw.SetAuth(password, db)
+	}
+	rlw.SetList(list).SetMaxLen(maxLen).SetEncoder(encoder)
+	return rlw.SetBatching(maxRecords, flushInterval).SetRetry(retries, BatchRetryMin, BatchRetryMax), true
+}
+
+func xmlToQuietHoursLogWriter(filename string, quiet xmlQuiet, writer LogWriter, enabled bool) (LogWriter, bool) {
+	lvl, ok := levelFromString(strings.Trim(quiet.Level, " \r\n"))
+	if !ok {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: <quiet> has unknown level in %s: %s\n", filename, quiet.Level)
+		return nil, false
+	}
+	if _, err := ParseSchedule(quiet.Schedule); err != nil {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: <quiet> has invalid schedule in %s: %s\n", filename, err)
+		return nil, false
+	}
+	duration, err := time.ParseDuration(quiet.Duration)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: <quiet> has invalid duration in %s: %s\n", filename, err)
+		return nil, false
+	}
+
+	// If it's disabled, we're just checking syntax
+	if !enabled {
+		return nil, true
+	}
+
+	return NewQuietHoursLogWriter(writer, quiet.Schedule, duration, lvl), true
+}
+
+func xmlToProcessor(filename string, xmlproc xmlProcessor) (Processor, bool) {
+	factory, ok := lookupProcessor(xmlproc.Type)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Unknown processor type \"%s\" in %s\n", xmlproc.Type, filename)
+		return nil, false
+	}
+
+	props := make(map[string]string)
+	for _, prop := range xmlproc.Property {
+		props[prop.Name] = substituteEnv(strings.Trim(prop.Value, " \r\n"))
+	}
+
+	proc, err := factory(props)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Could not create %s processor in %s: %s\n", xmlproc.Type, filename, err)
+		return nil, false
+	}
+	return proc, true
+}
+
+func xmlToMiddleware(filename string, xmlmw xmlProcessor, enabled bool) (WriterMiddleware, bool) {
+	factory, ok := lookupMiddleware(xmlmw.Type)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Unknown middleware type \"%s\" in %s\n", xmlmw.Type, filename)
+		return nil, false
+	}
+
+	// If it's disabled, we're just checking syntax
+	if !enabled {
+		return nil, true
+	}
+
+	props := make(map[string]string)
+	for _, prop := range xmlmw.Property {
+		props[prop.Name] = substituteEnv(strings.Trim(prop.Value, " \r\n"))
+	}
+
+	mw, err := factory(props)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Could not create %s middleware in %s: %s\n", xmlmw.Type, filename, err)
+		return nil, false
+	}
+	return mw, true
+}
+
+// A "perlevel" filter is shorthand for a file per level, routed by a
+// RouterLogWriter: a filename of app.log gives app.debug.log, app.error.log and
+// so on.  The "levels" property lists the levels to write (by default, every
+// level the filter passes); the other properties apply to each file.
+func xmlToPerLevelLogWriter(filename string, props []xmlProperty, filterLevel Level, enabled bool) (*RouterLogWriter, bool) {
+	file := ""
+	var levels []Level
+	var fileProps []xmlProperty
+
+	// Parse properties
+	for _, prop := range props {
+		switch prop.Name {
+		case "filename":
+			file = strings.Trim(prop.Value, " \r\n")
+		case "levels":
+			for _, name := range strings.Split(prop.Value, ",") {
+				lvl, ok := levelFromString(strings.Trim(name, " \r\n"))
+				if !ok {
+					fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Unknown level \"%s\" in levels for perlevel filter in %s\n", name, filename)
+					return nil, false
+				}
+				levels = append(levels, lvl)
+			}
+		default:
+			fileProps = append(fileProps, prop)
+		}
+	}
+
+	// Check properties
+	if len(file) == 0 {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required property \"%s\" for perlevel filter missing in %s\n", "filename", filename)
+		return nil, false
+	}
+	if levels == nil {
+		for lvl := filterLevel; lvl <= CRITICAL; lvl++ {
+			levels = append(levels, lvl)
+		}
+	}
+
+	router := NewRouterLogWriter()
+	for _, lvl := range levels {
+		levelProps := append([]xmlProperty{{Name: "filename", Value: perLevelFilename(file, lvl)}}, fileProps...)
+		flw, good := xmlToFileLogWriter(filename, levelProps, enabled)
+		if !good {
+			router.Close()
+			return nil, false
+		}
+		if enabled {
+			router.Route(lvl, flw)
+		}
+	}
+
+	// If it's disabled, we're just checking syntax
+	if !enabled {
+		return nil, true
+	}
+	return router, true
 }
@@ -0,0 +1,55 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"io"
+	"os"
+)
+
+// SetRotateCopyTruncate makes rotation copy the file to its rotated name and
+// truncate it, rather than renaming it and opening a new one (chainable).
+// This suits files which other processes hold open, since they go on writing
+// to the same file, and rotated names on another filesystem, where a rename
+// fails.  Records written by others between the copy and the truncation are
+// lost.
+func (w *FileLogWriter) SetRotateCopyTruncate(copyTruncate bool) *FileLogWriter {
+	w.configure(func() {
+		w.copyTruncate = copyTruncate
+	})
+	return w
+}
+
+// Copy filename to rotatedName, then truncate filename
+func copyTruncateFile(filename, rotatedName string) error {
+	src, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	mode := os.FileMode(0660)
+	if info, err := src.Stat(); err == nil {
+		mode = info.Mode().Perm()
+	}
+	dst, err := os.OpenFile(rotatedName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(rotatedName)
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		os.Remove(rotatedName)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(rotatedName)
+		return err
+	}
+
+	return os.Truncate(filename, 0)
+}
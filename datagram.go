@@ -0,0 +1,103 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// DatagramPolicy is what a SocketLogWriter using a datagram protocol does
+// with a record too large to send in one datagram.
+type DatagramPolicy int
+
+const (
+	// Split the record into GELF chunks, for collectors which reassemble them
+	DatagramSplit DatagramPolicy = iota
+
+	// Cut the record short to fit
+	DatagramTruncate
+)
+
+var datagramPolicyNames = []string{"split", "truncate"}
+
+func (p DatagramPolicy) String() string {
+	if p >= 0 && int(p) < len(datagramPolicyNames) {
+		return datagramPolicyNames[p]
+	}
+	return fmt.Sprintf("DatagramPolicy(%d)", int(p))
+}
+
+// ParseDatagramPolicy returns the policy with the given name, as returned by
+// String.
+func ParseDatagramPolicy(name string) (DatagramPolicy, bool) {
+	for i, policyName := range datagramPolicyNames {
+		if strings.EqualFold(name, policyName) {
+			return DatagramPolicy(i), true
+		}
+	}
+	return 0, false
+}
+
+// SocketStats counts what a SocketLogWriter using a datagram protocol has
+// sent since it was created.
+type SocketStats struct {
+	Sent      uint64 // Records sent
+	Split     uint64 // Records sent in more than one chunk
+	Truncated uint64 // Records cut short to fit in a datagram
+	Oversized uint64 // Records dropped for being too large even to split
+}
+
+// The counters behind SocketStats (accessed atomically)
+type socketCounters struct {
+	sent      uint64
+	split     uint64
+	truncated uint64
+	oversized uint64
+}
+
+// Stats returns the writer's counters.
+func (w *SocketLogWriterImp) Stats() SocketStats {
+	return SocketStats{
+		Sent:      atomic.LoadUint64(&w.counters.sent),
+		Split:     atomic.LoadUint64(&w.counters.split),
+		Truncated: atomic.LoadUint64(&w.counters.truncated),
+		Oversized: atomic.LoadUint64(&w.counters.oversized),
+	}
+}
+
+// SetDatagramSize sets the largest datagram sent, in place of
+// SocketMaxDatagramSize, and what to do with records which won't fit
+// (chainable).  It should be kept under the path MTU, less IP and UDP
+// headers, where collectors drop fragmented datagrams.  It has no effect on
+// stream protocols.
+func (w *SocketLogWriterImp) SetDatagramSize(size int, policy DatagramPolicy) *SocketLogWriterImp {
+	w.configure(func() {
+		w.maxDatagram, w.datagramPolicy = size, policy
+	})
+	return w
+}
+
+// Cut an encoded record short to size bytes, keeping any newline ending it
+// and not splitting a UTF-8 character
+func truncateRecord(buf []byte, size int) []byte {
+	if len(buf) <= size {
+		return buf
+	}
+	newline := buf[len(buf)-1] == '\n' && size > 0
+	n := size
+	if newline {
+		n--
+	}
+	for n > 0 && !utf8.RuneStart(buf[n]) {
+		n--
+	}
+	out := make([]byte, n, size)
+	copy(out, buf)
+	if newline {
+		out = append(out, '\n')
+	}
+	return out
+}
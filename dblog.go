@@ -0,0 +1,242 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DBColumns names the columns a DBLogWriter inserts each part of a record
+// into.  A part whose column is empty is left out.  Fields are inserted as a
+// JSON object.
+type DBColumns struct {
+	Time    string
+	Level   string
+	Source  string
+	Message string
+	Fields  string
+}
+
+// DefaultDBColumns are the columns a DBLogWriter inserts into unless told
+// otherwise.
+var DefaultDBColumns = DBColumns{Time: "time", Level: "level", Source: "source", Message: "message"}
+
+// DBPlaceholder is how a database driver numbers the parameters of a
+// statement.
+type DBPlaceholder int
+
+const (
+	DBQuestion DBPlaceholder = iota // ?, as used by MySQL and SQLite
+	DBDollar                        // $1, as used by PostgreSQL
+	DBColon                         // :1, as used by Oracle
+	DBAt                            // @p1, as used by SQL Server
+)
+
+var dbPlaceholderNames = []string{"question", "dollar", "colon", "at"}
+
+func (p DBPlaceholder) String() string {
+	if p >= 0 && int(p) < len(dbPlaceholderNames) {
+		return dbPlaceholderNames[p]
+	}
+	return fmt.Sprintf("DBPlaceholder(%d)", int(p))
+}
+
+// ParseDBPlaceholder returns the placeholder style with the given name, as
+// returned by String.
+func ParseDBPlaceholder(name string) (DBPlaceholder, bool) {
+	for i, placeholderName := range dbPlaceholderNames {
+		if strings.EqualFold(name, placeholderName) {
+			return DBPlaceholder(i), true
+		}
+	}
+	return 0, false
+}
+
+// The nth parameter, counting from 1
+func (p DBPlaceholder) param(n int) string {
+	switch p {
+	case DBDollar:
+		return "$" + strconv.Itoa(n)
+	case DBColon:
+		return ":" + strconv.Itoa(n)
+	case DBAt:
+		return "@p" + strconv.Itoa(n)
+	}
+	return "?"
+}
+
+// DBLogWriter inserts records into a table through database/sql.  Each batch
+// is inserted in one transaction, with a statement prepared once.  The
+// level is inserted by name, such as "ERROR".  The table and column names
+// are put into the statement as they are, so they must be trusted.
+type DBLogWriter struct {
+	*batchWriter
+
+	db          *sql.DB
+	closeDB     bool
+	table       string
+	columns     DBColumns
+	placeholder DBPlaceholder
+
+	// Called after each batch is inserted, if set
+	inserted func() error
+
+	// The prepared insert, once the first batch is sent
+	mu   sync.Mutex
+	stmt *sql.Stmt
+}
+
+// NewDBLogWriter creates a LogWriter which inserts records into table in db,
+// which is left open when the writer is closed.
+func NewDBLogWriter(db *sql.DB, table string) *DBLogWriter {
+	if err := db.Ping(); err != nil {
+		fmt.Fprintf(os.Stderr, "NewDBLogWriter(%q): %s\n", table, err)
+		return nil
+	}
+
+	w := &DBLogWriter{
+		db:      db,
+		table:   table,
+		columns: DefaultDBColumns,
+	}
+	w.batchWriter = newBatchWriter(fmt.Sprintf("DBLogWriter(%q)", table), w.insert)
+	return w
+}
+
+// SetColumns sets the columns inserted into, in place of DefaultDBColumns
+// (chainable).  Must be called before the first log message is written.
+func (w *DBLogWriter) SetColumns(columns DBColumns) *DBLogWriter {
+	w.columns = columns
+	return w
+}
+
+// SetPlaceholder sets how the driver numbers parameters, DBQuestion by
+// default (chainable).  Must be called before the first log message is
+// written.
+func (w *DBLogWriter) SetPlaceholder(placeholder DBPlaceholder) *DBLogWriter {
+	w.placeholder = placeholder
+	return w
+}
+
+// SetBatching sets the most records inserted together, the longest a record
+// is held before its batch is inserted, and how many batches are inserted at
+// once, in place of BatchMaxRecords, BatchFlushInterval and BatchMaxInFlight
+// (chainable).  Must be called before the first log message is written.
+func (w *DBLogWriter) SetBatching(maxRecords int, flushInterval time.Duration, maxInFlight int) *DBLogWriter {
+	w.maxRecords, w.flushInterval, w.maxInFlight = maxRecords, flushInterval, maxInFlight
+	return w
+}
+
+// SetRetry sets how many times a failed batch is tried again, and the
+// shortest and longest waits before doing so, in place of BatchRetries,
+// BatchRetryMin and BatchRetryMax (chainable).  Must be called before the
+// first log message is written.
+func (w *DBLogWriter) SetRetry(retries int, min, max time.Duration) *DBLogWriter {
+	w.retries, w.retryMin, w.retryMax = retries, min, max
+	return w
+}
+
+// Close inserts any queued records and releases the prepared statement.
+func (w *DBLogWriter) Close() {
+	w.batchWriter.Close()
+	if w.stmt != nil {
+		w.stmt.Close()
+	}
+	if w.closeDB {
+		w.db.Close()
+	}
+}
+
+// The insert statement for the columns in use
+func (w *DBLogWriter) statement() string {
+	var names, params []string
+	for _, name := range []string{w.columns.Time, w.columns.Level, w.columns.Source, w.columns.Message, w.columns.Fields} {
+		if len(name) > 0 {
+			names = append(names, name)
+			params = append(params, w.placeholder.param(len(params)+1))
+		}
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", w.table, strings.Join(names, ", "), strings.Join(params, ", "))
+}
+
+// The values to insert for a record, in the order of statement's columns
+func (w *DBLogWriter) values(rec *LogRecord) ([]interface{}, error) {
+	var values []interface{}
+	if len(w.columns.Time) > 0 {
+		values = append(values, rec.Created)
+	}
+	if len(w.columns.Level) > 0 {
+		level := "UNKNOWN"
+		if rec.Level >= 0 && int(rec.Level) < len(levelNames) {
+			level = levelNames[rec.Level]
+		}
+		values = append(values, level)
+	}
+	if len(w.columns.Source) > 0 {
+		values = append(values, rec.Source)
+	}
+	if len(w.columns.Message) > 0 {
+		values = append(values, rec.Message)
+	}
+	if len(w.columns.Fields) > 0 {
+		var fields interface{}
+		if len(rec.Fields) > 0 {
+			buf, err := json.Marshal(rec.Fields)
+			if err != nil {
+				return nil, err
+			}
+			fields = string(buf)
+		}
+		values = append(values, fields)
+	}
+	return values, nil
+}
+
+// Insert a batch of records in one transaction
+func (w *DBLogWriter) insert(batch []*LogRecord) error {
+	w.mu.Lock()
+	if w.stmt == nil {
+		stmt, err := w.db.Prepare(w.statement())
+		if err != nil {
+			w.mu.Unlock()
+			return err
+		}
+		w.stmt = stmt
+	}
+	stmt := w.stmt
+	w.mu.Unlock()
+
+	tx, err := w.db.Begin()
+	if err != nil {
+		return err
+	}
+	txStmt := tx.Stmt(stmt)
+	defer txStmt.Close()
+	for _, rec := range batch {
+		values, err := w.values(rec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "DBLogWriter(%q): Dropped record: %s\n", w.table, err)
+			continue
+		}
+		if _, err := txStmt.Exec(values...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if w.inserted != nil {
+		if err := w.inserted(); err != nil {
+			fmt.Fprintf(os.Stderr, "DBLogWriter(%q): %s\n", w.table, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"sync/atomic"
+)
+
+// DiscardLogWriter drops every record without formatting it, only counting
+// them.  It measures the cost of dispatching records apart from writing
+// them, and stands in for a writer which configuration has turned off but
+// which other code expects to find.  Pooled records are released at once.
+type DiscardLogWriter struct {
+	// Records discarded (accessed atomically)
+	discarded uint64
+}
+
+// NewDiscardLogWriter creates a LogWriter which discards every record.
+func NewDiscardLogWriter() *DiscardLogWriter {
+	return &DiscardLogWriter{}
+}
+
+// This is the DiscardLogWriter's output method
+func (w *DiscardLogWriter) LogWrite(rec *LogRecord) {
+	atomic.AddUint64(&w.discarded, 1)
+	rec.release()
+}
+
+func (w *DiscardLogWriter) releasesRecords() {}
+
+// Discarded returns how many records the writer has been given.
+func (w *DiscardLogWriter) Discarded() uint64 {
+	return atomic.LoadUint64(&w.discarded)
+}
+
+// Close does nothing.
+func (w *DiscardLogWriter) Close() {
+}
@@ -0,0 +1,173 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// FreeSpaceCheckInterval is how often a FileLogWriter with a minimum free
+// space checks the filesystem holding its file.
+var FreeSpaceCheckInterval = 10 * time.Second
+
+// Finds the free space on the filesystem holding a directory; replaced by
+// tests
+var freeSpace = diskFreeSpace
+
+// LowSpacePolicy is what a FileLogWriter does while the filesystem holding its
+// file has less free space than SetMinFreeSpace asks for.
+type LowSpacePolicy int
+
+const (
+	// Drop records until there is space again
+	LowSpaceDrop LowSpacePolicy = iota
+
+	// Rotate the file and remove the oldest rotated files until there is
+	// space, dropping records if there still isn't
+	LowSpacePrune
+
+	// Write records to the emergency file until there is space again
+	LowSpaceRedirect
+)
+
+var lowSpacePolicyNames = []string{"drop", "prune", "redirect"}
+
+func (p LowSpacePolicy) String() string {
+	if p >= 0 && int(p) < len(lowSpacePolicyNames) {
+		return lowSpacePolicyNames[p]
+	}
+	return fmt.Sprintf("LowSpacePolicy(%d)", int(p))
+}
+
+// ParseLowSpacePolicy returns the policy with the given name, as returned by
+// String.
+func ParseLowSpacePolicy(name string) (LowSpacePolicy, bool) {
+	for i, policyName := range lowSpacePolicyNames {
+		if strings.EqualFold(name, policyName) {
+			return LowSpacePolicy(i), true
+		}
+	}
+	return 0, false
+}
+
+// SetMinFreeSpace applies the low space policy, dropping records by default,
+// while the filesystem holding the file has fewer than bytes free (chainable).
+// Free space is checked every FreeSpaceCheckInterval.  Zero turns off the
+// checks.
+func (w *FileLogWriter) SetMinFreeSpace(bytes uint64) *FileLogWriter {
+	w.configure(func() {
+		w.minFreeSpace = bytes
+		if bytes == 0 {
+			w.endLowSpace()
+		}
+	})
+	return w
+}
+
+// SetLowSpacePolicy sets what to do while free space is low (chainable).
+// LowSpaceRedirect writes to emergencyFile, which should be on another
+// filesystem; the other policies ignore it.
+func (w *FileLogWriter) SetLowSpacePolicy(policy LowSpacePolicy, emergencyFile string) *FileLogWriter {
+	w.configure(func() {
+		w.endLowSpace()
+		w.lowSpacePolicy, w.emergencyFilename = policy, emergencyFile
+	})
+	return w
+}
+
+// Compare the free space with the minimum, applying the low space policy as
+// space runs out and lifting it once there is space again
+func (w *FileLogWriter) checkFreeSpace() {
+	dir := filepath.Dir(w.filename)
+	free, err := freeSpace(dir)
+	if err != nil {
+		fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Couldn't check free space: %s\n", w.filename, err)
+		return
+	}
+	if free >= w.minFreeSpace {
+		w.endLowSpace()
+		return
+	}
+
+	if w.lowSpacePolicy == LowSpacePrune {
+		if w.maxsize_cursize > w.headerSize {
+			err := w.handleRotateFor(ROTATE_SPACE, time.Now())
+			w.handleRotationFailure(err)
+		}
+		free = w.pruneForSpace(free)
+		if free >= w.minFreeSpace {
+			return
+		}
+	}
+
+	if w.lowSpace {
+		return
+	}
+	w.lowSpace = true
+	fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Only %d bytes free, below %d; applying the %s policy\n", w.filename, free, w.minFreeSpace, w.lowSpacePolicy)
+	if w.lowSpacePolicy == LowSpaceRedirect {
+		if err := makeDirectory(w.emergencyFilename, w.dirMode); err != nil {
+			fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Couldn't open emergency file %q: %s\n", w.filename, w.emergencyFilename, err)
+			return
+		}
+		fd, err := os.OpenFile(w.emergencyFilename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
+		if err != nil {
+			fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Couldn't open emergency file %q: %s\n", w.filename, w.emergencyFilename, err)
+			return
+		}
+		w.emergencyFile = fd
+	}
+}
+
+// Lift the low space policy
+func (w *FileLogWriter) endLowSpace() {
+	if !w.lowSpace {
+		return
+	}
+	w.lowSpace = false
+	if w.emergencyFile != nil {
+		w.emergencyFile.Close()
+		w.emergencyFile = nil
+	}
+	if w.lowSpaceDropped > 0 {
+		fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Dropped %d log message(s) while free space was low\n", w.filename, w.lowSpaceDropped)
+		w.lowSpaceDropped = 0
+	}
+}
+
+// Write an encoded record while free space is low
+func (w *FileLogWriter) writeLowSpace(buf []byte, encodeErr error) {
+	if w.emergencyFile == nil || encodeErr != nil {
+		w.lowSpaceDropped++
+		atomic.AddUint64(&w.counters.lowSpaceDropped, 1)
+		return
+	}
+	_, err := w.emergencyFile.Write(buf)
+	w.handleWriteFailure(err)
+}
+
+// Remove the oldest rotated files until there are at least minFreeSpace bytes
+// free, returning the free space left
+func (w *FileLogWriter) pruneForSpace(free uint64) uint64 {
+	task := w.newArchiveTask(w.filename)
+	files, err := task.rotatedFiles(task.dir())
+	if err != nil {
+		fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Couldn't find rotated files to remove: %s\n", w.filename, err)
+		return free
+	}
+	for _, file := range files {
+		if free >= w.minFreeSpace {
+			break
+		}
+		task.remove(file.name)
+		if free, err = freeSpace(filepath.Dir(w.filename)); err != nil {
+			return 0
+		}
+	}
+	return free
+}
@@ -0,0 +1,14 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+// +build !linux,!darwin,!freebsd,!dragonfly,!windows
+
+package log4go
+
+import (
+	"errors"
+)
+
+// Free space can't be found on this platform
+func diskFreeSpace(dir string) (uint64, error) {
+	return 0, errors.New("Free space checks are not supported on this platform")
+}
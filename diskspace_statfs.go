@@ -0,0 +1,18 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+// +build linux darwin freebsd dragonfly
+
+package log4go
+
+import (
+	"syscall"
+)
+
+// The bytes available to unprivileged users on the filesystem holding dir
+func diskFreeSpace(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
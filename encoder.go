@@ -0,0 +1,495 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An Encoder turns a LogRecord into the bytes that a writer sends to its
+// destination.  Separating this from the writers means any encoding can be
+// used with any transport.  Encoders must be safe for concurrent use.
+//
+// Every writer which formats records takes an Encoder, through SetEncoder or
+// a constructor, and a format string given to SetFormat is just shorthand for
+// a FormatEncoder.  Custom layouts are an EncoderFunc away.  Writers which
+// send records as structured documents, such as ElasticLogWriter and
+// SentryLogWriter, build those themselves.
+type Encoder interface {
+	Encode(rec *LogRecord) ([]byte, error)
+}
+
+// The results of encoding one record, shared by every writer the record is
+// dispatched to so that writers using the same encoder only encode it once
+type encodeCache struct {
+	mu      sync.Mutex
+	entries []encodeCacheEntry
+}
+
+type encodeCacheEntry struct {
+	enc Encoder
+	buf []byte
+	err error
+}
+
+// Encode a record, reusing the bytes if another writer has already encoded it
+// with an equal encoder.  The returned bytes are shared and must not be
+// modified.
+func encodeRecord(enc Encoder, rec *LogRecord) ([]byte, error) {
+	cache := rec.encoded
+	if cache == nil || !reflect.TypeOf(enc).Comparable() {
+		return enc.Encode(rec)
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	for _, entry := range cache.entries {
+		if sameEncoder(entry.enc, enc) {
+			return entry.buf, entry.err
+		}
+	}
+	buf, err := enc.Encode(rec)
+	cache.entries = append(cache.entries, encodeCacheEntry{enc, buf, err})
+	return buf, err
+}
+
+// Whether two encoders are equal.  A comparable type can still hold values
+// which aren't, such as a struct with an EncoderFunc in an interface field,
+// and comparing those panics; they are taken to be different.
+func sameEncoder(a, b Encoder) (same bool) {
+	defer func() {
+		if recover() != nil {
+			same = false
+		}
+	}()
+	return a == b
+}
+
+// Encode a record as text for a writer with nowhere to report an encoding
+// failure, falling back to FORMAT_DEFAULT so that the record isn't lost
+func encodeText(enc Encoder, rec *LogRecord) string {
+	buf, err := encodeRecord(enc, rec)
+	if err != nil {
+		return FormatLogRecord(FORMAT_DEFAULT, rec)
+	}
+	return string(buf)
+}
+
+// EncoderFunc adapts an ordinary function into an Encoder.
+type EncoderFunc func(rec *LogRecord) ([]byte, error)
+
+// Encode calls f(rec).
+func (f EncoderFunc) Encode(rec *LogRecord) ([]byte, error) {
+	return f(rec)
+}
+
+// FormatEncoder encodes records as text lines using FormatLogRecord.
+type FormatEncoder string
+
+// NewFormatEncoder returns an Encoder for the given format (see
+// FormatLogRecord for the known format codes).
+func NewFormatEncoder(format string) FormatEncoder {
+	return FormatEncoder(format)
+}
+
+// Encode formats the record as a line of text.
+func (e FormatEncoder) Encode(rec *LogRecord) ([]byte, error) {
+	return []byte(FormatLogRecord(string(e), rec)), nil
+}
+
+// The shape of a record in JSON, with the level written by name
+type jsonRecord struct {
+	Level   string    `json:"level"`
+	Created time.Time `json:"time"`
+	Source  string    `json:"source,omitempty"`
+	Message string    `json:"message"`
+	Fields  Fields    `json:"fields,omitempty"`
+}
+
+// JSONEncoder encodes each record as a JSON object on its own line.  The
+// zero value names the record's parts level, time, source, message and
+// fields; set the Key fields to rename them for a collector expecting, say,
+// "severity" and "msg".
+type JSONEncoder struct {
+	LevelKey   string
+	TimeKey    string
+	SourceKey  string
+	MessageKey string
+	FieldsKey  string
+
+	// Flatten writes each field as a key of its own rather than within
+	// FieldsKey.  Fields named like one of the keys above are left out.
+	Flatten bool
+}
+
+// Encode marshals the record as a line of JSON.
+func (e JSONEncoder) Encode(rec *LogRecord) ([]byte, error) {
+	if e != (JSONEncoder{}) {
+		return e.encodeKeyed(rec)
+	}
+	js, err := json.Marshal(jsonRecord{
+		Level:   rec.Level.String(),
+		Created: rec.Created,
+		Source:  rec.Source,
+		Message: rec.Message,
+		Fields:  rec.Fields,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(js, '\n'), nil
+}
+
+// Encode the record under the configured key names, in the same order as the
+// zero value does
+func (e JSONEncoder) encodeKeyed(rec *LogRecord) ([]byte, error) {
+	keyOr := func(key, def string) string {
+		if len(key) == 0 {
+			return def
+		}
+		return key
+	}
+	levelKey, timeKey := keyOr(e.LevelKey, "level"), keyOr(e.TimeKey, "time")
+	sourceKey, messageKey := keyOr(e.SourceKey, "source"), keyOr(e.MessageKey, "message")
+
+	out := bytes.NewBuffer(make([]byte, 0, 128))
+	out.WriteByte('{')
+	write := func(key string, value interface{}) error {
+		if out.Len() > 1 {
+			out.WriteByte(',')
+		}
+		js, _ := json.Marshal(key)
+		out.Write(js)
+		out.WriteByte(':')
+		js, err := json.Marshal(value)
+		out.Write(js)
+		return err
+	}
+
+	write(levelKey, rec.Level.String())
+	if err := write(timeKey, rec.Created); err != nil {
+		return nil, err
+	}
+	if len(rec.Source) > 0 {
+		write(sourceKey, rec.Source)
+	}
+	write(messageKey, rec.Message)
+
+	if len(rec.Fields) > 0 && !e.Flatten {
+		if err := write(keyOr(e.FieldsKey, "fields"), rec.Fields); err != nil {
+			return nil, err
+		}
+	} else if len(rec.Fields) > 0 {
+		keys := make([]string, 0, len(rec.Fields))
+		for k := range rec.Fields {
+			switch k {
+			case levelKey, timeKey, sourceKey, messageKey:
+				continue
+			}
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if err := write(k, rec.Fields[k]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	out.WriteString("}\n")
+	return out.Bytes(), nil
+}
+
+// ParseJSONKeys reads JSONEncoder settings from a comma-separated list of
+// part=key pairs, such as "level=severity,message=msg", where each part is
+// one of level, time, source, message or fields.  Naming fields "-" flattens
+// them.
+func ParseJSONKeys(value string) (JSONEncoder, error) {
+	var e JSONEncoder
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); len(pair) == 0 {
+			continue
+		}
+		eq := strings.Index(pair, "=")
+		if eq <= 0 || eq == len(pair)-1 {
+			return JSONEncoder{}, fmt.Errorf("%q should be part=key", pair)
+		}
+		part, key := strings.TrimSpace(pair[:eq]), strings.TrimSpace(pair[eq+1:])
+		switch part {
+		case "level":
+			e.LevelKey = key
+		case "time":
+			e.TimeKey = key
+		case "source":
+			e.SourceKey = key
+		case "message":
+			e.MessageKey = key
+		case "fields":
+			if key == "-" {
+				e.Flatten = true
+			} else {
+				e.FieldsKey = key
+			}
+		default:
+			return JSONEncoder{}, fmt.Errorf("unknown part %q", part)
+		}
+	}
+	return e, nil
+}
+
+// LogfmtEncoder encodes each record as a line of logfmt key=value pairs.
+type LogfmtEncoder struct{}
+
+// Encode writes the record as a line of logfmt.
+func (LogfmtEncoder) Encode(rec *LogRecord) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, 128))
+	out.WriteString("time=")
+	out.WriteString(rec.Created.Format(time.RFC3339Nano))
+	out.WriteString(" level=")
+	out.WriteString(rec.Level.String())
+	if len(rec.Source) > 0 {
+		out.WriteString(" source=")
+		writeLogfmtValue(out, rec.Source)
+	}
+	out.WriteString(" msg=")
+	writeLogfmtValue(out, rec.Message)
+
+	keys := make([]string, 0, len(rec.Fields))
+	for k := range rec.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		out.WriteByte(' ')
+		out.WriteString(k)
+		out.WriteByte('=')
+		writeLogfmtValue(out, fmt.Sprint(rec.Fields[k]))
+	}
+	out.WriteByte('\n')
+	return out.Bytes(), nil
+}
+
+// Write a logfmt value, quoting it if necessary
+func writeLogfmtValue(out *bytes.Buffer, value string) {
+	if len(value) > 0 && !strings.ContainsAny(value, " =\"\t\r\n") {
+		out.WriteString(value)
+		return
+	}
+	out.WriteString(strconv.Quote(value))
+}
+
+// CSVEncoder encodes each record as a row of comma-separated values: the
+// time, level, source and message, then a column for each field it was
+// created with.  Values are quoted as RFC 4180 has it, so messages holding
+// commas, quotes or newlines survive being imported into a spreadsheet.
+type CSVEncoder struct {
+	fields []string
+}
+
+// NewCSVEncoder returns a CSVEncoder giving each of the named fields a column
+// of its own.  Other fields are left out.
+func NewCSVEncoder(fields ...string) *CSVEncoder {
+	return &CSVEncoder{fields: fields}
+}
+
+// Encode writes the record as a row.
+func (e *CSVEncoder) Encode(rec *LogRecord) ([]byte, error) {
+	row := make([]string, 0, 4+len(e.fields))
+	row = append(row, rec.Created.Format(time.RFC3339Nano), rec.Level.String(), rec.Source, rec.Message)
+	for _, name := range e.fields {
+		value := ""
+		if v, ok := rec.Fields[name]; ok {
+			value = fmt.Sprint(v)
+		}
+		row = append(row, value)
+	}
+	return e.writeRow(row)
+}
+
+// Header returns the row naming the columns, without a line ending, as
+// FileLogWriter.SetHeadFoot takes it.  Field names holding % are written as
+// SetHeadFoot would format them.
+func (e *CSVEncoder) Header() string {
+	row, _ := e.writeRow(append([]string{"time", "level", "source", "message"}, e.fields...))
+	return strings.TrimSuffix(string(row), "\n")
+}
+
+func (e *CSVEncoder) writeRow(row []string) ([]byte, error) {
+	var out bytes.Buffer
+	w := csv.NewWriter(&out)
+	w.Write(row)
+	w.Flush()
+	return out.Bytes(), w.Error()
+}
+
+// XMLEncoder encodes each record as a <record> element, in the same layout
+// as NewXMLLogWriter but with the text properly escaped.
+type XMLEncoder struct{}
+
+// Encode writes the record as an XML element.
+func (XMLEncoder) Encode(rec *LogRecord) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, 256))
+	fmt.Fprintf(out, "\t<record level=\"%s\">\n", rec.Level)
+	fmt.Fprintf(out, "\t\t<timestamp>%s</timestamp>\n", rec.Created.Format("2006/01/02 15:04:05 MST"))
+	out.WriteString("\t\t<source>")
+	xml.EscapeText(out, []byte(rec.Source))
+	out.WriteString("</source>\n\t\t<message>")
+	xml.EscapeText(out, []byte(rec.Message))
+	out.WriteString("</message>\n\t</record>\n")
+	return out.Bytes(), nil
+}
+
+// ProtoEncoder encodes each record as a length-delimited protocol buffer
+// message (a varint byte count followed by the message) with the LogRecord
+// schema in log4go.proto:
+//
+//	message LogRecord {
+//	  Level level = 1;
+//	  int64 created_unix_nano = 2;
+//	  string source = 3;
+//	  string message = 4;
+//	  map<string, string> fields = 5;
+//	}
+type ProtoEncoder struct{}
+
+// Encode writes the record as a length-delimited protocol buffer.
+func (ProtoEncoder) Encode(rec *LogRecord) ([]byte, error) {
+	msg := encodeProtoRecord(rec)
+	out := make([]byte, 0, len(msg)+binary.MaxVarintLen64)
+	out = appendUvarint(out, uint64(len(msg)))
+	return append(out, msg...), nil
+}
+
+// Encode a record as a LogRecord message, without any length
+func encodeProtoRecord(rec *LogRecord) []byte {
+	msg := make([]byte, 0, 64+len(rec.Source)+len(rec.Message))
+	msg = appendProtoVarint(msg, 1, uint64(rec.Level))
+	msg = appendProtoVarint(msg, 2, uint64(rec.Created.UnixNano()))
+	msg = appendProtoBytes(msg, 3, []byte(rec.Source))
+	msg = appendProtoBytes(msg, 4, []byte(rec.Message))
+
+	keys := make([]string, 0, len(rec.Fields))
+	for k := range rec.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var entry []byte
+		entry = appendProtoBytes(entry, 1, []byte(k))
+		entry = appendProtoBytes(entry, 2, []byte(fmt.Sprint(rec.Fields[k])))
+		msg = appendProtoBytes(msg, 5, entry)
+	}
+	return msg
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+// Append a varint field (wire type 0); zero values are omitted as in proto3
+func appendProtoVarint(buf []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return buf
+	}
+	buf = appendUvarint(buf, uint64(field)<<3)
+	return appendUvarint(buf, v)
+}
+
+// Append a length-delimited field (wire type 2); empty values are omitted
+func appendProtoBytes(buf []byte, field int, v []byte) []byte {
+	if len(v) == 0 {
+		return buf
+	}
+	buf = appendUvarint(buf, uint64(field)<<3|2)
+	buf = appendUvarint(buf, uint64(len(v)))
+	return append(buf, v...)
+}
+
+// Map a level onto a syslog severity (RFC 5424)
+func syslogSeverity(lvl Level) int {
+	switch {
+	case lvl >= CRITICAL:
+		return 2
+	case lvl >= ERROR:
+		return 3
+	case lvl >= WARNING:
+		return 4
+	case lvl >= INFO:
+		return 6
+	}
+	return 7
+}
+
+// GELFEncoder encodes each record as a Graylog Extended Log Format (GELF 1.1)
+// message.  Fields are sent as additional fields, prefixed with an underscore.
+type GELFEncoder struct {
+	Host string
+}
+
+// NewGELFEncoder returns a GELFEncoder which reports the local hostname.
+func NewGELFEncoder() GELFEncoder {
+	host, _ := os.Hostname()
+	return GELFEncoder{Host: host}
+}
+
+// Encode marshals the record as a GELF message.
+func (e GELFEncoder) Encode(rec *LogRecord) ([]byte, error) {
+	msg := map[string]interface{}{
+		"version":   "1.1",
+		"host":      e.Host,
+		"timestamp": float64(rec.Created.UnixNano()/1e6) / 1e3,
+		"level":     syslogSeverity(rec.Level),
+	}
+	if i := strings.IndexByte(rec.Message, '\n'); i >= 0 {
+		msg["short_message"] = rec.Message[:i]
+		msg["full_message"] = rec.Message
+	} else {
+		msg["short_message"] = rec.Message
+	}
+	if len(rec.Source) > 0 {
+		msg["_source"] = rec.Source
+	}
+	for k, v := range rec.Fields {
+		// "_id" is reserved by GELF
+		if k == "id" {
+			k = "id_"
+		}
+		msg["_"+k] = v
+	}
+	return json.Marshal(msg)
+}
+
+// Choose an encoder by the name used in configuration files; "text" (or no
+// name) formats records with the given format string
+func encoderFromString(name, format string) (Encoder, bool) {
+	switch name {
+	case "", "text":
+		return NewFormatEncoder(format), true
+	case "json":
+		return JSONEncoder{}, true
+	case "logfmt":
+		return LogfmtEncoder{}, true
+	case "csv":
+		return NewCSVEncoder(), true
+	case "xml":
+		return XMLEncoder{}, true
+	case "proto", "binary":
+		return ProtoEncoder{}, true
+	case "gelf":
+		return NewGELFEncoder(), true
+	}
+	return nil, false
+}
@@ -0,0 +1,92 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FailureReportInterval is the least time between a FileLogWriter's reports
+// of failed writes, so that a full disk doesn't flood the error writer too.
+// Failures in between are counted, and the count reported with the next
+// report or once writes succeed again.
+var FailureReportInterval = 10 * time.Second
+
+// Where a FileLogWriter reports its own failures.  Each message is written
+// in one call, so a handler is given one error per message.  It is shared
+// with the background goroutine, hence the lock.
+//
+// The handler is called on a goroutine of its own, without the lock held, so
+// that it can call the writer's setters (which wait on the writer's
+// goroutine) or SetErrorHandler itself.  Failures reported meanwhile wait in
+// pending, and are handed over in order.
+type errorOutput struct {
+	mu         sync.Mutex
+	out        io.Writer
+	handler    func(error)
+	pending    []error
+	delivering bool
+}
+
+func (e *errorOutput) Write(p []byte) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.handler == nil {
+		return e.out.Write(p)
+	}
+	e.pending = append(e.pending, errors.New(strings.TrimRight(string(p), "\n")))
+	if !e.delivering {
+		e.delivering = true
+		go e.deliver()
+	}
+	return len(p), nil
+}
+
+// Hand the pending failures to the handler, or if it has since been removed,
+// write them out
+func (e *errorOutput) deliver() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for len(e.pending) > 0 {
+		err := e.pending[0]
+		e.pending = e.pending[1:]
+		if handler := e.handler; handler != nil {
+			e.mu.Unlock()
+			handler(err)
+			e.mu.Lock()
+		} else {
+			io.WriteString(e.out, err.Error()+"\n")
+		}
+	}
+	e.pending = nil
+	e.delivering = false
+}
+
+// SetErrorWriter sets where the writer reports its own failures, such as
+// failed writes and rotations, in place of os.Stderr (chainable).  It
+// replaces any handler set by SetErrorHandler.
+func (w *FileLogWriter) SetErrorWriter(out io.Writer) *FileLogWriter {
+	w.errors.mu.Lock()
+	defer w.errors.mu.Unlock()
+	w.errors.out = out
+	w.errors.handler = nil
+	return w
+}
+
+// SetErrorHandler has the writer pass each of its own failures to handler
+// rather than writing them out, e.g. to route them to monitoring
+// (chainable).  A nil handler goes back to the error writer.
+//
+// The handler is called in order on a goroutine of its own, so that it can
+// change the writer's settings, such as switching to a fallback file; the
+// failures it is given may arrive after the writer has moved on, or closed.
+func (w *FileLogWriter) SetErrorHandler(handler func(error)) *FileLogWriter {
+	w.errors.mu.Lock()
+	defer w.errors.mu.Unlock()
+	w.errors.handler = handler
+	return w
+}
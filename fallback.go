@@ -0,0 +1,83 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"time"
+)
+
+// FallbackRetryInterval is how often a FileLogWriter which has switched to its
+// fallback file checks whether its own file can be written again.
+var FallbackRetryInterval = 30 * time.Second
+
+// How many writes in a row must fail before switching to the fallback file
+const fallbackAfterFailures = 3
+
+// SetFallbackFilename makes the writer switch to writing to path when writes
+// to its file keep failing, as when the disk is full or the mount has gone
+// (chainable).  A notice is written to the error writer on switching, and the
+// writer switches back once its own file can be written again, checking every
+// FallbackRetryInterval.  Records which failed to be written before the switch
+// are lost.  An empty path turns fallback off.
+func (w *FileLogWriter) SetFallbackFilename(path string) *FileLogWriter {
+	w.configure(func() {
+		w.fallbackFilename = path
+		w.fallbackRetry = FallbackRetryInterval
+		if len(path) == 0 && len(w.primaryFilename) > 0 {
+			w.switchFile(w.primaryFilename)
+		}
+	})
+	return w
+}
+
+// Count a write which succeeded or failed, switching to the fallback file once
+// enough have failed in a row
+func (w *FileLogWriter) noteWriteResult(err error) {
+	if err == nil {
+		w.failedWrites = 0
+		return
+	}
+	w.failedWrites++
+	if w.failedWrites < fallbackAfterFailures || len(w.fallbackFilename) == 0 || len(w.primaryFilename) > 0 {
+		return
+	}
+
+	primary := w.filename
+	if w.switchFile(w.fallbackFilename) {
+		w.primaryFilename = primary
+		w.lastPrimaryCheck = time.Now()
+		fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Writes keep failing; switching to fallback file %q\n", primary, w.fallbackFilename)
+	}
+}
+
+// While writing to the fallback file, switch back to the writer's own file
+// if it can be written again
+func (w *FileLogWriter) retryPrimary(now time.Time) {
+	if len(w.primaryFilename) == 0 || now.Sub(w.lastPrimaryCheck) < w.fallbackRetry {
+		return
+	}
+	w.lastPrimaryCheck = now
+	fallback := w.filename
+	if w.switchFile(w.primaryFilename) {
+		fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Writable again; switching back from fallback file %q\n", w.filename, fallback)
+	}
+}
+
+// Start writing to another file, returning whether it could be opened
+func (w *FileLogWriter) switchFile(filename string) bool {
+	previous := w.filename
+	w.filename = filename
+	if err := w.openLogFile(); err != nil {
+		w.filename = previous
+		return false
+	}
+	if filename == w.primaryFilename {
+		w.primaryFilename = ""
+	}
+	w.failedWrites = 0
+	if err := w.compileMatcher(); err != nil {
+		fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): %s\n", w.filename, err)
+	}
+	return true
+}
@@ -0,0 +1,19 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+// +build linux darwin freebsd dragonfly netbsd openbsd
+
+package log4go
+
+import (
+	"os"
+	"syscall"
+)
+
+// Take an exclusive lock on a file, waiting for other processes to let go
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
+
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,19 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+// +build !linux,!darwin,!freebsd,!dragonfly,!netbsd,!openbsd,!windows
+
+package log4go
+
+import (
+	"os"
+)
+
+// Files can't be locked here, so processes sharing a file rely on noticing
+// that another has rotated it
+func lockFile(f *os.File) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -3,23 +3,41 @@
 package log4go
 
 import (
-	"archive/zip"
-	"compress/gzip"
+	"bufio"
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Time format
 const (
 	SuffixDateFormat = "2006-01-02"
+
+	// The date suffix layouts used by hourly, weekly and monthly rotation
+	HourlySuffixDateFormat  = "2006-01-02_15"
+	WeeklySuffixDateFormat  = "2006-W" + WeekNumberToken
+	MonthlySuffixDateFormat = "2006-01"
+
+	// Date suffix layouts for files rotated by size or lines many times a
+	// day, which keep apart files that would otherwise need counters
+	SecondSuffixDateFormat      = "2006-01-02_15-04-05"
+	MillisecondSuffixDateFormat = "2006-01-02_15-04-05.000"
 )
 
+// In a date suffix layout, WeekNumberToken is replaced by the ISO 8601 week
+// number, which time layouts can't express
+const WeekNumberToken = "WW"
+
 const (
 	FILELOG_ARCHIVE_REGEX = `\.[0-9]{4}-[0-9]{2}-[0-9]{2}(\.[0-9]{4})?(\.gz|\.zip)?$`
 )
@@ -27,8 +45,9 @@ const (
 type CompressionMethod string
 
 const (
-	COMPRESSION_GZIP CompressionMethod = "gz"
-	COMPRESSION_ZIP  CompressionMethod = "zip"
+	COMPRESSION_GZIP   CompressionMethod = "gz"
+	COMPRESSION_ZIP    CompressionMethod = "zip"
+	COMPRESSION_SNAPPY CompressionMethod = "snappy"
 )
 
 // Helper date comparison
@@ -41,11 +60,102 @@ func dateEqual(first time.Time, second time.Time) bool {
 	return false
 }
 
+// Helper hour comparison
+func hourEqual(first time.Time, second time.Time) bool {
+	return dateEqual(first, second) && first.Hour() == second.Hour()
+}
+
+// Format t according to a date suffix layout
+func formatDateSuffix(t time.Time, layout string) string {
+	suffix := t.Format(layout)
+	if strings.Contains(layout, WeekNumberToken) {
+		_, week := t.ISOWeek()
+		suffix = replaceWeekNumberToken(suffix, fmt.Sprintf("%02d", week))
+	}
+	return suffix
+}
+
+// Replace each WeekNumberToken in s with week, working from the right so that
+// "WWW" reads as a literal W followed by the week number
+func replaceWeekNumberToken(s, week string) string {
+	for i := strings.LastIndex(s, WeekNumberToken); i >= 0; i = strings.LastIndex(s[:i], WeekNumberToken) {
+		s = s[:i] + week + s[i+len(WeekNumberToken):]
+	}
+	return s
+}
+
+// Build the pattern matching the suffixes of files rotated with the given
+// date suffix layout, in the same form as FILELOG_ARCHIVE_REGEX
+func archiveRegex(layout string) string {
+	return dateSuffixRegex(layout) + `(\.[0-9]{4})?(\.gz|\.zip)?$`
+}
+
+// Build the pattern matching a date suffix, including its leading dot
+func dateSuffixRegex(layout string) string {
+	layout = replaceWeekNumberToken(layout, "00")
+	var out bytes.Buffer
+	out.WriteString(`\.`)
+	for i := 0; i < len(layout); {
+		c := layout[i]
+		class := ""
+		switch {
+		case c >= '0' && c <= '9':
+			class = "[0-9]"
+		case (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+			class = "[A-Za-z]"
+		default:
+			out.WriteString(regexp.QuoteMeta(string(c)))
+			i++
+			continue
+		}
+
+		// Collapse runs of the same class
+		n := 1
+		for i+n < len(layout) && sameSuffixClass(layout[i+n], c) {
+			n++
+		}
+		if n == 1 {
+			out.WriteString(class)
+		} else {
+			fmt.Fprintf(&out, "%s{%d}", class, n)
+		}
+		i += n
+	}
+	return out.String()
+}
+
+// Name a rotated file by adding suffix to filename, before its extension if
+// preserveExt is set (app.log becomes app.001.log rather than app.log.001)
+func rotatedFilename(filename, suffix string, preserveExt bool) string {
+	if ext := filepath.Ext(filename); preserveExt && len(ext) > 0 {
+		return filename[:len(filename)-len(ext)] + "." + suffix + ext
+	}
+	return filename + "." + suffix
+}
+
+func sameSuffixClass(a, b byte) bool {
+	isDigit := func(c byte) bool { return c >= '0' && c <= '9' }
+	isLetter := func(c byte) bool { return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') }
+	return (isDigit(a) && isDigit(b)) || (isLetter(a) && isLetter(b))
+}
+
+// LogDirectoryMode is the permissions given to directories created to hold
+// log files, subject to the umask.  On Windows, a mode which grants nothing to
+// group or other gives the directory an ACL allowing access only to its owner,
+// SYSTEM and Administrators; otherwise the directory inherits its parent's ACL.
+var LogDirectoryMode os.FileMode = 0750
+
+// MissingFileCheckInterval is how often a FileLogWriter which is writing
+// checks that its file hasn't been removed, recreating it if it has.  Writers
+// detecting external rotation check as often as that says instead.  Zero turns
+// off the checks.
+var MissingFileCheckInterval = time.Second
+
 // Create directory and check basic permissions
-func makeDirectory(filename string) error {
+func makeDirectory(filename string, mode os.FileMode) error {
 	// Create directory if doesn't exist
 	logDir := filepath.Dir(filename)
-	if err := os.MkdirAll(logDir, os.ModeDir|os.ModePerm); err != nil {
+	if err := mkdirAll(logDir, mode.Perm()); err != nil {
 		return err
 	}
 
@@ -59,23 +169,86 @@ func makeDirectory(filename string) error {
 	return nil
 }
 
-// This log writer sends output to a file
+// This log writer sends output to a file.  Its Set methods may be called at
+// any time: changes are handed to the writer's goroutine, which applies them
+// between records.
 type FileLogWriter struct {
+	// Records logged, records taken off the queue and records dropped because
+	// it was full (accessed atomically; first for alignment)
+	queued, dequeued, dropped uint64
+
+	// Counters reported by Stats
+	counters fileLogCounters
+
+	// What to do when the queue is full (accessed atomically)
+	overflow int32
+
+	// Set once CloseTimeout has given up waiting, after which queued records
+	// are discarded (accessed atomically)
+	abandon int32
+
 	rec             chan *LogRecord
+	queue           *queueTracker
 	rot             chan bool
+	cfg             chan func()
 	completed       chan int
-	backgroundTasks chan string
+	backgroundTasks chan archiveTask
 	wg              *sync.WaitGroup
 
 	// The opened file
 	filename string
 	file     *os.File
 
-	// The error channel
+	// Buffers writes to the file if bufferSize is set, writing out what has
+	// been buffered every flushInterval
+	bufferSize    int
+	buffer        *bufio.Writer
+	flushInterval time.Duration
+
+	// Write out the buffer straight after records at or above flushLevel,
+	// if flushOnLevel is set
+	flushLevel   Level
+	flushOnLevel bool
+
+	// Records encoded but not yet written, so that those already waiting in
+	// the queue can be written together
+	batch   []byte
+	batched []batchedRecord
+
+	// When to sync the file, and how many records have been written since it
+	// last was
+	syncPolicy SyncPolicy
+	unsynced   int
+
+	// Where to write when writes to the file keep failing.  While writing
+	// there, primaryFilename is the writer's own file, checked for whether it
+	// can be written again every fallbackRetry.
+	fallbackFilename string
+	primaryFilename  string
+	fallbackRetry    time.Duration
+	lastPrimaryCheck time.Time
+	failedWrites     int
+
+	// Other processes append to and rotate the file too
+	shared bool
+
+	// Permissions for directories created to hold the file
+	dirMode os.FileMode
+
+	// A symlink kept pointing at the file
+	symlink string
+
+	// The owner given to the file and its compressed copies; -1 leaves the
+	// owner or group unchanged
+	uid, gid int
+
+	// The error channel, which is errors unless replaced
 	errorWriter io.Writer
+	errors      *errorOutput
 
-	// The logging format
-	format string
+	// The logging format, and the encoder which applies it
+	format  string
+	encoder Encoder
 
 	// File header/trailer
 	header, trailer string
@@ -85,53 +258,257 @@ type FileLogWriter struct {
 	maxlines_curlines int
 
 	// Rotate at size
-	maxsize         int
-	maxsize_cursize int
+	maxsize         int64
+	maxsize_cursize int64
 
-	// Rotate daily
-	daily          bool
-	daily_opendate int
+	// What to do while the filesystem has less than minFreeSpace bytes free
+	minFreeSpace      uint64
+	lowSpacePolicy    LowSpacePolicy
+	emergencyFilename string
+	emergencyFile     *os.File
+	lowSpace          bool
+	lowSpaceDropped   uint64
+
+	// Rotate once the file has been open this long
+	maxFileAge time.Duration
+
+	// How much of the current file is its header
+	headerLines int
+	headerSize  int64
+
+	// How often to check whether something else has rotated the file, and
+	// when it was last checked
+	detectInterval time.Duration
+	lastDetect     time.Time
+
+	// Rotate at the end of each interval, counted from when the file was opened
+	interval RotateInterval
+	opentime time.Time
+
+	// Use UTC rather than local time for rotation boundaries and date suffixes
+	utc bool
+
+	// Rotate daily at a time of day rather than midnight, if rotateAtLoc is set
+	rotateAtHour, rotateAtMinute int
+	rotateAtLoc                  *time.Location
 
 	// Keep old logfiles
 	rotate bool
 
+	// Rotate by copying the file and truncating it, rather than renaming it
+	copyTruncate bool
+
+	// Move rotated files into a directory named after the rotation time
+	archiveDir string
+
+	// Rotation notification and metadata files
+	onRotate         []func(RotationEvent)
+	rotationHook     func(oldPath, newPath string) error
+	rotationMetadata bool
+
 	// Use date-based rotation
 	rotateDateSuffix bool
+	dateSuffixFormat string
+
+	// Put rotation suffixes before the extension
+	preserveExt bool
+
+	// Integer suffixes are padded to seqWidth digits and run up to seqMax,
+	// after which the oldest is reused if seqRecycle is set
+	seqWidth   int
+	seqMax     int
+	seqRecycle bool
+
+	// The last integer suffix used, found by scanning the directory seqDir
+	// when first needed or read from stateFile, where it is kept if set
+	seqLast   int
+	seqDir    string
+	stateFile string
+
+	// Name rotated files after a template rather than adding suffixes
+	nameTemplate string
 
 	// Rotate on startup
 	rotateOnStartup             bool
+	rotateStaleOnStartup        bool
 	currentFileExistedAtStartup bool
 
-	// Archive (age-off) options
-	filesToKeep    int
-	logfileMatcher *regexp.Regexp
+	// Archive (age-off) options.  Only files with date suffixes count
+	// towards filesToKeep until SetMaxBackups is called.
+	filesToKeep     int
+	countAllBackups bool
+	maxAge          time.Duration
+	maxTotalSize    int64
+	logfileMatcher  *regexp.Regexp
 
 	// Compression
 	compress          bool
 	compressionMethod CompressionMethod
+	compressor        Compressor // Overrides compressionMethod if set
+
+	// Scheduled flush and rotation
+	flushSchedule  *Schedule
+	rotateSchedule *Schedule
 
-	// Failure counters
-	rotationFailures uint64
-	writeFailures    uint64
+	// Failure counters, and when a write failure was last reported
+	rotationFailures  uint64
+	writeFailures     uint64
+	lastFailureReport time.Time
+
+	// Set while writes are failing (accessed atomically)
+	writeFailing int32
 
 	// Whether we've fully started, that is, received our first log message
 	started bool
 }
 
+// A record in the batch waiting to be written
+type batchedRecord struct {
+	size  int
+	lines int
+	level Level
+}
+
+// Work for the background goroutine after a rotation, carrying the settings
+// in force at the time
+type archiveTask struct {
+	filename          string
+	filesToKeep       int
+	countAllBackups   bool
+	maxAge            time.Duration
+	maxTotalSize      int64
+	matcher           *regexp.Regexp
+	base              string // The log file's name, for reading date suffixes
+	dateSuffixFormat  string
+	location          *time.Location // For reading date suffixes
+	preserveExt       bool
+	compress          bool
+	compressionMethod CompressionMethod
+	compressor        Compressor
+	archiveRoot       string // If set, rotated files are looked for anywhere below this
+	uid, gid          int
+	rotatedFrom       string // The log file's name, for the rotation hook
+	hook              func(oldPath, newPath string) error
+}
+
+// Apply a configuration change on the writer's goroutine, or directly once
+// the writer has been closed
+func (w *FileLogWriter) configure(change func()) {
+	done := make(chan bool)
+	select {
+	case w.cfg <- func() { change(); close(done) }:
+		<-done
+	case <-w.completed:
+		change()
+	}
+}
+
 // This is the FileLogWriter's output method
 func (w *FileLogWriter) LogWrite(rec *LogRecord) {
-	w.rec <- rec
+	w.enqueue(rec)
+}
+
+// FileLogWriters release records once they have been encoded
+func (w *FileLogWriter) releasesRecords() {}
+
+// Flush writes out everything logged so far which is still queued or
+// buffered, returning once it has been handed to the operating system.
+func (w *FileLogWriter) Flush() {
+	if !w.waitForQueue() {
+		return
+	}
+	w.configure(func() {
+		w.handleWriteFailure(w.flushBuffer())
+	})
+}
+
+// Wait until the writer's goroutine has taken every record logged so far off
+// the queue, returning false if the writer is closed first
+func (w *FileLogWriter) waitForQueue() bool {
+	for target := atomic.LoadUint64(&w.queued); atomic.LoadUint64(&w.dequeued) < target; {
+		select {
+		case <-w.completed:
+			return false
+		case <-time.After(time.Millisecond):
+		}
+	}
+	return true
+}
+
+// QueueStats reports on the records waiting to be written.
+func (w *FileLogWriter) QueueStats() QueueStats {
+	return QueueStats{
+		Length:    len(w.rec),
+		Capacity:  cap(w.rec),
+		OldestAge: w.queue.oldestAge(time.Now()),
+	}
 }
 
 func (w *FileLogWriter) Close() {
+	unregisterFileWriter(w)
 	close(w.rec)
 	<-w.completed
 	close(w.backgroundTasks)
 	w.wg.Wait()
 }
 
+// CloseTimeout closes the writer as Close does, but waits at most d for the
+// queued records to be written and for rotated files to be compressed and
+// pruned.  If time runs out, the records still queued are abandoned, so that
+// the writer's goroutines finish as soon as any write in progress returns,
+// and an error says how many were lost.
+func (w *FileLogWriter) CloseTimeout(d time.Duration) error {
+	unregisterFileWriter(w)
+	close(w.rec)
+	timeout := time.NewTimer(d)
+	defer timeout.Stop()
+
+	select {
+	case <-w.completed:
+	case <-timeout.C:
+		atomic.StoreInt32(&w.abandon, 1)
+		abandoned := atomic.LoadUint64(&w.queued) - atomic.LoadUint64(&w.dequeued)
+		go func() {
+			<-w.completed
+			close(w.backgroundTasks)
+		}()
+		return fmt.Errorf("FileLogWriter(%q): Close timed out after %s, abandoning %d queued log message(s)", w.filename, d, abandoned)
+	}
+	close(w.backgroundTasks)
+
+	done := make(chan bool)
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-timeout.C:
+		return fmt.Errorf("FileLogWriter(%q): Close timed out after %s waiting for rotated files to be archived", w.filename, d)
+	}
+}
+
+// Healthy reports whether the most recent write to the log file succeeded.
+func (w *FileLogWriter) Healthy() bool {
+	return atomic.LoadInt32(&w.writeFailing) == 0
+}
+
 // Track write failures and prints to stderr when possible. If err is nil, we'll try to clear the failures
 func (w *FileLogWriter) handleWriteFailure(err error) {
+	if err != nil {
+		atomic.StoreInt32(&w.writeFailing, 1)
+		atomic.AddUint64(&w.counters.writeFailures, 1)
+	} else {
+		atomic.StoreInt32(&w.writeFailing, 0)
+	}
+
+	// Count failures until it's time to report again
+	if err != nil && time.Since(w.lastFailureReport) < FailureReportInterval {
+		w.writeFailures += 1
+		return
+	}
+
 	// Try to note any previous failures
 	if w.writeFailures != 0 {
 		_, fprintfErr := fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Dropped %d previous log message(s)\n", w.filename, w.writeFailures)
@@ -150,12 +527,18 @@ func (w *FileLogWriter) handleWriteFailure(err error) {
 		_, fprintfErr := fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Write failed: %v\n", w.filename, err)
 		if fprintfErr != nil {
 			w.writeFailures += 1
+		} else {
+			w.lastFailureReport = time.Now()
 		}
 	}
 }
 
 // Track rotation failures and prints to stderr when possible. If err is nil, we'll try to clear the failures
 func (w *FileLogWriter) handleRotationFailure(err error) {
+	if err != nil {
+		atomic.AddUint64(&w.counters.rotationFailures, 1)
+	}
+
 	// Try to note any previous failures
 	if w.rotationFailures != 0 {
 		_, fprintfErr := fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): %d previous rotation failures occurred\n", w.filename, w.rotationFailures)
@@ -178,6 +561,18 @@ func (w *FileLogWriter) handleRotationFailure(err error) {
 	}
 }
 
+// This is called when the rotation schedule fires.  A file with nothing but
+// its header in it is left alone.
+func (w *FileLogWriter) handleScheduledRotation() {
+	if w.maxsize_cursize == w.headerSize {
+		return
+	}
+	// Startup rotation would only rotate the new file again
+	w.started = true
+	err := w.handleRotateFor(ROTATE_SCHEDULED, w.opentime)
+	w.handleRotationFailure(err)
+}
+
 // This is called on first log write
 func (w *FileLogWriter) handleStartupRotation() error {
 	// Skip rotation if the current file didn't exist at startup
@@ -187,9 +582,10 @@ func (w *FileLogWriter) handleStartupRotation() error {
 
 	// open the file for the first time, rotating only if necessary
 	fileInfo, fileInfoErr := os.Lstat(w.filename)
-	if fileInfoErr == nil {
-		if !dateEqual(fileInfo.ModTime(), time.Now()) || w.rotateOnStartup {
-			if err := w.handleRotate(fileInfo.ModTime()); err != nil {
+	if fileInfoErr == nil && (w.rotateOnStartup || w.rotateStaleOnStartup) {
+		lastWritten := w.lastWritten(fileInfo)
+		if w.rotateOnStartup || !w.sameInterval(lastWritten, time.Now()) {
+			if err := w.handleRotateFor(ROTATE_STARTUP, lastWritten); err != nil {
 				fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): %s\n", w.filename, err)
 				return err
 			}
@@ -198,6 +594,38 @@ func (w *FileLogWriter) handleStartupRotation() error {
 	return nil
 }
 
+// How much of the end of an existing file is searched for its last record
+const lastRecordSearchSize = 64 * 1024
+
+// When the existing log file was last written to.  This is the time of the
+// last record in it, if one can be read, since the modification time can be
+// changed by backup tools and the like; otherwise it is the modification time.
+func (w *FileLogWriter) lastWritten(info os.FileInfo) time.Time {
+	fd, err := os.Open(w.filename)
+	if err != nil {
+		return info.ModTime()
+	}
+	defer fd.Close()
+
+	if offset := info.Size() - lastRecordSearchSize; offset > 0 {
+		if _, err := fd.Seek(offset, io.SeekStart); err != nil {
+			return info.ModTime()
+		}
+	}
+
+	var last time.Time
+	r := NewLogReader(fd)
+	for r.Next() {
+		if created := r.Record().Created; !created.IsZero() {
+			last = created
+		}
+	}
+	if last.IsZero() {
+		return info.ModTime()
+	}
+	return last
+}
+
 // NewFileLogWriter creates a new LogWriter which writes to the given file and
 // has rotation enabled if rotate is true.
 //
@@ -208,32 +636,51 @@ func (w *FileLogWriter) handleStartupRotation() error {
 // The standard log-line format is:
 //   [%D %T] [%L] (%S) %M
 func NewFileLogWriter(fname string, rotate bool, compress bool) *FileLogWriter {
+	return NewFileLogWriterBuffered(fname, rotate, compress, LogBufferLength)
+}
+
+// NewFileLogWriterBuffered creates a FileLogWriter as NewFileLogWriter does,
+// but whose queue holds up to bufLen records rather than LogBufferLength, so
+// that a bursty writer can have a deep queue without affecting the others.
+func NewFileLogWriterBuffered(fname string, rotate bool, compress bool, bufLen int) *FileLogWriter {
+	if bufLen < 0 {
+		bufLen = 0
+	}
 	w := &FileLogWriter{
-		rec:                         make(chan *LogRecord, LogBufferLength),
+		rec:                         make(chan *LogRecord, bufLen),
+		queue:                       newQueueTracker(),
 		rot:                         make(chan bool),
-		backgroundTasks:             make(chan string, 1),
+		cfg:                         make(chan func()),
+		backgroundTasks:             make(chan archiveTask, 1),
 		completed:                   make(chan int),
 		filename:                    fname,
+		dirMode:                     LogDirectoryMode,
+		uid:                         -1,
+		gid:                         -1,
 		format:                      "[%D %T] [%L] (%S) %M",
+		encoder:                     NewFormatEncoder("[%D %T] [%L] (%S) %M"),
 		rotate:                      rotate,
 		rotateDateSuffix:            false,
+		dateSuffixFormat:            SuffixDateFormat,
+		flushInterval:               time.Second,
+		seqWidth:                    3,
+		seqMax:                      999,
 		rotateOnStartup:             true,
+		rotateStaleOnStartup:        true,
 		currentFileExistedAtStartup: true,
 		compress:                    compress,
 		compressionMethod:           FILELOG_DEFAULT_COMPRESSION_METHOD,
-		errorWriter:                 os.Stderr,
 		started:                     false,
 		filesToKeep:                 30,
 		wg:                          &sync.WaitGroup{},
 	}
+	w.errors = &errorOutput{out: os.Stderr}
+	w.errorWriter = w.errors
 
 	// Compile the regex to match against files to archive
-	logfilePrefix := filepath.Base(w.filename)
-	logfileMatcher, err := regexp.Compile("^" + regexp.QuoteMeta(logfilePrefix) + FILELOG_ARCHIVE_REGEX)
-	if err != nil {
+	if err := w.compileMatcher(); err != nil {
 		return nil
 	}
-	w.logfileMatcher = logfileMatcher
 
 	// If the current file doesn't exist, we should short-circuit handleStartupRotation,
 	// or we will rotate twice
@@ -252,45 +699,109 @@ func NewFileLogWriter(fname string, rotate bool, compress bool) *FileLogWriter {
 		defer w.wg.Done()
 
 		defer func() {
-			if w.file != nil {
-				fmt.Fprint(w.file, FormatLogRecord(w.trailer, &LogRecord{Created: time.Now()}))
-				w.file.Close()
+			w.closeLogFile()
+			w.endLowSpace()
+		}()
+
+		var flushTimer, rotateTimer scheduleTimer
+		defer flushTimer.stop()
+		defer rotateTimer.stop()
+
+		var spaceTicker *time.Ticker
+		var spaceCheck <-chan time.Time
+		defer func() {
+			if spaceTicker != nil {
+				spaceTicker.Stop()
+			}
+		}()
+
+		var bufferTicker *time.Ticker
+		var bufferFlush <-chan time.Time
+		var bufferInterval time.Duration
+		defer func() {
+			if bufferTicker != nil {
+				bufferTicker.Stop()
+			}
+		}()
+
+		var syncTicker *time.Ticker
+		var syncCheck <-chan time.Time
+		var syncInterval time.Duration
+		defer func() {
+			if syncTicker != nil {
+				syncTicker.Stop()
 			}
 		}()
 
 		for {
-			if w.started == false {
-				err := w.handleStartupRotation()
-				w.handleRotationFailure(err)
-				w.started = true
+			// Follow changes to the schedules
+			flushTimer.follow(w.flushSchedule)
+			rotateTimer.follow(w.rotateSchedule)
+
+			// Check free space only while there is a minimum
+			if spaceTicker != nil && w.minFreeSpace == 0 {
+				spaceTicker.Stop()
+				spaceTicker, spaceCheck = nil, nil
+			} else if spaceTicker == nil && w.minFreeSpace > 0 {
+				spaceTicker = time.NewTicker(FreeSpaceCheckInterval)
+				spaceCheck = spaceTicker.C
+			}
+
+			// Write out the buffer periodically only while there is one
+			interval := w.flushInterval
+			if w.buffer == nil {
+				interval = 0
+			}
+			if interval != bufferInterval {
+				if bufferTicker != nil {
+					bufferTicker.Stop()
+					bufferTicker, bufferFlush = nil, nil
+				}
+				if interval > 0 {
+					bufferTicker = time.NewTicker(interval)
+					bufferFlush = bufferTicker.C
+				}
+				bufferInterval = interval
+			}
+
+			// Follow changes to the sync interval
+			if w.syncPolicy.interval != syncInterval {
+				if syncTicker != nil {
+					syncTicker.Stop()
+					syncTicker, syncCheck = nil, nil
+				}
+				if w.syncPolicy.interval > 0 {
+					syncTicker = time.NewTicker(w.syncPolicy.interval)
+					syncCheck = syncTicker.C
+				}
+				syncInterval = w.syncPolicy.interval
 			}
+
 			select {
+			case <-spaceCheck:
+				w.checkFreeSpace()
+			case <-bufferFlush:
+				w.handleWriteFailure(w.flushBuffer())
+			case <-syncCheck:
+				if w.unsynced > 0 {
+					w.handleWriteFailure(w.flush())
+				}
+			case <-flushTimer.C:
+				w.handleWriteFailure(w.flush())
+				flushTimer.reset()
+			case <-rotateTimer.C:
+				w.handleScheduledRotation()
+				rotateTimer.reset()
+			case change := <-w.cfg:
+				change()
 			case <-w.rot:
-				err := w.handleRotate(time.Now())
+				err := w.handleRotateFor(ROTATE_MANUAL, time.Now())
 				w.handleRotationFailure(err)
 			case rec, ok := <-w.rec:
-				if !ok {
+				if !ok || !w.writeRecords(rec) {
 					close(w.completed)
 					return
 				}
-				now := time.Now()
-				if (w.maxlines > 0 && w.maxlines_curlines >= w.maxlines) ||
-					(w.maxsize > 0 && w.maxsize_cursize >= w.maxsize) {
-					err := w.handleRotate(now)
-					w.handleRotationFailure(err)
-				} else if w.daily && now.Day() != w.daily_opendate {
-					// Since we crossed the time boundary, back the date up by one day
-					err := w.handleRotate(now.Add(-1 * 24 * time.Hour))
-					w.handleRotationFailure(err)
-				}
-
-				// Perform the write
-				n, err := fmt.Fprint(w.file, FormatLogRecord(w.format, rec))
-				w.handleWriteFailure(err)
-
-				// Update the counts
-				w.maxlines_curlines++
-				w.maxsize_cursize += n
 			}
 		}
 	}()
@@ -300,79 +811,433 @@ func NewFileLogWriter(fname string, rotate bool, compress bool) *FileLogWriter {
 	go func() {
 		defer w.wg.Done()
 
-		for filename := range w.backgroundTasks {
-			if w.filesToKeep > 0 {
-				dir := filepath.Dir(filename)
-				err := w.archiveFiles(dir)
-				if err != nil {
-					fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Couldn't archive files: %s\n", filename, err)
+		for task := range w.backgroundTasks {
+			filename := task.filename
+
+			if task.hook != nil {
+				w.runRotationHook(task)
+
+				// The hook may have moved the file away
+				if _, err := os.Lstat(filename); os.IsNotExist(err) {
+					task.compress = false
 				}
 			}
 
-			if w.compress {
-				compressedFilename := filename + "." + string(w.compressionMethod)
+			// Compress first, so that the sizes of files are known when
+			// pruning
+			if task.compress && task.compressor == nil {
+				fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Unknown compression method: %q\n", w.filename, task.compressionMethod)
+			} else if task.compress {
+				compressedFilename := filename + "." + task.compressor.Extension()
 				compressedInprogressFilename := compressedFilename + ".inprogress"
 
-				success := w.compressFile(filename, compressedInprogressFilename, w.compressionMethod)
+				success := w.compressFile(filename, compressedInprogressFilename, task.compressor)
 				if success {
+					w.chownFile(compressedInprogressFilename, task.uid, task.gid)
 					w.moveCompressedFile(filename, compressedFilename, compressedInprogressFilename)
 				} else {
 					w.deleteInprogressFile(compressedInprogressFilename)
 				}
 			}
+
+			if task.prunes() {
+				err := w.archiveFiles(task.dir(), task)
+				if err != nil {
+					fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Couldn't archive files: %s\n", filename, err)
+				}
+			}
 		}
 	}()
 
+	registerFileWriter(w)
 	return w
 }
 
-func (w *FileLogWriter) archiveFiles(dir string) error {
+// Write rec along with the records already waiting behind it in the queue,
+// in a single write to the file, returning false once the queue is closed
+func (w *FileLogWriter) writeRecords(rec *LogRecord) bool {
+	if w.shared && w.started {
+		w.followSharedFile()
+	}
+	defer w.writeBatch()
+	w.batchRecord(rec)
+	for i := 1; i < cap(w.rec); i++ {
+		select {
+		case rec, ok := <-w.rec:
+			if !ok {
+				return false
+			}
+			w.batchRecord(rec)
+		default:
+			return true
+		}
+	}
+	return true
+}
+
+// Add a record to the batch, first rotating the file if the record calls for
+// it.  The line and size counts include the batch, and are corrected by
+// writeBatch if it doesn't all reach the file.
+func (w *FileLogWriter) batchRecord(rec *LogRecord) {
+	defer rec.release()
+	w.queue.pop()
+	atomic.AddUint64(&w.dequeued, 1)
+
+	// CloseTimeout has given up on what's left
+	if atomic.LoadInt32(&w.abandon) != 0 {
+		atomic.AddUint64(&w.counters.abandoned, 1)
+		return
+	}
+
+	// Startup rotation waits for the first message, so that the Set* methods
+	// have been called
+	if w.started == false {
+		err := w.handleStartupRotation()
+		w.handleRotationFailure(err)
+		w.started = true
+	}
+
+	buf, encodeErr := encodeRecord(w.encoder, rec)
+	lines := recordLines(w.encoder, buf)
+
+	// The file is left alone while free space is low
+	if w.lowSpace {
+		w.writeLowSpace(buf, encodeErr)
+		return
+	}
+
+	// Follow the file if something else has rotated it, or at least recreate
+	// it if it has been removed
+	now := time.Now()
+	if w.detectInterval > 0 && now.Sub(w.lastDetect) >= w.detectInterval {
+		w.lastDetect = now
+		w.writeBatch()
+		w.detectExternalRotation()
+	} else if w.detectInterval == 0 && MissingFileCheckInterval > 0 && now.Sub(w.lastDetect) >= MissingFileCheckInterval {
+		w.lastDetect = now
+		w.writeBatch()
+		w.recoverMissingFile()
+	}
+	if len(w.primaryFilename) > 0 {
+		w.writeBatch()
+		w.retryPrimary(now)
+	}
+
+	// Rotate if this record would take the file past a limit, unless the file
+	// holds nothing but its header
+	if reason, rotateTime, ok := w.rotationDue(lines, len(buf), now); ok {
+		w.writeBatch()
+		err := w.handleRotateFor(reason, rotateTime)
+		w.handleRotationFailure(err)
+	}
+
+	if encodeErr != nil {
+		w.handleWriteFailure(encodeErr)
+		return
+	}
+	w.batch = append(w.batch, buf...)
+	w.batched = append(w.batched, batchedRecord{len(buf), lines, rec.Level})
+	w.maxlines_curlines += lines
+	w.maxsize_cursize += int64(len(buf))
+}
+
+// Whether writing a record of lines lines and size bytes at now calls for a
+// rotation first, and if so why and with what time
+func (w *FileLogWriter) rotationDue(lines, size int, now time.Time) (RotationReason, time.Time, bool) {
+	switch {
+	case w.maxlines > 0 && w.maxlines_curlines > w.headerLines && w.maxlines_curlines+lines > w.maxlines:
+		return ROTATE_LINES, now, true
+	case w.maxsize > 0 && w.maxsize_cursize > w.headerSize && w.maxsize_cursize+int64(size) > w.maxsize:
+		return ROTATE_SIZE, now, true
+	case w.maxFileAge > 0 && w.maxsize_cursize > w.headerSize && now.Sub(w.opentime) >= w.maxFileAge:
+		return ROTATE_AGE, now, true
+	case w.interval != RotateNever && !w.sameInterval(w.opentime, now):
+		return w.interval.reason(), w.intervalTime(now), true
+	}
+	return "", now, false
+}
+
+// Write out the batch, taking anything which didn't reach the file back off
+// the counts, then sync if the policy calls for it
+func (w *FileLogWriter) writeBatch() {
+	if len(w.batched) == 0 {
+		return
+	}
+	n, err := w.output().Write(w.batch)
+	w.handleWriteFailure(err)
+	atomic.AddUint64(&w.counters.bytesWritten, uint64(n))
+
+	sync, flush, offset := false, false, 0
+	for _, r := range w.batched {
+		end := offset + r.size
+		if end > n {
+			written := 0
+			if n > offset {
+				written = n - offset
+				w.unsynced++
+			}
+			w.maxlines_curlines -= r.lines - recordLines(w.encoder, w.batch[offset:offset+written])
+			w.maxsize_cursize -= int64(r.size - written)
+		} else {
+			atomic.AddUint64(&w.counters.recordsWritten, 1)
+			w.unsynced++
+			sync = sync || w.syncPolicy.due(r.level, w.unsynced)
+			flush = flush || (w.flushOnLevel && r.level >= w.flushLevel)
+		}
+		offset = end
+	}
+	w.batch, w.batched = w.batch[:0], w.batched[:0]
+
+	// The file may have been removed from under us, or be unwritable
+	if err != nil {
+		w.recoverMissingFile()
+	}
+	w.noteWriteResult(err)
+
+	if sync {
+		w.handleWriteFailure(w.flush())
+	} else if flush {
+		w.handleWriteFailure(w.flushBuffer())
+	}
+}
+
+// The work for the background goroutine after rotating to rotatedName
+func (w *FileLogWriter) newArchiveTask(rotatedName string) archiveTask {
+	task := archiveTask{
+		filename:          rotatedName,
+		filesToKeep:       w.filesToKeep,
+		countAllBackups:   w.countAllBackups,
+		maxAge:            w.maxAge,
+		maxTotalSize:      w.maxTotalSize,
+		matcher:           w.logfileMatcher,
+		base:              filepath.Base(w.filename),
+		dateSuffixFormat:  w.dateSuffixFormat,
+		location:          w.location(),
+		preserveExt:       w.preserveExt,
+		compress:          w.compress,
+		compressionMethod: w.compressionMethod,
+		compressor:        w.rotationCompressor(),
+		uid:               w.uid,
+		gid:               w.gid,
+		rotatedFrom:       w.filename,
+		hook:              w.rotationHook,
+	}
+	if len(w.archiveDir) > 0 {
+		task.archiveRoot = w.archiveDirRoot()
+	}
+	return task
+}
+
+// Whether old rotated files are to be removed
+func (task archiveTask) prunes() bool {
+	return task.filesToKeep > 0 || task.maxAge > 0 || task.maxTotalSize > 0
+}
+
+// When a rotated file was written: the time in its date suffix if it has one,
+// otherwise its modification time.  dated reports which it was.
+func (task archiveTask) fileTime(baseFilename string, info os.FileInfo) (written time.Time, dated bool) {
+	prefix, ext := task.base, ""
+	if task.preserveExt {
+		ext = filepath.Ext(prefix)
+		prefix = prefix[:len(prefix)-len(ext)]
+	}
+	// Files named by a template capture their date
+	if i := task.matcher.SubexpIndex("date"); i >= 0 {
+		if m := task.matcher.FindStringSubmatch(baseFilename); m != nil {
+			if t, err := time.ParseInLocation(task.dateSuffixFormat, m[i], task.location); err == nil {
+				return t, true
+			}
+		}
+		return info.ModTime(), false
+	}
+
+	suffix := baseFilename
+	if task.compressor != nil {
+		suffix = strings.TrimSuffix(suffix, "."+task.compressor.Extension())
+	}
+	for _, compressed := range []string{".gz", ".zip"} {
+		suffix = strings.TrimSuffix(suffix, compressed)
+	}
+	suffix = strings.TrimSuffix(suffix, ext)
+	suffix = strings.TrimPrefix(suffix, prefix+".")
+	if t, err := time.ParseInLocation(task.dateSuffixFormat, suffix, task.location); err == nil {
+		return t, true
+	}
+	// Date suffixes may have a sequence number added
+	if dot := strings.LastIndex(suffix, "."); dot > 0 {
+		if t, err := time.ParseInLocation(task.dateSuffixFormat, suffix[:dot], task.location); err == nil {
+			return t, true
+		}
+	}
+	return info.ModTime(), false
+}
+
+// A rotated file found by rotatedFiles
+type rotatedFile struct {
+	name    string
+	written time.Time
+	dated   bool // Whether written is from the file's name
+	size    int64
+}
+
+// Describe a rotated file found in a directory listing
+func (task archiveTask) newRotatedFile(path string, info os.FileInfo) rotatedFile {
+	written, dated := task.fileTime(info.Name(), info)
+	return rotatedFile{path, written, dated, info.Size()}
+}
+
+// Whether a rotated file counts towards task.filesToKeep
+func (task archiveTask) counts(file rotatedFile) bool {
+	return file.dated || task.countAllBackups
+}
+
+// Find the rotated files in dir, oldest first.  With an archive root, dir is
+// that root and its subdirectories are searched too.
+func (task archiveTask) rotatedFiles(dir string) ([]rotatedFile, error) {
 
 	// Get a handle to the directory
 	dirFile, err := os.Open(dir)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer dirFile.Close()
 
 	dirInfo, err := dirFile.Stat()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if !dirInfo.IsDir() {
-		return fmt.Errorf("%q must be a directory", dir)
+		return nil, fmt.Errorf("%q must be a directory", dir)
 	}
 
 	var filesInDir []string
-	var matchedFiles []string
+	var matchedFiles []rotatedFile
+
+	// Rotated files are spread over the dated directories below the archive
+	// root
+	if len(task.archiveRoot) > 0 {
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() && task.matcher.MatchString(info.Name()) {
+				matchedFiles = append(matchedFiles, task.newRotatedFile(path, info))
+			}
+			return nil
+		})
+	}
 
-	for {
+	for len(task.archiveRoot) == 0 {
 		filesInDir, err = dirFile.Readdirnames(1000)
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			return err
+			return nil, err
 		}
 
-		for _, fullFilename := range filesInDir {
-			baseFilename := filepath.Base(fullFilename)
-			if !w.logfileMatcher.MatchString(baseFilename) {
+		for _, baseFilename := range filesInDir {
+			if !task.matcher.MatchString(baseFilename) {
 				// Not interested in this file
 				continue
 			}
 
-			matchedFiles = append(matchedFiles, fullFilename)
+			fullFilename := filepath.Join(dir, baseFilename)
+			info, err := os.Lstat(fullFilename)
+			if err != nil {
+				continue
+			}
+			matchedFiles = append(matchedFiles, task.newRotatedFile(fullFilename, info))
+		}
+	}
+
+	// matchedFiles contains all the logfiles that matched the regexp.  Order
+	// them by the time in their date suffixes, which backup tools can't change
+	// as they can modification times, then by name for the fixed width
+	// sequence numbers added to them - .log.YYYY-MM-DD.NNNN.  Integer suffixes
+	// are reused once freed, so those files can only go by when they were
+	// last modified.
+	sort.Slice(matchedFiles, func(i, j int) bool {
+		a, b := matchedFiles[i], matchedFiles[j]
+		if !a.written.Equal(b.written) {
+			return a.written.Before(b.written)
 		}
+		return a.name < b.name
+	})
+	return matchedFiles, nil
+}
+
+// Remove a rotated file along with its metadata
+func (task archiveTask) remove(filename string) {
+	os.Remove(filename)
+	if task.compressor != nil {
+		filename = strings.TrimSuffix(filename, "."+task.compressor.Extension())
+	}
+	os.Remove(rotationMetadataFilename(filename))
+
+	// Tidy away dated directories once they're empty
+	if len(task.archiveRoot) > 0 && filepath.Dir(filename) != filepath.Clean(task.archiveRoot) {
+		os.Remove(filepath.Dir(filename))
+	}
+}
+
+// The directory holding the rotated files for a task
+func (task archiveTask) dir() string {
+	if len(task.archiveRoot) > 0 {
+		return task.archiveRoot
 	}
+	return filepath.Dir(task.filename)
+}
 
-	// matchedFiles contains all the logfiles that matched the regexp.
-	// When sorted, we can find the oldest files because the suffixes are
-	// fixed width - .log.YYYY-MM-DD
-	sort.Strings(matchedFiles)
+// Remove rotated files from dir which are older than task.maxAge, then all but
+// the newest task.filesToKeep of those left, then the oldest until the rest
+// take up no more than task.maxTotalSize.  With an archive root, dir is that
+// root and its subdirectories are searched too.
+func (w *FileLogWriter) archiveFiles(dir string, task archiveTask) error {
+	matchedFiles, err := task.rotatedFiles(dir)
+	if err != nil {
+		return err
+	}
+	// Remove files which are too old
+	if task.maxAge > 0 {
+		cutoff := time.Now().Add(-task.maxAge)
+		kept := matchedFiles[:0]
+		for _, file := range matchedFiles {
+			if file.written.Before(cutoff) {
+				task.remove(file.name)
+			} else {
+				kept = append(kept, file)
+			}
+		}
+		matchedFiles = kept
+	}
 
 	// Remove unwanted files
-	if len(matchedFiles) > w.filesToKeep {
-		for _, filename := range matchedFiles[0 : len(matchedFiles)-w.filesToKeep] {
-			os.Remove(filename)
+	if task.filesToKeep > 0 {
+		excess := -task.filesToKeep
+		for _, file := range matchedFiles {
+			if task.counts(file) {
+				excess++
+			}
+		}
+		kept := matchedFiles[:0]
+		for _, file := range matchedFiles {
+			if excess > 0 && task.counts(file) {
+				task.remove(file.name)
+				excess--
+			} else {
+				kept = append(kept, file)
+			}
+		}
+		matchedFiles = kept
+	}
+
+	// Remove the oldest files until the rest fit
+	if task.maxTotalSize > 0 {
+		var total int64
+		for _, file := range matchedFiles {
+			total += file.size
+		}
+		for len(matchedFiles) > 0 && total > task.maxTotalSize {
+			task.remove(matchedFiles[0].name)
+			total -= matchedFiles[0].size
+			matchedFiles = matchedFiles[1:]
 		}
 	}
 
@@ -382,8 +1247,8 @@ func (w *FileLogWriter) archiveFiles(dir string) error {
 // Compress a file after it has been rotated.
 // plainFile - name of the rotated, uncompressed file
 // compressedInprogressFilename - name of a temporary file to hold compressed data
-// method - type of compression to use
-func (w *FileLogWriter) compressFile(plainFilename, compressedInprogressFilename string, method CompressionMethod) bool {
+// compressor - the compression to use
+func (w *FileLogWriter) compressFile(plainFilename, compressedInprogressFilename string, compressor Compressor) bool {
 	plainFile, err := os.Open(plainFilename)
 	if err != nil {
 		fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Couldn't open logfile %q to begin compression: %s\n", w.filename, plainFilename, err)
@@ -398,6 +1263,7 @@ func (w *FileLogWriter) compressFile(plainFilename, compressedInprogressFilename
 	}
 
 	// Defer closing the underlying file
+	success := true
 	defer func() {
 		err = compressedFile.Close()
 		if err != nil {
@@ -405,50 +1271,31 @@ func (w *FileLogWriter) compressFile(plainFilename, compressedInprogressFilename
 		}
 	}()
 
-	var compressedFileWriter io.Writer
-	switch method {
-	case "gz":
-		gzipWriter := gzip.NewWriter(compressedFile)
-
-		defer func() {
-			err = gzipWriter.Close()
-			if err != nil {
-				fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Couldn't close gzip writer on %q: %s\n", w.filename, compressedInprogressFilename, err)
-			}
-		}()
-		compressedFileWriter = gzipWriter
-	case "zip":
-		// zipWriter is the outer container, compressedFileWriter is an entry inside the zip
-		zipWriter := zip.NewWriter(compressedFile)
-
-		// Defer closing the zip writer
-		defer func() {
-			err = zipWriter.Close()
-			if err != nil {
-				fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Couldn't close zip writer on %q: %s\n", w.filename, compressedInprogressFilename, err)
-			}
-		}()
-
-		// compressedFileWriter, the zip file entry, doesn't have a Close() method
-		basename := filepath.Base(plainFilename)
-		compressedFileWriter, err = zipWriter.Create(basename)
-		if err != nil {
-			fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Couldn't open zip file entry: %s\n", w.filename, err)
-			return false
-		}
-	default:
-		fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Unknown compression method: %q\n", w.filename, method)
-		return false
-	}
+	compressedFileWriter, err := compressor.NewWriter(compressedFile, filepath.Base(plainFilename))
+	if err != nil {
+		fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Couldn't start compressing %q: %s\n", w.filename, compressedInprogressFilename, err)
+		return false
+	}
 
 	// Read plain file, write to compressed file
 	_, err = io.Copy(compressedFileWriter, plainFile)
 	if err != nil {
 		fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Couldn't write compressed file %q: %s\n", w.filename, compressedInprogressFilename, err)
-		return false
+		success = false
 	}
 
-	return true
+	err = compressedFileWriter.Close()
+	if err != nil {
+		fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Couldn't finish compressing %q: %s\n", w.filename, compressedInprogressFilename, err)
+		success = false
+	}
+
+	// Keep the modification time, by which old files are aged off
+	if info, err := plainFile.Stat(); err == nil && success {
+		os.Chtimes(compressedInprogressFilename, info.ModTime(), info.ModTime())
+	}
+
+	return success
 }
 
 func (w *FileLogWriter) moveCompressedFile(plainFilename, compressedFilename, compressedInprogressFilename string) {
@@ -486,22 +1333,136 @@ func (w *FileLogWriter) Rotate() {
 	w.rot <- true
 }
 
-// Generate the next filename for rotation using integer suffix
+// Reopen closes the file and opens it again by name, without renaming it,
+// so that records go to a new file once an external tool such as logrotate
+// has moved the old one away.  It does nothing once the writer is closed.
+func (w *FileLogWriter) Reopen() {
+	done := make(chan bool)
+	reopen := func() {
+		if err := w.openLogFile(); err != nil {
+			fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Couldn't reopen file: %s\n", w.filename, err)
+		}
+		close(done)
+	}
+	select {
+	case w.cfg <- reopen:
+		<-done
+	case <-w.completed:
+	}
+}
+
+// Generate the next filename for rotation using integer suffix, carrying on
+// from the last one used
 func (w *FileLogWriter) nextIntegerFilename(filename string) (string, error) {
-	for i := 1; i <= 999; i++ {
-		fullName := filename + fmt.Sprintf(".%03d", i)
-		if _, err := os.Lstat(fullName); os.IsNotExist(err) {
-			return fullName, nil
+	name := func(seq int) string {
+		return rotatedFilename(filename, fmt.Sprintf("%0*d", w.seqWidth, seq), w.preserveExt)
+	}
+	if dir := filepath.Dir(filename); w.seqLast == 0 || (len(w.stateFile) == 0 && dir != w.seqDir) {
+		w.seqLast, w.seqDir = w.lastSequence(name), dir
+	}
+
+	fullName, seq, ok := w.nextSequenceFilename(name, w.seqLast)
+	if !ok {
+		return "", fmt.Errorf("Rotate: Cannot find free log number to rename %s\n", filename)
+	}
+	w.seqLast = seq
+	w.saveSequenceState()
+	return fullName, nil
+}
+
+// Find the number of the most recently written file, or 0 if there are none
+func (w *FileLogWriter) lastSequence(name func(seq int) string) int {
+	last, lastTime := 0, time.Time{}
+	for i := 1; i <= w.seqMax; i++ {
+		for _, suffix := range w.rotatedSuffixes() {
+			if info, err := os.Lstat(name(i) + suffix); err == nil && !info.ModTime().Before(lastTime) {
+				last, lastTime = i, info.ModTime()
+			}
+		}
+	}
+	return last
+}
+
+// The suffixes a rotated file may have gained: none, or its compressed
+// extension
+func (w *FileLogWriter) rotatedSuffixes() []string {
+	suffixes := []string{""}
+	if c := w.rotationCompressor(); w.compress && c != nil {
+		suffixes = append(suffixes, "."+c.Extension())
+	}
+	return suffixes
+}
+
+// Find the first sequence number after last, wrapping around after seqMax,
+// whose name is free.  When they are all taken and seqRecycle is set, the
+// oldest file is removed and its name reused.
+func (w *FileLogWriter) nextSequenceFilename(name func(seq int) string, last int) (string, int, bool) {
+	for i := 0; i < w.seqMax; i++ {
+		seq := (last+i)%w.seqMax + 1
+		if fullName := name(seq); w.rotatedNameFree(fullName) {
+			return fullName, seq, true
+		}
+	}
+	if !w.seqRecycle {
+		return "", 0, false
+	}
+
+	// Either the file or its compressed copy may be there
+	oldest, oldestSeq, oldestTime := "", 0, time.Time{}
+	for i := 1; i <= w.seqMax; i++ {
+		for _, suffix := range w.rotatedSuffixes() {
+			info, err := os.Lstat(name(i) + suffix)
+			if err != nil {
+				continue
+			}
+			if len(oldest) == 0 || info.ModTime().Before(oldestTime) {
+				oldest, oldestSeq, oldestTime = name(i), i, info.ModTime()
+			}
 		}
 	}
+	if len(oldest) == 0 {
+		return "", 0, false
+	}
+	task := w.newArchiveTask(oldest)
+	for _, suffix := range w.rotatedSuffixes() {
+		task.remove(oldest + suffix)
+	}
+	return oldest, oldestSeq, w.rotatedNameFree(oldest)
+}
 
-	return "", fmt.Errorf("Rotate: Cannot find free log number to rename %s\n", filename)
+// Record the last integer suffix used in the state file, if there is one
+func (w *FileLogWriter) saveSequenceState() {
+	if len(w.stateFile) == 0 {
+		return
+	}
+	tmp := w.stateFile + ".tmp"
+	err := ioutil.WriteFile(tmp, []byte(strconv.Itoa(w.seqLast)+"\n"), 0644)
+	if err == nil {
+		err = os.Rename(tmp, w.stateFile)
+	}
+	if err != nil {
+		fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Couldn't save rotation state to %q: %s\n", w.filename, w.stateFile, err)
+	}
+}
+
+// Whether a file can be rotated to fullName, which must not be taken either
+// by a file or by a compressed one
+func (w *FileLogWriter) rotatedNameFree(fullName string) bool {
+	if _, err := os.Lstat(fullName); !os.IsNotExist(err) {
+		return false
+	}
+	if c := w.rotationCompressor(); w.compress && c != nil {
+		if _, err := os.Lstat(fullName + "." + c.Extension()); !os.IsNotExist(err) {
+			return false
+		}
+	}
+	return true
 }
 
 // Generate the next filename for rotation using date suffix
 func (w *FileLogWriter) nextDateFilename(filename string, suffix string) (string, error) {
 	// Attempt filename.suffix
-	fullName := fmt.Sprintf("%s.%s", filename, suffix)
+	fullName := rotatedFilename(filename, suffix, w.preserveExt)
 	if _, err := os.Stat(fullName); os.IsNotExist(err) {
 		// File does not exist, return it as the next filename
 		return fullName, nil
@@ -511,7 +1472,7 @@ func (w *FileLogWriter) nextDateFilename(filename string, suffix string) (string
 	var lastErr error
 	var lastFullname string
 	for i := 1; i < 10000; i++ {
-		fullNameWithSuffix := fmt.Sprintf("%s.%s.%04d", filename, suffix, i)
+		fullNameWithSuffix := rotatedFilename(filename, fmt.Sprintf("%s.%04d", suffix, i), w.preserveExt)
 		if _, err := os.Stat(fullNameWithSuffix); os.IsNotExist(err) {
 			return fullNameWithSuffix, nil
 		} else {
@@ -524,18 +1485,44 @@ func (w *FileLogWriter) nextDateFilename(filename string, suffix string) (string
 
 // If this is called in a threaded context, it MUST be synchronized
 func (w *FileLogWriter) handleRotate(rotateTime time.Time) error {
+	return w.handleRotateFor(ROTATE_MANUAL, rotateTime)
+}
+
+// Rotate the file, recording the reason for the rotation
+func (w *FileLogWriter) handleRotateFor(reason RotationReason, rotateTime time.Time) error {
+	if w.shared {
+		return w.rotateShared(func() error {
+			return w.rotateFor(reason, rotateTime)
+		})
+	}
+	return w.rotateFor(reason, rotateTime)
+}
+
+// Rotate the file as handleRotateFor does, without regard to other processes
+func (w *FileLogWriter) rotateFor(reason RotationReason, rotateTime time.Time) error {
 	rotatedName := ""
+	rotateTime = rotateTime.In(w.location())
 
 	// If we are keeping log files, move it to the correct date
 	if w.rotate {
 		_, err := os.Lstat(w.filename)
 		if err == nil { // file exists
+			base := w.filename
+			if len(w.archiveDir) > 0 {
+				base = filepath.Join(w.archiveDirFor(rotateTime), filepath.Base(w.filename))
+				if err := makeDirectory(base, w.dirMode); err != nil {
+					return fmt.Errorf("Rotate: %s\n", err)
+				}
+			}
+
 			var nextFilenameErr error
-			if w.rotateDateSuffix {
-				dateSuffix := rotateTime.Format(SuffixDateFormat)
-				rotatedName, nextFilenameErr = w.nextDateFilename(w.filename, dateSuffix)
+			if len(w.nameTemplate) > 0 {
+				rotatedName, nextFilenameErr = w.nextTemplateFilename(base, rotateTime)
+			} else if w.rotateDateSuffix {
+				dateSuffix := formatDateSuffix(rotateTime, w.dateSuffixFormat)
+				rotatedName, nextFilenameErr = w.nextDateFilename(base, dateSuffix)
 			} else {
-				rotatedName, nextFilenameErr = w.nextIntegerFilename(w.filename)
+				rotatedName, nextFilenameErr = w.nextIntegerFilename(base)
 			}
 			if nextFilenameErr != nil {
 				return nextFilenameErr
@@ -543,15 +1530,32 @@ func (w *FileLogWriter) handleRotate(rotateTime time.Time) error {
 
 			w.closeLogFile()
 
-			// Rename the file to its newfound home
-			err = os.Rename(w.filename, rotatedName)
+			// Rename the file to its newfound home, or copy it there and
+			// truncate it
+			if w.copyTruncate {
+				err = copyTruncateFile(w.filename, rotatedName)
+			} else {
+				err = os.Rename(w.filename, rotatedName)
+			}
 			if err != nil {
 				return fmt.Errorf("Rotate: %s\n", err)
 			}
 
-			// If we're configured to archive files, signal the background goroutine
-			if w.filesToKeep > 0 {
-				w.backgroundTasks <- rotatedName
+			atomic.AddUint64(&w.counters.rotations, 1)
+			w.notifyRotation(RotationEvent{
+				Reason:      reason,
+				Filename:    w.filename,
+				RotatedName: rotatedName,
+				Time:        time.Now(),
+				Lines:       w.maxlines_curlines,
+				Bytes:       w.maxsize_cursize,
+			})
+
+			// If we're configured to archive or compress files, signal the
+			// background goroutine
+			task := w.newArchiveTask(rotatedName)
+			if task.prunes() || task.compress || task.hook != nil {
+				w.backgroundTasks <- task
 			}
 		}
 	}
@@ -562,14 +1566,51 @@ func (w *FileLogWriter) handleRotate(rotateTime time.Time) error {
 func (w *FileLogWriter) closeLogFile() {
 	// Close any log file that may be open
 	if w.file != nil {
-		fmt.Fprint(w.file, FormatLogRecord(w.trailer, &LogRecord{Created: time.Now()}))
+		fmt.Fprint(w.output(), FormatLogRecord(w.trailer, &LogRecord{Created: time.Now()}))
+		w.handleWriteFailure(w.flushBuffer())
+		if w.syncPolicy.enabled() && w.unsynced > 0 {
+			w.file.Sync()
+		}
+		w.unsynced = 0
 		w.file.Close()
 		w.file = nil
+		w.buffer = nil
+	}
+}
+
+// Where writes to the file go: the buffer if there is one
+func (w *FileLogWriter) output() io.Writer {
+	if w.buffer != nil {
+		return w.buffer
 	}
+	return w.file
+}
+
+// Write out anything buffered to the file
+func (w *FileLogWriter) flushBuffer() error {
+	if w.buffer == nil {
+		return nil
+	}
+	return w.buffer.Flush()
+}
+
+// Force anything written so far out to stable storage
+func (w *FileLogWriter) flush() error {
+	if w.file == nil {
+		return nil
+	}
+	if err := w.flushBuffer(); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.unsynced = 0
+	return nil
 }
 
 func (w *FileLogWriter) openLogFile() error {
-	if err := makeDirectory(w.filename); err != nil {
+	if err := makeDirectory(w.filename, w.dirMode); err != nil {
 		return err
 	}
 
@@ -581,102 +1622,853 @@ func (w *FileLogWriter) openLogFile() error {
 
 	w.closeLogFile()
 	w.file = fd
+	if w.bufferSize > 0 {
+		w.buffer = bufio.NewWriterSize(fd, w.bufferSize)
+	}
+	w.chownFile(w.filename, w.uid, w.gid)
+
+	// initialize rotation values, counting anything already in the file
+	w.maxlines_curlines = 0
+	w.maxsize_cursize = 0
+	w.headerLines, w.headerSize = 0, 0
+	if info, err := fd.Stat(); err == nil && info.Size() > 0 {
+		w.maxsize_cursize = info.Size()
+		if w.maxlines > 0 {
+			w.maxlines_curlines = countFileLines(w.filename)
+		}
+	}
 
 	now := time.Now()
-	fmt.Fprint(w.file, FormatLogRecord(w.header, &LogRecord{Created: now}))
+	w.writeHeader(now)
 
-	// Set the daily open date to the current date
-	w.daily_opendate = now.Day()
+	// Rotation intervals are counted from now
+	w.opentime = now
 
-	// initialize rotation values
-	w.maxlines_curlines = 0
-	w.maxsize_cursize = 0
+	w.updateSymlink()
 
 	return nil
 }
 
-// Set the logging format (chainable).  Must be called before the first log
-// message is written.
+// Point the symlink, if any, at the log file.  The link is replaced by
+// renaming a new one over it, so readers never find it missing.
+func (w *FileLogWriter) updateSymlink() {
+	if len(w.symlink) == 0 {
+		return
+	}
+
+	// Link relative to the symlink's directory where possible, so that the
+	// pair can be moved together
+	target, err := filepath.Abs(w.filename)
+	if err != nil {
+		target = w.filename
+	}
+	if linkDir, err := filepath.Abs(filepath.Dir(w.symlink)); err == nil {
+		if rel, err := filepath.Rel(linkDir, target); err == nil {
+			target = rel
+		}
+	}
+	if current, err := os.Readlink(w.symlink); err == nil && current == target {
+		return
+	}
+
+	if err := makeDirectory(w.symlink, w.dirMode); err != nil {
+		fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Couldn't create symlink %q: %s\n", w.filename, w.symlink, err)
+		return
+	}
+	tmp := w.symlink + ".tmp"
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Couldn't create symlink %q: %s\n", w.filename, w.symlink, err)
+		return
+	}
+	if err := os.Rename(tmp, w.symlink); err != nil {
+		fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Couldn't update symlink %q: %s\n", w.filename, w.symlink, err)
+		os.Remove(tmp)
+	}
+}
+
+// Recreate the file if it has been removed, or couldn't be opened last time,
+// returning whether it was
+func (w *FileLogWriter) recoverMissingFile() bool {
+	if w.file != nil {
+		if _, err := os.Stat(w.filename); !os.IsNotExist(err) {
+			return false
+		}
+		fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Log file was removed; recreating it\n", w.filename)
+	}
+	return w.openLogFile() == nil
+}
+
+// Reopen the file if it has been moved or removed since it was opened, as by
+// logrotate, and recount it if it has been truncated
+func (w *FileLogWriter) detectExternalRotation() {
+	if w.file == nil {
+		return
+	}
+	opened, err := w.file.Stat()
+	if err != nil {
+		return
+	}
+	current, err := os.Stat(w.filename)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+
+	if err != nil || !os.SameFile(opened, current) {
+		if err := w.openLogFile(); err != nil {
+			fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Couldn't reopen file after external rotation: %s\n", w.filename, err)
+		}
+		return
+	}
+
+	// Whatever is buffered has been counted, but isn't in the file yet
+	if w.buffer != nil && w.buffer.Buffered() > 0 {
+		w.handleWriteFailure(w.flushBuffer())
+		if current, err = os.Stat(w.filename); err != nil {
+			return
+		}
+	}
+	if current.Size() < w.maxsize_cursize {
+		w.maxsize_cursize = current.Size()
+		w.maxlines_curlines = 0
+		if w.maxlines > 0 {
+			w.maxlines_curlines = countFileLines(w.filename)
+		}
+		w.headerLines, w.headerSize = 0, 0
+	}
+}
+
+// Write the header to the file, counting it towards the file's size
+func (w *FileLogWriter) writeHeader(now time.Time) {
+	header := FormatLogRecord(w.header, &LogRecord{Created: now})
+	n, _ := io.WriteString(w.output(), header)
+	lines := strings.Count(header[:n], "\n")
+	w.maxsize_cursize += int64(n)
+	w.maxlines_curlines += lines
+	w.headerSize += int64(n)
+	w.headerLines += lines
+}
+
+// Count the lines in a file
+func countFileLines(filename string) int {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return 0
+	}
+	defer fd.Close()
+
+	lines := 0
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := fd.Read(buf)
+		lines += bytes.Count(buf[:n], []byte{'\n'})
+		if err != nil {
+			return lines
+		}
+	}
+}
+
+// How many lines an encoded record counts as.  Records from encoders which
+// don't write lines of text count as one line each.
+func recordLines(enc Encoder, buf []byte) int {
+	if _, ok := enc.(ProtoEncoder); ok && len(buf) > 0 {
+		return 1
+	}
+	return bytes.Count(buf, []byte{'\n'})
+}
+
+// Set the logging format (chainable).  It applies from the next record.
 func (w *FileLogWriter) SetFormat(format string) *FileLogWriter {
-	w.format = format
+	w.configure(func() {
+		w.format = format
+		w.encoder = NewFormatEncoder(format)
+	})
 	return w
 }
 
-// Set the logfile header and footer (chainable).  Must be called before the first log
-// message is written.  These are formatted similar to the FormatLogRecord (e.g.
-// you can use %D and %T in your header/footer for date and time).
-func (w *FileLogWriter) SetHeadFoot(head, foot string) *FileLogWriter {
-	w.header, w.trailer = head, foot
-	if w.maxlines_curlines == 0 {
-		fmt.Fprint(w.file, FormatLogRecord(w.header, &LogRecord{Created: time.Now()}))
+// SetEncoder sets how records are turned into bytes, replacing the format set
+// by SetFormat (chainable).  It applies from the next record.
+func (w *FileLogWriter) SetEncoder(encoder Encoder) *FileLogWriter {
+	w.configure(func() {
+		w.encoder = encoder
+	})
+	return w
+}
+
+// Set the permissions for directories created to hold the log file
+// (chainable).  The log file's own directory is created when the writer is, so
+// this only affects directories created later; use LogDirectoryMode to set the
+// permissions of all directories.
+func (w *FileLogWriter) SetDirectoryMode(mode os.FileMode) *FileLogWriter {
+	w.configure(func() {
+		w.dirMode = mode
+	})
+	return w
+}
+
+// SetOwner gives the log file, and the compressed copies of rotated files, the
+// numeric owner and group uid and gid (chainable), for example so that a log
+// shipper can read them after the process drops its privileges.  Rotated files
+// keep the owner they had.  Either may be -1 to leave it unchanged.  Changing
+// the owner usually needs root, and does nothing on Windows.
+func (w *FileLogWriter) SetOwner(uid, gid int) *FileLogWriter {
+	w.configure(func() {
+		w.uid, w.gid = uid, gid
+		if w.file != nil {
+			w.chownFile(w.filename, uid, gid)
+		}
+	})
+	return w
+}
+
+// Give a file the owner set by SetOwner, if any
+func (w *FileLogWriter) chownFile(name string, uid, gid int) {
+	if uid < 0 && gid < 0 {
+		return
 	}
+	if err := chown(name, uid, gid); err != nil {
+		fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Couldn't change the owner of %q: %s\n", w.filename, name, err)
+	}
+}
+
+// SetDetectExternalRotation checks, before writing a record at most once every
+// interval, whether the file has been rotated by something else (chainable).
+// If it has been moved or removed, as by logrotate, a new file is opened in
+// its place rather than writing on into the old one; if it has been
+// truncated, the size and line counts start again from what is left.  Zero
+// turns off the checks.
+func (w *FileLogWriter) SetDetectExternalRotation(interval time.Duration) *FileLogWriter {
+	w.configure(func() {
+		w.detectInterval = interval
+	})
+	return w
+}
+
+// Set the logfile header and footer (chainable).  These are formatted similar
+// to the FormatLogRecord (e.g. you can use %D and %T in your header/footer for
+// date and time, or %V for the build that wrote the file).  The header is written straight away if nothing has been
+// written to the current file yet, and otherwise to the next file.
+func (w *FileLogWriter) SetHeadFoot(head, foot string) *FileLogWriter {
+	w.configure(func() {
+		w.header, w.trailer = head, foot
+		if w.maxsize_cursize == w.headerSize {
+			w.writeHeader(time.Now())
+		}
+	})
 	return w
 }
 
-// Set rotate at linecount (chainable). Must be called before the first log
-// message is written.
+// Set rotate at linecount (chainable).  Each line of a multi-line message
+// counts, as do any lines already in a file being appended to; the file is
+// rotated before a record would take it past the limit.
 func (w *FileLogWriter) SetRotateLines(maxlines int) *FileLogWriter {
 	//fmt.Fprintf(w.errorWriter, "FileLogWriter.SetRotateLines: %v\n", maxlines)
-	w.maxlines = maxlines
+	w.configure(func() {
+		if maxlines > 0 && w.maxlines <= 0 && w.file != nil {
+			// Lines weren't being counted
+			w.maxlines_curlines = countFileLines(w.filename)
+		}
+		w.maxlines = maxlines
+	})
 	return w
 }
 
-// Set rotate at size (chainable). Must be called before the first log message
-// is written.
+// Set rotate at size (chainable).  The file is rotated before a record would
+// take it past the limit.
 func (w *FileLogWriter) SetRotateSize(maxsize int) *FileLogWriter {
 	//fmt.Fprintf(w.errorWriter, "FileLogWriter.SetRotateSize: %v\n", maxsize)
-	w.maxsize = maxsize
+	return w.setRotateSize(int64(maxsize))
+}
+
+// SetRotateSizeString sets the size at which to rotate from a string such as
+// "100MB", "512k" or "1.5G" (chainable).  Units are powers of 1024 and case
+// doesn't matter; a plain number is in bytes.  Sizes above 2GB work even where
+// int is 32 bits.
+func (w *FileLogWriter) SetRotateSizeString(size string) *FileLogWriter {
+	maxsize, err := parseSize(size)
+	if err != nil {
+		fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): %s\n", w.filename, err)
+		return w
+	}
+	return w.setRotateSize(maxsize)
+}
+
+func (w *FileLogWriter) setRotateSize(maxsize int64) *FileLogWriter {
+	w.configure(func() {
+		w.maxsize = maxsize
+	})
 	return w
 }
 
-// Set rotate daily (chainable). Must be called before the first log message is
-// written.
+// Units for parseSize
+var sizeUnits = map[string]int64{
+	"":  1,
+	"b": 1,
+	"k": 1 << 10, "kb": 1 << 10, "kib": 1 << 10,
+	"m": 1 << 20, "mb": 1 << 20, "mib": 1 << 20,
+	"g": 1 << 30, "gb": 1 << 30, "gib": 1 << 30,
+	"t": 1 << 40, "tb": 1 << 40, "tib": 1 << 40,
+}
+
+// Parse a size such as "100MB", "512k" or "1.5G", in powers of 1024
+func parseSize(str string) (int64, error) {
+	str = strings.TrimSpace(str)
+	i := 0
+	for i < len(str) && (str[i] >= '0' && str[i] <= '9' || str[i] == '.') {
+		i++
+	}
+	unit, ok := sizeUnits[strings.ToLower(strings.TrimSpace(str[i:]))]
+	if !ok {
+		return 0, fmt.Errorf("Invalid size %q: unknown unit %q", str, str[i:])
+	}
+	num, err := strconv.ParseFloat(str[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid size %q", str)
+	}
+	return int64(num * float64(unit)), nil
+}
+
+// SetRotateMaxFileAge rotates the file when a record is written once it has
+// been open for at least d, however little has been written to it, as long as
+// it holds more than its header (chainable).  Unlike the rotation intervals,
+// this counts from when the file was opened rather than following the clock.
+// Zero turns it off.
+func (w *FileLogWriter) SetRotateMaxFileAge(d time.Duration) *FileLogWriter {
+	w.configure(func() {
+		w.maxFileAge = d
+	})
+	return w
+}
+
+// Set rotate daily (chainable).  The same as SetRotateInterval(RotateDaily),
+// or when daily is false, turning off daily rotation.
 func (w *FileLogWriter) SetRotateDaily(daily bool) *FileLogWriter {
 	//fmt.Fprintf(w.errorWriter, "FileLogWriter.SetRotateDaily: %v\n", daily)
-	w.daily = daily
+	w.configure(func() {
+		if daily {
+			w.setInterval(RotateDaily)
+		} else if w.interval == RotateDaily {
+			w.setInterval(RotateNever)
+		}
+	})
 	return w
 }
 
-// SetRotate changes whether or not the old logs are kept. (chainable) Must be
-// called before the first log message is written.  If rotate is false, the
-// files are overwritten; otherwise, they are rotated to another file before the
-// new log is opened.
+// SetRotateAt makes daily rotation happen at the given time of day in loc,
+// such as 03:00, rather than at midnight local time (chainable).  Rotated files
+// are named after the day which began at the previous rotation time.  A nil
+// loc means local time.
+func (w *FileLogWriter) SetRotateAt(hour, minute int, loc *time.Location) *FileLogWriter {
+	if hour < 0 || hour > 23 || minute < 0 || minute > 59 {
+		fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Invalid rotation time %02d:%02d\n", w.filename, hour, minute)
+		return w
+	}
+	if loc == nil {
+		loc = time.Local
+	}
+	w.configure(func() {
+		w.rotateAtHour, w.rotateAtMinute, w.rotateAtLoc = hour, minute, loc
+	})
+	return w
+}
+
+// The first daily rotation time set by SetRotateAt after t
+func (w *FileLogWriter) nextDailyRotation(t time.Time) time.Time {
+	t = t.In(w.rotateAtLoc)
+	next := time.Date(t.Year(), t.Month(), t.Day(), w.rotateAtHour, w.rotateAtMinute, 0, 0, w.rotateAtLoc)
+	if !next.After(t) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// Set rotate hourly (chainable).  The same as
+// SetRotateInterval(RotateHourly), or when hourly is false, turning off hourly
+// rotation.
+func (w *FileLogWriter) SetRotateHourly(hourly bool) *FileLogWriter {
+	w.configure(func() {
+		if hourly {
+			w.setInterval(RotateHourly)
+		} else if w.interval == RotateHourly {
+			w.setInterval(RotateNever)
+		}
+	})
+	return w
+}
+
+// SetRotateInterval rotates the file when a record is written in a different
+// hour, day, week or month from the one the file was opened in (chainable).
+// Unless another layout has been set with SetDateSuffixFormat, date suffixes
+// change to suit the interval, as in app.log.2010-01-02_15, app.log.2010-W01
+// or app.log.2010-01.
+func (w *FileLogWriter) SetRotateInterval(interval RotateInterval) *FileLogWriter {
+	w.configure(func() {
+		w.setInterval(interval)
+	})
+	return w
+}
+
+// Change the rotation interval, along with the date suffix layout if it is
+// still the default for the old interval
+func (w *FileLogWriter) setInterval(interval RotateInterval) {
+	if w.dateSuffixFormat == w.interval.suffixFormat() {
+		w.dateSuffixFormat = interval.suffixFormat()
+		if err := w.compileMatcher(); err != nil {
+			fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): %s\n", w.filename, err)
+		}
+	}
+	w.interval = interval
+}
+
+// Whether a and b fall in the same rotation interval.  Without an interval,
+// they must be on the same day.
+func (w *FileLogWriter) sameInterval(a, b time.Time) bool {
+	a, b = a.In(w.location()), b.In(w.location())
+	switch w.interval {
+	case RotateHourly:
+		return hourEqual(a, b)
+	case RotateWeekly:
+		aYear, aWeek := a.ISOWeek()
+		bYear, bWeek := b.ISOWeek()
+		return aYear == bYear && aWeek == bWeek
+	case RotateMonthly:
+		return a.Year() == b.Year() && a.Month() == b.Month()
+	case RotateDaily:
+		if w.rotateAtLoc != nil {
+			return w.nextDailyRotation(a).Equal(w.nextDailyRotation(b))
+		}
+	}
+	return dateEqual(a, b)
+}
+
+// The time to name a file rotated at the end of its interval after
+func (w *FileLogWriter) intervalTime(now time.Time) time.Time {
+	now = now.In(w.location())
+	opentime := w.opentime.In(w.location())
+	switch w.interval {
+	case RotateDaily:
+		if w.rotateAtLoc != nil {
+			// The day that began at the rotation time
+			return w.nextDailyRotation(w.opentime).AddDate(0, 0, -1)
+		}
+		// Since we crossed the time boundary, back the date up by one day
+		return now.Add(-1 * 24 * time.Hour)
+	case RotateWeekly:
+		// The Thursday of the week, which is in the week's ISO year
+		return opentime.AddDate(0, 0, 3-(int(opentime.Weekday())+6)%7)
+	}
+	return opentime
+}
+
+// SetUseUTC makes day boundaries for rotation, and the times in date suffixes
+// and archive directories, follow UTC rather than local time (chainable), so
+// that hosts in different time zones rotate together.  The time zone given to
+// SetRotateAt takes precedence.
+func (w *FileLogWriter) SetUseUTC(utc bool) *FileLogWriter {
+	w.configure(func() {
+		w.utc = utc
+	})
+	return w
+}
+
+// The time zone for rotation boundaries and date suffixes
+func (w *FileLogWriter) location() *time.Location {
+	if w.rotateAtLoc != nil {
+		return w.rotateAtLoc
+	}
+	if w.utc {
+		return time.UTC
+	}
+	return time.Local
+}
+
+// SetRotate changes whether or not the old logs are kept. (chainable)  If
+// rotate is false, the files are overwritten; otherwise, they are rotated to
+// another file before the new log is opened.
 func (w *FileLogWriter) SetRotate(rotate bool) *FileLogWriter {
 	//fmt.Fprintf(w.errorWriter, "FileLogWriter.SetRotate: %v\n", rotate)
-	w.rotate = rotate
+	w.configure(func() {
+		w.rotate = rotate
+	})
 	return w
 }
 
 // SetRotateDateSuffix uses date rotation (.YYYY-MM-DD) instead of
 // integer-based rotation (.001, .002, etc) (chainable)
 func (w *FileLogWriter) SetRotateDateSuffix(dateSuffix bool) *FileLogWriter {
-	w.rotateDateSuffix = dateSuffix
+	w.configure(func() {
+		w.rotateDateSuffix = dateSuffix
+	})
+	return w
+}
+
+// SetDateSuffixFormat sets the time layout used for date suffixes (chainable),
+// SuffixDateFormat by default.  For example, "2006-01-02_15" suits hourly
+// rotation and "20060102" gives compact suffixes; WeekNumberToken in the layout
+// is replaced by the ISO week number, as in "2006-WW".  Files rotated by size
+// or lines can be told apart by time rather than by .0001 counters with
+// SecondSuffixDateFormat or MillisecondSuffixDateFormat.  Old files are only
+// aged off in the right order if the layout sorts chronologically.
+func (w *FileLogWriter) SetDateSuffixFormat(layout string) *FileLogWriter {
+	w.configure(func() {
+		previous := w.dateSuffixFormat
+		w.dateSuffixFormat = layout
+		if err := w.compileMatcher(); err != nil {
+			fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Invalid date suffix format %q: %s\n", w.filename, layout, err)
+			w.dateSuffixFormat = previous
+		}
+	})
+	return w
+}
+
+// SetPreserveExtension puts rotation suffixes before the file's extension
+// (chainable), so that app.log rotates to app.2010-01-02.log or app.001.log
+// rather than app.log.2010-01-02 or app.log.001.  Some log shippers only pick
+// up files by their extension.
+func (w *FileLogWriter) SetPreserveExtension(preserve bool) *FileLogWriter {
+	w.configure(func() {
+		w.preserveExt = preserve
+		if err := w.compileMatcher(); err != nil {
+			fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): %s\n", w.filename, err)
+		}
+	})
+	return w
+}
+
+// SetRotationSequence sets the integer suffixes given to rotated files
+// (chainable): they are padded with zeros to width digits and run from 1 up to
+// max, 3 and 999 by default.  The same applies to %N in a rotation name
+// template.  Once all max are taken, rotation fails unless
+// SetRecycleRotationSequence is set.
+func (w *FileLogWriter) SetRotationSequence(width, max int) *FileLogWriter {
+	if width < 1 || max < 1 {
+		fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Invalid rotation sequence width %d and maximum %d\n", w.filename, width, max)
+		return w
+	}
+	w.configure(func() {
+		w.seqWidth, w.seqMax = width, max
+		if err := w.compileMatcher(); err != nil {
+			fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): %s\n", w.filename, err)
+		}
+	})
+	return w
+}
+
+// SetRotationStateFile keeps the last integer suffix used in the file at path
+// (chainable), so that numbering carries on exactly where it left off when the
+// process restarts, even if the rotated files have since been removed.
+// Without it, the rotated files are scanned at the first rotation and
+// numbering carries on from the most recently written.
+func (w *FileLogWriter) SetRotationStateFile(path string) *FileLogWriter {
+	w.configure(func() {
+		w.stateFile = path
+		if len(path) == 0 {
+			return
+		}
+		contents, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			return
+		}
+		seq := 0
+		if err == nil {
+			seq, err = strconv.Atoi(strings.TrimSpace(string(contents)))
+		}
+		if err == nil && seq < 0 {
+			err = fmt.Errorf("Invalid suffix %d", seq)
+		}
+		if err != nil {
+			fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Couldn't read rotation state from %q: %s\n", w.filename, path, err)
+			return
+		}
+		w.seqLast = seq
+	})
 	return w
 }
 
+// SetRecycleRotationSequence makes rotation reuse the integer suffix of the
+// oldest rotated file, removing it, once every suffix up to the maximum is
+// taken (chainable).  Otherwise busy writers stop rotating at that point.
+func (w *FileLogWriter) SetRecycleRotationSequence(recycle bool) *FileLogWriter {
+	w.configure(func() {
+		w.seqRecycle = recycle
+	})
+	return w
+}
+
+// Compile the regex which matches this file's rotated files, with either date
+// or integer suffixes
+func (w *FileLogWriter) compileMatcher() error {
+	prefix, ext := filepath.Base(w.filename), ""
+	if w.preserveExt {
+		ext = filepath.Ext(prefix)
+		prefix = prefix[:len(prefix)-len(ext)]
+	}
+	compressed := `\.gz|\.zip`
+	if c := w.rotationCompressor(); c != nil {
+		compressed += `|` + regexp.QuoteMeta("."+c.Extension())
+	}
+	pattern := "^" + regexp.QuoteMeta(prefix) + `(` + dateSuffixRegex(w.dateSuffixFormat) +
+		`(\.[0-9]{4})?|\.[0-9]{` + strconv.Itoa(w.seqWidth) + `,})` + regexp.QuoteMeta(ext) + `(` + compressed + `)?$`
+	if len(w.nameTemplate) > 0 {
+		pattern = "^" + w.nameTemplateRegex() + `(` + compressed + `)?$`
+	}
+	matcher, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	w.logfileMatcher = matcher
+	return nil
+}
+
 // SetRotateOnStartup determines wheter to rotate the logfile on startup.
 // When true, rotate the logfile at every startup. When false, rotate the
 // logfile only when the date of the existing logfile is different than the
-// current date
+// current date (see SetRotateStaleOnStartup).  Startup rotation happens when
+// the first log message is written, so this has no effect after that.
 func (w *FileLogWriter) SetRotateOnStartup(rotateOnStartup bool) *FileLogWriter {
-	w.rotateOnStartup = rotateOnStartup
+	w.configure(func() {
+		w.rotateOnStartup = rotateOnStartup
+	})
 	return w
 }
 
-// SetMaxArchiveFiles determines the maximum number of kept log files before
-// age-off. To keep all log files, set to 0.
+// SetRotateStaleOnStartup determines whether, when not rotating at every
+// startup, to rotate an existing logfile last written on a different day
+// (chainable).  The day is taken from the file's last record, falling back to
+// its modification time if no record can be read.  When false, the existing
+// logfile is always appended to.  Like SetRotateOnStartup, this has no effect
+// once the first log message has been written.
+func (w *FileLogWriter) SetRotateStaleOnStartup(rotateStale bool) *FileLogWriter {
+	w.configure(func() {
+		w.rotateStaleOnStartup = rotateStale
+	})
+	return w
+}
+
+// SetMaxBackups keeps only the newest n rotated files, whether they have
+// integer or date suffixes, deleting older ones after each rotation
+// (chainable); to keep all rotated files, set to 0.  Without it, the newest
+// 30 files with date suffixes are kept, and files with integer suffixes are
+// never deleted.
+func (w *FileLogWriter) SetMaxBackups(n int) *FileLogWriter {
+	w.configure(func() {
+		w.filesToKeep, w.countAllBackups = n, true
+	})
+	return w
+}
+
+// SetMaxAge deletes rotated files older than maxAge after each rotation
+// (chainable).  A file's age is taken from its date suffix, if it has one, or
+// else its modification time.  Zero, the default, keeps files however old they
+// are.
+func (w *FileLogWriter) SetMaxAge(maxAge time.Duration) *FileLogWriter {
+	w.configure(func() {
+		w.maxAge = maxAge
+	})
+	return w
+}
+
+// SetMaxTotalSize deletes the oldest rotated files after each rotation until
+// those left take up no more than maxTotalSize bytes (chainable).  Together
+// with SetRotateSize this bounds the disk space the log can use.  Zero, the
+// default, sets no limit.
+func (w *FileLogWriter) SetMaxTotalSize(maxTotalSize int64) *FileLogWriter {
+	w.configure(func() {
+		w.maxTotalSize = maxTotalSize
+	})
+	return w
+}
+
+// SetMaxArchiveFiles determines the maximum number of kept log files with
+// date suffixes before age-off. To keep all log files, set to 0.  Unlike
+// SetMaxBackups, files with integer suffixes are left alone.
 func (w *FileLogWriter) SetMaxArchiveFiles(filesToKeep int) *FileLogWriter {
-	w.filesToKeep = filesToKeep
+	w.configure(func() {
+		w.filesToKeep = filesToKeep
+	})
+	return w
+}
+
+// SetCompressRotated gzips each file after it is rotated, removing the
+// uncompressed original (chainable).  Compression happens in the background,
+// so it doesn't hold up logging.  It is the same as passing compress to
+// NewFileLogWriter and calling SetCompressionMethod(COMPRESSION_GZIP).
+func (w *FileLogWriter) SetCompressRotated(compress bool) *FileLogWriter {
+	w.configure(func() {
+		w.compress = compress
+	})
+	if compress {
+		w.SetCompressionMethod(COMPRESSION_GZIP)
+	}
 	return w
 }
 
 // SetCompressionMethod determines the type of compression to use. Valid options
-// are "gz" and "zip"
+// are "gz", "zip" and "snappy"; see SetRotationCompressor for others
 func (w *FileLogWriter) SetCompressionMethod(compressionMethod CompressionMethod) *FileLogWriter {
-	w.compressionMethod = compressionMethod
+	w.configure(func() {
+		w.compressionMethod = compressionMethod
+		if err := w.compileMatcher(); err != nil {
+			fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): %s\n", w.filename, err)
+		}
+	})
 	return w
 }
 
+// SetRotationCompressor compresses each file after it is rotated using c,
+// which can wrap codecs such as zstd that aren't built in (chainable).  The
+// file is streamed through the compressor in the background and the
+// uncompressed original removed.  Passing nil turns compression off.
+func (w *FileLogWriter) SetRotationCompressor(c Compressor) *FileLogWriter {
+	w.configure(func() {
+		w.compressor = c
+		w.compress = c != nil
+		if err := w.compileMatcher(); err != nil {
+			fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): %s\n", w.filename, err)
+		}
+	})
+	return w
+}
+
+// The compressor for rotated files, or nil if the compression method is unknown
+func (w *FileLogWriter) rotationCompressor() Compressor {
+	if w.compressor != nil {
+		return w.compressor
+	}
+	return compressorFor(w.compressionMethod)
+}
+
+// SetBufferSize buffers up to n bytes of records in memory before writing
+// them to the file (chainable), saving a system call per record.  What is
+// buffered is written out every flush interval, when the buffer fills, when
+// the file is rotated or closed, and on Flush; a crash loses it.  Zero, the
+// default, writes each record as it arrives.
+func (w *FileLogWriter) SetBufferSize(n int) *FileLogWriter {
+	w.configure(func() {
+		w.handleWriteFailure(w.flushBuffer())
+		w.bufferSize, w.buffer = n, nil
+		if n > 0 && w.file != nil {
+			w.buffer = bufio.NewWriterSize(w.file, n)
+		}
+	})
+	return w
+}
+
+// SetFlushInterval sets how often buffered records are written to the file
+// (chainable), a second by default, bounding how much is lost in a crash.
+// Zero writes them out only when the buffer fills.  It has no effect without
+// SetBufferSize.
+func (w *FileLogWriter) SetFlushInterval(d time.Duration) *FileLogWriter {
+	w.configure(func() {
+		w.flushInterval = d
+	})
+	return w
+}
+
+// SetFlushOnLevel writes out the buffer straight after any record at or above
+// lvl (chainable), so that the errors logged just before a crash aren't lost
+// with the buffer however large it is.  Add SetSyncPolicy(SyncAtLevel(lvl)) to
+// force them out to stable storage too.  It has no effect without
+// SetBufferSize.
+func (w *FileLogWriter) SetFlushOnLevel(lvl Level) *FileLogWriter {
+	w.configure(func() {
+		w.flushLevel, w.flushOnLevel = lvl, true
+	})
+	return w
+}
+
+// SetFlushSchedule forces the log file to be synced to disk at the times given
+// by a cron-like schedule (see ParseSchedule), e.g. "*/5 * * * *" (chainable).
+func (w *FileLogWriter) SetFlushSchedule(spec string) *FileLogWriter {
+	schedule, err := ParseSchedule(spec)
+	if err != nil {
+		fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): %s\n", w.filename, err)
+		return w
+	}
+	w.configure(func() {
+		w.flushSchedule = schedule
+	})
+	return w
+}
+
+// SetRotateSchedule rotates the file at the times given by a cron-like
+// schedule (see ParseSchedule), e.g. "0 3 * * *", whether or not anything is
+// being logged (chainable).  Rotated files are named after the time the file
+// was opened, and files with nothing written to them are not rotated.  An
+// empty spec removes the schedule.
+func (w *FileLogWriter) SetRotateSchedule(spec string) *FileLogWriter {
+	var schedule *Schedule
+	if len(spec) > 0 {
+		var err error
+		if schedule, err = ParseSchedule(spec); err != nil {
+			fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): %s\n", w.filename, err)
+			return w
+		}
+	}
+	w.configure(func() {
+		w.rotateSchedule = schedule
+	})
+	return w
+}
+
+// SetArchiveDirectory moves rotated files into a directory named by formatting
+// template with the time of the rotation, as for SetDateSuffixFormat, e.g.
+// "archive/2006-01-02" for logs/archive/2024-06-01/app.log.001 (chainable).
+// Relative templates are taken from the log file's directory, and the
+// directory must be on the same filesystem as the log file.  Directories are
+// created as needed with the mode given by SetDirectoryMode, and removed again
+// once pruning has emptied them.  An empty template puts rotated files next to
+// the log file.
+func (w *FileLogWriter) SetArchiveDirectory(template string) *FileLogWriter {
+	w.configure(func() {
+		w.archiveDir = template
+	})
+	return w
+}
+
+// SetSymlink keeps a symlink at path pointing at the log file (chainable),
+// updating it whenever the file is opened or rotated, so that tools can follow
+// one path whatever the rotation scheme.  The link is relative when possible.
+// An empty path stops updating the link, but leaves it in place.  Creating
+// symlinks on Windows needs the appropriate privilege.
+func (w *FileLogWriter) SetSymlink(path string) *FileLogWriter {
+	w.configure(func() {
+		w.symlink = path
+		if w.file != nil {
+			w.updateSymlink()
+		}
+	})
+	return w
+}
+
+// The directory files rotated at t are moved to
+func (w *FileLogWriter) archiveDirFor(t time.Time) string {
+	dir := filepath.FromSlash(formatDateSuffix(t, w.archiveDir))
+	if filepath.IsAbs(dir) {
+		return filepath.Clean(dir)
+	}
+	return filepath.Join(filepath.Dir(w.filename), dir)
+}
+
+// The leading part of the archive directory which doesn't depend on the time
+// of the rotation, below which all the rotated files are kept
+func (w *FileLogWriter) archiveDirRoot() string {
+	a := strings.Split(w.archiveDirFor(time.Date(2001, 2, 3, 4, 5, 6, 0, time.Local)), string(filepath.Separator))
+	b := strings.Split(w.archiveDirFor(time.Date(2012, 11, 10, 16, 17, 18, 0, time.Local)), string(filepath.Separator))
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	root := strings.Join(a[:n], string(filepath.Separator))
+	if len(root) == 0 {
+		return string(filepath.Separator)
+	}
+	return root
+}
+
+// The number of lines each record written by NewXMLLogWriter takes
+const xmlRecordLines = 5
+
 // NewXMLLogWriter is a utility method for creating a FileLogWriter set up to
 // output XML record log messages instead of line-based ones.
 func NewXMLLogWriter(fname string, rotate bool) *FileLogWriter {
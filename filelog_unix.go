@@ -2,6 +2,20 @@
 
 package log4go
 
+import (
+	"os"
+)
+
 const (
 	FILELOG_DEFAULT_COMPRESSION_METHOD = "gz"
 )
+
+// Create a directory and any missing parents with the given permissions
+func mkdirAll(dir string, mode os.FileMode) error {
+	return os.MkdirAll(dir, mode)
+}
+
+// Change the numeric owner and group of a file
+func chown(name string, uid, gid int) error {
+	return os.Chown(name, uid, gid)
+}
@@ -0,0 +1,86 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+// +build !windows
+
+package log4go
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSetOwner(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Changing the owner of files needs root")
+	}
+
+	dir, err := ioutil.TempDir("", "owner")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "app.log")
+
+	w := NewFileLogWriter(fname, true, true).SetRotateOnStartup(false).SetFormat("%M").SetOwner(1234, 5678)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "message"))
+	w.Rotate()
+	w.LogWrite(newLogRecord(INFO, "source", "message"))
+	w.Close()
+
+	for _, name := range []string{fname, fname + ".001.gz"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("Stat: %s", err)
+		}
+		stat := info.Sys().(*syscall.Stat_t)
+		if stat.Uid != 1234 || stat.Gid != 5678 {
+			t.Errorf("%s is owned by %d:%d, want 1234:5678", name, stat.Uid, stat.Gid)
+		}
+	}
+}
+
+func TestHandleSignals(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signals")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "app.log")
+
+	w := NewFileLogWriter(fname, false, false).SetFormat("%M")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer w.Close()
+	stop := HandleSignals(SignalReopen)
+	defer stop()
+
+	w.LogWrite(newLogRecord(INFO, "source", "before"))
+	waitForWrites(w)
+	if err := os.Rename(fname, fname+".1"); err != nil {
+		t.Fatalf("Rename: %s", err)
+	}
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+
+	// The new file is opened once the signal has been handled
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		if _, err := os.Stat(fname); err == nil {
+			break
+		}
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "after"))
+	waitForWrites(w)
+
+	for name, want := range map[string]string{fname + ".1": "before\n", fname: "after\n"} {
+		if contents, err := ioutil.ReadFile(name); err != nil || string(contents) != want {
+			t.Errorf("%s holds %q (%v), want %q", name, contents, err, want)
+		}
+	}
+}
@@ -1,5 +1,103 @@
 package log4go
 
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
 const (
 	FILELOG_DEFAULT_COMPRESSION_METHOD = "zip"
 )
+
+// Paths longer than this must use the \\?\ prefix to be created
+const maxShortPath = 248
+
+// An ACL for directories which shouldn't be open to everyone: full control for
+// the owner, SYSTEM and Administrators, not inherited from the parent
+const privateDirectorySDDL = "D:P(A;OICI;FA;;;OW)(A;OICI;FA;;;SY)(A;OICI;FA;;;BA)"
+
+var (
+	advapi32 = syscall.NewLazyDLL("advapi32.dll")
+
+	procConvertSDDL = advapi32.NewProc("ConvertStringSecurityDescriptorToSecurityDescriptorW")
+)
+
+// Create a directory and any missing parents.  Windows ignores Unix
+// permission bits, so a mode which grants nothing to group or other is taken
+// to mean the directories should be private to their owner.
+func mkdirAll(dir string, mode os.FileMode) error {
+	dir = longPath(dir)
+	if info, err := os.Stat(dir); err == nil {
+		if !info.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+
+	if parent := filepath.Dir(dir); parent != dir {
+		if err := mkdirAll(parent, mode); err != nil {
+			return err
+		}
+	}
+
+	if mode&0077 != 0 {
+		if err := os.Mkdir(dir, mode); err != nil && !os.IsExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	sa, err := privateSecurityAttributes()
+	if err != nil {
+		return &os.PathError{Op: "mkdir", Path: dir, Err: err}
+	}
+	defer syscall.LocalFree(syscall.Handle(sa.SecurityDescriptor))
+
+	path, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return &os.PathError{Op: "mkdir", Path: dir, Err: err}
+	}
+	if err := syscall.CreateDirectory(path, sa); err != nil && err != syscall.ERROR_ALREADY_EXISTS {
+		return &os.PathError{Op: "mkdir", Path: dir, Err: err}
+	}
+	return nil
+}
+
+// Files on Windows have no numeric owner to change
+func chown(name string, uid, gid int) error {
+	return nil
+}
+
+// Build security attributes carrying privateDirectorySDDL.  The descriptor
+// must be released with LocalFree.
+func privateSecurityAttributes() (*syscall.SecurityAttributes, error) {
+	sddl, err := syscall.UTF16PtrFromString(privateDirectorySDDL)
+	if err != nil {
+		return nil, err
+	}
+	var sd uintptr
+	const sddlRevision1 = 1
+	r, _, err := procConvertSDDL.Call(uintptr(unsafe.Pointer(sddl)), sddlRevision1, uintptr(unsafe.Pointer(&sd)), 0)
+	if r == 0 {
+		return nil, err
+	}
+	sa := &syscall.SecurityAttributes{SecurityDescriptor: sd}
+	sa.Length = uint32(unsafe.Sizeof(*sa))
+	return sa, nil
+}
+
+// Add the \\?\ prefix to long absolute paths so they can be created
+func longPath(path string) string {
+	if len(path) < maxShortPath || strings.HasPrefix(path, `\\?\`) || !filepath.IsAbs(path) {
+		return path
+	}
+	path = filepath.Clean(path)
+	if strings.HasPrefix(path, `\\`) {
+		// UNC path: \\server\share becomes \\?\UNC\server\share
+		return `\\?\UNC\` + path[2:]
+	}
+	return `\\?\` + path
+}
@@ -0,0 +1,41 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"sync/atomic"
+)
+
+// FileLogStats counts what a FileLogWriter has done since it was created, so
+// that lost records can be alarmed on.
+type FileLogStats struct {
+	RecordsWritten   uint64 // Records written to the file
+	BytesWritten     uint64 // Bytes of records written to the file
+	Rotations        uint64 // Times the file has been rotated
+	WriteFailures    uint64 // Writes to the file which failed
+	RotationFailures uint64 // Rotations which failed
+	Dropped          uint64 // Records dropped because the queue was full, space was low or CloseTimeout ran out of time
+}
+
+// The counters behind FileLogStats (accessed atomically)
+type fileLogCounters struct {
+	recordsWritten   uint64
+	bytesWritten     uint64
+	rotations        uint64
+	writeFailures    uint64
+	rotationFailures uint64
+	lowSpaceDropped  uint64
+	abandoned        uint64
+}
+
+// Stats returns the writer's counters.
+func (w *FileLogWriter) Stats() FileLogStats {
+	return FileLogStats{
+		RecordsWritten:   atomic.LoadUint64(&w.counters.recordsWritten),
+		BytesWritten:     atomic.LoadUint64(&w.counters.bytesWritten),
+		Rotations:        atomic.LoadUint64(&w.counters.rotations),
+		WriteFailures:    atomic.LoadUint64(&w.counters.writeFailures),
+		RotationFailures: atomic.LoadUint64(&w.counters.rotationFailures),
+		Dropped:          atomic.LoadUint64(&w.dropped) + atomic.LoadUint64(&w.counters.lowSpaceDropped) + atomic.LoadUint64(&w.counters.abandoned),
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A SyncPolicy says when a FileLogWriter forces what it has written out to
+// stable storage with fsync.  Policies can be combined with SetSyncPolicy, in
+// which case the file is synced whenever any of them says so.
+type SyncPolicy struct {
+	records  int
+	interval time.Duration
+	level    Level
+	byLevel  bool
+}
+
+// SyncEveryRecords syncs the file after every n records.
+func SyncEveryRecords(n int) SyncPolicy {
+	return SyncPolicy{records: n}
+}
+
+// SyncEveryInterval syncs the file at most d after a record is written.
+func SyncEveryInterval(d time.Duration) SyncPolicy {
+	return SyncPolicy{interval: d}
+}
+
+// SyncAtLevel syncs the file after each record at or above lvl.
+func SyncAtLevel(lvl Level) SyncPolicy {
+	return SyncPolicy{level: lvl, byLevel: true}
+}
+
+// Whether the policy ever syncs
+func (p SyncPolicy) enabled() bool {
+	return p.records > 0 || p.interval > 0 || p.byLevel
+}
+
+// Whether to sync after writing a record at lvl, with unsynced records
+// written since the last sync
+func (p SyncPolicy) due(lvl Level, unsynced int) bool {
+	if unsynced == 0 {
+		return false
+	}
+	return (p.records > 0 && unsynced >= p.records) || (p.byLevel && lvl >= p.level)
+}
+
+// Merge policies into one which syncs whenever any of them would
+func combineSyncPolicies(policies []SyncPolicy) SyncPolicy {
+	var combined SyncPolicy
+	for _, p := range policies {
+		if p.records > 0 && (combined.records == 0 || p.records < combined.records) {
+			combined.records = p.records
+		}
+		if p.interval > 0 && (combined.interval == 0 || p.interval < combined.interval) {
+			combined.interval = p.interval
+		}
+		if p.byLevel && (!combined.byLevel || p.level < combined.level) {
+			combined.level, combined.byLevel = p.level, true
+		}
+	}
+	return combined
+}
+
+// Parse a comma separated list of policies as used in configuration files:
+// numbers of records, durations and level names, e.g. "100, 5s, ERROR"
+func parseSyncPolicies(spec string) ([]SyncPolicy, error) {
+	var policies []SyncPolicy
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if len(field) == 0 {
+			continue
+		}
+		if n, err := strconv.Atoi(field); err == nil && n > 0 {
+			policies = append(policies, SyncEveryRecords(n))
+		} else if d, err := time.ParseDuration(field); err == nil && d > 0 {
+			policies = append(policies, SyncEveryInterval(d))
+		} else if lvl, ok := levelFromString(strings.ToUpper(field)); ok {
+			policies = append(policies, SyncAtLevel(lvl))
+		} else {
+			return nil, fmt.Errorf("Unknown sync policy %q", field)
+		}
+	}
+	return policies, nil
+}
+
+// SetSyncPolicy forces the file out to stable storage whenever any of the
+// policies says so (chainable), and when it is rotated or closed.  With none,
+// the default, the file is only synced by SetFlushSchedule and Sync.
+func (w *FileLogWriter) SetSyncPolicy(policies ...SyncPolicy) *FileLogWriter {
+	w.configure(func() {
+		w.syncPolicy = combineSyncPolicies(policies)
+	})
+	return w
+}
+
+// Sync writes out everything logged so far, as Flush does, and forces it out
+// to stable storage, returning once it is there.  Callers which must not
+// acknowledge a request until its audit record is durable can call it after
+// logging the record.
+func (w *FileLogWriter) Sync() {
+	if !w.waitForQueue() {
+		return
+	}
+	w.configure(func() {
+		w.handleWriteFailure(w.flush())
+	})
+}
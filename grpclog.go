@@ -0,0 +1,401 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+var (
+	// GRPCMaxBatch is the most records a GRPCLogWriter writes to its stream
+	// together.
+	GRPCMaxBatch = 64
+
+	// GRPCDialTimeout bounds how long a GRPCLogWriter waits to connect to
+	// its collector.
+	GRPCDialTimeout = 10 * time.Second
+
+	// GRPCCloseTimeout bounds how long closing a GRPCLogWriter waits for the
+	// collector to acknowledge the end of the stream.
+	GRPCCloseTimeout = 10 * time.Second
+)
+
+// The method records are streamed to, as log4go.proto defines it
+const grpcStreamPath = "/log4go.LogCollector/Stream"
+
+// GRPCLogWriter streams records to a collector implementing the LogCollector
+// service in log4go.proto, as one long-lived client-streaming call over
+// HTTP/2 with TLS.  (The standard library's HTTP/2 client only runs over TLS,
+// so collectors listening in cleartext can't be reached.)
+//
+// When the stream fails the writer reconnects as a SocketLogWriter does,
+// holding records meanwhile.  Records written just before a stream fails may
+// be lost.  A collector which reads slowly holds up the writer through HTTP/2
+// flow control, and once the writer's queue fills, LogWrite blocks.
+type GRPCLogWriter struct {
+	records   chan *LogRecord
+	queue     *queueTracker
+	completed chan int
+
+	addr      string
+	transport *http.Transport
+	client    *http.Client
+	headers   http.Header
+	stream    *grpcStream
+
+	// Reconnection after the stream fails, holding up to replayLength
+	// records meanwhile
+	reconnectMin time.Duration
+	reconnectMax time.Duration
+	replayLength int
+	replay       []*LogRecord
+	dropped      uint64
+}
+
+// An open call to the collector
+type grpcStream struct {
+	body   *io.PipeWriter
+	cancel context.CancelFunc
+	done   chan error // The outcome of the call, once it ends
+}
+
+// NewGRPCLogWriter creates a LogWriter which streams records to the collector
+// at addr, given as host:port.  The collector is connected to when the first
+// record is written.
+func NewGRPCLogWriter(addr string) *GRPCLogWriter {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "NewGRPCLogWriter(%q): %s\n", addr, err)
+		return nil
+	}
+
+	transport := &http.Transport{
+		DialContext:       (&net.Dialer{Timeout: GRPCDialTimeout}).DialContext,
+		TLSClientConfig:   &tls.Config{ServerName: host},
+		ForceAttemptHTTP2: true,
+	}
+	w := &GRPCLogWriter{
+		records:      make(chan *LogRecord, LogBufferLength),
+		queue:        newQueueTracker(),
+		completed:    make(chan int),
+		addr:         addr,
+		transport:    transport,
+		client:       &http.Client{Transport: transport},
+		headers:      make(http.Header),
+		reconnectMin: SocketReconnectMin,
+		reconnectMax: SocketReconnectMax,
+		replayLength: SocketReplayLength,
+	}
+	go w.run()
+	return w
+}
+
+// SetTLS sets how the collector is verified and the writer identifies itself
+// (chainable).  A config without a ServerName is given the host from the
+// writer's address.  Must be called before the first log message is written.
+func (w *GRPCLogWriter) SetTLS(config *tls.Config) *GRPCLogWriter {
+	if len(config.ServerName) == 0 {
+		config = config.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(w.addr)
+	}
+	w.transport.TLSClientConfig = config
+	return w
+}
+
+// SetHeader adds metadata to each call, such as an authorization token
+// (chainable).  Must be called before the first log message is written.
+func (w *GRPCLogWriter) SetHeader(key, value string) *GRPCLogWriter {
+	w.headers.Add(key, value)
+	return w
+}
+
+// SetReconnect sets how the stream is reestablished once it fails
+// (chainable): the wait between attempts starts at min and doubles up to
+// max, and up to replay records are held meanwhile.  Must be called before
+// the first log message is written.
+func (w *GRPCLogWriter) SetReconnect(min, max time.Duration, replay int) *GRPCLogWriter {
+	w.reconnectMin, w.reconnectMax, w.replayLength = min, max, replay
+	return w
+}
+
+// This is the GRPCLogWriter's output method.  This will block if the output
+// buffer is full.
+func (w *GRPCLogWriter) LogWrite(rec *LogRecord) {
+	w.queue.push(time.Now())
+	w.records <- rec
+}
+
+// QueueStats reports on the records waiting to be sent.
+func (w *GRPCLogWriter) QueueStats() QueueStats {
+	return QueueStats{
+		Length:    len(w.records),
+		Capacity:  cap(w.records),
+		OldestAge: w.queue.oldestAge(time.Now()),
+	}
+}
+
+// Close sends any queued records, ends the stream and waits for the
+// collector to acknowledge it.
+func (w *GRPCLogWriter) Close() {
+	close(w.records)
+	<-w.completed
+}
+
+func (w *GRPCLogWriter) run() {
+	defer close(w.completed)
+
+	batch := make([]*LogRecord, 0, GRPCMaxBatch)
+	var retry <-chan time.Time
+	var backoff time.Duration
+
+	// Drop a failed stream and schedule the next attempt
+	fail := func(err error) {
+		fmt.Fprintf(os.Stderr, "GRPCLogWriter(%q): %s; reconnecting\n", w.addr, err)
+		w.disconnect()
+		if backoff == 0 {
+			backoff = w.reconnectMin
+		} else if backoff *= 2; backoff > w.reconnectMax {
+			backoff = w.reconnectMax
+		}
+		retry = time.After(backoff)
+	}
+
+	for {
+		// While waiting to reconnect, hold records until the next attempt
+		if w.stream == nil && retry != nil {
+			select {
+			case rec, ok := <-w.records:
+				if !ok {
+					w.finish()
+					return
+				}
+				w.queue.pop()
+				w.hold(rec)
+			case <-retry:
+				retry = nil
+				// With nothing held, the next record reconnects
+				if len(w.replay) > 0 {
+					if err := w.reconnect(); err != nil {
+						fail(err)
+					}
+				}
+			}
+			continue
+		}
+
+		var done <-chan error
+		if w.stream != nil {
+			done = w.stream.done
+		}
+
+		select {
+		case err := <-done:
+			if err == nil {
+				err = errors.New("collector ended the stream")
+			}
+			fail(err)
+			continue
+		case rec, ok := <-w.records:
+			if !ok {
+				w.finish()
+				return
+			}
+			w.queue.pop()
+			batch = append(batch[:0], rec)
+		}
+
+		// Gather up whatever else is already waiting
+	gather:
+		for len(batch) < GRPCMaxBatch {
+			select {
+			case rec, ok := <-w.records:
+				if !ok {
+					break gather
+				}
+				w.queue.pop()
+				batch = append(batch, rec)
+			default:
+				break gather
+			}
+		}
+
+		if w.stream == nil {
+			if err := w.reconnect(); err != nil {
+				for _, rec := range batch {
+					w.hold(rec)
+				}
+				fail(err)
+				continue
+			}
+		}
+		if err := w.send(batch); err != nil {
+			for _, rec := range batch {
+				w.hold(rec)
+			}
+			fail(err)
+			continue
+		}
+		backoff = 0
+	}
+}
+
+// Once closed, send what is held if possible, then end the stream
+func (w *GRPCLogWriter) finish() {
+	if len(w.replay) > 0 {
+		if err := w.reconnect(); err != nil {
+			w.dropped += uint64(len(w.replay))
+			w.disconnect()
+		}
+	}
+	w.reportDropped()
+	if w.stream == nil {
+		return
+	}
+
+	w.stream.body.Close()
+	select {
+	case err := <-w.stream.done:
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "GRPCLogWriter(%q): %s\n", w.addr, err)
+		}
+	case <-time.After(GRPCCloseTimeout):
+		fmt.Fprintf(os.Stderr, "GRPCLogWriter(%q): Collector did not acknowledge the end of the stream\n", w.addr)
+	}
+	w.stream.cancel()
+	w.stream = nil
+}
+
+// Start a call to the collector, and send the records held while
+// disconnected
+func (w *GRPCLogWriter) reconnect() error {
+	w.stream = w.open()
+	for len(w.replay) > 0 {
+		n := len(w.replay)
+		if n > GRPCMaxBatch {
+			n = GRPCMaxBatch
+		}
+		if err := w.send(w.replay[:n]); err != nil {
+			w.disconnect()
+			return err
+		}
+		w.replay = w.replay[n:]
+	}
+	w.replay = nil
+	w.reportDropped()
+	return nil
+}
+
+// Abandon the current call, if any
+func (w *GRPCLogWriter) disconnect() {
+	if w.stream != nil {
+		w.stream.cancel()
+		w.stream.body.CloseWithError(errors.New("stream abandoned"))
+		w.stream = nil
+	}
+}
+
+// Hold a record to send once reconnected, dropping the oldest held if there
+// are too many
+func (w *GRPCLogWriter) hold(rec *LogRecord) {
+	w.replay = append(w.replay, rec)
+	if over := len(w.replay) - w.replayLength; over > 0 {
+		w.replay = w.replay[over:]
+		w.dropped += uint64(over)
+	}
+}
+
+// Note any records dropped while disconnected
+func (w *GRPCLogWriter) reportDropped() {
+	if w.dropped == 0 {
+		return
+	}
+	if _, err := fmt.Fprintf(os.Stderr, "GRPCLogWriter(%q): Dropped %d previous log message(s)\n", w.addr, w.dropped); err == nil {
+		w.dropped = 0
+	}
+}
+
+// Start the streaming call.  The request body is written to as records
+// arrive; the call runs until the body is closed or the stream fails, which
+// also fails any write to the body.
+func (w *GRPCLogWriter) open() *grpcStream {
+	pr, pw := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &grpcStream{body: pw, cancel: cancel, done: make(chan error, 1)}
+
+	req, _ := http.NewRequest("POST", "https://"+w.addr+grpcStreamPath, pr)
+	req = req.WithContext(ctx)
+	for key, values := range w.headers {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	req.Header.Set("TE", "trailers")
+
+	go func() {
+		err := w.call(req)
+		if err != nil {
+			pr.CloseWithError(err)
+		} else {
+			pr.Close()
+		}
+		s.done <- err
+	}()
+	return s
+}
+
+// Make the call, returning once the collector has ended it
+func (w *GRPCLogWriter) call(req *http.Request) error {
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		return fmt.Errorf("collector answered with %s, not HTTP/2", resp.Proto)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("collector answered with status %s", resp.Status)
+	}
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+		return err
+	}
+
+	// A call which fails at once sends its status with the headers
+	status, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if len(status) == 0 {
+		status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	switch status {
+	case "0":
+		return nil
+	case "":
+		return errors.New("collector sent no grpc-status")
+	}
+	if unescaped, err := url.PathUnescape(message); err == nil {
+		message = unescaped
+	}
+	return fmt.Errorf("grpc-status %s: %s", status, message)
+}
+
+// Write a batch of records to the stream, each as a length-prefixed message
+func (w *GRPCLogWriter) send(batch []*LogRecord) error {
+	var buf []byte
+	for _, rec := range batch {
+		msg := encodeProtoRecord(rec)
+		buf = append(buf, 0, 0, 0, 0, 0) // Uncompressed, then the length
+		binary.BigEndian.PutUint32(buf[len(buf)-4:], uint32(len(msg)))
+		buf = append(buf, msg...)
+	}
+	_, err := w.stream.body.Write(buf)
+	return err
+}
@@ -0,0 +1,98 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// A Hook observes the records accepted by a Logger.  Unlike a Processor it
+// cannot change or drop the record, and unlike a LogWriter it need not be
+// closed, so it is a lightweight way to drive metrics, tracing events or
+// circuit breakers from log activity.
+type Hook func(rec *LogRecord)
+
+// AddHook registers hooks which are called, in the order added, for every
+// record that at least one filter will accept, after the processors have run
+// and before the record is handed to the writers.  Hooks are called on the
+// logging goroutine, so they should be quick, and must not modify the record
+// or log through the same logger.  Returns the logger for chaining.
+func (log Logger) AddHook(hooks ...Hook) Logger {
+	log.updateSettings(func(settings *loggerSettings) {
+		all := make([]Hook, 0, len(settings.hooks)+len(hooks))
+		all = append(all, settings.hooks...)
+		settings.hooks = append(all, hooks...)
+	})
+	return log
+}
+
+// RemoveHooks removes all hooks from the logger.  Returns the logger for
+// chaining.
+func (log Logger) RemoveHooks() Logger {
+	log.updateSettings(func(settings *loggerSettings) {
+		settings.hooks = nil
+	})
+	return log
+}
+
+// ShutdownHookTimeout bounds how long each shutdown hook may run before the
+// next one is started.
+var ShutdownHookTimeout = 5 * time.Second
+
+type shutdownHook struct {
+	name string
+	hook func()
+}
+
+var (
+	shutdownHooksLock sync.Mutex
+	shutdownHooks     []shutdownHook
+
+	// Replaced by tests
+	exit = os.Exit
+)
+
+// AddShutdownHook registers a function to run before the program exits
+// through Fatal, Exit or Crash, such as one which flushes a writer, writes a
+// crash report or notifies a service manager.  Hooks run in the order they
+// were added, before the logger is closed, so they may still log.  The name
+// identifies the hook if it fails to finish within ShutdownHookTimeout.
+func AddShutdownHook(name string, hook func()) {
+	shutdownHooksLock.Lock()
+	defer shutdownHooksLock.Unlock()
+	shutdownHooks = append(shutdownHooks, shutdownHook{name, hook})
+}
+
+// RunShutdownHooks runs the registered shutdown hooks in order and removes
+// them, so that they run at most once.  A hook which panics or does not return
+// within ShutdownHookTimeout is reported on stderr and left behind.  Programs
+// with their own exit path, such as a signal handler, should call this before
+// exiting.
+func RunShutdownHooks() {
+	shutdownHooksLock.Lock()
+	hooks := shutdownHooks
+	shutdownHooks = nil
+	shutdownHooksLock.Unlock()
+
+	for _, h := range hooks {
+		done := make(chan bool, 1)
+		go func(h shutdownHook) {
+			defer func() {
+				if r := recover(); r != nil {
+					fmt.Fprintf(os.Stderr, "RunShutdownHooks: hook %q panicked: %v\n", h.name, r)
+				}
+				done <- true
+			}()
+			h.hook()
+		}(h)
+
+		select {
+		case <-done:
+		case <-time.After(ShutdownHookTimeout):
+			fmt.Fprintf(os.Stderr, "RunShutdownHooks: hook %q did not finish within %s\n", h.name, ShutdownHookTimeout)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// HTTPTimeout bounds each request an HTTPLogWriter makes.
+var HTTPTimeout = 10 * time.Second
+
+// HTTPLogWriter POSTs batches of records to an HTTP endpoint, such as a log
+// collector's ingestion API or a webhook.  By default each batch is sent as
+// newline-delimited JSON, one record per line.  Failed requests are retried
+// as BatchRetries describes, except those refused with a 4xx status other
+// than 429.
+type HTTPLogWriter struct {
+	*batchWriter
+
+	url     string
+	client  *http.Client
+	enc     Encoder
+	array   bool
+	headers http.Header
+}
+
+// NewHTTPLogWriter creates a LogWriter which POSTs batches of records to
+// endpoint.
+func NewHTTPLogWriter(endpoint string) *HTTPLogWriter {
+	if u, err := url.Parse(endpoint); err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 {
+		fmt.Fprintf(os.Stderr, "NewHTTPLogWriter(%q): Invalid URL\n", endpoint)
+		return nil
+	}
+
+	w := &HTTPLogWriter{
+		url:     endpoint,
+		client:  &http.Client{Timeout: HTTPTimeout},
+		enc:     JSONEncoder{},
+		headers: make(http.Header),
+	}
+	w.batchWriter = newBatchWriter(fmt.Sprintf("HTTPLogWriter(%q)", endpoint), w.post)
+	return w
+}
+
+// SetEncoder sets how each record is encoded, JSONEncoder by default
+// (chainable).  Must be called before the first log message is written.
+func (w *HTTPLogWriter) SetEncoder(enc Encoder) *HTTPLogWriter {
+	w.enc = enc
+	return w
+}
+
+// SetJSONArray sends each batch as a JSON array of records rather than one
+// record per line (chainable).  The encoder must produce JSON.  Must be
+// called before the first log message is written.
+func (w *HTTPLogWriter) SetJSONArray(array bool) *HTTPLogWriter {
+	w.array = array
+	return w
+}
+
+// SetHeader adds a header to each request, such as an API key (chainable).
+// Must be called before the first log message is written.
+func (w *HTTPLogWriter) SetHeader(key, value string) *HTTPLogWriter {
+	w.headers.Add(key, value)
+	return w
+}
+
+// SetTimeout bounds each request, in place of HTTPTimeout (chainable).  Must
+// be called before the first log message is written.
+func (w *HTTPLogWriter) SetTimeout(timeout time.Duration) *HTTPLogWriter {
+	w.client.Timeout = timeout
+	return w
+}
+
+// SetBatching sets the most records sent together, the longest a record is
+// held before its batch is sent, and how many batches are sent at once, in
+// place of BatchMaxRecords, BatchFlushInterval and BatchMaxInFlight
+// (chainable).  Must be called before the first log message is written.
+func (w *HTTPLogWriter) SetBatching(maxRecords int, flushInterval time.Duration, maxInFlight int) *HTTPLogWriter {
+	w.maxRecords, w.flushInterval, w.maxInFlight = maxRecords, flushInterval, maxInFlight
+	return w
+}
+
+// SetRetry sets how many times a failed batch is tried again, and the
+// shortest and longest waits before doing so, in place of BatchRetries,
+// BatchRetryMin and BatchRetryMax (chainable).  Must be called before the
+// first log message is written.
+func (w *HTTPLogWriter) SetRetry(retries int, min, max time.Duration) *HTTPLogWriter {
+	w.retries, w.retryMin, w.retryMax = retries, min, max
+	return w
+}
+
+// Send a batch of records in one request
+func (w *HTTPLogWriter) post(batch []*LogRecord) error {
+	var body bytes.Buffer
+	contentType := "application/x-ndjson"
+	if w.array {
+		contentType = "application/json"
+		body.WriteByte('[')
+	}
+	for _, rec := range batch {
+		buf, err := encodeRecord(w.enc, rec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "HTTPLogWriter(%q): Dropped record: %s\n", w.url, err)
+			continue
+		}
+		buf = bytes.TrimRight(buf, "\n")
+		if w.array {
+			if body.Len() > 1 {
+				body.WriteByte(',')
+			}
+			body.Write(buf)
+		} else {
+			body.Write(buf)
+			body.WriteByte('\n')
+		}
+	}
+	if w.array {
+		body.WriteByte(']')
+	}
+
+	req, err := http.NewRequest("POST", w.url, &body)
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", contentType)
+	for key, values := range w.headers {
+		req.Header[key] = values
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode/100 == 2:
+		return nil
+	case resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests:
+		return permanentError{fmt.Errorf("%s", resp.Status)}
+	}
+	return fmt.Errorf("%s", resp.Status)
+}
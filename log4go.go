@@ -39,18 +39,22 @@
 // Future work: (please let me know if you think I should work on any of these particularly)
 // - Log file rotation
 // - Logging configuration files ala log4j
-// - Have the ability to remove filters?
 // - Have GetInfoChannel, GetDebugChannel, etc return a chan string that allows
 //   for another method of logging
 // - Add an XML filter type
 package log4go
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"os"
+	"reflect"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -90,21 +94,56 @@ func (l Level) String() string {
 	return levelStrings[int(l)]
 }
 
+// ParseLevel returns the level named by either its short form, as written in
+// log output ("EROR"), or its long form, as used in configuration ("ERROR").
+func ParseLevel(name string) (Level, bool) {
+	for i, s := range levelStrings {
+		if s == name {
+			return Level(i), true
+		}
+	}
+	return levelFromString(name)
+}
+
 /****** Variables ******/
 var (
 	// LogBufferLength specifies how many log messages a particular log4go
-	// logger can buffer at a time before writing them.
+	// logger can buffer at a time before writing them.  File writers can be
+	// given their own length with NewFileLogWriterBuffered.
 	LogBufferLength = 32
 )
 
 /****** LogRecord ******/
 
+// Fields holds structured key/value data attached to a record.
+type Fields map[string]interface{}
+
 // A LogRecord contains all of the pertinent information for each message
 type LogRecord struct {
 	Level   Level     // The log level
 	Created time.Time // The time at which the log message was created (nanoseconds)
 	Source  string    // The message source
 	Message string    // The log message
+	Fields  Fields    `json:",omitempty"` // Structured data attached to the message
+
+	// The goroutine the message was logged from, if the logger notes them
+	Goroutine uint64 `json:",omitempty"`
+
+	// The stack trace from where the message was logged, innermost call
+	// first, if the logger captures them at the record's level
+	Stack string `json:",omitempty"`
+
+	// The function, file and line the message was logged from, if the
+	// logger found them, for %F and the forms of %S
+	function string
+	file     string
+	line     int
+
+	// Encodings shared between the writers the record is dispatched to
+	encoded *encodeCache
+
+	// References held to a pooled record (accessed atomically)
+	refs int32
 }
 
 /****** LogWriter ******/
@@ -129,7 +168,8 @@ type Filter struct {
 }
 
 // A Logger represents a collection of Filters through which log messages are
-// written.
+// written.  Once processors, hooks, global fields or other settings are set
+// on it, the Logger also holds them, under a name its methods pass over.
 type Logger map[string]*Filter
 
 // Create a new logger.
@@ -162,44 +202,386 @@ func NewDefaultLogger(lvl Level) Logger {
 // Closes all log writers in preparation for exiting the program or a
 // reconfiguration of logging.  Calling this is not really imperative, unless
 // you want to guarantee that all log messages are written.  Close removes
-// all filters (and thus all LogWriters) from the logger.
+// all filters (and thus all LogWriters) from the logger.  The logger's
+// processors, hooks, global fields and other settings are kept.
 func (log Logger) Close() {
-	// Close all open loggers
+	filtersLock.Lock()
+	filters := make([]*Filter, 0, len(log))
 	for name, filt := range log {
-		filt.Close()
+		if !isFilterName(name) {
+			continue
+		}
+		filters = append(filters, filt)
 		delete(log, name)
 	}
+	filtersLock.Unlock()
+
+	// Close all open loggers
+	for _, filt := range filters {
+		filt.Close()
+	}
+}
+
+// A Flusher is a LogWriter which holds on to records, and can be told to write
+// out everything it has been given so far.
+type Flusher interface {
+	Flush()
+}
+
+// Flush tells each filter's writer, and the writers it decorates, to write out
+// any records they are holding on to.
+func (log Logger) Flush() {
+	filtersLock.RLock()
+	writers := make([]LogWriter, 0, len(log))
+	for _, filt := range log {
+		writers = append(writers, filt.LogWriter)
+	}
+	filtersLock.RUnlock()
+
+	for _, w := range writers {
+		for w != nil {
+			if f, ok := w.(Flusher); ok {
+				f.Flush()
+			}
+			u, ok := w.(Unwrapper)
+			if !ok {
+				break
+			}
+			w = u.Unwrap()
+		}
+	}
 }
 
 // Add a new LogWriter to the Logger which will only log messages at lvl or
-// higher.  This function should not be called from multiple goroutines.
-// Returns the logger for chaining.
+// higher.  Returns the logger for chaining.
 func (log Logger) AddFilter(name string, lvl Level, writer LogWriter) Logger {
+	filtersLock.Lock()
+	defer filtersLock.Unlock()
+	log[name] = &Filter{lvl, writer}
+	return log
+}
+
+// ReplaceWriter swaps the writer of the named filter for writer, keeping the
+// filter's level.  Records logged before the swap go to the old writer, which
+// is then closed so that it writes out anything it has queued; records logged
+// after it go to the new writer.  This allows the destination of a
+// long-running program's logs to be changed without losing records.
+func (log Logger) ReplaceWriter(name string, writer LogWriter) error {
+	if writer == nil {
+		return fmt.Errorf("filter %q has no writer", name)
+	}
+	filtersLock.Lock()
+	filt, ok := log[name]
+	if !ok {
+		filtersLock.Unlock()
+		return fmt.Errorf("no filter named %q", name)
+	}
+	log[name] = &Filter{filt.Level, writer}
+	filtersLock.Unlock()
+
+	// Logging in progress has finished with the old writer
+	filt.Close()
+	return nil
+}
+
+// ListFilters returns the names of the logger's filters in sorted order.
+func (log Logger) ListFilters() []string {
+	filtersLock.RLock()
+	defer filtersLock.RUnlock()
+	names := make([]string, 0, len(log))
+	for name := range log {
+		if isFilterName(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// InsertFilter adds a filter like AddFilter, but returns an error instead of
+// replacing an existing filter with the same name.
+func (log Logger) InsertFilter(name string, lvl Level, writer LogWriter) error {
+	if writer == nil {
+		return fmt.Errorf("filter %q has no writer", name)
+	}
+	filtersLock.Lock()
+	defer filtersLock.Unlock()
+	if _, ok := log[name]; ok {
+		return fmt.Errorf("duplicate filter name %q", name)
+	}
+	log[name] = &Filter{lvl, writer}
+	return nil
+}
+
+// RemoveFilter removes the named filter from the logger and closes its
+// writer.
+func (log Logger) RemoveFilter(name string) error {
+	filtersLock.Lock()
+	filt, ok := log[name]
+	if !ok {
+		filtersLock.Unlock()
+		return fmt.Errorf("no filter named %q", name)
+	}
+	delete(log, name)
+	filtersLock.Unlock()
+
+	filt.Close()
+	return nil
+}
+
+// ReplaceFilter replaces both the level and the writer of the named filter.
+// As with ReplaceWriter, the old writer is closed once it is no longer in use.
+func (log Logger) ReplaceFilter(name string, lvl Level, writer LogWriter) error {
+	if writer == nil {
+		return fmt.Errorf("filter %q has no writer", name)
+	}
+	filtersLock.Lock()
+	filt, ok := log[name]
+	if !ok {
+		filtersLock.Unlock()
+		return fmt.Errorf("no filter named %q", name)
+	}
 	log[name] = &Filter{lvl, writer}
+	filtersLock.Unlock()
+
+	filt.Close()
+	return nil
+}
+
+/******* Per-Logger settings *******/
+
+// Since a Logger is a map of its filters, settings which apply to the Logger as
+// a whole are kept in it too, as the writer of a filter under a reserved name
+// which the Logger's methods pass over.  The entry is only added once a setting
+// is changed, so a Logger with just filters has an entry for each of them.
+// The settings are replaced whole when they change, never modified.
+const loggerSettingsName = "\x00log4go settings"
+
+type loggerSettings struct {
+	processors []Processor
+	hooks      []Hook
+	fields     Fields
+	pooling    bool
+	goroutines bool
+	stacks     bool
+	stackLevel Level
+}
+
+// Records never reach the settings, which are only a LogWriter to be kept
+// among the filters
+func (settings *loggerSettings) LogWrite(rec *LogRecord) {}
+func (settings *loggerSettings) Close()                  {}
+
+var (
+	// Guards the filters and settings of every Logger.  Logging holds it for
+	// reading; changes made through the Logger's methods hold it for writing.
+	filtersLock sync.RWMutex
+	noSettings  = &loggerSettings{}
+)
+
+// Whether name is one of a logger's filters, rather than its settings
+func isFilterName(name string) bool {
+	return name != loggerSettingsName
+}
+
+// Get the current settings for this logger, which must not be modified
+func (log Logger) settings() *loggerSettings {
+	filtersLock.RLock()
+	defer filtersLock.RUnlock()
+	return log.settingsLocked()
+}
+
+// Get the current settings, with filtersLock held
+func (log Logger) settingsLocked() *loggerSettings {
+	if filt, ok := log[loggerSettingsName]; ok {
+		if settings, ok := filt.LogWriter.(*loggerSettings); ok {
+			return settings
+		}
+	}
+	return noSettings
+}
+
+// Change the settings for this logger; update is given a copy of the current
+// settings, with the lock held, to make the new ones from
+func (log Logger) updateSettings(update func(*loggerSettings)) {
+	filtersLock.Lock()
+	defer filtersLock.Unlock()
+	settings := new(loggerSettings)
+	*settings = *log.settingsLocked()
+	update(settings)
+	log[loggerSettingsName] = &Filter{CRITICAL, settings}
+}
+
+// Whether any filter would accept a record at lvl
+func (log Logger) wouldLog(lvl Level) bool {
+	filtersLock.RLock()
+	defer filtersLock.RUnlock()
+	for name, filt := range log {
+		if lvl >= filt.Level && isFilterName(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetGoroutineIDs makes the logger note which goroutine each record is
+// logged from, for the %G format code.  Go keeps goroutine IDs to itself, and
+// finding one means reading the caller's stack trace, so this is for
+// debugging interleaved records only.  Returns the logger for chaining.
+func (log Logger) SetGoroutineIDs(enabled bool) Logger {
+	log.updateSettings(func(settings *loggerSettings) {
+		settings.goroutines = enabled
+	})
+	return log
+}
+
+// The ID of the calling goroutine, from the "goroutine N [running]:" line
+// that starts its stack trace
+func goroutineID() uint64 {
+	var buf [64]byte
+	n := runtime.Stack(buf[:], false)
+	fields := strings.Fields(string(buf[:n]))
+	if len(fields) < 2 {
+		return 0
+	}
+	id, _ := strconv.ParseUint(fields[1], 10, 64)
+	return id
+}
+
+// SetStackTraces makes the logger capture the stack trace from where each
+// record at lvl or above is logged, such as ERROR for failures, for the %K
+// format code.  Put %K at the end of a format to append traces to the records
+// which have them.  Returns the logger for chaining.
+func (log Logger) SetStackTraces(enabled bool, lvl Level) Logger {
+	log.updateSettings(func(settings *loggerSettings) {
+		settings.stacks, settings.stackLevel = enabled, lvl
+	})
 	return log
 }
 
+// The package's own functions are left out of stack traces
+var log4goPackage = reflect.TypeOf(LogRecord{}).PkgPath() + "."
+
+// The calling goroutine's frames, innermost first, from the caller of the
+// logging method
+func callerFrames() []runtime.Frame {
+	pcs := make([]uintptr, 64)
+	pcs = pcs[:runtime.Callers(2, pcs)]
+	var frames []runtime.Frame
+	iter := runtime.CallersFrames(pcs)
+	for more := len(pcs) > 0; more; {
+		var frame runtime.Frame
+		frame, more = iter.Next()
+		if len(frames) == 0 && strings.HasPrefix(frame.Function, log4goPackage) {
+			continue
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// The calling goroutine's stack trace, from the caller of the logging method,
+// laid out as in a panic's: each function, then its file and line indented
+func stackTrace() string {
+	var out bytes.Buffer
+	for i, frame := range callerFrames() {
+		if i > 0 {
+			out.WriteByte('\n')
+		}
+		fmt.Fprintf(&out, "%s\n\t%s:%d", frame.Function, frame.File, frame.Line)
+	}
+	return out.String()
+}
+
+// SetGlobalFields sets fields which are merged into every record sent through
+// this logger, such as the application name, version and host.  Fields set on
+// an individual record take precedence.  Passing nil clears them.  Returns the
+// logger for chaining.
+func (log Logger) SetGlobalFields(fields Fields) Logger {
+	copied := make(Fields, len(fields))
+	for k, v := range fields {
+		copied[k] = v
+	}
+	log.updateSettings(func(settings *loggerSettings) {
+		settings.fields = copied
+	})
+	return log
+}
+
+// GlobalFields returns a copy of the fields set with SetGlobalFields.
+func (log Logger) GlobalFields() Fields {
+	fields := log.settings().fields
+	copied := make(Fields, len(fields))
+	for k, v := range fields {
+		copied[k] = v
+	}
+	return copied
+}
+
 /******* Logging *******/
-// Send a formatted log message internally
-func (log Logger) intLogf(lvl Level, format string, args ...interface{}) {
-	skip := true
+// Run a record through the processors and send it to all interested filters
+func (log Logger) dispatch(rec *LogRecord) {
+	settings := log.settings()
+	if len(settings.fields) > 0 {
+		merged := make(Fields, len(settings.fields)+len(rec.Fields))
+		for k, v := range settings.fields {
+			merged[k] = v
+		}
+		// Fields on the record itself take precedence
+		for k, v := range rec.Fields {
+			merged[k] = v
+		}
+		rec.Fields = merged
+	}
+	for _, p := range settings.processors {
+		if rec = p.Process(rec); rec == nil {
+			return
+		}
+	}
 
-	// Determine if any logging will be done
-	for _, filt := range log {
-		if lvl >= filt.Level {
-			skip = false
-			break
+	filtersLock.RLock()
+	defer filtersLock.RUnlock()
+
+	writers := make([]LogWriter, 0, len(log))
+	for name, filt := range log {
+		if rec.Level >= filt.Level && isFilterName(name) {
+			writers = append(writers, filt.LogWriter)
+		}
+	}
+
+	// If the record is going to several writers, let them share encodings
+	if len(writers) > 1 && rec.encoded == nil {
+		rec.encoded = &encodeCache{}
+	}
+
+	// Let the hooks see the record if anything will write it
+	if len(writers) > 0 {
+		for _, hook := range settings.hooks {
+			hook(rec)
 		}
 	}
-	if skip {
+
+	// Dispatch the logs
+	rec.share(writers)
+	for _, w := range writers {
+		w.LogWrite(rec)
+	}
+	rec.release()
+}
+
+// Send a formatted log message internally
+func (log Logger) intLogf(lvl Level, format string, args ...interface{}) {
+	// Determine if any logging will be done
+	if !log.wouldLog(lvl) {
 		return
 	}
 
 	// Determine caller func
-	pc, _, lineno, ok := runtime.Caller(2)
-	src := ""
+	pc, file, lineno, ok := runtime.Caller(2)
+	src, function := "", ""
 	if ok {
-		src = fmt.Sprintf("%s:%d", runtime.FuncForPC(pc).Name(), lineno)
+		function = runtime.FuncForPC(pc).Name()
+		src = fmt.Sprintf("%s:%d", function, lineno)
 	}
 
 	msg := format
@@ -208,91 +590,45 @@ func (log Logger) intLogf(lvl Level, format string, args ...interface{}) {
 	}
 
 	// Make the log record
-	rec := &LogRecord{
-		Level:   lvl,
-		Created: time.Now(),
-		Source:  src,
-		Message: msg,
-	}
+	rec := log.newRecord(lvl, src, msg)
+	rec.function, rec.file, rec.line = function, file, lineno
 
-	// Dispatch the logs
-	for _, filt := range log {
-		if lvl < filt.Level {
-			continue
-		}
-		filt.LogWrite(rec)
-	}
+	log.dispatch(rec)
 }
 
 // Send a closure log message internally
 func (log Logger) intLogc(lvl Level, closure func() string) {
-	skip := true
-
 	// Determine if any logging will be done
-	for _, filt := range log {
-		if lvl >= filt.Level {
-			skip = false
-			break
-		}
-	}
-	if skip {
+	if !log.wouldLog(lvl) {
 		return
 	}
 
 	// Determine caller func
-	pc, _, lineno, ok := runtime.Caller(2)
-	src := ""
+	pc, file, lineno, ok := runtime.Caller(2)
+	src, function := "", ""
 	if ok {
-		src = fmt.Sprintf("%s:%d", runtime.FuncForPC(pc).Name(), lineno)
+		function = runtime.FuncForPC(pc).Name()
+		src = fmt.Sprintf("%s:%d", function, lineno)
 	}
 
 	// Make the log record
-	rec := &LogRecord{
-		Level:   lvl,
-		Created: time.Now(),
-		Source:  src,
-		Message: closure(),
-	}
+	rec := log.newRecord(lvl, src, closure())
+	rec.function, rec.file, rec.line = function, file, lineno
 
-	// Dispatch the logs
-	for _, filt := range log {
-		if lvl < filt.Level {
-			continue
-		}
-		filt.LogWrite(rec)
-	}
+	log.dispatch(rec)
 }
 
 // Send a log message with manual Level, source, and message.
 func (log Logger) Log(lvl Level, source, message string) {
-	skip := true
-
 	// Determine if any logging will be done
-	for _, filt := range log {
-		if lvl >= filt.Level {
-			skip = false
-			break
-		}
-	}
-	if skip {
+	if !log.wouldLog(lvl) {
 		return
 	}
 
 	// Make the log record
-	rec := &LogRecord{
-		Level:   lvl,
-		Created: time.Now(),
-		Source:  source,
-		Message: message,
-	}
+	rec := log.newRecord(lvl, source, message)
 
-	// Dispatch the logs
-	for _, filt := range log {
-		if lvl < filt.Level {
-			continue
-		}
-		filt.LogWrite(rec)
-	}
+	log.dispatch(rec)
 }
 
 // Logf logs a formatted log message at the given log level, using the caller as
@@ -482,3 +818,25 @@ func (log Logger) Critical(arg0 interface{}, args ...interface{}) error {
 	log.intLogf(lvl, msg)
 	return errors.New(msg)
 }
+
+// Fatal logs a message at the critical log level, runs the shutdown hooks,
+// closes the logger and exits the program with status 1.  See Debug for an
+// explanation of the parameters.
+func (log Logger) Fatal(arg0 interface{}, args ...interface{}) {
+	var msg string
+	switch first := arg0.(type) {
+	case string:
+		// Use the string as a format string
+		msg = fmt.Sprintf(first, args...)
+	case func() string:
+		// Log the closure (no other arguments used)
+		msg = first()
+	default:
+		// Build a format string so that it will be similar to Sprint
+		msg = fmt.Sprintf(fmt.Sprint(first)+strings.Repeat(" %v", len(args)), args...)
+	}
+	log.intLogf(CRITICAL, "%s", msg)
+	RunShutdownHooks()
+	log.Close()
+	exit(1)
+}
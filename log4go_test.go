@@ -3,17 +3,32 @@
 package log4go
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"crypto/md5"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"runtime"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -66,6 +81,33 @@ var formatTests = []struct {
 			FORMAT_ABBREV:  "[EROR] message\n",
 		},
 	},
+	{
+		Test: "Time layouts",
+		Record: &LogRecord{
+			Level:   ERROR,
+			Source:  "source",
+			Message: "message",
+			Created: now,
+		},
+		Formats: map[string]string{
+			"%T{2006-01-02T15:04:05.000Z07:00} %M": "2009-02-13T23:31:30.123Z message\n",
+			"[%T{Jan _2 15:04:05}] [%L] %M":        "[Feb 13 23:31:30] [EROR] message\n",
+			"%T{unterminated %M":                   "23:31:30 UTC{unterminated message\n",
+		},
+	},
+	{
+		Test: "Field lookups",
+		Record: &LogRecord{
+			Level:   INFO,
+			Message: "message",
+			Created: now,
+			Fields:  Fields{"request": "r-42", "tenant": 7},
+		},
+		Formats: map[string]string{
+			"[%X{request}] [%X{missing}] %M": "[r-42] [] message\n",
+			"%M {%X}":                        "message {request=r-42 tenant=7}\n",
+		},
+	},
 }
 
 func TestFormatLogRecord(t *testing.T) {
@@ -79,6 +121,22 @@ func TestFormatLogRecord(t *testing.T) {
 			}
 		}
 	}
+
+	host, _ := os.Hostname()
+	want := fmt.Sprintf("%s[%d]: message\n", host, os.Getpid())
+	if got := FormatLogRecord("%H[%P]: %M", newLogRecord(INFO, "source", "message")); got != want {
+		t.Errorf("Process tokens: got %q, want %q", got, want)
+	}
+
+	os.Setenv("LOG4GO_TEST_ENV", "staging")
+	defer os.Unsetenv("LOG4GO_TEST_ENV")
+	want = fmt.Sprintf("env=staging build=%s\n", buildVersion())
+	if got := FormatLogRecord("env=%E{LOG4GO_TEST_ENV} build=%V", newLogRecord(INFO, "source", "message")); got != want {
+		t.Errorf("Build tokens: got %q, want %q", got, want)
+	}
+	if buildVersion() == "" {
+		t.Errorf("Empty build version")
+	}
 }
 
 var logRecordWriteTests = []struct {
@@ -123,6 +181,68 @@ func TestConsoleLogWriter(t *testing.T) {
 	}
 }
 
+func TestConsoleLogWriterEncoder(t *testing.T) {
+	console := ConsoleLogWriterImp{
+		records:   make(chan *LogRecord, LogBufferLength),
+		completed: make(chan int),
+		enc: EncoderFunc(func(rec *LogRecord) ([]byte, error) {
+			return []byte(strings.ToUpper(rec.Message) + "\n"), nil
+		}),
+	}
+
+	r, w := io.Pipe()
+	go console.run(w)
+	defer console.Close()
+
+	buf := make([]byte, 1024)
+	console.LogWrite(newLogRecord(INFO, "source", "message"))
+	n, _ := r.Read(buf)
+	if got, want := string(buf[:n]), "MESSAGE\n"; got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+}
+
+func TestColorConsoleLogWriter(t *testing.T) {
+	palette, err := ParseConsolePalette("WARNING=33, EROR=1;31")
+	if err != nil {
+		t.Fatalf("ParseConsolePalette: %s", err)
+	}
+	if _, err := ParseConsolePalette("ERROR=red"); err == nil {
+		t.Errorf("ParseConsolePalette: expected an error for a color name")
+	}
+	console := ConsoleLogWriterImp{
+		records:   make(chan *LogRecord, LogBufferLength),
+		completed: make(chan int),
+		enc:       NewFormatEncoder("[%L] %M"),
+		palette:   palette,
+	}
+
+	r, w := io.Pipe()
+	go console.run(w)
+	defer console.Close()
+
+	buf := make([]byte, 1024)
+	for _, test := range []struct {
+		lvl  Level
+		want string
+	}{
+		{INFO, "[INFO] message\n"},
+		{WARNING, "\x1b[33m[WARN] message\x1b[0m\n"},
+		{ERROR, "\x1b[1;31m[EROR] message\x1b[0m\n"},
+	} {
+		console.LogWrite(newLogRecord(test.lvl, "source", "message"))
+		n, _ := r.Read(buf)
+		if got := string(buf[:n]); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.lvl, got, test.want)
+		}
+	}
+
+	// Not to a terminal
+	if consoleColorEnabled(&bytes.Buffer{}) {
+		t.Errorf("Colors enabled for a buffer")
+	}
+}
+
 func TestFileLogWriter(t *testing.T) {
 	defer func(buflen int) {
 		LogBufferLength = buflen
@@ -305,7 +425,7 @@ func TestFileLogFailureReporting(t *testing.T) {
 
 	// Drop a message
 	w.LogWrite(newLogRecord(CRITICAL, "source", "foo"))
-	for i := 0; w.maxlines_curlines == 1 || i == 1000; i++ {
+	for i := 0; w.Stats().WriteFailures == 0 && i < 1000; i++ {
 		runtime.Gosched()
 	}
 
@@ -1039,60 +1159,4174 @@ func TestEscapedBackspace(t *testing.T) {
 	}
 }
 
-func BenchmarkFormatLogRecord(b *testing.B) {
-	const updateEvery = 1
+func TestScheduleNext(t *testing.T) {
+	base := time.Date(2010, time.January, 31, 23, 58, 30, 0, time.UTC)
+	tests := []struct {
+		Spec string
+		Next time.Time
+	}{
+		{"* * * * *", time.Date(2010, time.January, 31, 23, 59, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2010, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"30 2 * * *", time.Date(2010, time.February, 1, 2, 30, 0, 0, time.UTC)},
+		{"0 0 * * 6", time.Date(2010, time.February, 6, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2010, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 12 29 2 *", time.Date(2012, time.February, 29, 12, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		s, err := ParseSchedule(test.Spec)
+		if err != nil {
+			t.Errorf("ParseSchedule(%q): %s", test.Spec, err)
+			continue
+		}
+		if got := s.Next(base); !got.Equal(test.Next) {
+			t.Errorf("%q.Next(%s) = %s, want %s", test.Spec, base, got, test.Next)
+		}
+	}
+
+	for _, bad := range []string{"", "* * * *", "60 * * * *", "*/0 * * * *", "a b c d e", "0 0 30 2 *", "0 0 31 4,6,9,11 *"} {
+		if _, err := ParseSchedule(bad); err == nil {
+			t.Errorf("ParseSchedule(%q) should have failed", bad)
+		}
+	}
+
+	// Days of the week are matched as an alternative, so this fires on Mondays
+	if s, err := ParseSchedule("0 0 30 2 1"); err != nil || s.Next(base).IsZero() {
+		t.Errorf("ParseSchedule(%q) should fire on Mondays (%v)", "0 0 30 2 1", err)
+	}
+
+	// Leap days are eight years apart around 2100
+	s, _ := ParseSchedule("0 12 29 2 *")
+	from, want := time.Date(2097, time.January, 1, 0, 0, 0, 0, time.UTC), time.Date(2104, time.February, 29, 12, 0, 0, 0, time.UTC)
+	if got := s.Next(from); !got.Equal(want) {
+		t.Errorf("Next(%s) = %s, want %s", from, got, want)
+	}
+}
+
+type recordingLogWriter struct {
+	records []*LogRecord
+}
+
+func (w *recordingLogWriter) LogWrite(rec *LogRecord) { w.records = append(w.records, rec) }
+func (w *recordingLogWriter) Close()                  {}
+
+func TestQuietHoursLogWriter(t *testing.T) {
+	sink := &recordingLogWriter{}
+	w := NewQuietHoursLogWriter(sink, "0 1 * * *", 2*time.Hour, INFO)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	day := time.Now().AddDate(0, 0, 1)
+	at := func(hour int) time.Time {
+		return time.Date(day.Year(), day.Month(), day.Day(), hour, 30, 0, 0, time.Local)
+	}
+
+	for _, hour := range []int{0, 1, 2, 3} {
+		w.LogWrite(&LogRecord{Level: DEBUG, Created: at(hour), Message: "debug"})
+		w.LogWrite(&LogRecord{Level: WARNING, Created: at(hour), Message: "warning"})
+	}
+
+	// DEBUG should only be dropped at 01:30 and 02:30
+	if got, want := len(sink.records), 6; got != want {
+		t.Fatalf("Expected %d records to pass, got %d", want, got)
+	}
+	for _, rec := range sink.records {
+		if rec.Level == DEBUG && rec.Created.Hour() != 0 && rec.Created.Hour() != 3 {
+			t.Errorf("DEBUG record at %s should have been dropped", rec.Created)
+		}
+	}
+}
+
+func TestProcessors(t *testing.T) {
+	sink := &recordingLogWriter{}
+	l := make(Logger)
+	l.AddFilter("sink", FINEST, sink)
+
+	redact, err := NewRedactProcessor(`password=\S+`, "password=***")
+	if err != nil {
+		t.Fatalf("NewRedactProcessor: %s", err)
+	}
+	l.AddProcessor(redact, ProcessorFunc(func(rec *LogRecord) *LogRecord {
+		if rec.Level == FINEST {
+			return nil
+		}
+		rec.Message = "[app] " + rec.Message
+		return rec
+	}))
+	defer l.SetProcessors()
+
+	l.Log(FINEST, "src", "dropped")
+	l.Log(INFO, "src", "login user=bob password=hunter2")
+
+	if len(sink.records) != 1 {
+		t.Fatalf("Expected 1 record, got %d", len(sink.records))
+	}
+	if got, want := sink.records[0].Message, "[app] login user=bob password=***"; got != want {
+		t.Errorf("Processed message: got %q, want %q", got, want)
+	}
+
+	l.SetProcessors()
+	if len(l.Processors()) != 0 {
+		t.Errorf("SetProcessors() should remove all processors")
+	}
+}
+
+func TestTransformLogWriter(t *testing.T) {
+	plain, transformed := &recordingLogWriter{}, &recordingLogWriter{}
+	l := make(Logger)
+	l.AddFilter("plain", FINEST, plain)
+	l.AddFilter("transformed", FINEST, NewTransformLogWriter(transformed,
+		RemapLevels(map[Level]Level{TRACE: DEBUG}),
+		TrimSourcePrefix("/src/repo/")))
+
+	l.Log(TRACE, "/src/repo/main.go:10", "message")
+
+	if len(plain.records) != 1 || len(transformed.records) != 1 {
+		t.Fatalf("Expected one record on each writer")
+	}
+	if rec := plain.records[0]; rec.Level != TRACE || rec.Source != "/src/repo/main.go:10" {
+		t.Errorf("Untransformed record was modified: %+v", rec)
+	}
+	if rec := transformed.records[0]; rec.Level != DEBUG || rec.Source != "main.go:10" {
+		t.Errorf("Record was not transformed: %+v", rec)
+	}
+
+	// Fields are copied too, so removing one leaves the other writers' alone
+	stripped := &recordingLogWriter{}
+	l.AddFilter("stripped", FINEST, NewTransformLogWriter(stripped, ProcessorFunc(func(rec *LogRecord) *LogRecord {
+		delete(rec.Fields, "secret")
+		return rec
+	})))
+	l.dispatch(&LogRecord{Level: INFO, Message: "fields", Fields: Fields{"user": "bob", "secret": "hunter2"}})
+	if rec := plain.records[1]; len(rec.Fields) != 2 {
+		t.Errorf("Untransformed record lost fields: %v", rec.Fields)
+	}
+	if rec := stripped.records[0]; len(rec.Fields) != 1 || rec.Fields["user"] != "bob" {
+		t.Errorf("Field was not removed: %v", rec.Fields)
+	}
+}
+
+func TestGlobalFields(t *testing.T) {
+	sink := &recordingLogWriter{}
+	l := make(Logger)
+	l.AddFilter("sink", FINEST, sink)
+	l.SetGlobalFields(Fields{"app": "billing", "version": "1.2"})
+	defer l.SetGlobalFields(nil)
+
+	l.Log(INFO, "src", "message")
+	l.dispatch(&LogRecord{Level: INFO, Message: "override", Fields: Fields{"version": "1.3"}})
+
+	if len(sink.records) != 2 {
+		t.Fatalf("Expected 2 records, got %d", len(sink.records))
+	}
+	if got, want := FormatLogRecord("%X", sink.records[0]), "app=billing version=1.2\n"; got != want {
+		t.Errorf("Global fields: got %q, want %q", got, want)
+	}
+	if got, want := FormatLogRecord("%X", sink.records[1]), "app=billing version=1.3\n"; got != want {
+		t.Errorf("Record fields should take precedence: got %q, want %q", got, want)
+	}
+}
+
+func TestLoggerSettingsLifetime(t *testing.T) {
+	// Settings stay with their logger, even once nothing else refers to it
+	for i := 0; i < 100; i++ {
+		make(Logger).SetGlobalFields(Fields{"stale": i})
+	}
+	runtime.GC()
+	for i := 0; i < 100; i++ {
+		if fields := make(Logger).GlobalFields(); len(fields) > 0 {
+			t.Fatalf("New logger inherited fields %v", fields)
+		}
+	}
+
+	// Close only removes the filters
+	l := make(Logger)
+	l.AddFilter("sink", FINEST, &recordingLogWriter{})
+	l.SetGlobalFields(Fields{"app": "billing"}).SetStackTraces(true, ERROR)
+	l.Close()
+	if names := l.ListFilters(); len(names) != 0 {
+		t.Errorf("Filters %v kept after Close", names)
+	}
+	if l.wouldLog(CRITICAL) {
+		t.Errorf("Settings taken for a filter")
+	}
+	sink := &recordingLogWriter{}
+	l.AddFilter("sink", FINEST, sink)
+	l.Error("again")
+	if len(sink.records) != 1 || sink.records[0].Fields["app"] != "billing" || len(sink.records[0].Stack) == 0 {
+		t.Errorf("Settings lost after Close: %+v", sink.records)
+	}
+}
+
+func TestSourceForms(t *testing.T) {
+	sink := &recordingLogWriter{}
+	l := make(Logger)
+	l.AddFilter("sink", FINEST, sink)
+	_, file, line, _ := runtime.Caller(0)
+	l.Info("message")
+	l.Log(INFO, "github.com/example/app/handlers.(*Server).Get:12", "manual")
+
+	logged, manual := sink.records[0], sink.records[1]
+	for format, want := range map[string]string{
+		"%S":        fmt.Sprintf("github.com/scalingdata/log4go.TestSourceForms:%d", line+1),
+		"%S{full}":  fmt.Sprintf("%s:%d", file, line+1),
+		"%S{short}": fmt.Sprintf("log4go_test.go:%d", line+1),
+		"%S{pkg}":   "log4go.TestSourceForms",
+		"%F":        "TestSourceForms",
+	} {
+		if got := strings.TrimSuffix(FormatLogRecord(format, logged), "\n"); got != want {
+			t.Errorf("%s: got %q, want %q", format, got, want)
+		}
+	}
+
+	// Without a file, the forms are taken from the source
+	for format, want := range map[string]string{
+		"%S{full}":  "github.com/example/app/handlers.(*Server).Get:12",
+		"%S{short}": "handlers.(*Server).Get:12",
+		"%S{pkg}":   "handlers.(*Server).Get",
+		"%F":        "(*Server).Get",
+	} {
+		if got := strings.TrimSuffix(FormatLogRecord(format, manual), "\n"); got != want {
+			t.Errorf("%s without a file: got %q, want %q", format, got, want)
+		}
+	}
+
+	// Version elements in import paths aren't taken for the function
+	for source, want := range map[string]string{
+		"gopkg.in/yaml.v2.(*T).M:3":         "(*T).M",
+		"gopkg.in/yaml.v2.Unmarshal":        "Unmarshal",
+		"example.com/pkg.v2.v3.F.func1":     "F.func1",
+		"example.com/pkg.vendor":            "vendor",
+		"example.com/pkg.v2":                "v2",
+		"example.com/app/handlers.(*S).Get": "(*S).Get",
+	} {
+		rec := &LogRecord{Level: INFO, Created: time.Now(), Source: source, Message: "message"}
+		if got := strings.TrimSuffix(FormatLogRecord("%F", rec), "\n"); got != want {
+			t.Errorf("%%F for %s: got %q, want %q", source, got, want)
+		}
+	}
+}
+
+func TestGoroutineIDs(t *testing.T) {
+	sink := &recordingLogWriter{}
+	l := make(Logger)
+	l.AddFilter("sink", FINEST, sink)
+	l.Log(INFO, "src", "unnoted")
+	l.SetGoroutineIDs(true)
+	defer l.SetGoroutineIDs(false)
+
+	l.Log(INFO, "src", "here")
+	done := make(chan bool)
+	go func() {
+		l.Log(INFO, "src", "elsewhere")
+		close(done)
+	}()
+	<-done
+
+	if len(sink.records) != 3 {
+		t.Fatalf("Expected 3 records, got %d", len(sink.records))
+	}
+	if got := FormatLogRecord("%G", sink.records[0]); got != "\n" {
+		t.Errorf("Goroutine noted before SetGoroutineIDs: %q", got)
+	}
+	here, elsewhere := sink.records[1].Goroutine, sink.records[2].Goroutine
+	if here == 0 || elsewhere == 0 || here == elsewhere {
+		t.Errorf("Goroutine IDs %d and %d should be distinct and set", here, elsewhere)
+	}
+	if got, want := FormatLogRecord("[%G] %M", sink.records[1]), fmt.Sprintf("[%d] here\n", here); got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+}
+
+func TestStackTraces(t *testing.T) {
+	sink := &recordingLogWriter{}
+	l := make(Logger)
+	l.AddFilter("sink", FINEST, sink)
+	l.Error("untraced")
+	l.SetStackTraces(true, ERROR)
+	defer l.SetStackTraces(false, ERROR)
+
+	l.Warn("below the level")
+	l.Error("traced")
+	l.Log(CRITICAL, "src", "traced too")
+
+	if len(sink.records) != 4 {
+		t.Fatalf("Expected 4 records, got %d", len(sink.records))
+	}
+	for i, want := range []bool{false, false, true, true} {
+		if got := len(sink.records[i].Stack) > 0; got != want {
+			t.Errorf("Record %d (%q): traced = %v, want %v", i, sink.records[i].Message, got, want)
+		}
+	}
+
+	// The trace starts at the caller, leaving out the package's own frames
+	// (which, in its own tests, include the test function)
+	stack := sink.records[2].Stack
+	if !strings.HasPrefix(stack, "testing.tRunner\n\t") || strings.Contains(stack, "newRecord") {
+		t.Errorf("Unexpected stack trace:\n%s", stack)
+	}
+	if got, want := FormatLogRecord("%M%K", sink.records[2]), "traced\n"+stack+"\n"; got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+	if got := FormatLogRecord("%M%K", sink.records[1]); got != "below the level\n" {
+		t.Errorf("Got %q for a record without a trace", got)
+	}
+}
+
+func TestEncoders(t *testing.T) {
 	rec := &LogRecord{
-		Level:   CRITICAL,
-		Created: now,
+		Level:   ERROR,
 		Source:  "source",
-		Message: "message",
+		Message: "a <message>",
+		Created: now,
+		Fields:  Fields{"user": "bob smith"},
 	}
-	for i := 0; i < b.N; i++ {
-		rec.Created = rec.Created.Add(1 * time.Second / updateEvery)
-		if i%2 == 0 {
-			FormatLogRecord(FORMAT_DEFAULT, rec)
-		} else {
-			FormatLogRecord(FORMAT_SHORT, rec)
+
+	tests := map[Encoder]string{
+		NewFormatEncoder(FORMAT_ABBREV): "[EROR] a <message>\n",
+		JSONEncoder{}:                   `{"level":"EROR","time":"2009-02-13T23:31:30.123456789Z","source":"source","message":"a \u003cmessage\u003e","fields":{"user":"bob smith"}}` + "\n",
+		LogfmtEncoder{}:                 `time=2009-02-13T23:31:30.123456789Z level=EROR source=source msg="a <message>" user="bob smith"` + "\n",
+		XMLEncoder{}:                    "\t<record level=\"EROR\">\n\t\t<timestamp>2009/02/13 23:31:30 UTC</timestamp>\n\t\t<source>source</source>\n\t\t<message>a &lt;message&gt;</message>\n\t</record>\n",
+		JSONEncoder{LevelKey: "severity", MessageKey: "msg", FieldsKey: "data"}: `{"severity":"EROR","time":"2009-02-13T23:31:30.123456789Z","source":"source","msg":"a \u003cmessage\u003e","data":{"user":"bob smith"}}` + "\n",
+		JSONEncoder{TimeKey: "ts", Flatten: true}:                               `{"level":"EROR","ts":"2009-02-13T23:31:30.123456789Z","source":"source","message":"a \u003cmessage\u003e","user":"bob smith"}` + "\n",
+	}
+	for enc, want := range tests {
+		got, err := enc.Encode(rec)
+		if err != nil {
+			t.Errorf("%T: %s", enc, err)
+		} else if string(got) != want {
+			t.Errorf("%T:  got %q", enc, got)
+			t.Errorf("%T: want %q", enc, want)
 		}
 	}
+
+	csvEnc := NewCSVEncoder("user", "missing")
+	if got, want := csvEnc.Header(), "time,level,source,message,user,missing"; got != want {
+		t.Errorf("CSVEncoder header: got %q, want %q", got, want)
+	}
+	quoted := &LogRecord{Level: INFO, Created: now, Message: "a \"quoted\", message", Fields: Fields{"user": "bob"}}
+	if got, _ := csvEnc.Encode(quoted); string(got) != `2009-02-13T23:31:30.123456789Z,INFO,,"a ""quoted"", message",bob,`+"\n" {
+		t.Errorf("CSVEncoder: got %q", got)
+	}
+
+	if enc, err := ParseJSONKeys("time=ts, fields=-"); err != nil || enc != (JSONEncoder{TimeKey: "ts", Flatten: true}) {
+		t.Errorf("ParseJSONKeys: got %+v, %v", enc, err)
+	}
+	if _, err := ParseJSONKeys("when=ts"); err == nil {
+		t.Errorf("ParseJSONKeys: expected an error for an unknown part")
+	}
+
+	buf, _ := ProtoEncoder{}.Encode(rec)
+	size, n := binary.Uvarint(buf)
+	if n <= 0 || int(size) != len(buf)-n {
+		t.Errorf("ProtoEncoder: bad length prefix %d for %d byte message", size, len(buf)-n)
+	}
 }
 
-func BenchmarkConsoleLog(b *testing.B) {
-	/* This doesn't seem to work on OS X
-	sink, err := os.Open(os.DevNull)
+type unhealthyLogWriter struct {
+	recordingLogWriter
+}
+
+func (w *unhealthyLogWriter) Healthy() bool { return false }
+
+func TestWriterMiddleware(t *testing.T) {
+	sink := &recordingLogWriter{}
+	w := Chain(sink, WithSampling(3, WARNING), WithBuffer(5, 0))
+	for i := 0; i < 9; i++ {
+		w.LogWrite(newLogRecord(DEBUG, "source", fmt.Sprintf("msg %d", i)))
+	}
+	w.LogWrite(newLogRecord(ERROR, "source", "error"))
+
+	// 3 of the DEBUG records are sampled, and the buffer holds them all
+	if len(sink.records) != 0 {
+		t.Errorf("Expected records to be buffered, got %d", len(sink.records))
+	}
+	w.Close()
+	if len(sink.records) != 4 {
+		t.Fatalf("Expected 4 records after close, got %d", len(sink.records))
+	}
+	if sink.records[3].Level != ERROR {
+		t.Errorf("ERROR records should not be sampled")
+	}
+
+	limited := WithRateLimit(0, 2)(sink).(*RateLimitLogWriter)
+	for i := 0; i < 5; i++ {
+		limited.LogWrite(newLogRecord(INFO, "source", "limited"))
+	}
+	if dropped := limited.Dropped(); dropped != 3 {
+		t.Errorf("Expected 3 records dropped by rate limit, got %d", dropped)
+	}
+
+	// A slow rate still lets a record through
+	middleware, err := newRateLimitMiddlewareFromProps(map[string]string{"persecond": "0.5"})
 	if err != nil {
-		panic(err)
+		t.Fatalf("newRateLimitMiddlewareFromProps: %s", err)
 	}
-	if err := syscall.Dup2(int(sink.Fd()), syscall.Stdout); err != nil {
-		panic(err)
+	slow := middleware(sink).(*RateLimitLogWriter)
+	slow.LogWrite(newLogRecord(INFO, "source", "slow"))
+	if dropped := slow.Dropped(); dropped != 0 {
+		t.Errorf("Expected the first record at half a record a second to pass, %d dropped", dropped)
 	}
-	*/
 
-	stdout = ioutil.Discard
-	sl := NewDefaultLogger(INFO)
-	for i := 0; i < b.N; i++ {
-		sl.Log(WARNING, "here", "This is a log message")
+	primary, secondary := &unhealthyLogWriter{}, &recordingLogWriter{}
+	WithFailover(secondary)(primary).LogWrite(newLogRecord(INFO, "source", "failover"))
+	if len(primary.records) != 0 || len(secondary.records) != 1 {
+		t.Errorf("Expected record to fail over to the secondary writer")
 	}
 }
 
-func BenchmarkConsoleNotLogged(b *testing.B) {
-	sl := NewDefaultLogger(INFO)
-	for i := 0; i < b.N; i++ {
-		sl.Log(DEBUG, "here", "This is a log message")
+type countingEncoder struct {
+	mu    sync.Mutex
+	count int
+}
+
+func (e *countingEncoder) Encode(rec *LogRecord) ([]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.count++
+	return []byte(rec.Message + "\n"), nil
+}
+
+// Encodes records synchronously, as the asynchronous writers do in their goroutines
+type encodingLogWriter struct {
+	enc Encoder
+	out bytes.Buffer
+}
+
+func (w *encodingLogWriter) LogWrite(rec *LogRecord) {
+	buf, _ := encodeRecord(w.enc, rec)
+	w.out.Write(buf)
+}
+func (w *encodingLogWriter) Close() {}
+
+func TestSharedEncoding(t *testing.T) {
+	enc := &countingEncoder{}
+	one, two := &encodingLogWriter{enc: enc}, &encodingLogWriter{enc: enc}
+	l := make(Logger)
+	l.AddFilter("one", FINEST, one)
+	l.AddFilter("two", FINEST, two)
+
+	l.Log(INFO, "source", "shared")
+
+	if enc.count != 1 {
+		t.Errorf("Expected record to be encoded once, encoded %d times", enc.count)
+	}
+	if one.out.String() != "shared\n" || two.out.String() != "shared\n" {
+		t.Errorf("Unexpected output: %q, %q", one.out.String(), two.out.String())
+	}
+
+	// A comparable type holding a func can't be compared, so isn't shared
+	wrapped := wrappingEncoder{EncoderFunc(func(rec *LogRecord) ([]byte, error) {
+		return []byte(rec.Message + "\n"), nil
+	})}
+	l.AddFilter("one", FINEST, &encodingLogWriter{enc: wrapped})
+	l.AddFilter("two", FINEST, &encodingLogWriter{enc: wrapped})
+	l.Log(INFO, "source", "unshared")
+	if out := l["two"].LogWriter.(*encodingLogWriter).out.String(); out != "unshared\n" {
+		t.Errorf("Unexpected output: %q", out)
 	}
 }
 
-func BenchmarkConsoleUtilLog(b *testing.B) {
-	sl := NewDefaultLogger(INFO)
-	for i := 0; i < b.N; i++ {
-		sl.Info("%s is a log message", "This")
+type wrappingEncoder struct {
+	inner Encoder
+}
+
+func (e wrappingEncoder) Encode(rec *LogRecord) ([]byte, error) { return e.inner.Encode(rec) }
+
+func TestDatagramChunking(t *testing.T) {
+	var chunks [][]byte
+	sock := writerFunc(func(p []byte) (int, error) {
+		chunks = append(chunks, append([]byte(nil), p...))
+		return len(p), nil
+	})
+
+	msg := bytes.Repeat([]byte("0123456789"), 25)
+	if err := writeChunked(sock, msg, 100); err != nil {
+		t.Fatalf("writeChunked: %s", err)
+	}
+
+	// 250 bytes in 88-byte payloads
+	if len(chunks) != 3 {
+		t.Fatalf("Expected 3 chunks, got %d", len(chunks))
+	}
+	var reassembled []byte
+	for i, chunk := range chunks {
+		if len(chunk) > 100 {
+			t.Errorf("Chunk %d is %d bytes, larger than the datagram size", i, len(chunk))
+		}
+		if chunk[0] != 0x1e || chunk[1] != 0x0f || int(chunk[10]) != i || chunk[11] != 3 {
+			t.Errorf("Chunk %d has a bad header: % x", i, chunk[:12])
+		}
+		if !bytes.Equal(chunk[2:10], chunks[0][2:10]) {
+			t.Errorf("Chunk %d has a different message ID", i)
+		}
+		reassembled = append(reassembled, chunk[12:]...)
+	}
+	if !bytes.Equal(reassembled, msg) {
+		t.Errorf("Reassembled message doesn't match")
+	}
+
+	if err := writeChunked(sock, make([]byte, 129*88), 100); err == nil {
+		t.Errorf("Expected an error for a message needing too many chunks")
 	}
 }
 
-func BenchmarkConsoleUtilNotLog(b *testing.B) {
-	sl := NewDefaultLogger(INFO)
-	for i := 0; i < b.N; i++ {
-		sl.Debug("%s is a log message", "This")
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+// Decode a snappy block, for checking the encoder
+func snappyDecodeBlock(src []byte) ([]byte, error) {
+	n, i := binary.Uvarint(src)
+	if i <= 0 {
+		return nil, fmt.Errorf("bad length")
+	}
+	dst := make([]byte, 0, n)
+	for i < len(src) {
+		tag := src[i]
+		switch tag & 3 {
+		case 0:
+			length := int(tag>>2) + 1
+			i++
+			switch length {
+			case 61:
+				length = int(src[i]) + 1
+				i++
+			case 62:
+				length = int(src[i]) | int(src[i+1])<<8 + 1
+				i += 2
+			}
+			dst = append(dst, src[i:i+length]...)
+			i += length
+		case 2:
+			length := int(tag>>2) + 1
+			offset := int(src[i+1]) | int(src[i+2])<<8
+			i += 3
+			for j := 0; j < length; j++ {
+				dst = append(dst, dst[len(dst)-offset])
+			}
+		default:
+			return nil, fmt.Errorf("unexpected tag %x", tag)
+		}
+	}
+	if uint64(len(dst)) != n {
+		return nil, fmt.Errorf("decoded %d bytes, expected %d", len(dst), n)
+	}
+	return dst, nil
+}
+
+func TestSnappyEncodeBlock(t *testing.T) {
+	inputs := [][]byte{
+		[]byte("short"),
+		bytes.Repeat([]byte("[2009/02/13 23:31:30 UTC] [EROR] (source) message\n"), 200),
+		[]byte(strings.Repeat("a", 70) + strings.Repeat("abcdefgh", 300)),
+	}
+	for _, input := range inputs {
+		block := snappyEncodeBlock(nil, input)
+		got, err := snappyDecodeBlock(block)
+		if err != nil {
+			t.Errorf("decode: %s", err)
+		} else if !bytes.Equal(got, input) {
+			t.Errorf("Round trip of %d bytes failed", len(input))
+		}
+	}
+}
+
+func TestSocketLogWriterChannel(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	defer ln.Close()
+
+	// A SocketLogWriter is still a channel records can be sent on
+	w := NewSocketLogWriterWithEncoder("tcp", ln.Addr().String(), NewFormatEncoder("%M"))
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	sock, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %s", err)
+	}
+	defer sock.Close()
+	w <- newLogRecord(INFO, "source", "one")
+	w.LogWrite(newLogRecord(INFO, "source", "two"))
+	close(w)
+	if got, err := ioutil.ReadAll(sock); err != nil || string(got) != "one\ntwo\n" {
+		t.Errorf("Got %q (%v), want %q", got, err, "one\ntwo\n")
+	}
+}
+
+func TestSocketLogWriterCompression(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Couldn't listen: %s", err)
+	}
+	defer ln.Close()
+
+	received := make(chan []byte)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(received)
+			return
+		}
+		defer conn.Close()
+		zr, err := gzip.NewReader(conn)
+		if err != nil {
+			close(received)
+			return
+		}
+		buf, _ := ioutil.ReadAll(zr)
+		received <- buf
+	}()
+
+	w := NewSocketLogWriterCompressed("tcp", ln.Addr().String(), NewFormatEncoder("%M"), COMPRESSION_GZIP)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "one"))
+	w.LogWrite(newLogRecord(INFO, "source", "two"))
+	w.Close()
+
+	select {
+	case got := <-received:
+		if string(got) != "one\ntwo\n" {
+			t.Errorf("Received %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for records")
+	}
+}
+
+type lockedRecordingLogWriter struct {
+	mu sync.Mutex
+	recordingLogWriter
+}
+
+func (w *lockedRecordingLogWriter) LogWrite(rec *LogRecord) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.recordingLogWriter.LogWrite(rec)
+}
+
+func (w *lockedRecordingLogWriter) count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.records)
+}
+
+func TestHeartbeat(t *testing.T) {
+	sink := &lockedRecordingLogWriter{}
+	w := WithHeartbeat(20*time.Millisecond, INFO, "still alive")(sink)
+	defer w.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for sink.count() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if len(sink.records) == 0 {
+		t.Fatalf("No heartbeat was written")
+	}
+	if rec := sink.records[0]; rec.Message != "still alive" || rec.Fields["heartbeat"] != true {
+		t.Errorf("Unexpected heartbeat record: %+v", rec)
+	}
+
+	// Intervals too short to tick a quarter of are fine, and none at all
+	// means no heartbeats
+	WithHeartbeat(time.Nanosecond, INFO, "fast")(&lockedRecordingLogWriter{}).Close()
+	for _, interval := range []time.Duration{0, -time.Second} {
+		if w := WithHeartbeat(interval, INFO, "never")(sink); w != LogWriter(sink) {
+			t.Errorf("Interval %s: got %T, want the writer undecorated", interval, w)
+		}
+	}
+}
+
+func TestQueueStats(t *testing.T) {
+	// No goroutine is draining this writer, so records stay queued
+	console := ConsoleLogWriterImp{
+		records:   make(chan *LogRecord, 4),
+		queue:     newQueueTracker(),
+		completed: make(chan int),
+	}
+	l := make(Logger)
+	l.AddFilter("console", FINEST, Chain(console, WithSampling(1, WARNING)))
+
+	l.Log(INFO, "source", "one")
+	time.Sleep(10 * time.Millisecond)
+	l.Log(INFO, "source", "two")
+
+	stats, ok := l.QueueStats()["console"]
+	if !ok {
+		t.Fatalf("Expected queue stats for the console writer")
+	}
+	if stats.Length != 2 || stats.Capacity != 4 {
+		t.Errorf("Expected 2 of 4 queued, got %d of %d", stats.Length, stats.Capacity)
+	}
+	if stats.OldestAge < 10*time.Millisecond {
+		t.Errorf("Oldest record age %s is too young", stats.OldestAge)
+	}
+
+	<-console.records
+	console.queue.pop()
+	if age := console.QueueStats().OldestAge; age >= stats.OldestAge {
+		t.Errorf("Oldest age should drop once the oldest record is written, got %s", age)
+	}
+}
+
+func TestQueueTrackerUnpush(t *testing.T) {
+	q := newQueueTracker()
+	start := time.Now()
+
+	// A record fails to queue after another goroutine has queued one behind it
+	dropped := q.push(start)
+	q.push(start.Add(time.Second))
+	q.unpush(dropped)
+	if age := q.oldestAge(start.Add(2 * time.Second)); age != time.Second {
+		t.Errorf("Oldest age after unpush: got %s, want the survivor's 1s", age)
+	}
+
+	// The record queued behind it is popped before it is forgotten, taking
+	// its entry; forgetting it leaves one entry per record still queued
+	q.pop()
+	dropped = q.push(start.Add(3 * time.Second))
+	q.push(start.Add(4 * time.Second))
+	q.push(start.Add(5 * time.Second))
+	q.pop()
+	q.unpush(dropped)
+	if age := q.oldestAge(start.Add(6 * time.Second)); age != time.Second {
+		t.Errorf("Oldest age after a late unpush: got %s, want the last record's 1s", age)
+	}
+	q.pop()
+	if age := q.oldestAge(start.Add(6 * time.Second)); age != 0 {
+		t.Errorf("Oldest age with nothing queued: got %s, want 0", age)
+	}
+}
+
+func TestPerLevelConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "_log4go")
+	if err != nil {
+		t.Fatalf("Couldn't create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	configfile := filepath.Join(dir, "perlevel.xml")
+
+	config := `<logging>
+  <filter enabled="true">
+    <tag>app</tag>
+    <type>perlevel</type>
+    <level>INFO</level>
+    <property name="filename">` + filepath.Join(dir, "app.log") + `</property>
+    <property name="levels">INFO, ERROR</property>
+    <property name="format">%M</property>
+  </filter>
+</logging>`
+	if err := ioutil.WriteFile(configfile, []byte(config), 0644); err != nil {
+		t.Fatalf("Could not write %s: %s", configfile, err)
+	}
+
+	log := make(Logger)
+	log.LoadConfiguration(configfile)
+	log.Info("info message")
+	log.Warn("dropped warning")
+	log.Error("error message")
+	log.Close()
+
+	for file, want := range map[string]string{"app.info.log": "info message\n", "app.error.log": "error message\n"} {
+		contents, err := ioutil.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			t.Errorf("read(%q): %s", file, err)
+		} else if string(contents) != want {
+			t.Errorf("%s: got %q, want %q", file, contents, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "app.warning.log")); !os.IsNotExist(err) {
+		t.Errorf("No file should be created for unlisted levels")
+	}
+}
+
+func TestLogReader(t *testing.T) {
+	created := time.Date(2010, 1, 2, 3, 4, 5, 0, time.Local)
+	rec := &LogRecord{
+		Level:   ERROR,
+		Created: created,
+		Source:  "source",
+		Message: "message",
+	}
+	withFields := &LogRecord{
+		Level:   WARNING,
+		Created: created,
+		Source:  "source",
+		Message: "with fields",
+		Fields:  Fields{"user": "bob"},
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(FormatLogRecord("header %D", rec))
+	buf.WriteString(FormatLogRecord(FORMAT_DEFAULT, rec))
+	buf.WriteString("  continued\n")
+	buf.WriteString(FormatLogRecord(FORMAT_ABBREV, rec))
+	for _, enc := range []Encoder{JSONEncoder{}, LogfmtEncoder{}, XMLEncoder{}} {
+		out, err := enc.Encode(withFields)
+		if err != nil {
+			t.Fatalf("%T: %s", enc, err)
+		}
+		buf.Write(out)
+	}
+	js, _ := json.Marshal(withFields)
+	buf.Write(append(js, '\n'))
+
+	r := NewLogReader(&buf)
+	var got []*LogRecord
+	var lines []int
+	for r.Next() {
+		got = append(got, r.Record())
+		lines = append(lines, r.Line())
+	}
+	if err := r.Err(); err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+	if len(got) != 6 {
+		t.Fatalf("Read %d records, want 6", len(got))
+	}
+	if r.Skipped() != 1 {
+		t.Errorf("Skipped %d lines, want 1", r.Skipped())
+	}
+	if want := []int{2, 4, 5, 6, 7, 12}; fmt.Sprint(lines) != fmt.Sprint(want) {
+		t.Errorf("Records start on lines %v, want %v", lines, want)
+	}
+
+	if g := got[0]; g.Level != ERROR || !g.Created.Equal(created) || g.Source != "source" || g.Message != "message\n  continued" {
+		t.Errorf("Text record read as %+v", g)
+	}
+	if g := got[1]; g.Level != ERROR || g.Message != "message" {
+		t.Errorf("Abbreviated record read as %+v", g)
+	}
+	for i, g := range got[2:] {
+		if g.Level != WARNING || !g.Created.Equal(created) || g.Source != "source" || g.Message != "with fields" {
+			t.Errorf("%d: Record read as %+v", i+2, g)
+		}
+		// XML doesn't carry fields
+		if i != 2 && fmt.Sprint(g.Fields["user"]) != "bob" {
+			t.Errorf("%d: Fields read as %v", i+2, g.Fields)
+		}
+	}
+}
+
+func TestLogReaderHeadFoot(t *testing.T) {
+	rec := &LogRecord{Level: INFO, Created: time.Date(2010, 1, 2, 3, 4, 5, 0, time.Local), Source: "source", Message: "message"}
+	head, foot := "== opened %D %T ==", "== closed %D %T{15:04} ==\n%V"
+
+	var buf bytes.Buffer
+	buf.WriteString(FormatLogRecord(head, rec))
+	buf.WriteString(FormatLogRecord(FORMAT_DEFAULT, rec))
+	buf.WriteString("  continued\n")
+	buf.WriteString(FormatLogRecord(foot, rec))
+
+	// Without the footer, it is taken as part of the message
+	r := NewLogReader(bytes.NewReader(buf.Bytes()))
+	if !r.Next() || !strings.HasSuffix(r.Record().Message, "==\n"+formatVersion) {
+		t.Errorf("Expected the footer in the message, got %+v", r.Record())
+	}
+
+	r = NewLogReader(bytes.NewReader(buf.Bytes())).SetHeadFoot(head, foot)
+	if !r.Next() || r.Record().Message != "message\n  continued" {
+		t.Fatalf("Read %+v, want the message and its continuation", r.Record())
+	}
+	if r.Next() || r.Err() != nil {
+		t.Errorf("Expected clean end of input, got %v", r.Err())
+	}
+	if !r.EndsWithFooter() {
+		t.Errorf("Footer not found at the end of the input")
+	}
+	// The header, and the footer's lines from the first recognized one
+	if r.Skipped() != 3 {
+		t.Errorf("Skipped %d lines, want 3", r.Skipped())
+	}
+}
+
+func TestBinaryLogReader(t *testing.T) {
+	recs := []*LogRecord{
+		{Level: ERROR, Created: time.Unix(1262401445, 123456789), Source: "source", Message: "message"},
+		{Level: FINEST, Created: time.Unix(1262401446, 0), Message: "with fields", Fields: Fields{"user": "bob", "n": 3}},
+	}
+
+	var buf bytes.Buffer
+	for _, rec := range recs {
+		out, err := ProtoEncoder{}.Encode(rec)
+		if err != nil {
+			t.Fatalf("Encode: %s", err)
+		}
+		buf.Write(out)
+	}
+	encoded := buf.Bytes()
+
+	r := NewBinaryLogReader(bytes.NewReader(encoded))
+	for i, want := range recs {
+		if !r.Next() {
+			t.Fatalf("%d: Next failed: %v", i, r.Err())
+		}
+		got := r.Record()
+		if got.Level != want.Level || !got.Created.Equal(want.Created) || got.Source != want.Source || got.Message != want.Message {
+			t.Errorf("%d: Read %+v, want %+v", i, got, want)
+		}
+		for k, v := range want.Fields {
+			if got.Fields[k] != fmt.Sprint(v) {
+				t.Errorf("%d: Field %q read as %v, want %v", i, k, got.Fields[k], v)
+			}
+		}
+	}
+	if r.Next() || r.Err() != nil {
+		t.Errorf("Expected clean end of input, got %v", r.Err())
+	}
+
+	// A truncated file is reported
+	r = NewBinaryLogReader(bytes.NewReader(encoded[:len(encoded)-3]))
+	for r.Next() {
+	}
+	if r.Err() == nil {
+		t.Errorf("Expected error reading truncated input")
+	}
+}
+
+func TestFileRelay(t *testing.T) {
+	defer func(interval time.Duration) { RelayPollInterval = interval }(RelayPollInterval)
+	RelayPollInterval = 10 * time.Millisecond
+
+	dir, err := ioutil.TempDir("", "relay")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "app.log")
+
+	appendLines := func(lines ...string) {
+		fd, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
+		if err != nil {
+			t.Fatalf("Open: %s", err)
+		}
+		defer fd.Close()
+		for _, line := range lines {
+			fmt.Fprintln(fd, line)
+		}
+	}
+	waitFor := func(sink *lockedRecordingLogWriter, n int) {
+		deadline := time.Now().Add(5 * time.Second)
+		for sink.count() < n && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if got := sink.count(); got != n {
+			t.Fatalf("Relayed %d records, want %d", got, n)
+		}
+	}
+
+	appendLines("[2010/01/02 03:04:05 UTC] [INFO] (src) before")
+
+	sink := &lockedRecordingLogWriter{}
+	relay := NewFileRelay(filename, sink, false)
+	defer relay.Close()
+
+	// Give the relay a chance to skip to the end of the file
+	time.Sleep(5 * RelayPollInterval)
+	appendLines("[2010/01/02 03:04:06 UTC] [EROR] (src) first", "  continued", `{"level":"WARN","time":"2010-01-02T03:04:07Z","message":"second"}`)
+	waitFor(sink, 2)
+
+	// Rotate the file, as a FileLogWriter would
+	if err := os.Rename(filename, filename+".1"); err != nil {
+		t.Fatalf("Rename: %s", err)
+	}
+	appendLines("time=2010-01-02T03:04:08Z level=INFO msg=third")
+	waitFor(sink, 3)
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	for i, want := range []string{"first\n  continued", "second", "third"} {
+		if got := sink.records[i].Message; got != want {
+			t.Errorf("%d: Relayed message %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestLogDirectoryMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix permissions only")
+	}
+	defer func(mode os.FileMode) { LogDirectoryMode = mode }(LogDirectoryMode)
+	LogDirectoryMode = 0700
+
+	dir, err := ioutil.TempDir("", "dirmode")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	w := NewFileLogWriter(filepath.Join(dir, "a", "b", "app.log"), false, false)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer w.Close()
+
+	for _, sub := range []string{"a", filepath.Join("a", "b")} {
+		info, err := os.Stat(filepath.Join(dir, sub))
+		if err != nil {
+			t.Fatalf("Stat: %s", err)
+		}
+		if mode := info.Mode().Perm(); mode != 0700 {
+			t.Errorf("Directory %q created with mode %o, want 700", sub, mode)
+		}
+	}
+}
+
+func TestStartupRotationUsesLastRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "startup")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "app.log")
+	yesterday := time.Now().Add(-24 * time.Hour)
+
+	for _, rotateStale := range []bool{true, false} {
+		// The file was last written to yesterday, but touched today
+		old := FormatLogRecord(FORMAT_DEFAULT, &LogRecord{Level: INFO, Created: yesterday, Message: "old"})
+		if err := ioutil.WriteFile(filename, []byte(old), 0660); err != nil {
+			t.Fatalf("WriteFile: %s", err)
+		}
+
+		w := NewFileLogWriter(filename, true, false)
+		if w == nil {
+			t.Fatalf("Invalid return: w should not be nil")
+		}
+		w.SetRotateOnStartup(false).SetRotateDateSuffix(true).SetRotateStaleOnStartup(rotateStale)
+		w.LogWrite(newLogRecord(INFO, "source", "new"))
+		w.Close()
+
+		rotated := filename + "." + yesterday.Format(SuffixDateFormat)
+		_, statErr := os.Stat(rotated)
+		if rotateStale && statErr != nil {
+			t.Errorf("Expected stale file to be rotated to %s: %s", rotated, statErr)
+		}
+		if !rotateStale && statErr == nil {
+			t.Errorf("Expected stale file not to be rotated")
+		}
+		os.Remove(rotated)
+	}
+}
+
+func TestDateSuffixFormat(t *testing.T) {
+	if got := archiveRegex(SuffixDateFormat); got != FILELOG_ARCHIVE_REGEX {
+		t.Errorf("archiveRegex(%q) = %q, want %q", SuffixDateFormat, got, FILELOG_ARCHIVE_REGEX)
+	}
+
+	when := time.Date(2024, 5, 1, 13, 0, 0, 0, time.Local)
+	for layout, want := range map[string]string{
+		"2006-01-02_15": "2024-05-01_13",
+		"20060102":      "20240501",
+		"2006-WW":       "2024-18",
+	} {
+		if got := formatDateSuffix(when, layout); got != want {
+			t.Errorf("formatDateSuffix(%q) = %q, want %q", layout, got, want)
+		}
+		matcher := regexp.MustCompile("^app\\.log" + archiveRegex(layout))
+		for _, name := range []string{"app.log." + want, "app.log." + want + ".0001.gz"} {
+			if !matcher.MatchString(name) {
+				t.Errorf("Archive pattern for %q doesn't match %q", layout, name)
+			}
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "suffix")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "app.log")
+
+	w := NewFileLogWriter(filename, true, false)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.SetRotateOnStartup(false).SetRotateDateSuffix(true).SetDateSuffixFormat("20060102").SetMaxArchiveFiles(0)
+	w.LogWrite(newLogRecord(INFO, "source", "message"))
+	w.Close()
+	if err := w.handleRotate(when); err != nil {
+		t.Fatalf("handleRotate: %s", err)
+	}
+	w.closeLogFile()
+	if _, err := os.Stat(filename + ".20240501"); err != nil {
+		t.Errorf("Expected rotated file: %s", err)
+	}
+
+	// Rotations by size are told apart by time rather than by counters
+	os.Remove(filename)
+	w = NewFileLogWriter(filename, true, false).SetRotateOnStartup(false).SetFormat("%M").
+		SetRotateDateSuffix(true).SetDateSuffixFormat(MillisecondSuffixDateFormat).SetRotateSize(10)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	for i := 0; i < 3; i++ {
+		w.LogWrite(newLogRecord(INFO, "source", "0123456789"))
+		time.Sleep(2 * time.Millisecond)
+	}
+	w.Close()
+	rotated, _ := filepath.Glob(filename + ".*-*-*_*-*-*.*")
+	if len(rotated) != 2 {
+		t.Fatalf("Expected 2 files with millisecond suffixes, got %v", rotated)
+	}
+	for _, name := range rotated {
+		if strings.Count(filepath.Base(name), ".") != 3 {
+			t.Errorf("Rotated file %q has a counter", name)
+		}
+		info, _ := os.Stat(name)
+		task := archiveTask{base: "app.log", dateSuffixFormat: MillisecondSuffixDateFormat, location: time.Local, matcher: w.logfileMatcher}
+		if written, dated := task.fileTime(filepath.Base(name), info); !dated || time.Since(written) > time.Minute {
+			t.Errorf("Rotated file %q read as written at %s", name, written)
+		}
+	}
+}
+
+func TestPreserveExtension(t *testing.T) {
+	dir, err := ioutil.TempDir("", "preserve")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "app.log")
+
+	w := NewFileLogWriter(filename, true, false)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.SetRotateOnStartup(false).SetPreserveExtension(true).SetMaxArchiveFiles(0)
+	w.LogWrite(newLogRecord(INFO, "source", "message"))
+	w.Close()
+
+	when := time.Date(2024, 5, 1, 0, 0, 0, 0, time.Local)
+	for _, dateSuffix := range []bool{false, true, true} {
+		w.SetRotateDateSuffix(dateSuffix)
+		if err := w.handleRotate(when); err != nil {
+			t.Fatalf("handleRotate: %s", err)
+		}
+	}
+	w.closeLogFile()
+
+	for _, name := range []string{"app.001.log", "app.2024-05-01.log", "app.2024-05-01.0001.log"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Expected rotated file: %s", err)
+		}
+	}
+	if !w.logfileMatcher.MatchString("app.2024-05-01.0001.log.gz") || w.logfileMatcher.MatchString("app.log.2024-05-01") {
+		t.Errorf("Archive pattern %q matches the wrong files", w.logfileMatcher)
+	}
+}
+
+func TestRotationReason(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reason")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "app.log")
+
+	var events []RotationEvent
+	w := NewFileLogWriter(filename, true, false)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.SetRotateOnStartup(false).SetRotateLines(2).SetMaxArchiveFiles(0).SetRotationMetadata(true)
+	w.OnRotate(func(ev RotationEvent) { events = append(events, ev) })
+	for i := 0; i < 3; i++ {
+		w.LogWrite(newLogRecord(INFO, "source", "message"))
+	}
+	w.Close()
+
+	if len(events) != 1 {
+		t.Fatalf("Got %d rotation events, want 1", len(events))
+	}
+	if ev := events[0]; ev.Reason != ROTATE_LINES || ev.Lines != 2 || ev.RotatedName != filename+".001" {
+		t.Errorf("Unexpected rotation event %+v", ev)
+	}
+
+	contents, err := ioutil.ReadFile(filename + ".001.meta")
+	if err != nil {
+		t.Fatalf("Expected metadata file: %s", err)
+	}
+	var meta RotationEvent
+	if err := json.Unmarshal(contents, &meta); err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+	if meta.Reason != ROTATE_LINES || meta.Bytes != events[0].Bytes {
+		t.Errorf("Metadata %+v doesn't match event %+v", meta, events[0])
+	}
+}
+
+func TestRotationAccounting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accounting")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "app.log")
+
+	// Each record is two lines; the limit allows two records per file
+	w := NewFileLogWriter(filename, true, false)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.SetRotateOnStartup(false).SetMaxArchiveFiles(0).SetFormat("%M").SetRotateLines(5)
+	for i := 0; i < 5; i++ {
+		w.LogWrite(newLogRecord(INFO, "source", fmt.Sprintf("message %d\ncontinued", i)))
+	}
+	w.Close()
+
+	for _, name := range []string{filename + ".001", filename + ".002", filename} {
+		contents, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatalf("ReadFile: %s", err)
+		}
+		if lines := bytes.Count(contents, []byte("\n")); lines > 5 {
+			t.Errorf("%s has %d lines, more than the limit of 5", name, lines)
+		}
+	}
+
+	// Sizes count the bytes actually written, including the header
+	w = NewFileLogWriter(filepath.Join(dir, "size.log"), true, false)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.SetRotateOnStartup(false).SetMaxArchiveFiles(0).SetFormat("%M").SetHeadFoot("header", "")
+	w.LogWrite(newLogRecord(INFO, "source", "héllo"))
+	w.Close()
+	if want := int64(len("header\n") + len("héllo\n")); w.maxsize_cursize != want {
+		t.Errorf("Counted %d bytes, want %d", w.maxsize_cursize, want)
+	}
+}
+
+func TestReplaceWriter(t *testing.T) {
+	log := make(Logger)
+	defer log.Close()
+
+	before := &lockedRecordingLogWriter{}
+	after := &lockedRecordingLogWriter{}
+	log.AddFilter("sink", INFO, before)
+
+	if err := log.ReplaceWriter("missing", after); err == nil {
+		t.Errorf("ReplaceWriter of a missing filter should fail")
+	}
+
+	const count = 1000
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < count; i++ {
+			log.Info("record %d", i)
+		}
+		close(done)
+	}()
+	if err := log.ReplaceWriter("sink", after); err != nil {
+		t.Fatalf("ReplaceWriter: %s", err)
+	}
+	<-done
+
+	if got := before.count() + after.count(); got != count {
+		t.Errorf("Records written: got %d, want %d", got, count)
+	}
+	if log["sink"].Level != INFO {
+		t.Errorf("Level changed to %s", log["sink"].Level)
+	}
+	log.Info("last")
+	if after.records[len(after.records)-1].Message != "last" {
+		t.Errorf("Records after the swap should go to the new writer")
+	}
+}
+
+func TestFilterManagement(t *testing.T) {
+	log := make(Logger)
+	defer log.Close()
+
+	a, b := &recordingLogWriter{}, &recordingLogWriter{}
+	if err := log.InsertFilter("b", INFO, b); err != nil {
+		t.Fatalf("InsertFilter: %s", err)
+	}
+	if err := log.InsertFilter("a", DEBUG, a); err != nil {
+		t.Fatalf("InsertFilter: %s", err)
+	}
+	if err := log.InsertFilter("a", INFO, b); err == nil {
+		t.Errorf("InsertFilter of a duplicate name should fail")
+	}
+	if got, want := strings.Join(log.ListFilters(), ","), "a,b"; got != want {
+		t.Errorf("ListFilters: got %q, want %q", got, want)
+	}
+
+	if err := log.ReplaceFilter("a", ERROR, a); err != nil {
+		t.Fatalf("ReplaceFilter: %s", err)
+	}
+	if err := log.ReplaceFilter("c", ERROR, a); err == nil {
+		t.Errorf("ReplaceFilter of a missing filter should fail")
+	}
+	log.Warn("warning")
+	if len(a.records) != 0 || len(b.records) != 1 {
+		t.Errorf("Records written: got %d and %d, want 0 and 1", len(a.records), len(b.records))
+	}
+
+	if err := log.RemoveFilter("b"); err != nil {
+		t.Fatalf("RemoveFilter: %s", err)
+	}
+	if err := log.RemoveFilter("b"); err == nil {
+		t.Errorf("RemoveFilter of a missing filter should fail")
+	}
+	if got, want := strings.Join(log.ListFilters(), ","), "a"; got != want {
+		t.Errorf("ListFilters: got %q, want %q", got, want)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	log := make(Logger)
+	defer log.Close()
+	sink := &recordingLogWriter{}
+	log.AddFilter("sink", WARNING, sink)
+
+	var seen []string
+	log.AddHook(func(rec *LogRecord) {
+		seen = append(seen, rec.Level.String()+" "+rec.Message)
+	})
+	log.AddProcessor(ProcessorFunc(func(rec *LogRecord) *LogRecord {
+		if rec.Message == "drop" {
+			return nil
+		}
+		return rec
+	}))
+
+	log.Info("filtered")
+	log.Warn("drop")
+	log.Error("kept")
+	if got, want := strings.Join(seen, ","), "EROR kept"; got != want {
+		t.Errorf("Hooks saw %q, want %q", got, want)
+	}
+
+	log.RemoveHooks()
+	log.Error("unhooked")
+	if len(seen) != 1 || len(sink.records) != 2 {
+		t.Errorf("After RemoveHooks: %d hooked and %d written, want 1 and 2", len(seen), len(sink.records))
+	}
+}
+
+func TestShutdownHooks(t *testing.T) {
+	defer func(timeout time.Duration) { ShutdownHookTimeout = timeout }(ShutdownHookTimeout)
+	ShutdownHookTimeout = 50 * time.Millisecond
+	defer func() { exit = os.Exit }()
+	var status = -1
+	exit = func(code int) { status = code }
+
+	var ran []string
+	AddShutdownHook("first", func() { ran = append(ran, "first") })
+	AddShutdownHook("panics", func() { panic("boom") })
+	AddShutdownHook("hangs", func() { select {} })
+	AddShutdownHook("last", func() { ran = append(ran, "last") })
+
+	log := make(Logger)
+	sink := &recordingLogWriter{}
+	log.AddFilter("sink", INFO, sink)
+	log.Fatal("fatal %d", 1)
+
+	if status != 1 {
+		t.Errorf("Exit status: got %d, want 1", status)
+	}
+	if got, want := strings.Join(ran, ","), "first,last"; got != want {
+		t.Errorf("Hooks ran: got %q, want %q", got, want)
+	}
+	if len(sink.records) != 1 || sink.records[0].Level != CRITICAL || sink.records[0].Message != "fatal 1" {
+		t.Errorf("Fatal should log one critical record, got %v", sink.records)
+	}
+	if len(log) != 0 {
+		t.Errorf("Fatal should close the logger")
+	}
+
+	// Hooks only run once
+	ran = nil
+	RunShutdownHooks()
+	if len(ran) != 0 {
+		t.Errorf("Hooks ran again: %v", ran)
+	}
+}
+
+func TestFileLogWriterReconfigure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reconfigure")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "app.log")
+
+	w := NewFileLogWriter(fname, true, false).SetFormat("first %M")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+
+	// Change settings while records are being written
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			w.LogWrite(newLogRecord(INFO, "source", "message"))
+		}
+		close(done)
+	}()
+	for i := 0; i < 10; i++ {
+		w.SetRotateSize(1 << 20).SetRotateLines(1000).SetRotateDaily(true).SetMaxArchiveFiles(5)
+	}
+	<-done
+
+	w.SetFormat("second %M")
+	w.LogWrite(newLogRecord(INFO, "source", "last"))
+	w.Close()
+
+	// Settings can still be changed once closed
+	w.SetRotateSize(0)
+
+	contents, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	if len(lines) != 101 || lines[0] != "first message" || lines[100] != "second last" {
+		t.Errorf("Unexpected contents: %d lines, first %q, last %q", len(lines), lines[0], lines[len(lines)-1])
+	}
+}
+
+func TestCompressRotated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compress")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "app.log")
+
+	w := NewFileLogWriter(fname, true, false).SetMaxArchiveFiles(0).SetCompressRotated(true)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "rotated"))
+	w.Rotate()
+	w.LogWrite(newLogRecord(INFO, "source", "current"))
+	w.Close()
+
+	if _, err := os.Stat(fname + ".001"); !os.IsNotExist(err) {
+		t.Errorf("Uncompressed file should have been removed: %v", err)
+	}
+	fd, err := os.Open(fname + ".001.gz")
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	defer fd.Close()
+	zr, err := gzip.NewReader(fd)
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %s", err)
+	}
+	contents, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("ReadAll: %s", err)
+	}
+	if !strings.Contains(string(contents), "rotated") || strings.Contains(string(contents), "current") {
+		t.Errorf("Unexpected compressed contents: %q", contents)
+	}
+}
+
+// Compresses by reversing each write, counting how often it is written to
+type reversingCompressor struct {
+	writes *int
+}
+
+func (c reversingCompressor) Extension() string { return "rev" }
+
+func (c reversingCompressor) NewWriter(dst io.Writer, name string) (io.WriteCloser, error) {
+	return reversingWriter{dst, c.writes}, nil
+}
+
+type reversingWriter struct {
+	dst    io.Writer
+	writes *int
+}
+
+func (r reversingWriter) Write(p []byte) (int, error) {
+	*r.writes++
+	rev := make([]byte, len(p))
+	for i := range p {
+		rev[len(p)-1-i] = p[i]
+	}
+	return r.dst.Write(rev)
+}
+
+func (r reversingWriter) Close() error { return nil }
+
+func TestRotationCompressor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compressor")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "app.log")
+
+	writes := 0
+	w := NewFileLogWriter(fname, true, false).SetFormat("%M").SetRotateDateSuffix(true).
+		SetRotationCompressor(reversingCompressor{&writes})
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	if !w.logfileMatcher.MatchString("app.log.2024-05-01.rev") {
+		t.Errorf("Archive pattern %q should match compressed files", w.logfileMatcher)
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "abc"))
+	w.Rotate()
+	w.Close()
+
+	rotated, _ := filepath.Glob(fname + ".*.rev")
+	if len(rotated) != 1 {
+		t.Fatalf("Compressed files: got %v, want one", rotated)
+	}
+	contents, err := ioutil.ReadFile(rotated[0])
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+	if string(contents) != "\ncba" || writes == 0 {
+		t.Errorf("Compressed contents: got %q after %d writes", contents, writes)
+	}
+
+	// The built-in codecs round trip
+	for _, c := range []Compressor{GzipCompressor{}, ZipCompressor{}, SnappyCompressor{}} {
+		var buf bytes.Buffer
+		zw, err := c.NewWriter(&buf, "app.log")
+		if err != nil {
+			t.Fatalf("%s: NewWriter: %s", c.Extension(), err)
+		}
+		io.WriteString(zw, "hello")
+		if err := zw.Close(); err != nil || buf.Len() == 0 {
+			t.Errorf("%s: Close: %v, %d bytes", c.Extension(), err, buf.Len())
+		}
+	}
+}
+
+func TestMaxBackups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backups")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "app.log")
+
+	// Leftovers from a different suffix scheme count too
+	old := time.Now().Add(-time.Hour)
+	for _, name := range []string{"app.log.2010-01-01", "app.log.2010-01-02.gz"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0660); err != nil {
+			t.Fatalf("WriteFile: %s", err)
+		}
+		os.Chtimes(filepath.Join(dir, name), old, old)
+	}
+
+	w := NewFileLogWriter(fname, true, false).SetRotateOnStartup(false).SetFormat("%M").SetMaxBackups(3)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	for i := 0; i < 5; i++ {
+		w.LogWrite(newLogRecord(INFO, "source", fmt.Sprintf("msg %d", i)))
+		waitForWrites(w)
+		w.Rotate()
+	}
+	w.Close()
+
+	// Freed numbers are reused, so check which records survived
+	rotated, _ := filepath.Glob(fname + ".*")
+	var kept []string
+	for _, name := range rotated {
+		contents, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatalf("ReadFile: %s", err)
+		}
+		kept = append(kept, strings.TrimSpace(string(contents)))
+	}
+	sort.Strings(kept)
+	if got, want := strings.Join(kept, ","), "msg 2,msg 3,msg 4"; got != want {
+		t.Errorf("Rotated files hold %q, want %q", got, want)
+	}
+}
+
+func TestMaxArchiveFilesDatedOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archivefiles")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "app.log")
+
+	// Dated files go by their suffixes, whatever their mtimes say
+	now := time.Now()
+	files := map[string]time.Time{
+		"app.log.2010-01-01": now,
+		"app.log.2010-01-02": now.Add(-2 * time.Hour),
+		"app.log.2010-01-03": now.Add(-time.Hour),
+		"app.log.001":        now.Add(-3 * time.Hour),
+		"app.log.002":        now.Add(-3 * time.Hour),
+	}
+	for name, mtime := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, nil, 0660); err != nil {
+			t.Fatalf("WriteFile: %s", err)
+		}
+		os.Chtimes(path, mtime, mtime)
+	}
+
+	// Without SetMaxBackups, integer suffixed files are left alone
+	w := NewFileLogWriter(fname, true, false).SetRotateOnStartup(false).SetRotateDateSuffix(true).SetMaxArchiveFiles(2)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "message"))
+	w.Rotate()
+	w.Close()
+
+	rotated, _ := filepath.Glob(fname + ".*")
+	var names []string
+	for _, name := range rotated {
+		names = append(names, filepath.Base(name))
+	}
+	today := "app.log." + now.Format(SuffixDateFormat)
+	if got, want := strings.Join(names, ","), "app.log.001,app.log.002,app.log.2010-01-03,"+today; got != want {
+		t.Errorf("Kept %s, want %s", got, want)
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maxage")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "app.log")
+
+	now := time.Now()
+	recent := now.AddDate(0, 0, -2).Format(SuffixDateFormat)
+	old := now.AddDate(0, 0, -40).Format(SuffixDateFormat)
+	files := map[string]time.Time{
+		"app.log." + old + ".gz":   now, // Old by its suffix, whatever its mtime
+		"app.log." + old + ".0001": now,
+		"app.log." + recent:        now.AddDate(0, 0, -40), // Recent by its suffix
+		"app.log.001":              now.AddDate(0, 0, -40), // Old by its mtime
+		"app.log.002":              now,
+		"unrelated.log." + old:     now.AddDate(0, 0, -40),
+	}
+	for name, mtime := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, nil, 0660); err != nil {
+			t.Fatalf("WriteFile: %s", err)
+		}
+		os.Chtimes(path, mtime, mtime)
+	}
+
+	w := NewFileLogWriter(fname, true, false).SetRotateOnStartup(false).SetRotateDateSuffix(true).
+		SetMaxBackups(0).SetMaxAge(30 * 24 * time.Hour)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "msg"))
+	w.Rotate()
+	w.Close()
+
+	var left []string
+	infos, _ := ioutil.ReadDir(dir)
+	for _, info := range infos {
+		left = append(left, info.Name())
+	}
+	want := []string{"app.log", "app.log." + now.Format(SuffixDateFormat), "app.log." + recent, "app.log.002", "unrelated.log." + old}
+	sort.Strings(want)
+	if got := strings.Join(left, ","); got != strings.Join(want, ",") {
+		t.Errorf("Files left: got %q, want %q", got, strings.Join(want, ","))
+	}
+}
+
+func TestMaxTotalSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "totalsize")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "app.log")
+
+	w := NewFileLogWriter(fname, true, false).SetRotateOnStartup(false).SetFormat("%M").
+		SetMaxBackups(0).SetMaxTotalSize(25)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	for i := 0; i < 5; i++ {
+		// Each rotated file holds 10 bytes
+		w.LogWrite(newLogRecord(INFO, "source", fmt.Sprintf("message %d", i)))
+		waitForWrites(w)
+		w.Rotate()
+	}
+	w.Close()
+
+	rotated, _ := filepath.Glob(fname + ".*")
+	var total int64
+	var kept []string
+	for _, name := range rotated {
+		contents, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatalf("ReadFile: %s", err)
+		}
+		total += int64(len(contents))
+		kept = append(kept, strings.TrimSpace(string(contents)))
+	}
+	sort.Strings(kept)
+	if got, want := strings.Join(kept, ","), "message 3,message 4"; got != want || total > 25 {
+		t.Errorf("Rotated files hold %q in %d bytes, want %q", got, total, want)
+	}
+}
+
+func TestArchiveDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archivedir")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "app.log")
+
+	w := NewFileLogWriter(fname, true, false).SetRotateOnStartup(false).SetFormat("%M").
+		SetArchiveDirectory("archive/2006-01-02").SetMaxBackups(2)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	if got, want := w.archiveDirRoot(), filepath.Join(dir, "archive"); got != want {
+		t.Errorf("Archive root: got %q, want %q", got, want)
+	}
+
+	// Files from an earlier day should be pruned along with their directory
+	old := filepath.Join(dir, "archive", "2001-02-03", "app.log.001")
+	if err := os.MkdirAll(filepath.Dir(old), 0755); err != nil {
+		t.Fatalf("MkdirAll: %s", err)
+	}
+	ioutil.WriteFile(old, []byte("old\n"), 0644)
+	os.Chtimes(old, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour))
+
+	for i := 0; i < 2; i++ {
+		w.LogWrite(newLogRecord(INFO, "source", fmt.Sprintf("message %d", i)))
+		waitForWrites(w)
+		w.Rotate()
+	}
+	w.Close()
+
+	today := filepath.Join(dir, "archive", time.Now().Format("2006-01-02"))
+	for i, name := range []string{"app.log.001", "app.log.002"} {
+		contents, err := ioutil.ReadFile(filepath.Join(today, name))
+		if err != nil {
+			t.Fatalf("ReadFile: %s", err)
+		}
+		if got, want := string(contents), fmt.Sprintf("message %d\n", i); got != want {
+			t.Errorf("%s holds %q, want %q", name, got, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Dir(old)); !os.IsNotExist(err) {
+		t.Errorf("Old archive directory should have been removed: %v", err)
+	}
+	if rotated, _ := filepath.Glob(fname + ".*"); len(rotated) != 0 {
+		t.Errorf("Rotated files left next to the log: %v", rotated)
+	}
+}
+
+func TestRotationNameTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nametemplate")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "app.log")
+	host, _ := os.Hostname()
+
+	w := NewFileLogWriter(fname, true, false).SetRotateOnStartup(false).SetFormat("%M").
+		SetRotationNameTemplate("%B-%H-%P-%D.%N%E").SetMaxBackups(2)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+
+	// Files from earlier processes are aged off too
+	old := filepath.Join(dir, fmt.Sprintf("app-%s-1-2001-02-03.001.log", host))
+	ioutil.WriteFile(old, []byte("old\n"), 0644)
+
+	for i := 0; i < 2; i++ {
+		w.LogWrite(newLogRecord(INFO, "source", fmt.Sprintf("message %d", i)))
+		waitForWrites(w)
+		w.Rotate()
+	}
+	w.Close()
+
+	prefix := fmt.Sprintf("app-%s-%d-%s", host, os.Getpid(), time.Now().Format(SuffixDateFormat))
+	for i, name := range []string{prefix + ".001.log", prefix + ".002.log"} {
+		contents, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("ReadFile: %s", err)
+		}
+		if got, want := string(contents), fmt.Sprintf("message %d\n", i); got != want {
+			t.Errorf("%s holds %q, want %q", name, got, want)
+		}
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("Old file should have been aged off: %v", err)
+	}
+	if _, err := os.Stat(fname); err != nil {
+		t.Errorf("Log file should have been kept: %s", err)
+	}
+
+	// Templates which could reuse the log file's name are refused
+	buf := new(bytes.Buffer)
+	w = NewFileLogWriter(fname, true, false)
+	w.errorWriter = buf
+	w.SetRotationNameTemplate("%F").Close()
+	if w.nameTemplate != "" || !strings.Contains(buf.String(), "must include") {
+		t.Errorf("Template %q accepted: %q", w.nameTemplate, buf.String())
+	}
+}
+
+func TestSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "symlink")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "logs", "app.log")
+	link := filepath.Join(dir, "current.log")
+
+	// A stale link is replaced
+	os.Symlink("elsewhere.log", link)
+
+	w := NewFileLogWriter(fname, true, false).SetRotateOnStartup(false).SetFormat("%M").SetSymlink(link)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "before"))
+	w.Rotate()
+	w.LogWrite(newLogRecord(INFO, "source", "after"))
+	w.Close()
+
+	if target, err := os.Readlink(link); err != nil || target != filepath.Join("logs", "app.log") {
+		t.Errorf("Symlink points at %q (%v), want %q", target, err, filepath.Join("logs", "app.log"))
+	}
+	if contents, err := ioutil.ReadFile(link); err != nil || string(contents) != "after\n" {
+		t.Errorf("Read %q through symlink (%v), want %q", contents, err, "after\n")
+	}
+}
+
+func TestUseUTC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "utc")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "app.log")
+
+	w := NewFileLogWriter(fname, true, false).SetRotateOnStartup(false).SetFormat("%M").
+		SetRotateDateSuffix(true).SetUseUTC(true)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer w.Close()
+
+	// 23:00 and 00:30 UTC fall on the same day five hours east
+	east := time.FixedZone("east", 5*60*60)
+	before := time.Date(2010, 1, 3, 4, 0, 0, 0, east)
+	after := time.Date(2010, 1, 3, 5, 30, 0, 0, east)
+	if w.sameInterval(before, after) {
+		t.Errorf("%s and %s should be on different days in UTC", before, after)
+	}
+
+	w.LogWrite(newLogRecord(INFO, "source", "message"))
+	waitForWrites(w)
+	w.configure(func() {
+		err = w.handleRotateFor(ROTATE_MANUAL, before)
+	})
+	if err != nil {
+		t.Fatalf("handleRotateFor: %s", err)
+	}
+	if _, err := os.Stat(fname + ".2010-01-02"); err != nil {
+		t.Errorf("File should be named for the day in UTC: %s", err)
+	}
+}
+
+func TestDetectExternalRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "external")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "app.log")
+
+	w := NewFileLogWriter(fname, false, false).SetFormat("%M").SetDetectExternalRotation(time.Nanosecond)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "before move"))
+	waitForWrites(w)
+	if err := os.Rename(fname, fname+".1"); err != nil {
+		t.Fatalf("Rename: %s", err)
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "after move"))
+	waitForWrites(w)
+	if err := os.Truncate(fname, 0); err != nil {
+		t.Fatalf("Truncate: %s", err)
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "after truncate"))
+	waitForWrites(w)
+	var size int64
+	w.configure(func() {
+		size = w.maxsize_cursize
+	})
+	w.Close()
+
+	for name, want := range map[string]string{
+		fname + ".1": "before move\n",
+		fname:        "after truncate\n",
+	} {
+		if contents, err := ioutil.ReadFile(name); err != nil || string(contents) != want {
+			t.Errorf("%s holds %q (%v), want %q", name, contents, err, want)
+		}
+	}
+	if size != int64(len("after truncate\n")) {
+		t.Errorf("Size after truncation: got %d, want %d", size, len("after truncate\n"))
+	}
+}
+
+func TestRotationHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotationhook")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "app.log")
+
+	type call struct{ oldPath, newPath, contents string }
+	calls := make(chan call, 2)
+	w := NewFileLogWriter(fname, true, true).SetRotateOnStartup(false).SetFormat("%M").
+		SetRotationHook(func(oldPath, newPath string) error {
+			// The rotated file isn't compressed until the hook is done
+			contents, err := ioutil.ReadFile(newPath)
+			calls <- call{oldPath, newPath, string(contents)}
+			if err != nil {
+				return err
+			}
+			return errors.New("upload failed")
+		})
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	buf := new(bytes.Buffer)
+	w.errorWriter = buf
+	w.LogWrite(newLogRecord(INFO, "source", "message"))
+	w.Rotate()
+	w.Close()
+
+	select {
+	case c := <-calls:
+		if want := (call{fname, fname + ".001", "message\n"}); c != want {
+			t.Errorf("Hook called with %+v, want %+v", c, want)
+		}
+	default:
+		t.Fatalf("Hook wasn't called")
+	}
+	if _, err := os.Stat(fname + ".001.gz"); err != nil {
+		t.Errorf("Rotated file should be compressed after the hook: %s", err)
+	}
+	if !strings.Contains(buf.String(), "Rotation failed: upload failed") {
+		t.Errorf("Hook failure not reported: %q", buf.String())
+	}
+}
+
+func TestArchiveUploader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uploader")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "app.log")
+
+	type upload struct{ method, path, query, auth, body string }
+	uploads := make(chan upload, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		uploads <- upload{req.Method, req.URL.Path, req.URL.RawQuery, req.Header.Get("Authorization"), string(body)}
+	}))
+	defer server.Close()
+
+	for _, test := range []struct {
+		uploader Uploader
+		want     upload
+	}{
+		{
+			&GCSUploader{Bucket: "logs", Endpoint: server.URL, Token: func() (string, error) { return "token", nil }},
+			upload{"POST", "/upload/storage/v1/b/logs/o", "uploadType=media&name=web1%2Fapp.log.001", "Bearer token", "message\n"},
+		},
+		{
+			&S3Uploader{Bucket: "logs", Region: "us-east-1", AccessKeyID: "AKID", SecretAccessKey: "secret", Endpoint: server.URL},
+			upload{"PUT", "/logs/web1/app.log.001", "", "AWS4-HMAC-SHA256 Credential=AKID/", "message\n"},
+		},
+	} {
+		w := NewFileLogWriter(fname, true, true).SetRotateOnStartup(false).SetFormat("%M")
+		if w == nil {
+			t.Fatalf("Invalid return: w should not be nil")
+		}
+		NewArchiveUploader(test.uploader).SetPrefix("web1/").Watch(w)
+		w.LogWrite(newLogRecord(INFO, "source", "message"))
+		w.Rotate()
+		w.Close()
+
+		select {
+		case got := <-uploads:
+			if strings.HasPrefix(got.auth, test.want.auth) {
+				got.auth = test.want.auth
+			}
+			if got != test.want {
+				t.Errorf("Uploaded %+v, want %+v", got, test.want)
+			}
+		default:
+			t.Errorf("%T: Nothing uploaded", test.uploader)
+		}
+		if rotated, _ := filepath.Glob(fname + ".*"); len(rotated) != 0 {
+			t.Errorf("%T: Uploaded files left behind: %v", test.uploader, rotated)
+		}
+	}
+}
+
+func TestRotateSizeString(t *testing.T) {
+	for str, want := range map[string]int64{
+		"1024":  1024,
+		"512k":  512 << 10,
+		"100MB": 100 << 20,
+		"1.5G":  3 << 29,
+		"8 GiB": 8 << 30,
+	} {
+		if got, err := parseSize(str); err != nil || got != want {
+			t.Errorf("parseSize(%q) = %d, %v; want %d", str, got, err, want)
+		}
+	}
+	for _, str := range []string{"", "MB", "10 parsecs"} {
+		if _, err := parseSize(str); err == nil {
+			t.Errorf("parseSize(%q) should fail", str)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "sizestring")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	w := NewFileLogWriter(filepath.Join(dir, "app.log"), true, false).SetRotateSizeString("4GB")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.Close()
+	if w.maxsize != 4<<30 {
+		t.Errorf("Rotate size: got %d, want %d", w.maxsize, int64(4<<30))
+	}
+}
+
+func TestLowSpacePolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lowspace")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "app.log")
+	emergency := filepath.Join(dir, "emergency", "app.log")
+
+	// Each rotated file takes up 100 bytes of the 1000 free
+	defer func(f func(string) (uint64, error)) { freeSpace = f }(freeSpace)
+	var free uint64
+	freeSpace = func(string) (uint64, error) {
+		if free > 0 {
+			return free, nil
+		}
+		rotated, _ := filepath.Glob(fname + ".*")
+		return 1000 - 100*uint64(len(rotated)), nil
+	}
+
+	for _, policy := range []LowSpacePolicy{LowSpaceDrop, LowSpaceRedirect, LowSpacePrune} {
+		os.RemoveAll(dir)
+		free = 10
+		if policy == LowSpacePrune {
+			free = 0
+			os.MkdirAll(dir, 0755)
+			for _, name := range []string{".001", ".002", ".003"} {
+				ioutil.WriteFile(fname+name, []byte("old\n"), 0644)
+			}
+		}
+
+		w := NewFileLogWriter(fname, true, false).SetRotateOnStartup(false).SetFormat("%M").
+			SetLowSpacePolicy(policy, emergency).SetMinFreeSpace(850)
+		if w == nil {
+			t.Fatalf("Invalid return: w should not be nil")
+		}
+		buf := new(bytes.Buffer)
+		w.errorWriter = buf
+		w.LogWrite(newLogRecord(INFO, "source", "before"))
+		waitForWrites(w)
+		w.configure(w.checkFreeSpace)
+		w.LogWrite(newLogRecord(INFO, "source", "during"))
+		waitForWrites(w)
+		free = 1000
+		w.configure(w.checkFreeSpace)
+		w.LogWrite(newLogRecord(INFO, "source", "after"))
+		w.Close()
+
+		want := map[string]string{fname: "before\nafter\n"}
+		switch policy {
+		case LowSpaceDrop:
+			if !strings.Contains(buf.String(), "Dropped 1 log message(s)") {
+				t.Errorf("%s: Dropped record not reported: %q", policy, buf.String())
+			}
+		case LowSpaceRedirect:
+			want[emergency] = "during\n"
+		case LowSpacePrune:
+			// The oldest files are removed until there is room
+			want = map[string]string{fname: "during\nafter\n", fname + ".004": "before\n"}
+		}
+		files, _ := filepath.Glob(filepath.Join(dir, "*"))
+		emergencyFiles, _ := filepath.Glob(filepath.Join(dir, "emergency", "*"))
+		if got := len(files) + len(emergencyFiles); policy != LowSpaceRedirect && got != len(want) {
+			t.Errorf("%s: Left %v, want %d files", policy, files, len(want))
+		}
+		for name, contents := range want {
+			if got, err := ioutil.ReadFile(name); err != nil || string(got) != contents {
+				t.Errorf("%s: %s holds %q (%v), want %q", policy, name, got, err, contents)
+			}
+		}
+	}
+}
+
+func TestRotationSequence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sequence")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "app.log")
+
+	for _, recycle := range []bool{false, true} {
+		os.RemoveAll(dir)
+		os.MkdirAll(dir, 0755)
+		// .02 is the oldest, so it is the one recycled
+		for i, name := range []string{".01", ".02", ".03"} {
+			ioutil.WriteFile(fname+name, []byte("old"+name+"\n"), 0644)
+			modTime := time.Now().Add(-time.Hour)
+			if i == 1 {
+				modTime = modTime.Add(-time.Hour)
+			}
+			os.Chtimes(fname+name, modTime, modTime)
+		}
+		ioutil.WriteFile(fname+".001", []byte("other width\n"), 0644)
+
+		w := NewFileLogWriter(fname, true, false).SetRotateOnStartup(false).SetFormat("%M").
+			SetRotationSequence(2, 3).SetRecycleRotationSequence(recycle)
+		if w == nil {
+			t.Fatalf("Invalid return: w should not be nil")
+		}
+		buf := new(bytes.Buffer)
+		w.errorWriter = buf
+		w.LogWrite(newLogRecord(INFO, "source", "new"))
+		w.Rotate()
+		w.Close()
+
+		want := map[string]string{
+			fname + ".01":  "old.01\n",
+			fname + ".02":  "old.02\n",
+			fname + ".03":  "old.03\n",
+			fname + ".001": "other width\n",
+			fname:          "new\n",
+		}
+		if recycle {
+			want[fname+".02"] = "new\n"
+			delete(want, fname)
+		} else if !strings.Contains(buf.String(), "Cannot find free log number") {
+			t.Errorf("Running out of numbers not reported: %q", buf.String())
+		}
+		for name, contents := range want {
+			if got, err := ioutil.ReadFile(name); err != nil || string(got) != contents {
+				t.Errorf("recycle=%v: %s holds %q (%v), want %q", recycle, name, got, err, contents)
+			}
+		}
+	}
+}
+
+func TestRotationStateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statefile")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "app.log")
+	state := filepath.Join(dir, "app.state")
+
+	// Without a state file, numbering carries on from the newest file rather
+	// than filling the gap at .001
+	ioutil.WriteFile(fname+".002", []byte("old\n"), 0644)
+	w := NewFileLogWriter(fname, true, false).SetRotateOnStartup(false).SetFormat("%M")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "first"))
+	w.Rotate()
+	w.Close()
+	if contents, err := ioutil.ReadFile(fname + ".003"); err != nil || string(contents) != "first\n" {
+		t.Errorf("%s.003 holds %q (%v), want %q", fname, contents, err, "first\n")
+	}
+
+	// With one, it carries on even once the rotated files are gone
+	os.Remove(fname + ".002")
+	os.Remove(fname + ".003")
+	ioutil.WriteFile(state, []byte("41\n"), 0644)
+	w = NewFileLogWriter(fname, true, false).SetRotateOnStartup(false).SetFormat("%M").SetRotationStateFile(state)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "second"))
+	w.Rotate()
+	w.Close()
+	if contents, err := ioutil.ReadFile(fname + ".042"); err != nil || string(contents) != "second\n" {
+		t.Errorf("%s.042 holds %q (%v), want %q", fname, contents, err, "second\n")
+	}
+	if contents, err := ioutil.ReadFile(state); err != nil || string(contents) != "42\n" {
+		t.Errorf("State file holds %q (%v), want %q", contents, err, "42\n")
+	}
+}
+
+func TestBufferedWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buffered")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "app.log")
+
+	w := NewFileLogWriter(fname, false, false).SetFormat("%M").SetBufferSize(4096).SetFlushInterval(0)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer w.Close()
+	log := Logger{"file": &Filter{INFO, w}}
+
+	w.LogWrite(newLogRecord(INFO, "source", "first"))
+	waitForWrites(w)
+	if contents, _ := ioutil.ReadFile(fname); len(contents) != 0 {
+		t.Errorf("Buffered record written early: %q", contents)
+	}
+	log.Flush()
+	if contents, _ := ioutil.ReadFile(fname); string(contents) != "first\n" {
+		t.Errorf("After Flush the file holds %q, want %q", contents, "first\n")
+	}
+
+	// Buffered records are written out every flush interval
+	w.SetFlushInterval(10 * time.Millisecond)
+	w.LogWrite(newLogRecord(INFO, "source", "second"))
+	contents := []byte{}
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		if contents, _ = ioutil.ReadFile(fname); string(contents) == "first\nsecond\n" {
+			break
+		}
+	}
+	if string(contents) != "first\nsecond\n" {
+		t.Errorf("After the flush interval the file holds %q, want %q", contents, "first\nsecond\n")
+	}
+
+	// Errors are written out straight away
+	w.SetFlushInterval(0).SetFlushOnLevel(ERROR)
+	w.LogWrite(newLogRecord(INFO, "source", "third"))
+	w.LogWrite(newLogRecord(ERROR, "source", "fourth"))
+	waitForWrites(w)
+	if contents, _ := ioutil.ReadFile(fname); string(contents) != "first\nsecond\nthird\nfourth\n" {
+		t.Errorf("After an error the file holds %q, want %q", contents, "first\nsecond\nthird\nfourth\n")
+	}
+}
+
+func TestSyncPolicy(t *testing.T) {
+	policies, err := parseSyncPolicies("100, 5s, error")
+	if err != nil {
+		t.Fatalf("parseSyncPolicies: %s", err)
+	}
+	want := []SyncPolicy{SyncEveryRecords(100), SyncEveryInterval(5 * time.Second), SyncAtLevel(ERROR)}
+	if !reflect.DeepEqual(policies, want) {
+		t.Errorf("parseSyncPolicies: got %+v, want %+v", policies, want)
+	}
+	if _, err := parseSyncPolicies("sometimes"); err == nil {
+		t.Errorf("parseSyncPolicies should reject unknown policies")
+	}
+
+	dir, err := ioutil.TempDir("", "sync")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	w := NewFileLogWriter(filepath.Join(dir, "app.log"), false, false).SetFormat("%M").
+		SetSyncPolicy(SyncEveryRecords(3), SyncAtLevel(ERROR))
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer w.Close()
+	unsynced := func() (n int) {
+		waitForWrites(w)
+		w.configure(func() { n = w.unsynced })
+		return n
+	}
+
+	w.LogWrite(newLogRecord(INFO, "source", "one"))
+	w.LogWrite(newLogRecord(INFO, "source", "two"))
+	if n := unsynced(); n != 2 {
+		t.Errorf("Unsynced after 2 records: got %d, want 2", n)
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "three"))
+	if n := unsynced(); n != 0 {
+		t.Errorf("Unsynced after 3 records: got %d, want 0", n)
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "four"))
+	w.LogWrite(newLogRecord(ERROR, "source", "five"))
+	if n := unsynced(); n != 0 {
+		t.Errorf("Unsynced after an error: got %d, want 0", n)
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "six"))
+	w.Sync()
+	if n := unsynced(); n != 0 {
+		t.Errorf("Unsynced after Sync: got %d, want 0", n)
+	}
+}
+
+func TestOverflowPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overflow")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "app.log")
+
+	for _, policy := range []OverflowPolicy{OverflowDropNewest, OverflowDropOldest} {
+		os.Remove(fname)
+		w := NewFileLogWriterBuffered(fname, false, false, 8).SetFormat("%M").SetOverflowPolicy(policy)
+		if w == nil {
+			t.Fatalf("Invalid return: w should not be nil")
+		}
+		if stats := w.QueueStats(); stats.Capacity != 8 {
+			t.Errorf("Queue capacity: got %d, want 8", stats.Capacity)
+		}
+
+		// Stall the writer, then log more than the queue holds
+		stalled, release := make(chan bool), make(chan bool)
+		go w.configure(func() {
+			close(stalled)
+			<-release
+		})
+		<-stalled
+		for i := 0; i < 8+5; i++ {
+			w.LogWrite(newLogRecord(INFO, "source", fmt.Sprint(i)))
+		}
+		close(release)
+		w.Close()
+
+		if got := w.DroppedRecords(); got != 5 {
+			t.Errorf("%s: Dropped %d records, want 5", policy, got)
+		}
+		contents, _ := ioutil.ReadFile(fname)
+		lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+		first := "0"
+		if policy == OverflowDropOldest {
+			first = "5"
+		}
+		if len(lines) != 8 || lines[0] != first {
+			t.Errorf("%s: Wrote %d records starting with %q, want 8 starting with %q", policy, len(lines), lines[0], first)
+		}
+	}
+}
+
+func TestFileLogStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stats")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	w := NewFileLogWriter(filepath.Join(dir, "app.log"), true, false).SetRotateOnStartup(false).SetFormat("%M")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "one"))
+	w.LogWrite(newLogRecord(INFO, "source", "two"))
+	w.Rotate()
+	w.LogWrite(newLogRecord(INFO, "source", "three"))
+	w.Close()
+
+	want := FileLogStats{RecordsWritten: 3, BytesWritten: 14, Rotations: 1}
+	if got := w.Stats(); got != want {
+		t.Errorf("Stats: got %+v, want %+v", got, want)
+	}
+}
+
+// Counts the writes passed on to a writer
+type writeCounter struct {
+	io.Writer
+	writes int
+}
+
+func (c *writeCounter) Write(p []byte) (int, error) {
+	c.writes++
+	return c.Writer.Write(p)
+}
+
+func TestBatchedWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "batch")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "app.log")
+
+	w := NewFileLogWriter(fname, true, false).SetRotateOnStartup(false).SetFormat("%M").SetRotateLines(4)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+
+	// A buffer smaller than the batch passes it straight through, so the
+	// counter sees each write to the file
+	counter := &writeCounter{}
+	w.configure(func() {
+		counter.Writer = w.file
+		w.buffer = bufio.NewWriterSize(counter, 16)
+	})
+
+	// Records queued while the writer is busy are written together, but the
+	// file still rotates between records
+	stalled, release := make(chan bool), make(chan bool)
+	go w.configure(func() {
+		close(stalled)
+		<-release
+	})
+	<-stalled
+	for i := 0; i < 3; i++ {
+		w.LogWrite(newLogRecord(INFO, "source", fmt.Sprintf("record %d", i)))
+	}
+	close(release)
+	waitForWrites(w)
+	if counter.writes != 1 {
+		t.Errorf("3 queued records took %d writes, want 1", counter.writes)
+	}
+
+	for i := 3; i < 10; i++ {
+		w.LogWrite(newLogRecord(INFO, "source", fmt.Sprintf("record %d", i)))
+	}
+	w.Close()
+
+	for name, want := range map[string]string{
+		fname + ".001": "record 0\nrecord 1\nrecord 2\nrecord 3\n",
+		fname + ".002": "record 4\nrecord 5\nrecord 6\nrecord 7\n",
+		fname:          "record 8\nrecord 9\n",
+	} {
+		if contents, err := ioutil.ReadFile(name); err != nil || string(contents) != want {
+			t.Errorf("%s holds %q (%v), want %q", name, contents, err, want)
+		}
+	}
+}
+
+func TestRecordPooling(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pooling")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "app.log")
+
+	for _, shared := range []bool{false, true} {
+		w := NewFileLogWriter(fname, false, false).SetFormat("%M")
+		if w == nil {
+			t.Fatalf("Invalid return: w should not be nil")
+		}
+		log := Logger{"file": &Filter{INFO, w}}.SetRecordPooling(true)
+
+		// A writer which doesn't release records keeps them out of the pool
+		if shared {
+			log["recording"] = &Filter{INFO, &recordingLogWriter{}}
+		}
+
+		rec := log.newRecord(INFO, "source", "message")
+		log.dispatch(rec)
+		log.Close()
+
+		if recycled := len(rec.Message) == 0; recycled == shared {
+			t.Errorf("shared=%v: Record recycled = %v", shared, recycled)
+		}
+	}
+	if contents, _ := ioutil.ReadFile(fname); string(contents) != "message\nmessage\n" {
+		t.Errorf("File holds %q, want %q", contents, "message\nmessage\n")
+	}
+}
+
+func TestCloseTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "closetimeout")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "app.log")
+
+	w := NewFileLogWriter(fname, false, false).SetFormat("%M")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "written"))
+	waitForWrites(w)
+
+	// Stall the writer so that nothing more can be written in time
+	stalled, release := make(chan bool), make(chan bool)
+	go w.configure(func() {
+		close(stalled)
+		<-release
+	})
+	<-stalled
+	for i := 0; i < 3; i++ {
+		w.LogWrite(newLogRecord(INFO, "source", "abandoned"))
+	}
+	err = w.CloseTimeout(10 * time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "abandoning 3 queued log message(s)") {
+		t.Errorf("CloseTimeout: got %v, want 3 abandoned messages", err)
+	}
+	close(release)
+
+	// The writer finishes without writing the abandoned records
+	<-w.completed
+	w.wg.Wait()
+	if contents, _ := ioutil.ReadFile(fname); string(contents) != "written\n" {
+		t.Errorf("File holds %q, want %q", contents, "written\n")
+	}
+	if stats := w.Stats(); stats.Dropped != 3 {
+		t.Errorf("Dropped: got %d, want 3", stats.Dropped)
+	}
+
+	w = NewFileLogWriter(fname, false, false)
+	if err := w.CloseTimeout(time.Second); err != nil {
+		t.Errorf("CloseTimeout: %s", err)
+	}
+}
+
+func TestRecoverMissingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "missing")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "logs", "app.log")
+
+	defer func(d time.Duration) { MissingFileCheckInterval = d }(MissingFileCheckInterval)
+	MissingFileCheckInterval = time.Millisecond
+
+	w := NewFileLogWriter(fname, false, false).SetFormat("%M")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	buf := new(bytes.Buffer)
+	w.errorWriter = buf
+	w.LogWrite(newLogRecord(INFO, "source", "before"))
+	waitForWrites(w)
+
+	// Even the directory is recreated
+	os.RemoveAll(filepath.Dir(fname))
+	time.Sleep(5 * time.Millisecond)
+	w.LogWrite(newLogRecord(INFO, "source", "after"))
+	w.Close()
+
+	if contents, err := ioutil.ReadFile(fname); err != nil || string(contents) != "after\n" {
+		t.Errorf("%s holds %q (%v), want %q", fname, contents, err, "after\n")
+	}
+	if !strings.Contains(buf.String(), "recreating it") {
+		t.Errorf("Recreating the file not reported: %q", buf.String())
+	}
+}
+
+func TestFallbackFilename(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fallback")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "app.log")
+	fallback := filepath.Join(dir, "fallback", "app.log")
+
+	w := NewFileLogWriter(fname, false, false).SetFormat("%M").SetFallbackFilename(fallback)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	buf := new(bytes.Buffer)
+	w.configure(func() {
+		w.errorWriter = buf
+		w.fallbackRetry = time.Hour
+	})
+
+	// Writes fail once the file has been closed behind the writer's back
+	w.configure(func() { w.file.Close() })
+	for i := 0; i < fallbackAfterFailures; i++ {
+		w.LogWrite(newLogRecord(INFO, "source", "lost"))
+		waitForWrites(w)
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "fallback"))
+	waitForWrites(w)
+
+	// Once the file can be written again, the writer switches back
+	w.configure(func() { w.fallbackRetry = 0 })
+	w.LogWrite(newLogRecord(INFO, "source", "primary"))
+	w.Close()
+
+	for name, want := range map[string]string{fallback: "fallback\n", fname: "primary\n"} {
+		if contents, err := ioutil.ReadFile(name); err != nil || string(contents) != want {
+			t.Errorf("%s holds %q (%v), want %q", name, contents, err, want)
+		}
+	}
+	for _, notice := range []string{"switching to fallback file", "switching back"} {
+		if !strings.Contains(buf.String(), notice) {
+			t.Errorf("%q not reported: %q", notice, buf.String())
+		}
+	}
+}
+
+func TestSharedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shared")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "app.log")
+
+	// Two writers stand in for two processes
+	w1 := NewFileLogWriter(fname, true, false).SetFormat("%M").SetSharedFile(true)
+	w2 := NewFileLogWriter(fname, true, false).SetFormat("%M").SetSharedFile(true)
+	if w1 == nil || w2 == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w1.LogWrite(newLogRecord(INFO, "source", "a1"))
+	waitForWrites(w1)
+	w2.LogWrite(newLogRecord(INFO, "source", "b1"))
+	waitForWrites(w2)
+
+	// Only the first to rotate renames the file
+	w1.Rotate()
+	waitForWrites(w1)
+	w2.Rotate()
+
+	w2.LogWrite(newLogRecord(INFO, "source", "b2"))
+	waitForWrites(w2)
+	w2.Rotate()
+	waitForWrites(w2)
+	w1.LogWrite(newLogRecord(INFO, "source", "a2"))
+	w1.Close()
+	w2.Close()
+
+	for name, want := range map[string]string{
+		fname + ".001": "a1\nb1\n",
+		fname + ".002": "b2\n",
+		fname:          "a2\n",
+	} {
+		if contents, err := ioutil.ReadFile(name); err != nil || string(contents) != want {
+			t.Errorf("%s holds %q (%v), want %q", name, contents, err, want)
+		}
+	}
+	if _, err := os.Stat(fname + ".003"); err == nil {
+		t.Errorf("%s.003 should not exist", fname)
+	}
+}
+
+func TestRotateCopyTruncate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "copytruncate")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "app.log")
+
+	w := NewFileLogWriter(fname, true, false).SetFormat("%M").SetRotateCopyTruncate(true)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "first"))
+	waitForWrites(w)
+
+	// Another process holding the file open goes on writing to the same file
+	before, err := os.Stat(fname)
+	if err != nil {
+		t.Fatalf("Stat: %s", err)
+	}
+	w.Rotate()
+	waitForWrites(w)
+	after, err := os.Stat(fname)
+	if err != nil {
+		t.Fatalf("Stat: %s", err)
+	}
+	if !os.SameFile(before, after) {
+		t.Errorf("%s was replaced rather than truncated", fname)
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "second"))
+	w.Close()
+
+	for name, want := range map[string]string{fname + ".001": "first\n", fname: "second\n"} {
+		if contents, err := ioutil.ReadFile(name); err != nil || string(contents) != want {
+			t.Errorf("%s holds %q (%v), want %q", name, contents, err, want)
+		}
+	}
+}
+
+func TestReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reopen")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "app.log")
+
+	w := NewFileLogWriter(fname, false, false).SetFormat("%M")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "first"))
+	waitForWrites(w)
+
+	// Move the file away as logrotate would, then have the writer reopen it
+	if err := os.Rename(fname, fname+".1"); err != nil {
+		t.Fatalf("Rename: %s", err)
+	}
+	w.Reopen()
+	w.LogWrite(newLogRecord(INFO, "source", "second"))
+	w.Close()
+	w.Reopen()
+
+	for name, want := range map[string]string{fname + ".1": "first\n", fname: "second\n"} {
+		if contents, err := ioutil.ReadFile(name); err != nil || string(contents) != want {
+			t.Errorf("%s holds %q (%v), want %q", name, contents, err, want)
+		}
+	}
+}
+
+func TestErrorHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "errors")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	buf := &bytes.Buffer{}
+	w := NewFileLogWriter(filepath.Join(dir, "app.log"), false, false).SetErrorWriter(buf)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer w.Close()
+
+	w.configure(func() { w.handleRotationFailure(errors.New("first")) })
+	if want := "Rotation failed: first\n"; !strings.HasSuffix(buf.String(), want) {
+		t.Errorf("Error writer got %q, want it to end %q", buf.String(), want)
+	}
+
+	// A handler takes each failure in place of the writer, and can change the
+	// writer's settings
+	handled := make(chan error, 1)
+	w.SetErrorHandler(func(err error) {
+		w.SetRotateLines(10)
+		handled <- err
+	})
+	buf.Reset()
+	w.configure(func() { w.handleRotationFailure(errors.New("second")) })
+	select {
+	case err := <-handled:
+		if !strings.HasSuffix(err.Error(), "Rotation failed: second") {
+			t.Errorf("Handler got %v, want a rotation failure", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Handler wasn't called")
+	}
+	if buf.Len() > 0 {
+		t.Errorf("Error writer got %q with a handler set", buf.String())
+	}
+}
+
+func TestFailureReportInterval(t *testing.T) {
+	defer func(interval time.Duration) {
+		FailureReportInterval = interval
+	}(FailureReportInterval)
+	FailureReportInterval = time.Hour
+
+	dir, err := ioutil.TempDir("", "failures")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	buf := &bytes.Buffer{}
+	w := NewFileLogWriter(filepath.Join(dir, "app.log"), false, false).SetErrorWriter(buf)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer w.Close()
+
+	// Only the first of a run of failures is reported straight away
+	w.configure(func() {
+		for i := 0; i < 3; i++ {
+			w.handleWriteFailure(errors.New("disk full"))
+		}
+	})
+	if got := strings.Count(buf.String(), "Write failed"); got != 1 {
+		t.Errorf("Reported %d failures, want 1: %q", got, buf.String())
+	}
+
+	// The rest are counted once writes succeed again
+	w.configure(func() { w.handleWriteFailure(nil) })
+	if !strings.Contains(buf.String(), "Dropped 2 previous log message(s)") {
+		t.Errorf("Suppressed failures not summarized: %q", buf.String())
+	}
+}
+
+func TestSyslogLogWriter(t *testing.T) {
+	created := time.Date(2024, time.March, 5, 14, 3, 9, 250000000, time.UTC)
+
+	// RFC 5424 over UDP, one message per datagram
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %s", err)
+	}
+	defer conn.Close()
+	w := NewSyslogLogWriter("udp", conn.LocalAddr().String(), SyslogLocal0, "app").SetHostname("host")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.LogWrite(&LogRecord{Level: ERROR, Created: created, Source: "source", Message: "failed"})
+	w.Close()
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom: %s", err)
+	}
+	want := fmt.Sprintf("<131>1 2024-03-05T14:03:09.250000Z host app %d - - failed", os.Getpid())
+	if got := string(buf[:n]); got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+
+	// RFC 3164 over TCP, one message per line
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	defer ln.Close()
+	w = NewSyslogLogWriter("tcp", ln.Addr().String(), SyslogDaemon, "app").SetHostname("host").SetSyslogFormat(SyslogRFC3164)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.LogWrite(&LogRecord{Level: DEBUG, Created: created, Source: "source", Message: "one"})
+	w.LogWrite(&LogRecord{Level: WARNING, Created: created, Source: "source", Message: "two"})
+	w.Close()
+
+	sock, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %s", err)
+	}
+	defer sock.Close()
+	got, err := ioutil.ReadAll(sock)
+	if err != nil {
+		t.Fatalf("ReadAll: %s", err)
+	}
+	pid := os.Getpid()
+	want = fmt.Sprintf("<31>Mar  5 14:03:09 host app[%d]: one\n<28>Mar  5 14:03:09 host app[%d]: two\n", pid, pid)
+	if string(got) != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+}
+
+func TestSyslogLogWriterTLS(t *testing.T) {
+	// Borrow httptest's certificate for the collector, and present it as the
+	// client's too
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+	cert := ts.TLS.Certificates[0]
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	defer ln.Close()
+	received := make(chan string, 1)
+	go func() {
+		sock, err := ln.Accept()
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		defer sock.Close()
+		got, _ := ioutil.ReadAll(sock)
+		received <- string(got)
+	}()
+
+	config := &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{cert}}
+	w := NewSyslogLogWriterTLS(ln.Addr().String(), config, SyslogUser, "app").SetHostname("host")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	created := time.Date(2024, time.March, 5, 14, 3, 9, 0, time.UTC)
+	w.LogWrite(&LogRecord{Level: INFO, Created: created, Source: "source", Message: "secret"})
+	w.Close()
+
+	// Each message is preceded by its length
+	msg := fmt.Sprintf("<14>1 2024-03-05T14:03:09.000000Z host app %d - - secret", os.Getpid())
+	if got, want := <-received, fmt.Sprintf("%d %s", len(msg), msg); got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+
+	// A server which can't be verified is refused
+	if w := NewSyslogLogWriterTLS(ts.Listener.Addr().String(), &tls.Config{}, SyslogUser, "app"); w != nil {
+		w.Close()
+		t.Errorf("Unverified server was accepted")
+	}
+}
+
+func TestSocketLogWriterReconnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	addr := ln.Addr().String()
+
+	w := NewSocketLogWriterCompressed("tcp", addr, NewFormatEncoder("%M"), "")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.SetReconnect(10*time.Millisecond, 50*time.Millisecond, 2)
+	sock, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %s", err)
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "one"))
+	if line, err := bufio.NewReader(sock).ReadString('\n'); err != nil || line != "one\n" {
+		t.Fatalf("Got %q (%v), want %q", line, err, "one\n")
+	}
+
+	// Reset the connection, and refuse new ones for now
+	ln.Close()
+	sock.(*net.TCPConn).SetLinger(0)
+	sock.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	// Only the newest records are held while disconnected
+	for _, msg := range []string{"two", "three", "four"} {
+		w.LogWrite(newLogRecord(INFO, "source", msg))
+	}
+	for w.QueueStats().Length > 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// and sent once the writer reconnects
+	if ln, err = net.Listen("tcp", addr); err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	defer ln.Close()
+	if sock, err = ln.Accept(); err != nil {
+		t.Fatalf("Accept: %s", err)
+	}
+	defer sock.Close()
+	w.Close()
+	if got, err := ioutil.ReadAll(sock); err != nil || string(got) != "three\nfour\n" {
+		t.Errorf("Got %q (%v), want %q", got, err, "three\nfour\n")
+	}
+}
+
+func TestSocketLogWriterSettingsWhileLogging(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %s", err)
+	}
+	defer conn.Close()
+
+	// Settings are handed to the writer's goroutine, so they can change at any time
+	w := NewSocketLogWriterCompressed("udp", conn.LocalAddr().String(), NewFormatEncoder("%M"), "")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.LogWrite(newLogRecord(INFO, "source", strings.Repeat("x", 100)))
+	for w.QueueStats().Length > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	w.SetDatagramSize(40, DatagramTruncate).SetReconnect(time.Millisecond, time.Second, 10)
+	w.LogWrite(newLogRecord(INFO, "source", strings.Repeat("y", 100)))
+	w.Close()
+
+	if want := (SocketStats{Sent: 2, Truncated: 1}); w.Stats() != want {
+		t.Errorf("Stats are %+v, want %+v", w.Stats(), want)
+	}
+}
+
+func TestSocketLogWriterDatagramSize(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %s", err)
+	}
+	defer conn.Close()
+	long := strings.Repeat("x", 100)
+
+	for _, policy := range []DatagramPolicy{DatagramTruncate, DatagramSplit} {
+		w := NewSocketLogWriterCompressed("udp", conn.LocalAddr().String(), NewFormatEncoder("%M"), "")
+		if w == nil {
+			t.Fatalf("Invalid return: w should not be nil")
+		}
+		w.SetDatagramSize(40, policy)
+		w.LogWrite(newLogRecord(INFO, "source", "short"))
+		w.LogWrite(newLogRecord(INFO, "source", long))
+		w.Close()
+
+		var datagrams []string
+		buf := make([]byte, 1024)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			datagrams = append(datagrams, string(buf[:n]))
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		}
+
+		stats := w.Stats()
+		switch policy {
+		case DatagramTruncate:
+			want := []string{"short\n", long[:39] + "\n"}
+			if !reflect.DeepEqual(datagrams, want) {
+				t.Errorf("%s: Got %q, want %q", policy, datagrams, want)
+			}
+			if want := (SocketStats{Sent: 2, Truncated: 1}); stats != want {
+				t.Errorf("%s: Stats are %+v, want %+v", policy, stats, want)
+			}
+		case DatagramSplit:
+			// 101 bytes in chunks of 28 after their headers
+			if len(datagrams) != 5 {
+				t.Errorf("%s: Got %d datagrams, want 5", policy, len(datagrams))
+			}
+			if want := (SocketStats{Sent: 2, Split: 1}); stats != want {
+				t.Errorf("%s: Stats are %+v, want %+v", policy, stats, want)
+			}
+		}
+	}
+}
+
+func TestHTTPLogWriter(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	failures := 1
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := ioutil.ReadAll(req.Body)
+		if req.Header.Get("X-Api-Key") != "secret" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if failures > 0 {
+			failures--
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		bodies = append(bodies, req.Header.Get("Content-Type")+" "+string(body))
+	}))
+	defer ts.Close()
+
+	// The first attempt fails, and the batch is sent again
+	w := NewHTTPLogWriter(ts.URL).SetEncoder(NewFormatEncoder("%M")).SetHeader("X-Api-Key", "secret")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.SetBatching(2, time.Hour, 1).SetRetry(1, time.Millisecond, time.Millisecond)
+	for _, msg := range []string{"one", "two", "three"} {
+		w.LogWrite(newLogRecord(INFO, "source", msg))
+	}
+	w.Close()
+	want := []string{"application/x-ndjson one\ntwo\n", "application/x-ndjson three\n"}
+	if !reflect.DeepEqual(bodies, want) {
+		t.Errorf("Got %q, want %q", bodies, want)
+	}
+	if stats, want := w.Stats(), (BatchStats{Batches: 2, Records: 3, Retries: 1}); stats != want {
+		t.Errorf("Stats are %+v, want %+v", stats, want)
+	}
+
+	// Batches can be sent as JSON arrays
+	bodies = nil
+	w = NewHTTPLogWriter(ts.URL).SetJSONArray(true).SetHeader("X-Api-Key", "secret")
+	w.LogWrite(&LogRecord{Level: INFO, Created: time.Unix(0, 0).UTC(), Message: "one"})
+	w.LogWrite(&LogRecord{Level: INFO, Created: time.Unix(0, 0).UTC(), Message: "two"})
+	w.Close()
+	record := `{"level":"INFO","time":"1970-01-01T00:00:00Z","message":"%s"}`
+	want = []string{"application/json [" + fmt.Sprintf(record, "one") + "," + fmt.Sprintf(record, "two") + "]"}
+	if !reflect.DeepEqual(bodies, want) {
+		t.Errorf("Got %q, want %q", bodies, want)
+	}
+
+	// A refused batch isn't tried again
+	w = NewHTTPLogWriter(ts.URL).SetRetry(3, time.Millisecond, time.Millisecond)
+	w.LogWrite(newLogRecord(INFO, "source", "refused"))
+	w.Close()
+	if stats, want := w.Stats(), (BatchStats{Dropped: 1}); stats != want {
+		t.Errorf("Stats are %+v, want %+v", stats, want)
+	}
+}
+
+func TestElasticLogWriter(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := ioutil.ReadAll(req.Body)
+		bodies = append(bodies, req.URL.Path+" "+string(body))
+
+		// The first request has one record to try again and one refused
+		if len(bodies) == 1 {
+			io.WriteString(rw, `{"errors":true,"items":[{"index":{"status":201}},{"index":{"status":429}},{"index":{"status":400,"error":{"type":"mapper_parsing_exception","reason":"bad"}}}]}`)
+			return
+		}
+		io.WriteString(rw, `{"errors":false,"items":[{"index":{"status":201}}]}`)
+	}))
+	defer ts.Close()
+
+	w := NewElasticLogWriter(ts.URL, "logs")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.SetBatching(3, time.Hour, 1).SetRetry(1, time.Millisecond, time.Millisecond)
+	for _, msg := range []string{"one", "two", "three"} {
+		w.LogWrite(&LogRecord{Level: WARNING, Created: time.Unix(0, 0).UTC(), Source: "main.main:12", Message: msg, Fields: Fields{"user.id": 7, "message": "lost"}})
+	}
+	w.Close()
+
+	action := `{"index":{"_index":"logs-1970.01.01"}}` + "\n"
+	doc := `{"@timestamp":"1970-01-01T00:00:00Z","ecs":{"version":"1.12.0"},"log":{"level":"warning","origin":{"file":{"line":12},"function":"main.main"}},"message":"%s","user.id":7}` + "\n"
+	want := []string{
+		"/_bulk " + action + fmt.Sprintf(doc, "one") + action + fmt.Sprintf(doc, "two") + action + fmt.Sprintf(doc, "three"),
+		"/_bulk " + action + fmt.Sprintf(doc, "two"),
+	}
+	if !reflect.DeepEqual(bodies, want) {
+		t.Errorf("Got %q, want %q", bodies, want)
+	}
+	if stats, want := w.Stats(), (BatchStats{Batches: 1, Records: 2, Retries: 1, Dropped: 1}); stats != want {
+		t.Errorf("Stats are %+v, want %+v", stats, want)
+	}
+}
+
+func TestSentryLogWriter(t *testing.T) {
+	var mu sync.Mutex
+	var events []map[string]interface{}
+	var paths, auths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		var event map[string]interface{}
+		json.NewDecoder(req.Body).Decode(&event)
+		events = append(events, event)
+		paths = append(paths, req.URL.Path)
+		auths = append(auths, req.Header.Get("X-Sentry-Auth"))
+	}))
+	defer ts.Close()
+
+	// Only ERROR and above are sent, up to the rate limit
+	w := NewSentryLogWriter(strings.Replace(ts.URL, "://", "://key@", 1) + "/42")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.SetStackTrace(true).SetRateLimit(2, time.Hour)
+	w.LogWrite(newLogRecord(WARNING, "source", "ignored"))
+	w.LogWrite(&LogRecord{Level: ERROR, Created: time.Now(), Source: "main.main:12", Message: "failed", Fields: Fields{"user": "bob"}})
+	w.LogWrite(newLogRecord(CRITICAL, "source", "down"))
+	w.LogWrite(newLogRecord(CRITICAL, "source", "limited"))
+	w.Close()
+
+	if len(events) != 2 {
+		t.Fatalf("Got %d events, want 2", len(events))
+	}
+	if paths[0] != "/api/42/store/" || !strings.Contains(auths[0], "sentry_key=key") {
+		t.Errorf("Sent to %q with auth %q", paths[0], auths[0])
+	}
+	event := events[0]
+	if event["level"] != "error" || event["message"] != "failed" || event["culprit"] != "main.main:12" || !reflect.DeepEqual(event["extra"], map[string]interface{}{"user": "bob"}) {
+		t.Errorf("Got event %v", event)
+	}
+	if len(event["event_id"].(string)) != 32 {
+		t.Errorf("Event ID %q should be 32 hex digits", event["event_id"])
+	}
+	frames, _ := event["stacktrace"].(map[string]interface{})["frames"].([]interface{})
+	if len(frames) == 0 || frames[len(frames)-1].(map[string]interface{})["function"] != "testing.tRunner" {
+		t.Errorf("Stack trace should end with the test runner, leaving out this package: %v", frames)
+	}
+	if events[1]["level"] != "fatal" {
+		t.Errorf("CRITICAL records should be fatal events, not %v", events[1]["level"])
+	}
+	if stats, want := w.Stats(), (SentryStats{Sent: 2, RateLimited: 1}); stats != want {
+		t.Errorf("Stats are %+v, want %+v", stats, want)
+	}
+
+	// Sampling leaves records out
+	w = NewSentryLogWriter(strings.Replace(ts.URL, "://", "://key@", 1) + "/42").SetSampleRate(0)
+	w.LogWrite(newLogRecord(ERROR, "source", "sampled"))
+	w.Close()
+	if stats, want := w.Stats(), (SentryStats{Sampled: 1}); stats != want {
+		t.Errorf("Stats are %+v, want %+v", stats, want)
+	}
+}
+
+func TestAlertLogWriter(t *testing.T) {
+	var mu sync.Mutex
+	var texts []string
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		var msg struct{ Text string }
+		json.NewDecoder(req.Body).Decode(&msg)
+		texts = append(texts, msg.Text)
+	}))
+	defer ts.Close()
+
+	// Similar records after the first are counted, and summed up on closing
+	w := NewAlertLogWriter(ts.URL).SetWindow(time.Hour)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.LogWrite(newLogRecord(ERROR, "db.go:10", "ignored"))
+	w.LogWrite(newLogRecord(CRITICAL, "db.go:10", "one"))
+	w.LogWrite(newLogRecord(CRITICAL, "db.go:10", "two"))
+	w.LogWrite(newLogRecord(CRITICAL, "web.go:20", "other"))
+	w.LogWrite(newLogRecord(CRITICAL, "db.go:10", "three"))
+	w.Close()
+
+	want := []string{"[CRIT] one", "[CRIT] other", "2 similar message(s) in the last second, most recently:\n[CRIT] three"}
+	if !reflect.DeepEqual(texts, want) {
+		t.Errorf("Got %q, want %q", texts, want)
+	}
+
+	// Counts are posted as each window ends
+	texts = nil
+	w = NewAlertLogWriter(ts.URL).SetWindow(50 * time.Millisecond)
+	w.LogWrite(newLogRecord(CRITICAL, "db.go:10", "one"))
+	w.LogWrite(newLogRecord(CRITICAL, "db.go:10", "two"))
+	time.Sleep(200 * time.Millisecond)
+	mu.Lock()
+	if len(texts) != 2 || !strings.HasPrefix(texts[1], "1 similar message(s)") {
+		t.Errorf("Got %q, want the count posted once the window ended", texts)
+	}
+	mu.Unlock()
+	w.Close()
+}
+
+func TestSMTPLogWriter(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	defer ln.Close()
+
+	// A server which collects the subject and body of each message
+	var mu sync.Mutex
+	var mails []string
+	go func() {
+		for {
+			sock, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(sock net.Conn) {
+				defer sock.Close()
+				in := bufio.NewReader(sock)
+				io.WriteString(sock, "220 localhost ESMTP\r\n")
+				for {
+					line, err := in.ReadString('\n')
+					if err != nil {
+						return
+					}
+					switch verb := strings.ToUpper(strings.Fields(line)[0]); verb {
+					case "EHLO":
+						io.WriteString(sock, "250-localhost\r\n250 8BITMIME\r\n")
+					case "DATA":
+						io.WriteString(sock, "354 go ahead\r\n")
+						var subject, body string
+						inBody := false
+						for {
+							line, _ := in.ReadString('\n')
+							if line == ".\r\n" || len(line) == 0 {
+								break
+							}
+							line = strings.TrimPrefix(line, ".")
+							switch {
+							case inBody:
+								body += line
+							case line == "\r\n":
+								inBody = true
+							case strings.HasPrefix(line, "Subject: "):
+								subject = strings.TrimSpace(line[len("Subject: "):])
+							}
+						}
+						mu.Lock()
+						mails = append(mails, subject+"|"+body)
+						mu.Unlock()
+						io.WriteString(sock, "250 queued\r\n")
+					case "QUIT":
+						io.WriteString(sock, "221 bye\r\n")
+						return
+					default:
+						io.WriteString(sock, "250 ok\r\n")
+					}
+				}
+			}(sock)
+		}
+	}()
+
+	// Each record at or above the level is emailed on its own
+	w := NewSMTPLogWriter(ln.Addr().String(), "app@example.com", []string{"ops@example.com"})
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.SetFormat("[%L] %M").SetTLS(SMTPNoTLS, nil)
+	w.LogWrite(newLogRecord(WARNING, "source", "ignored"))
+	w.LogWrite(newLogRecord(ERROR, "source", "one"))
+	w.LogWrite(newLogRecord(CRITICAL, "source", "two"))
+	w.Close()
+	want := []string{"[EROR] one|[EROR] one\r\n", "[CRIT] two|[CRIT] two\r\n"}
+	if !reflect.DeepEqual(mails, want) {
+		t.Errorf("Got %q, want %q", mails, want)
+	}
+
+	// A digest holds every record logged in the interval
+	mails = nil
+	SMTPDigestMax = 2
+	defer func() { SMTPDigestMax = 1000 }()
+	w = NewSMTPLogWriter(ln.Addr().String(), "app@example.com", []string{"ops@example.com"})
+	w.SetFormat("[%L] %M").SetDigest(time.Hour).SetTLS(SMTPNoTLS, nil)
+	for _, msg := range []string{"one", "two", "three"} {
+		w.LogWrite(newLogRecord(ERROR, "source", msg))
+	}
+	w.Close()
+	if len(mails) != 1 || !strings.HasPrefix(mails[0], "3 log message(s)") || !strings.HasSuffix(mails[0], "|[EROR] one\r\n[EROR] two\r\n\r\n... and 1 more log message(s)\r\n") {
+		t.Errorf("Got %q, want one digest of the records", mails)
+	}
+}
+
+// A database/sql driver which logs the statements it is given
+type testSQLDriver struct{}
+
+type testSQLConn struct{}
+
+type testSQLStmt struct{ query string }
+
+var testSQL struct {
+	sync.Mutex
+	log []string
+}
+
+func init() {
+	sql.Register("log4gotest", testSQLDriver{})
+}
+
+func (testSQLDriver) Open(name string) (driver.Conn, error) { return testSQLConn{}, nil }
+
+func (testSQLConn) Prepare(query string) (driver.Stmt, error) { return testSQLStmt{query}, nil }
+func (testSQLConn) Close() error                              { return nil }
+func (c testSQLConn) Begin() (driver.Tx, error)               { c.logf("BEGIN"); return c, nil }
+func (c testSQLConn) Commit() error                           { c.logf("COMMIT"); return nil }
+func (c testSQLConn) Rollback() error                         { c.logf("ROLLBACK"); return nil }
+
+func (testSQLConn) logf(format string, args ...interface{}) {
+	testSQL.Lock()
+	defer testSQL.Unlock()
+	testSQL.log = append(testSQL.log, fmt.Sprintf(format, args...))
+}
+
+func (s testSQLStmt) Close() error  { return nil }
+func (s testSQLStmt) NumInput() int { return -1 }
+func (s testSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	testSQLConn{}.logf("%s %v", s.query, args)
+	return driver.RowsAffected(1), nil
+}
+func (s testSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("queries not supported")
+}
+
+// Take the statements logged so far
+func takeTestSQL() []string {
+	testSQL.Lock()
+	defer testSQL.Unlock()
+	log := testSQL.log
+	testSQL.log = nil
+	return log
+}
+
+func TestDBLogWriter(t *testing.T) {
+	db, err := sql.Open("log4gotest", "")
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	defer db.Close()
+	takeTestSQL()
+
+	// Each batch is inserted in a transaction
+	w := NewDBLogWriter(db, "logs")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.SetColumns(DBColumns{Level: "lvl", Message: "msg", Fields: "data"}).SetPlaceholder(DBDollar)
+	w.SetBatching(2, time.Hour, 1)
+	w.LogWrite(newLogRecord(ERROR, "source", "one"))
+	w.LogWrite(&LogRecord{Level: INFO, Message: "two", Fields: Fields{"user": 7}})
+	w.LogWrite(newLogRecord(WARNING, "source", "three"))
+	w.Close()
+
+	insert := "INSERT INTO logs (lvl, msg, data) VALUES ($1, $2, $3)"
+	want := []string{
+		"BEGIN",
+		insert + " [ERROR one <nil>]",
+		insert + ` [INFO two {"user":7}]`,
+		"COMMIT",
+		"BEGIN",
+		insert + " [WARNING three <nil>]",
+		"COMMIT",
+	}
+	if got := takeTestSQL(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+	if stats, want := w.Stats(), (BatchStats{Batches: 2, Records: 3}); stats != want {
+		t.Errorf("Stats are %+v, want %+v", stats, want)
+	}
+}
+
+func TestSQLiteLogWriter(t *testing.T) {
+	defer func(driver string) { SQLiteDriver = driver }(SQLiteDriver)
+	SQLiteDriver = "log4gotest"
+	dir, err := ioutil.TempDir("", "log4go")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "logs.db")
+	takeTestSQL()
+
+	// The table is created, and pruned once the file is over its size (the
+	// test driver doesn't write to it, so it's made large to start with)
+	ioutil.WriteFile(filename, make([]byte, 2048), 0644)
+	w := NewSQLiteLogWriter(filename)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.SetMaxSize(1024)
+	w.LogWrite(&LogRecord{Level: ERROR, Created: time.Unix(0, 0).UTC(), Source: "source", Message: "one", Fields: Fields{"user": 7}})
+	w.Close()
+
+	got := takeTestSQL()
+	if len(got) != 8 {
+		t.Fatalf("Got %d statements, want 8: %q", len(got), got)
+	}
+	if want := sqliteSchema; !reflect.DeepEqual(got[:3], []string{want[0] + " []", want[1] + " []", want[2] + " []"}) {
+		t.Errorf("Got schema %q, want %q", got[:3], want)
+	}
+	insert := "INSERT INTO logs (time, level, source, message, fields) VALUES (?, ?, ?, ?, ?)"
+	if want := insert + ` [1970-01-01 00:00:00 +0000 UTC ERROR source one {"user":7}]`; got[4] != want {
+		t.Errorf("Got %q, want %q", got[4], want)
+	}
+	if !strings.HasPrefix(got[6], "DELETE FROM logs WHERE id <=") || got[7] != "PRAGMA incremental_vacuum []" {
+		t.Errorf("Got %q, want the oldest records pruned", got[6:])
+	}
+	if prunes := w.Prunes(); prunes != 1 {
+		t.Errorf("Pruned %d times, want 1", prunes)
+	}
+}
+
+func TestRingBufferLogWriter(t *testing.T) {
+	w := NewRingBufferLogWriter(3).SetFormat("%M")
+	w.LogWrite(newLogRecord(DEBUG, "source", "one"))
+	if got := w.Snapshot(); len(got) != 1 || got[0].Message != "one" {
+		t.Errorf("Got %+v, want the one record", got)
+	}
+
+	// Once full, the oldest records are replaced
+	for _, msg := range []string{"two", "three", "four", "five"} {
+		w.LogWrite(newLogRecord(DEBUG, "source", msg))
+	}
+	var buf bytes.Buffer
+	if err := w.DumpTo(&buf); err != nil {
+		t.Fatalf("DumpTo: %s", err)
+	}
+	if got, want := buf.String(), "three\nfour\nfive\n"; got != want {
+		t.Errorf("Dumped %q, want %q", got, want)
+	}
+
+	w.Reset()
+	if got := w.Snapshot(); len(got) != 0 {
+		t.Errorf("Got %+v after Reset, want nothing", got)
+	}
+}
+
+func TestDiscardLogWriter(t *testing.T) {
+	w := NewDiscardLogWriter()
+	log := make(Logger).SetRecordPooling(true)
+	log.AddFilter("discard", FINEST, w)
+	log.Info("one")
+	log.Debug("two")
+	log.Close()
+	if n := w.Discarded(); n != 2 {
+		t.Errorf("Discarded %d records, want 2", n)
+	}
+}
+
+func TestWriterLog(t *testing.T) {
+	var buf bytes.Buffer
+	out := bufio.NewWriter(&buf)
+	w := NewWriterLog(out, "[%L] %M")
+	w.LogWrite(newLogRecord(INFO, "source", "one"))
+	w.LogWrite(newLogRecord(ERROR, "source", "two"))
+	w.Close()
+
+	// The bufio.Writer was flushed
+	if got, want := buf.String(), "[INFO] one\n[EROR] two\n"; got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+}
+
+func TestMultiLogWriter(t *testing.T) {
+	var first, second bytes.Buffer
+	var failed *HTTPLogWriter
+	w := NewMultiLogWriter(NewWriterLog(&first, "%M"), failed, NewWriterLog(&second, "[%L] %M"))
+	w.LogWrite(newLogRecord(INFO, "source", "one"))
+	w.LogWrite(newLogRecord(ERROR, "source", "two"))
+	w.Close()
+
+	if got, want := first.String(), "one\ntwo\n"; got != want {
+		t.Errorf("First writer got %q, want %q", got, want)
+	}
+	if got, want := second.String(), "[INFO] one\n[EROR] two\n"; got != want {
+		t.Errorf("Second writer got %q, want %q", got, want)
+	}
+}
+
+// A writer which waits to be let go before taking each record
+type gatedLogWriter struct {
+	gate    chan bool
+	written []string
+}
+
+func (w *gatedLogWriter) LogWrite(rec *LogRecord) {
+	<-w.gate
+	w.written = append(w.written, rec.Message)
+}
+
+func (w *gatedLogWriter) Close() {}
+
+func TestAsyncLogWriter(t *testing.T) {
+	for _, policy := range []OverflowPolicy{OverflowDropNewest, OverflowDropOldest} {
+		// The first record is taken off the queue and held up in the
+		// wrapped writer, while the rest fill the queue
+		inner := &gatedLogWriter{gate: make(chan bool)}
+		w := NewAsyncLogWriter(inner, 2, policy)
+		w.LogWrite(newLogRecord(INFO, "source", "held"))
+		for w.QueueStats().Length > 0 {
+			time.Sleep(time.Millisecond)
+		}
+		for _, msg := range []string{"one", "two", "three", "four"} {
+			w.LogWrite(newLogRecord(INFO, "source", msg))
+		}
+		close(inner.gate)
+		w.Close()
+
+		want := []string{"held", "one", "two"}
+		if policy == OverflowDropOldest {
+			want = []string{"held", "three", "four"}
+		}
+		if !reflect.DeepEqual(inner.written, want) {
+			t.Errorf("%s: Wrote %q, want %q", policy, inner.written, want)
+		}
+		if dropped := w.DroppedRecords(); dropped != 2 {
+			t.Errorf("%s: Dropped %d records, want 2", policy, dropped)
+		}
+	}
+}
+
+func TestGRPCLogWriter(t *testing.T) {
+	// The collector rewrites the stream's messages with varint lengths, as
+	// ProtoEncoder writes them, for a BinaryLogReader to read back
+	streams := make(chan []byte, 1)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.URL.Path != "/log4go.LogCollector/Stream" || r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("Unexpected %s request for %s with headers %v", r.Proto, r.URL.Path, r.Header)
+		}
+		var out []byte
+		var header [5]byte
+		for {
+			if _, err := io.ReadFull(r.Body, header[:]); err != nil {
+				break
+			}
+			msg := make([]byte, binary.BigEndian.Uint32(header[1:]))
+			if _, err := io.ReadFull(r.Body, msg); err != nil {
+				t.Errorf("Truncated message: %s", err)
+				break
+			}
+			out = appendUvarint(out, uint64(len(msg)))
+			out = append(out, msg...)
+		}
+		rw.Header().Set("Content-Type", "application/grpc+proto")
+		rw.WriteHeader(http.StatusOK)
+		rw.Write([]byte{0, 0, 0, 0, 0})
+		rw.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+		streams <- out
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+
+	w := NewGRPCLogWriter(ts.Listener.Addr().String()).SetTLS(&tls.Config{RootCAs: roots}).SetHeader("Authorization", "Bearer token")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	recs := []*LogRecord{
+		{Level: ERROR, Created: time.Unix(1262401445, 123456789), Source: "source", Message: "message"},
+		{Level: INFO, Created: time.Unix(1262401446, 0), Message: "with fields", Fields: Fields{"user": "bob"}},
+	}
+	for _, rec := range recs {
+		w.LogWrite(rec)
+	}
+	w.Close()
+
+	var stream []byte
+	select {
+	case stream = <-streams:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Collector never saw the stream end")
+	}
+	r := NewBinaryLogReader(bytes.NewReader(stream))
+	for i, want := range recs {
+		if !r.Next() {
+			t.Fatalf("%d: Next failed: %v", i, r.Err())
+		}
+		got := r.Record()
+		if got.Level != want.Level || !got.Created.Equal(want.Created) || got.Source != want.Source || got.Message != want.Message || !reflect.DeepEqual(got.Fields, want.Fields) {
+			t.Errorf("%d: Streamed %+v, want %+v", i, got, want)
+		}
+	}
+	if r.Next() {
+		t.Errorf("Unexpected extra record %+v", r.Record())
+	}
+}
+
+func TestAMQPLogWriter(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	defer ln.Close()
+
+	// A broker which accepts the handshake, then collects what is published
+	type published struct {
+		exchange, key, body string
+		mode                byte
+	}
+	received := make(chan []published, 1)
+	go func() {
+		sock, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer sock.Close()
+		c := &amqpConn{sock: sock, out: bufio.NewWriter(sock)}
+		in := bufio.NewReader(sock)
+		io.ReadFull(in, make([]byte, len(amqpProtocolHeader)))
+		c.writeMethod(0, amqpConnectionClass, amqpConnectionStart, []byte{0, 9, 0, 0, 0, 0, 0, 0, 0, 5, 'P', 'L', 'A', 'I', 'N', 0, 0, 0, 5, 'e', 'n', '_', 'U', 'S'})
+		expectAMQP(in, amqpConnectionClass, amqpConnectionStartOk)
+		c.writeMethod(0, amqpConnectionClass, amqpConnectionTune, []byte{0, 1, 0, 0, 16, 0, 0, 0})
+		expectAMQP(in, amqpConnectionClass, amqpConnectionTuneOk)
+		expectAMQP(in, amqpConnectionClass, amqpConnectionOpen)
+		c.writeMethod(0, amqpConnectionClass, amqpConnectionOpenOk, []byte{0})
+		expectAMQP(in, amqpChannelClass, amqpChannelOpen)
+		c.writeMethod(1, amqpChannelClass, amqpChannelOpenOk, []byte{0, 0, 0, 0})
+
+		var got []published
+		for {
+			frame, err := readAMQPFrame(in)
+			if err != nil {
+				break
+			}
+			switch class, method := frame.method(); {
+			case class == amqpBasicClass && method == amqpBasicPublish:
+				args := frame.payload[6:]
+				exchange := string(args[1 : 1+args[0]])
+				args = args[1+args[0]:]
+				got = append(got, published{exchange: exchange, key: string(args[1 : 1+args[0]])})
+			case class == amqpConnectionClass && method == amqpConnectionClose:
+				c.writeMethod(0, amqpConnectionClass, amqpConnectionCloseOk, nil)
+				received <- got
+				return
+			case frame.kind == amqpFrameHeader:
+				got[len(got)-1].mode = frame.payload[14]
+			case frame.kind == amqpFrameBody:
+				got[len(got)-1].body += string(frame.payload)
+			}
+		}
+		received <- got
+	}()
+
+	// Bodies larger than a frame are split over several
+	long := strings.Repeat("x", 5000)
+	w := NewAMQPLogWriter("amqp://user:pass@"+ln.Addr().String()+"/", "logs", "app")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.SetEncoder(NewFormatEncoder("%M")).SetPersistent(false)
+	w.LogWrite(newLogRecord(INFO, "source", "one"))
+	w.LogWrite(newLogRecord(INFO, "source", long))
+	w.Close()
+
+	want := []published{{"logs", "app", "one\n", 1}, {"logs", "app", long + "\n", 1}}
+	if got := <-received; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v, want %+v", got, want)
+	}
+}
+
+func TestRedisLogWriter(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	defer ln.Close()
+
+	// A server which drops the first connection to send a command, and
+	// collects the commands sent on the others
+	var mu sync.Mutex
+	var commands [][]interface{}
+	dropped := false
+	go func() {
+		for {
+			sock, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(sock net.Conn) {
+				defer sock.Close()
+				in := bufio.NewReader(sock)
+				for {
+					cmd, err := readRESP(in)
+					if err != nil {
+						return
+					}
+					mu.Lock()
+					if !dropped {
+						dropped = true
+						mu.Unlock()
+						return
+					}
+					args := cmd.([]interface{})
+					commands = append(commands, args)
+					mu.Unlock()
+					switch args[0] {
+					case "XADD":
+						io.WriteString(sock, "$3\r\n1-0\r\n")
+					case "RPUSH":
+						io.WriteString(sock, ":1\r\n")
+					case "AUTH":
+						if args[1] != "secret" {
+							io.WriteString(sock, "-WRONGPASS invalid password\r\n")
+							continue
+						}
+						fallthrough
+					default:
+						io.WriteString(sock, "+OK\r\n")
+					}
+				}
+			}(sock)
+		}
+	}()
+
+	// Streams get an entry per record, sent again on a new connection
+	w := NewRedisLogWriter(ln.Addr().String(), "logs")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.SetMaxLen(1000).SetBatching(10, time.Hour).SetRetry(1, time.Millisecond, time.Millisecond)
+	w.LogWrite(&LogRecord{Level: INFO, Created: time.Unix(0, 0).UTC(), Source: "source", Message: "one", Fields: Fields{"user": 7}})
+	w.Close()
+	want := [][]interface{}{{"XADD", "logs", "MAXLEN", "~", "1000", "*", "level", "INFO", "time", "1970-01-01T00:00:00Z", "source", "source", "message", "one", "user", "7"}}
+	if !reflect.DeepEqual(commands, want) {
+		t.Errorf("Got %q, want %q", commands, want)
+	}
+	if stats, want := w.Stats(), (BatchStats{Batches: 1, Records: 1, Retries: 1}); stats != want {
+		t.Errorf("Stats are %+v, want %+v", stats, want)
+	}
+
+	// Lists get encoded records, trimmed after each batch
+	commands = nil
+	w = NewRedisLogWriter(ln.Addr().String(), "logs").SetAuth("secret", 2).SetList(true).SetMaxLen(100)
+	w.SetEncoder(NewFormatEncoder("%M"))
+	w.LogWrite(newLogRecord(INFO, "source", "one"))
+	w.LogWrite(newLogRecord(INFO, "source", "two"))
+	w.Close()
+	want = [][]interface{}{
+		{"AUTH", "secret"},
+		{"SELECT", "2"},
+		{"RPUSH", "logs", "one"},
+		{"RPUSH", "logs", "two"},
+		{"LTRIM", "logs", "-100", "-1"},
+	}
+	if !reflect.DeepEqual(commands, want) {
+		t.Errorf("Got %q, want %q", commands, want)
+	}
+
+	// Errors from the server aren't tried again
+	w = NewRedisLogWriter(ln.Addr().String(), "logs").SetAuth("wrong", 0).SetRetry(3, time.Millisecond, time.Millisecond)
+	w.LogWrite(newLogRecord(INFO, "source", "refused"))
+	w.Close()
+	if stats, want := w.Stats(), (BatchStats{Dropped: 1}); stats != want {
+		t.Errorf("Stats are %+v, want %+v", stats, want)
+	}
+}
+
+func TestNATSLogWriter(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	defer ln.Close()
+
+	// A server which accepts the client, then collects what is published
+	received := make(chan []string, 1)
+	go func() {
+		sock, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer sock.Close()
+		in := bufio.NewReader(sock)
+		io.WriteString(sock, "INFO {\"max_payload\":64}\r\n")
+		var got []string
+		for {
+			line, err := in.ReadString('\n')
+			if err != nil {
+				break
+			}
+			var subject string
+			var size int
+			switch {
+			case strings.HasPrefix(line, "CONNECT "):
+				if !strings.Contains(line, `"auth_token":"secret"`) {
+					io.WriteString(sock, "-ERR 'Authorization Violation'\r\n")
+				}
+			case line == "PING\r\n":
+				io.WriteString(sock, "PONG\r\n")
+			case strings.HasPrefix(line, "PUB "):
+				fmt.Sscanf(line, "PUB %s %d", &subject, &size)
+				body := make([]byte, size+2)
+				io.ReadFull(in, body)
+				got = append(got, subject+" "+string(body[:size]))
+			}
+		}
+		received <- got
+	}()
+
+	w := NewNATSLogWriter("nats://secret@"+ln.Addr().String(), "logs.{logger}.{level}")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.SetEncoder(NewFormatEncoder("%M"))
+	w.LogWrite(newLogRecord(INFO, "source", "one"))
+	w.LogWrite(&LogRecord{Level: ERROR, Message: "two", Fields: Fields{"logger": "db pool"}})
+	w.LogWrite(newLogRecord(INFO, "source", strings.Repeat("x", 100)))
+	w.Close()
+
+	want := []string{"logs.default.info one\n", "logs.db_pool.error two\n"}
+	if got := <-received; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+	if stats, want := w.Stats(), (NATSStats{Published: 2, Oversized: 1}); stats != want {
+		t.Errorf("Stats are %+v, want %+v", stats, want)
+	}
+}
+
+// Wait until w has written every record logged so far, so that a change made
+// through configure can't overtake them
+func waitForWrites(w *FileLogWriter) {
+	for len(w.rec) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	w.configure(func() {})
+}
+
+func TestRotateMaxFileAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileage")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "app.log")
+
+	var reasons []RotationReason
+	w := NewFileLogWriter(fname, true, false).SetRotateOnStartup(false).SetFormat("%M").
+		SetRotateMaxFileAge(time.Hour).OnRotate(func(ev RotationEvent) { reasons = append(reasons, ev.Reason) })
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "young"))
+	w.LogWrite(newLogRecord(INFO, "source", "still young"))
+	waitForWrites(w)
+
+	// Pretend the file was opened an hour ago
+	w.configure(func() {
+		w.opentime = w.opentime.Add(-time.Hour)
+	})
+	w.LogWrite(newLogRecord(INFO, "source", "old"))
+	w.Close()
+
+	for name, want := range map[string]string{
+		fname + ".001": "young\nstill young\n",
+		fname:          "old\n",
+	} {
+		if contents, err := ioutil.ReadFile(name); err != nil || string(contents) != want {
+			t.Errorf("%s holds %q (%v), want %q", name, contents, err, want)
+		}
+	}
+	if len(reasons) != 1 || reasons[0] != ROTATE_AGE {
+		t.Errorf("Rotation reasons: got %v, want [%s]", reasons, ROTATE_AGE)
+	}
+}
+
+func TestRotateHourly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hourly")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "app.log")
+
+	w := NewFileLogWriter(fname, true, false).SetRotateOnStartup(false).SetFormat("%M").
+		SetRotateDateSuffix(true).SetRotateHourly(true)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	if w.dateSuffixFormat != HourlySuffixDateFormat {
+		t.Errorf("Date suffix format: got %q, want %q", w.dateSuffixFormat, HourlySuffixDateFormat)
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "last hour"))
+	waitForWrites(w)
+
+	// Pretend the file was opened an hour ago
+	var opened time.Time
+	w.configure(func() {
+		w.opentime = w.opentime.Add(-time.Hour)
+		opened = w.opentime
+	})
+	w.LogWrite(newLogRecord(INFO, "source", "this hour"))
+	w.Close()
+
+	contents, err := ioutil.ReadFile(fname + "." + opened.Format(HourlySuffixDateFormat))
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+	if got := strings.TrimSpace(string(contents)); got != "last hour" {
+		t.Errorf("Rotated file holds %q, want %q", got, "last hour")
+	}
+	if contents, _ := ioutil.ReadFile(fname); strings.TrimSpace(string(contents)) != "this hour" {
+		t.Errorf("Current file holds %q, want %q", contents, "this hour")
+	}
+}
+
+func TestRotateAt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotateat")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "app.log")
+
+	zone := time.FixedZone("UTC+5", 5*60*60)
+	w := NewFileLogWriter(fname, true, false).SetRotateOnStartup(false).SetFormat("%M").
+		SetRotateDateSuffix(true).SetRotateDaily(true).SetRotateAt(3, 30, zone)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+
+	for _, test := range []struct{ now, next string }{
+		{"2024-06-01T01:00:00+05:00", "2024-06-01T03:30:00+05:00"},
+		{"2024-06-01T03:30:00+05:00", "2024-06-02T03:30:00+05:00"},
+		{"2024-06-01T22:00:00Z", "2024-06-02T03:30:00+05:00"},
+	} {
+		now, _ := time.Parse(time.RFC3339, test.now)
+		if got := w.nextDailyRotation(now).Format(time.RFC3339); got != test.next {
+			t.Errorf("nextDailyRotation(%s): got %s, want %s", test.now, got, test.next)
+		}
+	}
+
+	w.LogWrite(newLogRecord(INFO, "source", "yesterday"))
+	waitForWrites(w)
+
+	// Pretend the file was opened before the last rotation time
+	var boundary time.Time
+	w.configure(func() {
+		boundary = w.nextDailyRotation(time.Now()).AddDate(0, 0, -1)
+		w.opentime = boundary.Add(-time.Minute)
+	})
+	w.LogWrite(newLogRecord(INFO, "source", "today"))
+	w.Close()
+
+	rotated := fname + "." + boundary.AddDate(0, 0, -1).Format(SuffixDateFormat)
+	if contents, err := ioutil.ReadFile(rotated); err != nil || strings.TrimSpace(string(contents)) != "yesterday" {
+		t.Errorf("Rotated file %s holds %q (%v)", rotated, contents, err)
+	}
+}
+
+func TestRotateInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "interval")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "app.log")
+
+	w := NewFileLogWriter(fname, true, false).SetRotateOnStartup(false).SetFormat("%M").
+		SetRotateDateSuffix(true).SetRotateInterval(RotateWeekly)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	if !w.logfileMatcher.MatchString("app.log.2024-W23") {
+		t.Errorf("Archive pattern %q should match weekly suffixes", w.logfileMatcher)
+	}
+
+	// Weeks are named by their ISO year
+	var weekly, monthly string
+	w.configure(func() {
+		opened := w.opentime
+		w.opentime = time.Date(2024, 12, 30, 12, 0, 0, 0, time.Local)
+		weekly = formatDateSuffix(w.intervalTime(time.Now()), w.dateSuffixFormat)
+		w.opentime = opened
+	})
+	if weekly != "2025-W01" {
+		t.Errorf("Weekly suffix: got %q, want %q", weekly, "2025-W01")
+	}
+
+	w.SetRotateInterval(RotateMonthly)
+	w.LogWrite(newLogRecord(INFO, "source", "last month"))
+	w.configure(func() {
+		w.opentime = w.opentime.AddDate(0, -1, 0)
+		monthly = formatDateSuffix(w.opentime, w.dateSuffixFormat)
+	})
+	w.LogWrite(newLogRecord(INFO, "source", "this month"))
+	w.Close()
+
+	if contents, err := ioutil.ReadFile(fname + "." + monthly); err != nil || strings.TrimSpace(string(contents)) != "last month" {
+		t.Errorf("Rotated file %s holds %q (%v)", monthly, contents, err)
+	}
+	if _, ok := ParseRotateInterval("monthly"); !ok {
+		t.Errorf("ParseRotateInterval(%q) failed", "monthly")
+	}
+}
+
+func TestRotateSchedule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schedule")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "app.log")
+
+	var events []RotationEvent
+	w := NewFileLogWriter(fname, true, false).SetRotateOnStartup(false).SetFormat("%M").
+		SetRotateSchedule("0 3 * * *").OnRotate(func(ev RotationEvent) { events = append(events, ev) })
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+
+	// An empty file is left alone
+	w.configure(w.handleScheduledRotation)
+	w.LogWrite(newLogRecord(INFO, "source", "scheduled"))
+	waitForWrites(w)
+	w.configure(w.handleScheduledRotation)
+	w.Close()
+
+	if len(events) != 1 || events[0].Reason != ROTATE_SCHEDULED {
+		t.Fatalf("Rotations: got %+v, want one scheduled", events)
+	}
+	if contents, err := ioutil.ReadFile(events[0].RotatedName); err != nil || strings.TrimSpace(string(contents)) != "scheduled" {
+		t.Errorf("Rotated file holds %q (%v)", contents, err)
+	}
+
+	// The timer is armed for the next scheduled time
+	var timer scheduleTimer
+	schedule, _ := ParseSchedule("* * * * *")
+	timer.follow(schedule)
+	defer timer.stop()
+	if timer.C == nil {
+		t.Errorf("Timer not armed")
+	}
+}
+
+func BenchmarkFormatLogRecord(b *testing.B) {
+	const updateEvery = 1
+	rec := &LogRecord{
+		Level:   CRITICAL,
+		Created: now,
+		Source:  "source",
+		Message: "message",
+	}
+	for i := 0; i < b.N; i++ {
+		rec.Created = rec.Created.Add(1 * time.Second / updateEvery)
+		if i%2 == 0 {
+			FormatLogRecord(FORMAT_DEFAULT, rec)
+		} else {
+			FormatLogRecord(FORMAT_SHORT, rec)
+		}
+	}
+}
+
+func BenchmarkConsoleLog(b *testing.B) {
+	/* This doesn't seem to work on OS X
+	sink, err := os.Open(os.DevNull)
+	if err != nil {
+		panic(err)
+	}
+	if err := syscall.Dup2(int(sink.Fd()), syscall.Stdout); err != nil {
+		panic(err)
+	}
+	*/
+
+	stdout = ioutil.Discard
+	sl := NewDefaultLogger(INFO)
+	for i := 0; i < b.N; i++ {
+		sl.Log(WARNING, "here", "This is a log message")
+	}
+}
+
+func BenchmarkConsoleNotLogged(b *testing.B) {
+	sl := NewDefaultLogger(INFO)
+	for i := 0; i < b.N; i++ {
+		sl.Log(DEBUG, "here", "This is a log message")
+	}
+}
+
+func BenchmarkConsoleUtilLog(b *testing.B) {
+	sl := NewDefaultLogger(INFO)
+	for i := 0; i < b.N; i++ {
+		sl.Info("%s is a log message", "This")
+	}
+}
+
+func BenchmarkConsoleUtilNotLog(b *testing.B) {
+	sl := NewDefaultLogger(INFO)
+	for i := 0; i < b.N; i++ {
+		sl.Debug("%s is a log message", "This")
+	}
+}
+
+func BenchmarkDiscardLog(b *testing.B) {
+	sl := make(Logger)
+	sl.AddFilter("discard", INFO, NewDiscardLogWriter())
+	for i := 0; i < b.N; i++ {
+		sl.Log(WARNING, "here", "This is a log message")
 	}
 }
 
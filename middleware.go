@@ -0,0 +1,474 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A WriterMiddleware decorates a LogWriter with some extra capability, such as
+// buffering or rate limiting, and returns the decorated writer.  The returned
+// writer must pass Close through to the one it wraps.
+type WriterMiddleware func(LogWriter) LogWriter
+
+// Chain decorates w with each of the middlewares.  The first middleware given
+// is the outermost, so it sees each record first.
+func Chain(w LogWriter, middlewares ...WriterMiddleware) LogWriter {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		w = middlewares[i](w)
+	}
+	return w
+}
+
+// WithTransform is the middleware form of NewTransformLogWriter.
+func WithTransform(transforms ...Processor) WriterMiddleware {
+	return func(w LogWriter) LogWriter {
+		return NewTransformLogWriter(w, transforms...)
+	}
+}
+
+// A HealthReporter is a LogWriter which can tell whether its last write
+// succeeded.  It is used by WithFailover to decide where to send records.
+type HealthReporter interface {
+	Healthy() bool
+}
+
+/****** Buffering ******/
+
+// BufferedLogWriter collects records in memory and hands them to the wrapped
+// writer in bursts, either when size records have accumulated or when the
+// oldest has waited for the flush interval.
+type BufferedLogWriter struct {
+	LogWriter
+
+	mu       sync.Mutex
+	size     int
+	interval time.Duration
+	pending  []*LogRecord
+	timer    *time.Timer
+}
+
+// WithBuffer returns a middleware which buffers up to size records for at
+// most interval before passing them on.
+func WithBuffer(size int, interval time.Duration) WriterMiddleware {
+	return func(w LogWriter) LogWriter {
+		return &BufferedLogWriter{
+			LogWriter: w,
+			size:      size,
+			interval:  interval,
+			pending:   make([]*LogRecord, 0, size),
+		}
+	}
+}
+
+// Unwrap returns the writer being decorated.
+func (w *BufferedLogWriter) Unwrap() LogWriter {
+	return w.LogWriter
+}
+
+// This is the BufferedLogWriter's output method
+func (w *BufferedLogWriter) LogWrite(rec *LogRecord) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.pending = append(w.pending, rec)
+	if len(w.pending) >= w.size {
+		w.flushLocked()
+		return
+	}
+	if w.timer == nil && w.interval > 0 {
+		w.timer = time.AfterFunc(w.interval, w.Flush)
+	}
+}
+
+// Flush passes all buffered records to the wrapped writer.
+func (w *BufferedLogWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.flushLocked()
+}
+
+func (w *BufferedLogWriter) flushLocked() {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	for _, rec := range w.pending {
+		w.LogWriter.LogWrite(rec)
+	}
+	w.pending = w.pending[:0]
+}
+
+// Close flushes any buffered records and closes the wrapped writer.
+func (w *BufferedLogWriter) Close() {
+	w.Flush()
+	w.LogWriter.Close()
+}
+
+/****** Sampling ******/
+
+// SamplingLogWriter passes on one of every n records below a threshold level;
+// records at or above the threshold are always passed on.
+type SamplingLogWriter struct {
+	LogWriter
+	n         uint64
+	threshold Level
+	count     uint64
+}
+
+// WithSampling returns a middleware which keeps one of every n records below
+// threshold.
+func WithSampling(n int, threshold Level) WriterMiddleware {
+	if n < 1 {
+		n = 1
+	}
+	return func(w LogWriter) LogWriter {
+		return &SamplingLogWriter{LogWriter: w, n: uint64(n), threshold: threshold}
+	}
+}
+
+// Unwrap returns the writer being decorated.
+func (w *SamplingLogWriter) Unwrap() LogWriter {
+	return w.LogWriter
+}
+
+// This is the SamplingLogWriter's output method
+func (w *SamplingLogWriter) LogWrite(rec *LogRecord) {
+	if rec.Level < w.threshold && (atomic.AddUint64(&w.count, 1)-1)%w.n != 0 {
+		return
+	}
+	w.LogWriter.LogWrite(rec)
+}
+
+/****** Rate limiting ******/
+
+// RateLimitLogWriter drops records which exceed a rate, using a token bucket
+// so that short bursts are allowed.
+type RateLimitLogWriter struct {
+	LogWriter
+
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	tokens  float64
+	last    time.Time
+	dropped uint64
+}
+
+// WithRateLimit returns a middleware which passes on at most perSecond records
+// per second on average, with bursts of up to burst records.  A burst below
+// one is taken as one, since no record could ever pass otherwise.
+func WithRateLimit(perSecond float64, burst int) WriterMiddleware {
+	if burst < 1 {
+		burst = 1
+	}
+	return func(w LogWriter) LogWriter {
+		return &RateLimitLogWriter{
+			LogWriter: w,
+			rate:      perSecond,
+			burst:     float64(burst),
+			tokens:    float64(burst),
+			last:      time.Now(),
+		}
+	}
+}
+
+// Unwrap returns the writer being decorated.
+func (w *RateLimitLogWriter) Unwrap() LogWriter {
+	return w.LogWriter
+}
+
+// This is the RateLimitLogWriter's output method
+func (w *RateLimitLogWriter) LogWrite(rec *LogRecord) {
+	w.mu.Lock()
+	now := time.Now()
+	w.tokens += now.Sub(w.last).Seconds() * w.rate
+	if w.tokens > w.burst {
+		w.tokens = w.burst
+	}
+	w.last = now
+	allowed := w.tokens >= 1
+	if allowed {
+		w.tokens--
+	} else {
+		w.dropped++
+	}
+	w.mu.Unlock()
+
+	if allowed {
+		w.LogWriter.LogWrite(rec)
+	}
+}
+
+// Dropped returns the number of records dropped so far.
+func (w *RateLimitLogWriter) Dropped() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.dropped
+}
+
+/****** Failover ******/
+
+// FailoverLogWriter sends records to a primary writer while it reports itself
+// healthy (see HealthReporter) and to a secondary writer otherwise.
+type FailoverLogWriter struct {
+	LogWriter
+	secondary LogWriter
+}
+
+// WithFailover returns a middleware which diverts records to secondary
+// whenever the wrapped writer is unhealthy.  Writers which don't implement
+// HealthReporter are always considered healthy.
+func WithFailover(secondary LogWriter) WriterMiddleware {
+	return func(w LogWriter) LogWriter {
+		return &FailoverLogWriter{LogWriter: w, secondary: secondary}
+	}
+}
+
+// Unwrap returns the writer being decorated.
+func (w *FailoverLogWriter) Unwrap() LogWriter {
+	return w.LogWriter
+}
+
+// This is the FailoverLogWriter's output method
+func (w *FailoverLogWriter) LogWrite(rec *LogRecord) {
+	if hr, ok := w.LogWriter.(HealthReporter); ok && !hr.Healthy() {
+		w.secondary.LogWrite(rec)
+		return
+	}
+	w.LogWriter.LogWrite(rec)
+}
+
+// Close closes both the primary and secondary writers.
+func (w *FailoverLogWriter) Close() {
+	w.LogWriter.Close()
+	w.secondary.Close()
+}
+
+/****** Heartbeat ******/
+
+// HeartbeatLogWriter writes a heartbeat record to the wrapped writer whenever
+// it has been idle for the heartbeat interval, so that whoever collects the
+// logs can tell a quiet service from a broken logging pipeline.  Heartbeat
+// records carry the field "heartbeat" set to true.
+type HeartbeatLogWriter struct {
+	LogWriter
+
+	interval time.Duration
+	level    Level
+	message  string
+
+	mu   sync.Mutex
+	last time.Time
+	stop chan bool
+	done chan bool
+}
+
+// WithHeartbeat returns a middleware which writes a record with the given
+// level and message after every interval without any other records.  An
+// interval of zero or less means no heartbeats, and the writer is left as it
+// is.
+func WithHeartbeat(interval time.Duration, lvl Level, message string) WriterMiddleware {
+	return func(w LogWriter) LogWriter {
+		if interval <= 0 {
+			return w
+		}
+		hw := &HeartbeatLogWriter{
+			LogWriter: w,
+			interval:  interval,
+			level:     lvl,
+			message:   message,
+			last:      time.Now(),
+			stop:      make(chan bool),
+			done:      make(chan bool),
+		}
+		go hw.run()
+		return hw
+	}
+}
+
+func (w *HeartbeatLogWriter) run() {
+	defer close(w.done)
+	// Check a few times an interval, or as often as allowed for tiny ones
+	tick := w.interval / 4
+	if tick <= 0 {
+		tick = w.interval
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case now := <-ticker.C:
+			w.mu.Lock()
+			if now.Sub(w.last) >= w.interval {
+				w.last = now
+				w.LogWriter.LogWrite(&LogRecord{
+					Level:   w.level,
+					Created: now,
+					Source:  "log4go",
+					Message: w.message,
+					Fields:  Fields{"heartbeat": true},
+				})
+			}
+			w.mu.Unlock()
+		}
+	}
+}
+
+// Unwrap returns the writer being decorated.
+func (w *HeartbeatLogWriter) Unwrap() LogWriter {
+	return w.LogWriter
+}
+
+// This is the HeartbeatLogWriter's output method
+func (w *HeartbeatLogWriter) LogWrite(rec *LogRecord) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.last = time.Now()
+	w.LogWriter.LogWrite(rec)
+}
+
+// Close stops the heartbeat and closes the wrapped writer.
+func (w *HeartbeatLogWriter) Close() {
+	close(w.stop)
+	<-w.done
+	w.LogWriter.Close()
+}
+
+/****** Configuration ******/
+
+// A MiddlewareFactory builds a WriterMiddleware from the properties given for
+// it in a configuration file.
+type MiddlewareFactory func(props map[string]string) (WriterMiddleware, error)
+
+var (
+	middlewareFactoriesLock sync.RWMutex
+	middlewareFactories     = map[string]MiddlewareFactory{
+		"buffer":    newBufferMiddlewareFromProps,
+		"sample":    newSamplingMiddlewareFromProps,
+		"ratelimit": newRateLimitMiddlewareFromProps,
+		"failover":  newFailoverMiddlewareFromProps,
+		"heartbeat": newHeartbeatMiddlewareFromProps,
+	}
+)
+
+// RegisterMiddleware makes a middleware type available to configuration files
+// under the given name.  Registering an existing name replaces it.
+func RegisterMiddleware(name string, factory MiddlewareFactory) {
+	middlewareFactoriesLock.Lock()
+	defer middlewareFactoriesLock.Unlock()
+	middlewareFactories[name] = factory
+}
+
+// Look up a middleware type registered with RegisterMiddleware
+func lookupMiddleware(name string) (MiddlewareFactory, bool) {
+	middlewareFactoriesLock.RLock()
+	defer middlewareFactoriesLock.RUnlock()
+	factory, ok := middlewareFactories[name]
+	return factory, ok
+}
+
+// Get an integer property, or def if it isn't set
+func intProperty(props map[string]string, name string, def int) (int, error) {
+	value, ok := props[name]
+	if !ok {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("property %q: %s", name, err)
+	}
+	return n, nil
+}
+
+func newBufferMiddlewareFromProps(props map[string]string) (WriterMiddleware, error) {
+	size, err := intProperty(props, "size", 100)
+	if err != nil {
+		return nil, err
+	}
+	interval := time.Second
+	if value, ok := props["interval"]; ok {
+		if interval, err = time.ParseDuration(value); err != nil {
+			return nil, fmt.Errorf("property %q: %s", "interval", err)
+		}
+	}
+	return WithBuffer(size, interval), nil
+}
+
+func newSamplingMiddlewareFromProps(props map[string]string) (WriterMiddleware, error) {
+	n, err := intProperty(props, "every", 10)
+	if err != nil {
+		return nil, err
+	}
+	threshold := WARNING
+	if value, ok := props["threshold"]; ok {
+		if threshold, ok = levelFromString(value); !ok {
+			return nil, fmt.Errorf("property %q: unknown level %q", "threshold", value)
+		}
+	}
+	return WithSampling(n, threshold), nil
+}
+
+func newRateLimitMiddlewareFromProps(props map[string]string) (WriterMiddleware, error) {
+	value, ok := props["persecond"]
+	if !ok {
+		return nil, fmt.Errorf("required property %q missing", "persecond")
+	}
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, fmt.Errorf("property %q: %s", "persecond", err)
+	}
+	// Rates below one a second still let single records through
+	defaultBurst := int(rate)
+	if defaultBurst < 1 {
+		defaultBurst = 1
+	}
+	burst, err := intProperty(props, "burst", defaultBurst)
+	if err != nil {
+		return nil, err
+	}
+	return WithRateLimit(rate, burst), nil
+}
+
+func newFailoverMiddlewareFromProps(props map[string]string) (WriterMiddleware, error) {
+	file, ok := props["filename"]
+	if !ok {
+		return nil, fmt.Errorf("required property %q missing", "filename")
+	}
+	secondary := NewFileLogWriter(file, false, false)
+	if secondary == nil {
+		return nil, fmt.Errorf("could not open failover file %q", file)
+	}
+	if format, ok := props["format"]; ok {
+		secondary.SetFormat(format)
+	}
+	return WithFailover(secondary), nil
+}
+
+func newHeartbeatMiddlewareFromProps(props map[string]string) (WriterMiddleware, error) {
+	interval := time.Minute
+	if value, ok := props["interval"]; ok {
+		var err error
+		if interval, err = time.ParseDuration(value); err != nil || interval <= 0 {
+			return nil, fmt.Errorf("property %q: invalid duration %q", "interval", value)
+		}
+	}
+	lvl := INFO
+	if value, ok := props["level"]; ok {
+		if lvl, ok = levelFromString(value); !ok {
+			return nil, fmt.Errorf("property %q: unknown level %q", "level", value)
+		}
+	}
+	message, ok := props["message"]
+	if !ok {
+		message = "heartbeat"
+	}
+	return WithHeartbeat(interval, lvl, message), nil
+}
@@ -0,0 +1,52 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"reflect"
+	"sync"
+)
+
+// MultiLogWriter sends each record to several writers, so that one filter
+// can feed, say, both a file and a network sink.
+type MultiLogWriter struct {
+	writers []LogWriter
+}
+
+// NewMultiLogWriter creates a LogWriter which sends each record to every one
+// of writers, in order.  Nil writers, as returned by failed constructors, are
+// left out.
+func NewMultiLogWriter(writers ...LogWriter) *MultiLogWriter {
+	w := &MultiLogWriter{}
+	for _, writer := range writers {
+		if writer == nil {
+			continue
+		}
+		if v := reflect.ValueOf(writer); v.Kind() == reflect.Ptr && v.IsNil() {
+			continue
+		}
+		w.writers = append(w.writers, writer)
+	}
+	return w
+}
+
+// This is the MultiLogWriter's output method
+func (w *MultiLogWriter) LogWrite(rec *LogRecord) {
+	for _, writer := range w.writers {
+		writer.LogWrite(rec)
+	}
+}
+
+// Close closes every writer at once, so that each flushes its queue in
+// parallel, and returns once they have all finished.
+func (w *MultiLogWriter) Close() {
+	var wg sync.WaitGroup
+	for _, writer := range w.writers {
+		wg.Add(1)
+		go func(writer LogWriter) {
+			defer wg.Done()
+			writer.Close()
+		}(writer)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,447 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// NATSFlushInterval is the longest a NATSLogWriter holds published records
+// in its buffer before flushing them to the server.
+var NATSFlushInterval = 100 * time.Millisecond
+
+// NATSStats counts what a NATSLogWriter has done since it was created.
+type NATSStats struct {
+	Published uint64 // Records flushed to the server
+	Dropped   uint64 // Records dropped because the writer fell behind
+	Oversized uint64 // Records dropped for exceeding the server's max_payload
+}
+
+// The counters behind NATSStats (accessed atomically)
+type natsCounters struct {
+	published uint64
+	dropped   uint64
+	oversized uint64
+}
+
+// NATSLogWriter publishes records to a NATS server, on a subject built from
+// each record's level and logger.  Publishing is asynchronous: records are
+// buffered and flushed every NATSFlushInterval, or sooner when the buffer
+// fills.  Like a slow consumer, a writer which falls behind drops the
+// records logged once its queue of LogBufferLength records is full, and
+// counts them.  The writer reconnects on its own.
+type NATSLogWriter struct {
+	// Counters reported by Stats (first for alignment)
+	counters natsCounters
+
+	records   chan *LogRecord
+	queue     *queueTracker
+	closing   chan int
+	completed chan int
+
+	url           *url.URL
+	subject       string
+	enc           Encoder
+	flushInterval time.Duration
+
+	reconnectMin, reconnectMax time.Duration
+
+	conn     *natsConn
+	pending  uint64 // Records buffered since the last flush
+	reported uint64
+}
+
+// NewNATSLogWriter creates a LogWriter which publishes each record to the
+// NATS server at natsURL, e.g. "nats://localhost:4222".  In subject,
+// {level} is replaced by the record's level in lower case ("warning") and
+// {logger} by its "logger" field, as set with SetGlobalFields, or "default",
+// so "logs.{logger}.{level}" lets subscribers pick records with wildcards.
+// Records are encoded as JSON by default.
+func NewNATSLogWriter(natsURL, subject string) *NATSLogWriter {
+	u, err := url.Parse(natsURL)
+	if err == nil && u.Scheme != "nats" {
+		err = fmt.Errorf("scheme must be nats")
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "NewNATSLogWriter(%q): %s\n", natsURL, err)
+		return nil
+	}
+
+	conn, err := dialNATS(u)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "NewNATSLogWriter(%q): %s\n", u.Host, err)
+		return nil
+	}
+
+	w := &NATSLogWriter{
+		records:       make(chan *LogRecord, LogBufferLength),
+		queue:         newQueueTracker(),
+		closing:       make(chan int),
+		completed:     make(chan int),
+		url:           u,
+		subject:       subject,
+		enc:           JSONEncoder{},
+		flushInterval: NATSFlushInterval,
+		reconnectMin:  SocketReconnectMin,
+		reconnectMax:  SocketReconnectMax,
+		conn:          conn,
+	}
+	go w.run()
+	return w
+}
+
+// This is the NATSLogWriter's output method
+func (w *NATSLogWriter) LogWrite(rec *LogRecord) {
+	token := w.queue.push(time.Now())
+	select {
+	case w.records <- rec:
+	default:
+		w.queue.unpush(token)
+		atomic.AddUint64(&w.counters.dropped, 1)
+	}
+}
+
+// QueueStats reports on the records waiting to be published.
+func (w *NATSLogWriter) QueueStats() QueueStats {
+	return QueueStats{
+		Length:    len(w.records),
+		Capacity:  cap(w.records),
+		OldestAge: w.queue.oldestAge(time.Now()),
+	}
+}
+
+// Stats returns the writer's counters.
+func (w *NATSLogWriter) Stats() NATSStats {
+	return NATSStats{
+		Published: atomic.LoadUint64(&w.counters.published),
+		Dropped:   atomic.LoadUint64(&w.counters.dropped),
+		Oversized: atomic.LoadUint64(&w.counters.oversized),
+	}
+}
+
+// Close publishes and flushes any queued records and closes the connection.
+// If the server can't be reached, the records still queued are dropped.
+func (w *NATSLogWriter) Close() {
+	close(w.closing)
+	close(w.records)
+	<-w.completed
+}
+
+// SetEncoder sets how each record is encoded, JSONEncoder by default
+// (chainable).  Must be called before the first log message is written.
+func (w *NATSLogWriter) SetEncoder(enc Encoder) *NATSLogWriter {
+	w.enc = enc
+	return w
+}
+
+// SetFlushInterval sets the longest records are buffered before being
+// flushed, in place of NATSFlushInterval (chainable).  Must be called before
+// the first log message is written.
+func (w *NATSLogWriter) SetFlushInterval(flushInterval time.Duration) *NATSLogWriter {
+	w.flushInterval = flushInterval
+	return w
+}
+
+// SetReconnect sets the shortest and longest waits between attempts to
+// reconnect, doubling after each failed attempt (chainable).  Must be called
+// before the first log message is written.
+func (w *NATSLogWriter) SetReconnect(min, max time.Duration) *NATSLogWriter {
+	w.reconnectMin, w.reconnectMax = min, max
+	return w
+}
+
+func (w *NATSLogWriter) run() {
+	defer close(w.completed)
+	defer func() {
+		if w.conn != nil {
+			w.flush()
+			if w.conn != nil {
+				w.conn.close()
+			}
+		}
+	}()
+
+	// Buffered records are flushed flushInterval after the first of them
+	// was published
+	var flushTimer <-chan time.Time
+	for {
+		select {
+		case rec, ok := <-w.records:
+			if !ok {
+				return
+			}
+			w.queue.pop()
+			if !w.publish(rec) {
+				return
+			}
+			if w.pending > 0 && flushTimer == nil {
+				flushTimer = time.After(w.flushInterval)
+			}
+		case <-flushTimer:
+			flushTimer = nil
+			w.flush()
+		}
+		w.reportDropped()
+	}
+}
+
+// Publish a record, holding on to it until the connection takes it.  It
+// returns false if the writer closed while the server couldn't be reached.
+func (w *NATSLogWriter) publish(rec *LogRecord) bool {
+	body, err := encodeRecord(w.enc, rec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "NATSLogWriter(%q): Dropped record: %s\n", w.url.Host, err)
+		return true
+	}
+
+	wait := w.reconnectMin
+	for {
+		if w.conn == nil {
+			if w.conn, err = dialNATS(w.url); err != nil {
+				w.conn = nil
+				select {
+				case <-time.After(wait):
+				case <-w.closing:
+					w.abandon()
+					return false
+				}
+				if wait *= 2; wait > w.reconnectMax {
+					wait = w.reconnectMax
+				}
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "NATSLogWriter(%q): Reconnected\n", w.url.Host)
+		}
+		if w.conn.maxPayload > 0 && len(body) > w.conn.maxPayload {
+			atomic.AddUint64(&w.counters.oversized, 1)
+			fmt.Fprintf(os.Stderr, "NATSLogWriter(%q): Dropped record of %d bytes, over the server's max_payload of %d\n", w.url.Host, len(body), w.conn.maxPayload)
+			return true
+		}
+		if err = w.conn.publish(natsSubject(w.subject, rec), body); err == nil {
+			w.pending++
+			return true
+		}
+		w.disconnect(err)
+	}
+}
+
+// Flush what has been published to the server
+func (w *NATSLogWriter) flush() {
+	if w.conn == nil || w.pending == 0 {
+		return
+	}
+	if err := w.conn.flush(); err != nil {
+		w.disconnect(err)
+		return
+	}
+	atomic.AddUint64(&w.counters.published, w.pending)
+	w.pending = 0
+}
+
+// Drop the connection after it failed, along with anything still buffered
+func (w *NATSLogWriter) disconnect(err error) {
+	if w.pending > 0 {
+		atomic.AddUint64(&w.counters.dropped, w.pending)
+		fmt.Fprintf(os.Stderr, "NATSLogWriter(%q): Dropped %d unflushed log message(s)\n", w.url.Host, w.pending)
+		w.pending = 0
+	}
+	fmt.Fprintf(os.Stderr, "NATSLogWriter(%q): %s; reconnecting\n", w.url.Host, err)
+	w.conn.close()
+	w.conn = nil
+}
+
+// Give up on the record being published and those still queued, on closing
+// while the server can't be reached
+func (w *NATSLogWriter) abandon() {
+	dropped := 1
+	for range w.records {
+		w.queue.pop()
+		dropped++
+	}
+	atomic.AddUint64(&w.counters.dropped, uint64(dropped))
+	w.reported += uint64(dropped)
+	fmt.Fprintf(os.Stderr, "NATSLogWriter(%q): Dropped %d log message(s) on closing while disconnected\n", w.url.Host, dropped)
+}
+
+// Note any records dropped since last time
+func (w *NATSLogWriter) reportDropped() {
+	dropped := atomic.LoadUint64(&w.counters.dropped)
+	if dropped == w.reported {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "NATSLogWriter(%q): Dropped %d log message(s) as a slow consumer\n", w.url.Host, dropped-w.reported)
+	w.reported = dropped
+}
+
+// The subject to publish a record on, built from template
+func natsSubject(template string, rec *LogRecord) string {
+	if !strings.Contains(template, "{") {
+		return template
+	}
+	level := "unknown"
+	if rec.Level >= 0 && int(rec.Level) < len(levelNames) {
+		level = strings.ToLower(levelNames[rec.Level])
+	}
+	logger := "default"
+	if name, ok := rec.Fields["logger"].(string); ok && len(name) > 0 {
+		logger = natsToken.Replace(name)
+	}
+	return strings.NewReplacer("{level}", level, "{logger}", logger).Replace(template)
+}
+
+// Characters which can't appear in a subject token
+var natsToken = strings.NewReplacer(" ", "_", "\t", "_", "\r", "_", "\n", "_", "*", "_", ">", "_")
+
+// A connection to a NATS server which only publishes.  What the server sends
+// is read on another goroutine, which answers its PINGs.
+type natsConn struct {
+	sock       net.Conn
+	maxPayload int
+
+	mu  sync.Mutex
+	out *bufio.Writer
+	err error // Why the server closed the connection, once it has
+}
+
+// Connect to the server at u and introduce ourselves, with the user and
+// password or token from u
+func dialNATS(u *url.URL) (*natsConn, error) {
+	host := u.Host
+	if len(u.Port()) == 0 {
+		host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	sock, err := net.DialTimeout("tcp", host, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c := &natsConn{sock: sock, out: bufio.NewWriter(sock)}
+	in := bufio.NewReader(sock)
+	sock.SetDeadline(time.Now().Add(30 * time.Second))
+	if err := c.handshake(u, in); err != nil {
+		sock.Close()
+		return nil, err
+	}
+	sock.SetDeadline(time.Time{})
+	go c.read(in)
+	return c, nil
+}
+
+func (c *natsConn) handshake(u *url.URL, in *bufio.Reader) error {
+	line, err := in.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("unexpected %q from server", strings.TrimSpace(line))
+	}
+	var info struct {
+		MaxPayload  int  `json:"max_payload"`
+		TLSRequired bool `json:"tls_required"`
+	}
+	if err := json.Unmarshal([]byte(line[len("INFO "):]), &info); err != nil {
+		return fmt.Errorf("invalid INFO from server: %s", err)
+	}
+	if info.TLSRequired {
+		return fmt.Errorf("server requires TLS, which isn't supported")
+	}
+	c.maxPayload = info.MaxPayload
+
+	options := map[string]interface{}{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "log4go",
+		"lang":     "go",
+		"version":  L4G_VERSION,
+	}
+	if u.User != nil {
+		if pass, ok := u.User.Password(); ok {
+			options["user"], options["pass"] = u.User.Username(), pass
+		} else {
+			options["auth_token"] = u.User.Username()
+		}
+	}
+	connect, _ := json.Marshal(options)
+	fmt.Fprintf(c.out, "CONNECT %s\r\nPING\r\n", connect)
+	if err := c.out.Flush(); err != nil {
+		return err
+	}
+
+	// The server answers the PING once it has accepted us
+	for {
+		line, err := in.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		switch line = strings.TrimSpace(line); {
+		case line == "PONG":
+			return nil
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("server refused connection: %s", strings.TrimSpace(line[len("-ERR"):]))
+		}
+	}
+}
+
+// Read what the server sends until the connection closes
+func (c *natsConn) read(in *bufio.Reader) {
+	for {
+		line, err := in.ReadString('\n')
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		switch line = strings.TrimSpace(line); {
+		case line == "PING":
+			c.mu.Lock()
+			c.out.WriteString("PONG\r\n")
+			c.out.Flush()
+			c.mu.Unlock()
+		case strings.HasPrefix(line, "-ERR"):
+			c.fail(fmt.Errorf("server error: %s", strings.TrimSpace(line[len("-ERR"):])))
+		}
+	}
+}
+
+// Note why the connection failed, if it hasn't already
+func (c *natsConn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+// Buffer a message on subject
+func (c *natsConn) publish(subject string, body []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	fmt.Fprintf(c.out, "PUB %s %d\r\n", subject, len(body))
+	c.out.Write(body)
+	_, err := c.out.WriteString("\r\n")
+	return err
+}
+
+// Send what has been buffered
+func (c *natsConn) flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	return c.out.Flush()
+}
+
+func (c *natsConn) close() {
+	c.sock.Close()
+}
@@ -0,0 +1,96 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy is what a FileLogWriter or AsyncLogWriter does with a record
+// logged while its queue is full.
+type OverflowPolicy int32
+
+const (
+	// Wait for room in the queue, stalling the caller
+	OverflowBlock OverflowPolicy = iota
+
+	// Drop the record being logged
+	OverflowDropNewest
+
+	// Drop the oldest queued record to make room
+	OverflowDropOldest
+)
+
+var overflowPolicyNames = []string{"block", "dropnewest", "dropoldest"}
+
+func (p OverflowPolicy) String() string {
+	if p >= 0 && int(p) < len(overflowPolicyNames) {
+		return overflowPolicyNames[p]
+	}
+	return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+}
+
+// ParseOverflowPolicy returns the policy with the given name, as returned by
+// String.
+func ParseOverflowPolicy(name string) (OverflowPolicy, bool) {
+	for i, policyName := range overflowPolicyNames {
+		if strings.EqualFold(name, policyName) {
+			return OverflowPolicy(i), true
+		}
+	}
+	return 0, false
+}
+
+// SetOverflowPolicy sets what LogWrite does when the queue of records waiting
+// to be written is full (chainable).  OverflowBlock, the default, waits for
+// room; the others shed records instead, so that a slow disk doesn't stall
+// latency-sensitive callers.  Dropped records are counted by DroppedRecords.
+func (w *FileLogWriter) SetOverflowPolicy(policy OverflowPolicy) *FileLogWriter {
+	atomic.StoreInt32(&w.overflow, int32(policy))
+	return w
+}
+
+// DroppedRecords returns how many records have been dropped because the queue
+// was full.
+func (w *FileLogWriter) DroppedRecords() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
+
+// Queue a record, applying the overflow policy if the queue is full
+func (w *FileLogWriter) enqueue(rec *LogRecord) {
+	token := w.queue.push(time.Now())
+	atomic.AddUint64(&w.queued, 1)
+
+	switch OverflowPolicy(atomic.LoadInt32(&w.overflow)) {
+	case OverflowDropNewest:
+		select {
+		case w.rec <- rec:
+		default:
+			w.queue.unpush(token)
+			atomic.AddUint64(&w.queued, ^uint64(0))
+			atomic.AddUint64(&w.dropped, 1)
+			rec.release()
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case w.rec <- rec:
+				return
+			default:
+			}
+			select {
+			case dropped := <-w.rec:
+				w.queue.pop()
+				atomic.AddUint64(&w.dequeued, 1)
+				atomic.AddUint64(&w.dropped, 1)
+				dropped.release()
+			default:
+			}
+		}
+	default:
+		w.rec <- rec
+	}
+}
@@ -6,6 +6,12 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"os"
+	"path"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 const (
@@ -33,15 +39,73 @@ var millisFormatCache = &struct {
 	millisTime string
 }{}
 
+// The process ID, host name and build, looked up once for %P, %H and %V
+var (
+	formatPID      = strconv.Itoa(os.Getpid())
+	formatHostname = func() string {
+		host, _ := os.Hostname()
+		return host
+	}()
+	formatVersion = buildVersion()
+)
+
+// Describe the running build by its main module's version and the VCS
+// revision it was built from, such as "v1.2.0 3f2a9c1d7e4b-dirty"
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	var parts []string
+	if v := info.Main.Version; len(v) > 0 && v != "(devel)" {
+		parts = append(parts, v)
+	}
+	revision, modified := "", false
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	if len(revision) > 0 && modified {
+		revision += "-dirty"
+	}
+	if len(revision) > 0 {
+		parts = append(parts, revision)
+	}
+	if len(parts) == 0 {
+		return "unknown"
+	}
+	return strings.Join(parts, " ")
+}
+
 // Known format codes:
 // %A - Time w/ milliseconds (15:04:05.000)
 // %T - Time (15:04:05 MST)
+// %T{layout} - Time in any Go layout, e.g. %T{2006-01-02T15:04:05.000Z07:00}
 // %t - Time (15:04)
 // %D - Date (2006/01/02)
 // %d - Date (01/02/06)
 // %L - Level (FNST, FINE, DEBG, TRAC, WARN, EROR, CRIT)
-// %S - Source
+// %S - Source (package/path.Function:line)
+// %S{full} - Source file path and line
+// %S{short} - Source file name and line
+// %S{pkg} - Source function, qualified by its package name only
+// %F - Source function's name, without its package, e.g. (*Server).Get
 // %M - Message
+// %X - Fields (key=value pairs, sorted by key)
+// %X{key} - The field key, as log4j's MDC lookup would have it
+// %P - Process ID
+// %H - Host name
+// %G - Goroutine ID, if the logger notes them (see Logger.SetGoroutineIDs)
+// %K - Stack trace on the following lines, if captured (see Logger.SetStackTraces)
+// %E{VAR} - The environment variable VAR
+// %V - Version and VCS revision of the running build, as far as it knows them
 // Ignores unknown formats
 // Recommended: "[%D %T] [%L] (%S) %M"
 func FormatLogRecord(format string, rec *LogRecord) string {
@@ -89,11 +153,17 @@ func FormatLogRecord(format string, rec *LogRecord) string {
 	// Iterate over the pieces, replacing known formats
 	for i, piece := range pieces {
 		if i > 0 && len(piece) > 0 {
+			rest := piece[1:]
 			switch piece[0] {
 			case 'A':
 				out.WriteString(millisFormatCache.millisTime)
 			case 'T':
-				out.WriteString(timeFormatCache.longTime)
+				if layout, after, ok := formatArgument(rest); ok {
+					out.WriteString(rec.Created.Format(layout))
+					rest = after
+				} else {
+					out.WriteString(timeFormatCache.longTime)
+				}
 			case 't':
 				out.WriteString(timeFormatCache.shortTime)
 			case 'D':
@@ -103,13 +173,47 @@ func FormatLogRecord(format string, rec *LogRecord) string {
 			case 'L':
 				out.WriteString(levelStrings[rec.Level])
 			case 'S':
-				out.WriteString(rec.Source)
+				if form, after, ok := formatArgument(rest); ok {
+					out.WriteString(formatSource(form, rec))
+					rest = after
+				} else {
+					out.WriteString(rec.Source)
+				}
 			case 'M':
 				out.WriteString(rec.Message)
+			case 'F':
+				out.WriteString(formatFunction(rec))
+			case 'P':
+				out.WriteString(formatPID)
+			case 'H':
+				out.WriteString(formatHostname)
+			case 'G':
+				if rec.Goroutine != 0 {
+					out.WriteString(strconv.FormatUint(rec.Goroutine, 10))
+				}
+			case 'K':
+				if len(rec.Stack) > 0 {
+					out.WriteByte('\n')
+					out.WriteString(rec.Stack)
+				}
+			case 'E':
+				if name, after, ok := formatArgument(rest); ok {
+					out.WriteString(os.Getenv(name))
+					rest = after
+				}
+			case 'V':
+				out.WriteString(formatVersion)
+			case 'X':
+				if key, after, ok := formatArgument(rest); ok {
+					if value, found := rec.Fields[key]; found {
+						fmt.Fprint(out, value)
+					}
+					rest = after
+				} else {
+					writeFields(out, rec.Fields)
+				}
 			}
-			if len(piece) > 1 {
-				out.Write(piece[1:])
-			}
+			out.Write(rest)
 		} else if len(piece) > 0 {
 			out.Write(piece)
 		}
@@ -119,19 +223,105 @@ func FormatLogRecord(format string, rec *LogRecord) string {
 	return out.String()
 }
 
+// Split off the {argument} following a format code, if there is one
+func formatArgument(rest []byte) (arg string, after []byte, ok bool) {
+	if len(rest) == 0 || rest[0] != '{' {
+		return "", rest, false
+	}
+	end := bytes.IndexByte(rest, '}')
+	if end < 0 {
+		return "", rest, false
+	}
+	return string(rest[1:end]), rest[end+1:], true
+}
+
+// Render a record's source in one of the forms %S takes.  Records made other
+// than by a Logger's own methods don't know their file, so the forms needing
+// one are taken from the source instead.
+func formatSource(form string, rec *LogRecord) string {
+	switch form {
+	case "full":
+		if len(rec.file) > 0 {
+			return rec.file + ":" + strconv.Itoa(rec.line)
+		}
+	case "short":
+		if len(rec.file) > 0 {
+			return path.Base(rec.file) + ":" + strconv.Itoa(rec.line)
+		}
+		return rec.Source[strings.LastIndex(rec.Source, "/")+1:]
+	case "pkg":
+		function := rec.Source
+		if colon := strings.LastIndex(function, ":"); colon >= 0 && len(strings.Trim(function[colon+1:], "0123456789")) == 0 {
+			function = function[:colon]
+		}
+		return function[strings.LastIndex(function, "/")+1:]
+	}
+	return rec.Source
+}
+
+// The name of the function a record was logged from, without its package
+func formatFunction(rec *LogRecord) string {
+	function := rec.function
+	if len(function) > 0 {
+		function = function[strings.LastIndex(function, "/")+1:]
+	} else {
+		function = formatSource("pkg", rec)
+	}
+	return trimPackage(function)
+}
+
+// Cut the package name from a function name without its import path.  The
+// package name ends at the first dot, except for the version elements of
+// paths such as gopkg.in/yaml.v2, so yaml.v2.(*T).M gives (*T).M.
+func trimPackage(function string) string {
+	dot := strings.Index(function, ".")
+	for dot >= 0 {
+		rest := function[dot+1:]
+		digits := strings.TrimPrefix(rest, "v")
+		after := strings.TrimLeft(digits, "0123456789")
+		if digits == rest || after == digits || !strings.HasPrefix(after, ".") {
+			break
+		}
+		dot = len(function) - len(after)
+	}
+	return function[dot+1:]
+}
+
+// Write fields as space-separated key=value pairs in key order
+func writeFields(out *bytes.Buffer, fields Fields) {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		if i > 0 {
+			out.WriteByte(' ')
+		}
+		fmt.Fprintf(out, "%s=%v", k, fields[k])
+	}
+}
+
 // This is the standard writer that prints to standard output.
 type FormatLogWriter chan *LogRecord
 
 // This creates a new FormatLogWriter
 func NewFormatLogWriter(out io.Writer, format string) FormatLogWriter {
+	return NewEncodedLogWriter(out, NewFormatEncoder(format))
+}
+
+// This creates a new FormatLogWriter which writes records encoded with enc
+func NewEncodedLogWriter(out io.Writer, enc Encoder) FormatLogWriter {
 	records := make(FormatLogWriter, LogBufferLength)
-	go records.run(out, format)
+	go records.run(out, enc)
 	return records
 }
 
-func (w FormatLogWriter) run(out io.Writer, format string) {
+func (w FormatLogWriter) run(out io.Writer, enc Encoder) {
 	for rec := range w {
-		fmt.Fprint(out, FormatLogRecord(format, rec))
+		if buf, err := encodeRecord(enc, rec); err == nil {
+			out.Write(buf)
+		}
 	}
 }
 
@@ -141,6 +331,12 @@ func (w FormatLogWriter) LogWrite(rec *LogRecord) {
 	w <- rec
 }
 
+// QueueStats reports on the records waiting to be written.  The age of the
+// oldest record is not tracked.
+func (w FormatLogWriter) QueueStats() QueueStats {
+	return QueueStats{Length: len(w), Capacity: cap(w)}
+}
+
 // Close stops the logger from sending messages to standard output.  Attempts to
 // send log messages to this logger after a Close have undefined behavior.
 func (w FormatLogWriter) Close() {
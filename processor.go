@@ -0,0 +1,111 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+)
+
+// A Processor is run by the Logger on every record before it is dispatched to
+// the filters.  It may enrich, redact or otherwise transform the record and
+// return it (or a replacement), or return nil to drop the record entirely.
+// Processors are run in the order they were added.
+type Processor interface {
+	Process(rec *LogRecord) *LogRecord
+}
+
+// ProcessorFunc adapts an ordinary function into a Processor.
+type ProcessorFunc func(rec *LogRecord) *LogRecord
+
+// Process calls f(rec).
+func (f ProcessorFunc) Process(rec *LogRecord) *LogRecord {
+	return f(rec)
+}
+
+// AddProcessor appends processors to the chain run on every record before it
+// is dispatched.  Returns the logger for chaining.
+func (log Logger) AddProcessor(processors ...Processor) Logger {
+	log.updateSettings(func(settings *loggerSettings) {
+		chain := make([]Processor, 0, len(settings.processors)+len(processors))
+		chain = append(chain, settings.processors...)
+		settings.processors = append(chain, processors...)
+	})
+	return log
+}
+
+// SetProcessors replaces the processor chain; with no arguments, all processors
+// are removed.  Returns the logger for chaining.
+func (log Logger) SetProcessors(processors ...Processor) Logger {
+	log.updateSettings(func(settings *loggerSettings) {
+		settings.processors = append([]Processor(nil), processors...)
+	})
+	return log
+}
+
+// Processors returns the current processor chain.
+func (log Logger) Processors() []Processor {
+	return append([]Processor(nil), log.settings().processors...)
+}
+
+// A ProcessorFactory builds a Processor from the properties given for it in a
+// configuration file.
+type ProcessorFactory func(props map[string]string) (Processor, error)
+
+var (
+	processorFactoriesLock sync.RWMutex
+	processorFactories     = map[string]ProcessorFactory{
+		"redact": newRedactProcessorFromProps,
+	}
+)
+
+// RegisterProcessor makes a processor type available to configuration files
+// under the given name.  Registering an existing name replaces it.
+func RegisterProcessor(name string, factory ProcessorFactory) {
+	processorFactoriesLock.Lock()
+	defer processorFactoriesLock.Unlock()
+	processorFactories[name] = factory
+}
+
+// Look up a processor type registered with RegisterProcessor
+func lookupProcessor(name string) (ProcessorFactory, bool) {
+	processorFactoriesLock.RLock()
+	defer processorFactoriesLock.RUnlock()
+	factory, ok := processorFactories[name]
+	return factory, ok
+}
+
+// RedactProcessor replaces every match of a regular expression in the message
+// with a replacement string (which may use $1 style references).
+type RedactProcessor struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// NewRedactProcessor compiles pattern into a RedactProcessor.
+func NewRedactProcessor(pattern, replacement string) (*RedactProcessor, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &RedactProcessor{Pattern: re, Replacement: replacement}, nil
+}
+
+// Process redacts the record's message.
+func (p *RedactProcessor) Process(rec *LogRecord) *LogRecord {
+	rec.Message = p.Pattern.ReplaceAllString(rec.Message, p.Replacement)
+	return rec
+}
+
+func newRedactProcessorFromProps(props map[string]string) (Processor, error) {
+	pattern, ok := props["pattern"]
+	if !ok {
+		return nil, fmt.Errorf("required property %q missing", "pattern")
+	}
+	replacement, ok := props["replacement"]
+	if !ok {
+		replacement = "[REDACTED]"
+	}
+	return NewRedactProcessor(pattern, replacement)
+}
@@ -0,0 +1,137 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"sync"
+	"time"
+)
+
+// QueueStats describes the records waiting in a writer's queue.
+type QueueStats struct {
+	Length    int           // Number of records waiting to be written
+	Capacity  int           // Size of the queue's buffer
+	OldestAge time.Duration // How long the oldest waiting record has waited
+}
+
+// A QueueReporter is a LogWriter which queues records and can report on the
+// state of its queue.
+type QueueReporter interface {
+	QueueStats() QueueStats
+}
+
+// An Unwrapper is a LogWriter which decorates another, such as those built by
+// a WriterMiddleware.
+type Unwrapper interface {
+	Unwrap() LogWriter
+}
+
+// QueueStats returns the queue statistics for each filter whose writer (or
+// the writer it decorates) queues records, keyed by filter name.
+func (log Logger) QueueStats() map[string]QueueStats {
+	filtersLock.RLock()
+	defer filtersLock.RUnlock()
+
+	stats := make(map[string]QueueStats)
+	for name, filt := range log {
+		var w LogWriter = filt.LogWriter
+		for w != nil {
+			if qr, ok := w.(QueueReporter); ok {
+				stats[name] = qr.QueueStats()
+				break
+			}
+			u, ok := w.(Unwrapper)
+			if !ok {
+				break
+			}
+			w = u.Unwrap()
+		}
+	}
+	return stats
+}
+
+// Tracks when each queued record was enqueued, in order, so the age of the
+// oldest can be reported.  A nil tracker tracks nothing.
+type queueTracker struct {
+	mu      sync.Mutex
+	entries []queueEntry
+	head    int
+	next    uint64
+}
+
+// A queued record's enqueue time, tagged with the token push returned for it
+type queueEntry struct {
+	token uint64
+	t     time.Time
+}
+
+func newQueueTracker() *queueTracker {
+	return &queueTracker{}
+}
+
+// Note that a record has been queued, returning a token which unpush takes
+// to forget it again
+func (q *queueTracker) push(t time.Time) uint64 {
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// Reclaim the space used by dequeued entries once it's the bulk of the slice
+	if q.head > 0 && q.head >= len(q.entries)/2 {
+		n := copy(q.entries, q.entries[q.head:])
+		q.entries = q.entries[:n]
+		q.head = 0
+	}
+	q.next++
+	q.entries = append(q.entries, queueEntry{q.next, t})
+	return q.next
+}
+
+// Forget the record push returned token for, which wasn't queued after all.
+// Other goroutines may have queued records since, so the entry is looked up
+// rather than assumed to be the last.  If a pop has already taken it (popping
+// for a record queued after it), the oldest entry left is forgotten instead,
+// since that record's own pop is still to come.
+func (q *queueTracker) unpush(token uint64) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i := len(q.entries) - 1; i >= q.head; i-- {
+		if q.entries[i].token == token {
+			q.entries = append(q.entries[:i], q.entries[i+1:]...)
+			return
+		}
+	}
+	if q.head < len(q.entries) {
+		q.head++
+	}
+}
+
+// Note that the oldest queued record has been taken off the queue
+func (q *queueTracker) pop() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.head < len(q.entries) {
+		q.head++
+	}
+}
+
+// Age of the oldest queued record, or zero if the queue is empty
+func (q *queueTracker) oldestAge(now time.Time) time.Duration {
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.head >= len(q.entries) {
+		return 0
+	}
+	return now.Sub(q.entries[q.head].t)
+}
@@ -0,0 +1,72 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// QuietHoursLogWriter wraps another LogWriter and raises its minimum level
+// during recurring windows, for example to suppress DEBUG output while a
+// nightly batch job runs.  Each window opens at a time given by a Schedule and
+// stays open for a fixed duration.
+type QuietHoursLogWriter struct {
+	LogWriter
+
+	schedule *Schedule
+	duration time.Duration
+	level    Level
+
+	mu          sync.Mutex
+	nextStart   time.Time
+	activeUntil time.Time
+}
+
+// NewQuietHoursLogWriter returns a LogWriter which drops records below lvl that
+// are created within duration of a time matched by the schedule spec, and
+// passes everything else through to w.  Returns nil if spec is invalid.
+func NewQuietHoursLogWriter(w LogWriter, spec string, duration time.Duration, lvl Level) *QuietHoursLogWriter {
+	schedule, err := ParseSchedule(spec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "NewQuietHoursLogWriter(%q): %s\n", spec, err)
+		return nil
+	}
+
+	return &QuietHoursLogWriter{
+		LogWriter: w,
+		schedule:  schedule,
+		duration:  duration,
+		level:     lvl,
+		// Start looking one window back so that a window already in progress counts
+		nextStart: schedule.Next(time.Now().Add(-duration)),
+	}
+}
+
+// Quiet reports whether t falls inside a quiet window.  Times are expected to be
+// roughly increasing, as they are for records coming from a Logger.
+func (w *QuietHoursLogWriter) Quiet(t time.Time) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for !w.nextStart.IsZero() && !t.Before(w.nextStart) {
+		w.activeUntil = w.nextStart.Add(w.duration)
+		w.nextStart = w.schedule.Next(w.nextStart)
+	}
+	return t.Before(w.activeUntil)
+}
+
+// Unwrap returns the writer being decorated.
+func (w *QuietHoursLogWriter) Unwrap() LogWriter {
+	return w.LogWriter
+}
+
+// This is the QuietHoursLogWriter's output method
+func (w *QuietHoursLogWriter) LogWrite(rec *LogRecord) {
+	if rec.Level < w.level && w.Quiet(rec.Created) {
+		return
+	}
+	w.LogWriter.LogWrite(rec)
+}
@@ -0,0 +1,490 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Layouts of the date and time in the text formats: FORMAT_DEFAULT (and the
+// XML writer's timestamp), FORMAT_MILLIS and FORMAT_SHORT
+var readerTimeLayouts = []string{
+	"2006/01/02 15:04:05 MST",
+	"2006/01/02 15:04:05.000",
+	"15:04 01/02/06",
+}
+
+// LogReader reads records back from log output: the text formats
+// (FORMAT_DEFAULT, FORMAT_MILLIS, FORMAT_SHORT and FORMAT_ABBREV), XML as
+// written by NewXMLLogWriter or XMLEncoder, JSON as written by JSONEncoder or
+// NewSocketLogWriter, and logfmt as written by LogfmtEncoder.  The format is
+// recognized record by record, so files whose format changed part way through
+// can be read.
+//
+// Lines which continue a text record (such as the rest of a multi-line
+// message) are appended to its message.  Other lines which aren't part of a
+// record, such as a file's header, are skipped.  A footer can't be told from
+// the rest of the last record's message unless the reader is given it with
+// SetHeadFoot.
+//
+//	r := NewLogReader(file)
+//	for r.Next() {
+//		rec := r.Record()
+//		...
+//	}
+//	if err := r.Err(); err != nil {
+//		...
+//	}
+type LogReader struct {
+	in      *bufio.Reader
+	closers []io.Closer
+
+	rec     *LogRecord
+	raw     []byte
+	line    int
+	skipped int
+	err     error
+
+	// A line read ahead while looking for the end of a text record
+	pending    []byte
+	hasPending bool
+	lineNo     int
+
+	// Patterns matching the lines of the header and footer
+	header, footer []*regexp.Regexp
+
+	// The lines skipped since the last record
+	trailer [][]byte
+}
+
+// NewLogReader returns a LogReader reading from r.
+func NewLogReader(r io.Reader) *LogReader {
+	return &LogReader{in: bufio.NewReader(r)}
+}
+
+// OpenLogFile opens the named log file for reading.  Rotated files which have
+// been compressed (ending in .gz or .zip) are decompressed as they are read.
+// The LogReader should be closed when it is no longer needed.
+func OpenLogFile(filename string) (*LogReader, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var in io.Reader = fd
+	closers := []io.Closer{fd}
+	switch filepath.Ext(filename) {
+	case ".gz":
+		gz, err := gzip.NewReader(fd)
+		if err != nil {
+			fd.Close()
+			return nil, fmt.Errorf("%s: %s", filename, err)
+		}
+		in = gz
+	case ".zip":
+		info, err := fd.Stat()
+		if err != nil {
+			fd.Close()
+			return nil, err
+		}
+		zr, err := zip.NewReader(fd, info.Size())
+		if err == nil && len(zr.File) != 1 {
+			err = fmt.Errorf("expected a single log file, found %d", len(zr.File))
+		}
+		if err != nil {
+			fd.Close()
+			return nil, fmt.Errorf("%s: %s", filename, err)
+		}
+		entry, err := zr.File[0].Open()
+		if err != nil {
+			fd.Close()
+			return nil, fmt.Errorf("%s: %s", filename, err)
+		}
+		in = entry
+		closers = append(closers, entry)
+	}
+
+	r := NewLogReader(in)
+	r.closers = closers
+	return r, nil
+}
+
+// SetHeadFoot gives the reader the header and footer the input was written
+// with, as given to FileLogWriter.SetHeadFoot, so that their lines are skipped
+// rather than taken as continuing the record before them (chainable).  Format
+// codes in them match any text.
+func (r *LogReader) SetHeadFoot(head, foot string) *LogReader {
+	r.header, r.footer = headFootPatterns(head), headFootPatterns(foot)
+	return r
+}
+
+// EndsWithFooter reports whether the lines after the last record include
+// those of the footer given to SetHeadFoot, in order, as they do in a file
+// which was closed cleanly.  It is only meaningful once Next has returned
+// false.
+func (r *LogReader) EndsWithFooter() bool {
+	matched := 0
+	for _, line := range r.trailer {
+		if matched < len(r.footer) && r.footer[matched].Match(bytes.TrimRight(line, "\r\n")) {
+			matched++
+		}
+	}
+	return len(r.footer) > 0 && matched == len(r.footer)
+}
+
+// Patterns matching each line of a header or footer, with format codes
+// matching any text.  Lines made only of format codes would match nearly
+// anything, so are left out.
+func headFootPatterns(format string) []*regexp.Regexp {
+	var patterns []*regexp.Regexp
+	for _, line := range strings.Split(format, "\n") {
+		pattern, literal := "^", ""
+		for i, piece := range strings.Split(line, "%") {
+			if i > 0 && len(piece) > 0 {
+				pattern += ".*"
+				_, after, _ := formatArgument([]byte(piece[1:]))
+				piece = string(after)
+			}
+			pattern += regexp.QuoteMeta(piece)
+			literal += piece
+		}
+		if len(strings.TrimSpace(literal)) > 0 {
+			patterns = append(patterns, regexp.MustCompile(pattern+"$"))
+		}
+	}
+	return patterns
+}
+
+// Whether a line is part of the header or footer
+func (r *LogReader) isHeadFoot(line []byte) bool {
+	line = bytes.TrimRight(line, "\r\n")
+	for _, pattern := range append(r.header, r.footer...) {
+		if pattern.Match(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// Close closes the file opened by OpenLogFile.
+func (r *LogReader) Close() error {
+	var err error
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		if cerr := r.closers[i].Close(); err == nil {
+			err = cerr
+		}
+	}
+	r.closers = nil
+	return err
+}
+
+// Next advances to the next record, returning false at the end of the input
+// or if an error occurs.
+func (r *LogReader) Next() bool {
+	r.rec, r.raw = nil, nil
+	if r.err != nil {
+		return false
+	}
+
+	for {
+		line, ok := r.readLine()
+		if !ok {
+			return false
+		}
+		start := r.lineNo
+
+		if rec, ok := parseRecordLine(line); ok {
+			r.rec, r.raw, r.line, r.trailer = rec, line, start, r.trailer[:0]
+			if isTextRecord(line) {
+				r.readContinuation()
+			}
+			return true
+		}
+
+		if bytes.HasPrefix(bytes.TrimSpace(line), []byte("<record")) {
+			raw := r.readXMLRecord(line)
+			if rec, ok := parseXMLRecord(raw); ok {
+				r.rec, r.raw, r.line, r.trailer = rec, raw, start, r.trailer[:0]
+				return true
+			}
+			r.skipped += r.lineNo - start + 1
+			r.trailer = append(r.trailer, raw)
+			continue
+		}
+
+		r.skipped++
+		r.trailer = append(r.trailer, line)
+	}
+}
+
+// Record returns the current record.
+func (r *LogReader) Record() *LogRecord {
+	return r.rec
+}
+
+// Raw returns the lines the current record was read from, including their
+// line endings.
+func (r *LogReader) Raw() []byte {
+	return r.raw
+}
+
+// Line returns the line number on which the current record starts.
+func (r *LogReader) Line() int {
+	return r.line
+}
+
+// Skipped returns the number of lines so far which weren't part of a record.
+func (r *LogReader) Skipped() int {
+	return r.skipped
+}
+
+// Err returns the first error encountered while reading, if any.
+func (r *LogReader) Err() error {
+	return r.err
+}
+
+// Read the next line, or the line read ahead
+func (r *LogReader) readLine() ([]byte, bool) {
+	if r.hasPending {
+		r.hasPending = false
+		return r.pending, true
+	}
+	line, err := r.in.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		r.err = err
+		return nil, false
+	}
+	if len(line) == 0 {
+		return nil, false
+	}
+	r.lineNo++
+	return line, true
+}
+
+// Append lines which don't start a record, and aren't part of the header or
+// footer, to the current text record
+func (r *LogReader) readContinuation() {
+	for {
+		line, ok := r.readLine()
+		if !ok {
+			return
+		}
+		if startsRecord(line) || r.isHeadFoot(line) {
+			r.pending, r.hasPending = line, true
+			return
+		}
+		r.raw = append(r.raw, line...)
+		r.rec.Message += "\n" + strings.TrimRight(string(line), "\r\n")
+	}
+}
+
+// Gather the lines of an XML record through its closing tag
+func (r *LogReader) readXMLRecord(first []byte) []byte {
+	raw := append([]byte(nil), first...)
+	for !bytes.Contains(raw, []byte("</record>")) {
+		line, ok := r.readLine()
+		if !ok {
+			break
+		}
+		raw = append(raw, line...)
+	}
+	return raw
+}
+
+// Whether line starts a record in any format
+func startsRecord(line []byte) bool {
+	if _, ok := parseRecordLine(line); ok {
+		return true
+	}
+	return bytes.HasPrefix(bytes.TrimSpace(line), []byte("<record"))
+}
+
+func isTextRecord(line []byte) bool {
+	return bytes.HasPrefix(line, []byte("["))
+}
+
+// Parse a record held on a single line
+func parseRecordLine(line []byte) (*LogRecord, bool) {
+	line = bytes.TrimRight(line, "\r\n")
+	switch {
+	case bytes.HasPrefix(line, []byte("{")):
+		return parseJSONRecord(line)
+	case bytes.HasPrefix(line, []byte("[")):
+		return parseTextRecord(string(line))
+	case bytes.HasPrefix(line, []byte("time=")):
+		return parseLogfmtRecord(string(line))
+	}
+	return nil, false
+}
+
+// Parse a record in one of the text formats
+func parseTextRecord(line string) (*LogRecord, bool) {
+	end := strings.IndexByte(line, ']')
+	if end < 0 {
+		return nil, false
+	}
+	stamp, rest := line[1:end], line[end+1:]
+
+	// FORMAT_ABBREV has only the level in the first brackets
+	if lvl, ok := ParseLevel(stamp); ok {
+		return &LogRecord{Level: lvl, Message: strings.TrimPrefix(rest, " ")}, true
+	}
+
+	rec := &LogRecord{}
+	parsed := false
+	for _, layout := range readerTimeLayouts {
+		if t, err := time.ParseInLocation(layout, stamp, time.Local); err == nil {
+			rec.Created, parsed = t, true
+			break
+		}
+	}
+	if !parsed {
+		return nil, false
+	}
+
+	rest = strings.TrimPrefix(rest, " ")
+	if len(rest) < 6 || rest[0] != '[' || rest[5] != ']' {
+		return nil, false
+	}
+	lvl, ok := ParseLevel(rest[1:5])
+	if !ok {
+		return nil, false
+	}
+	rec.Level = lvl
+	rest = strings.TrimPrefix(rest[6:], " ")
+
+	// The source, if present, is in parentheses
+	if strings.HasPrefix(rest, "(") {
+		if paren := strings.Index(rest, ") "); paren >= 0 {
+			rec.Source, rest = rest[1:paren], rest[paren+2:]
+		} else if strings.HasSuffix(rest, ")") {
+			rec.Source, rest = rest[1:len(rest)-1], ""
+		}
+	}
+	rec.Message = rest
+	return rec, true
+}
+
+// Parse a record written by JSONEncoder, or by json.Marshal as the
+// SocketLogWriter does
+func parseJSONRecord(line []byte) (*LogRecord, bool) {
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(line, &keys); err != nil {
+		return nil, false
+	}
+
+	if _, ok := keys["Created"]; ok {
+		rec := &LogRecord{}
+		if err := json.Unmarshal(line, rec); err != nil {
+			return nil, false
+		}
+		return rec, true
+	}
+
+	var js jsonRecord
+	if err := json.Unmarshal(line, &js); err != nil {
+		return nil, false
+	}
+	lvl, ok := ParseLevel(js.Level)
+	if !ok {
+		return nil, false
+	}
+	return &LogRecord{
+		Level:   lvl,
+		Created: js.Created,
+		Source:  js.Source,
+		Message: js.Message,
+		Fields:  js.Fields,
+	}, true
+}
+
+// Parse a record written by LogfmtEncoder.  Fields are read back as strings.
+func parseLogfmtRecord(line string) (*LogRecord, bool) {
+	rec := &LogRecord{}
+	sawLevel := false
+	for line = strings.TrimSpace(line); len(line) > 0; line = strings.TrimLeft(line, " ") {
+		eq := strings.IndexByte(line, '=')
+		if eq <= 0 || strings.ContainsAny(line[:eq], " \"") {
+			return nil, false
+		}
+		key := line[:eq]
+		line = line[eq+1:]
+
+		var value string
+		if strings.HasPrefix(line, "\"") {
+			quoted, err := strconv.QuotedPrefix(line)
+			if err != nil {
+				return nil, false
+			}
+			value, _ = strconv.Unquote(quoted)
+			line = line[len(quoted):]
+		} else if sp := strings.IndexByte(line, ' '); sp >= 0 {
+			value, line = line[:sp], line[sp:]
+		} else {
+			value, line = line, ""
+		}
+
+		switch key {
+		case "time":
+			t, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				return nil, false
+			}
+			rec.Created = t
+		case "level":
+			lvl, ok := ParseLevel(value)
+			if !ok {
+				return nil, false
+			}
+			rec.Level, sawLevel = lvl, true
+		case "source":
+			rec.Source = value
+		case "msg":
+			rec.Message = value
+		default:
+			if rec.Fields == nil {
+				rec.Fields = make(Fields)
+			}
+			rec.Fields[key] = value
+		}
+	}
+	return rec, sawLevel
+}
+
+// The shape of a <record> element
+type xmlRecord struct {
+	Level     string `xml:"level,attr"`
+	Timestamp string `xml:"timestamp"`
+	Source    string `xml:"source"`
+	Message   string `xml:"message"`
+}
+
+// Parse a record written by NewXMLLogWriter or XMLEncoder
+func parseXMLRecord(raw []byte) (*LogRecord, bool) {
+	var x xmlRecord
+	if err := xml.Unmarshal(raw, &x); err != nil {
+		return nil, false
+	}
+	lvl, ok := ParseLevel(x.Level)
+	if !ok {
+		return nil, false
+	}
+	t, err := time.ParseInLocation(readerTimeLayouts[0], x.Timestamp, time.Local)
+	if err != nil {
+		return nil, false
+	}
+	return &LogRecord{Level: lvl, Created: t, Source: x.Source, Message: x.Message}, true
+}
@@ -0,0 +1,82 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Records recycled by loggers with pooling turned on
+var recordPool = sync.Pool{
+	New: func() interface{} { return new(LogRecord) },
+}
+
+// A recordReleaser is a LogWriter which releases each record once it has
+// finished with it, so that pooled records sent to it can be reused.
+type recordReleaser interface {
+	releasesRecords()
+}
+
+// SetRecordPooling makes the logger take the records it creates from a pool,
+// and return them once every writer has finished with them, cutting garbage
+// for services logging many records a second.  Returns the logger for
+// chaining.
+//
+// A record is only recycled if every writer it is sent to releases it, which
+// FileLogWriters (undecorated) do; records sent to any other writer are left
+// to the garbage collector as usual.  Hooks and processors must not keep the
+// records they are given once pooling is on.
+func (log Logger) SetRecordPooling(enabled bool) Logger {
+	log.updateSettings(func(settings *loggerSettings) {
+		settings.pooling = enabled
+	})
+	return log
+}
+
+// Make a record, from the pool if the logger is pooling them
+func (log Logger) newRecord(lvl Level, source, message string) *LogRecord {
+	settings := log.settings()
+	var rec *LogRecord
+	if !settings.pooling {
+		rec = &LogRecord{Level: lvl, Created: time.Now(), Source: source, Message: message}
+	} else {
+		rec = recordPool.Get().(*LogRecord)
+		rec.Level, rec.Created, rec.Source, rec.Message = lvl, time.Now(), source, message
+		rec.refs = 1
+	}
+	if settings.goroutines {
+		rec.Goroutine = goroutineID()
+	}
+	if settings.stacks && lvl >= settings.stackLevel {
+		rec.Stack = stackTrace()
+	}
+	return rec
+}
+
+// Note that the holder of a reference has finished with the record, putting
+// it back in the pool once nothing else holds one.  Records which weren't
+// taken from the pool hold no references, so they are never put back.
+func (rec *LogRecord) release() {
+	if rec == nil || atomic.AddInt32(&rec.refs, -1) != 0 {
+		return
+	}
+	*rec = LogRecord{}
+	recordPool.Put(rec)
+}
+
+// Give each of the writers a pooled record is about to be sent to a reference
+// to it, or if any of them won't release it, take it out of the pool's hands
+func (rec *LogRecord) share(writers []LogWriter) {
+	if atomic.LoadInt32(&rec.refs) <= 0 {
+		return
+	}
+	for _, w := range writers {
+		if _, ok := w.(recordReleaser); !ok {
+			atomic.StoreInt32(&rec.refs, 0)
+			return
+		}
+	}
+	atomic.AddInt32(&rec.refs, int32(len(writers)))
+}
@@ -0,0 +1,274 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// RedisLogWriter adds records to a Redis stream with XADD, or to a list with
+// RPUSH, so that Redis can buffer them in front of their consumers.  Records
+// are sent in batches, pipelined over one connection, which is reopened if
+// it fails.
+//
+// Stream entries have the fields level, time, source and message, followed
+// by the record's own fields; list items are encoded records, JSON by
+// default.
+type RedisLogWriter struct {
+	*batchWriter
+
+	addr     string
+	key      string
+	list     bool
+	maxLen   int
+	password string
+	db       int
+	enc      Encoder
+
+	conn net.Conn
+	in   *bufio.Reader
+}
+
+// NewRedisLogWriter creates a LogWriter which adds each record to the stream
+// key on the Redis server at addr.
+func NewRedisLogWriter(addr, key string) *RedisLogWriter {
+	conn, err := net.DialTimeout("tcp", addr, 30*time.Second)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "NewRedisLogWriter(%q): %s\n", addr, err)
+		return nil
+	}
+
+	w := &RedisLogWriter{
+		addr: addr,
+		key:  key,
+		enc:  JSONEncoder{},
+		conn: conn,
+		in:   bufio.NewReader(conn),
+	}
+	w.batchWriter = newBatchWriter(fmt.Sprintf("RedisLogWriter(%q)", addr), w.send)
+	w.maxInFlight = 1 // One connection, in order
+	return w
+}
+
+// SetList makes the writer RPUSH records onto a list rather than adding them
+// to a stream (chainable).  Must be called before the first log message is
+// written.
+func (w *RedisLogWriter) SetList(list bool) *RedisLogWriter {
+	w.list = list
+	return w
+}
+
+// SetMaxLen trims the stream or list to about maxLen records as they are
+// added, or leaves it to grow if maxLen is zero (chainable).  Streams are
+// trimmed with MAXLEN ~, which Redis may let run a little over.  Must be
+// called before the first log message is written.
+func (w *RedisLogWriter) SetMaxLen(maxLen int) *RedisLogWriter {
+	w.maxLen = maxLen
+	return w
+}
+
+// SetAuth sets the password to AUTH with and the database to SELECT on each
+// connection (chainable).  The current connection is unaffected, so this
+// should be called straight after NewRedisLogWriter, before the first log
+// message is written.
+func (w *RedisLogWriter) SetAuth(password string, db int) *RedisLogWriter {
+	w.password, w.db = password, db
+	w.conn.Close()
+	w.conn = nil
+	return w
+}
+
+// SetEncoder sets how each record is encoded for a list, JSONEncoder by
+// default (chainable).  Must be called before the first log message is
+// written.
+func (w *RedisLogWriter) SetEncoder(enc Encoder) *RedisLogWriter {
+	w.enc = enc
+	return w
+}
+
+// SetBatching sets the most records sent together and the longest a record
+// is held before its batch is sent, in place of BatchMaxRecords and
+// BatchFlushInterval (chainable).  Must be called before the first log
+// message is written.
+func (w *RedisLogWriter) SetBatching(maxRecords int, flushInterval time.Duration) *RedisLogWriter {
+	w.maxRecords, w.flushInterval = maxRecords, flushInterval
+	return w
+}
+
+// SetRetry sets how many times a failed batch is tried again, and the
+// shortest and longest waits before doing so, in place of BatchRetries,
+// BatchRetryMin and BatchRetryMax (chainable).  Must be called before the
+// first log message is written.
+func (w *RedisLogWriter) SetRetry(retries int, min, max time.Duration) *RedisLogWriter {
+	w.retries, w.retryMin, w.retryMax = retries, min, max
+	return w
+}
+
+// Close sends any queued records and closes the connection.
+func (w *RedisLogWriter) Close() {
+	w.batchWriter.Close()
+	if w.conn != nil {
+		w.conn.Close()
+	}
+}
+
+// Connect, authenticating and selecting the database
+func (w *RedisLogWriter) connect() error {
+	conn, err := net.DialTimeout("tcp", w.addr, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	w.conn, w.in = conn, bufio.NewReader(conn)
+
+	var cmds bytes.Buffer
+	n := 0
+	if len(w.password) > 0 {
+		writeRESP(&cmds, "AUTH", w.password)
+		n++
+	}
+	if w.db != 0 {
+		writeRESP(&cmds, "SELECT", strconv.Itoa(w.db))
+		n++
+	}
+	if err := w.pipeline(cmds.Bytes(), n); err != nil {
+		w.conn.Close()
+		w.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Send a batch of records, pipelined
+func (w *RedisLogWriter) send(batch []*LogRecord) error {
+	if w.conn == nil {
+		if err := w.connect(); err != nil {
+			return err
+		}
+	}
+
+	var cmds bytes.Buffer
+	n := 0
+	for _, rec := range batch {
+		if !w.list {
+			args := []string{"XADD", w.key}
+			if w.maxLen > 0 {
+				args = append(args, "MAXLEN", "~", strconv.Itoa(w.maxLen))
+			}
+			args = append(args, "*", "level", rec.Level.String(), "time", rec.Created.Format(time.RFC3339Nano), "source", rec.Source, "message", rec.Message)
+			keys := make([]string, 0, len(rec.Fields))
+			for k := range rec.Fields {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				args = append(args, k, fmt.Sprint(rec.Fields[k]))
+			}
+			writeRESP(&cmds, args...)
+			n++
+			continue
+		}
+
+		buf, err := encodeRecord(w.enc, rec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "RedisLogWriter(%q): Dropped record: %s\n", w.addr, err)
+			continue
+		}
+		writeRESP(&cmds, "RPUSH", w.key, string(bytes.TrimRight(buf, "\n")))
+		n++
+	}
+	if w.list && w.maxLen > 0 {
+		writeRESP(&cmds, "LTRIM", w.key, strconv.Itoa(-w.maxLen), "-1")
+		n++
+	}
+
+	err := w.pipeline(cmds.Bytes(), n)
+	if _, refused := err.(permanentError); err != nil && !refused {
+		w.conn.Close()
+		w.conn = nil
+	}
+	return err
+}
+
+// Write commands, and read the n replies, returning the first error
+func (w *RedisLogWriter) pipeline(cmds []byte, n int) error {
+	if n == 0 {
+		return nil
+	}
+	w.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer w.conn.SetDeadline(time.Time{})
+	if _, err := w.conn.Write(cmds); err != nil {
+		return err
+	}
+	var first error
+	for i := 0; i < n; i++ {
+		_, err := readRESP(w.in)
+		if _, refused := err.(permanentError); err != nil && !refused {
+			return err
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Write a command as an array of bulk strings
+func writeRESP(buf *bytes.Buffer, args ...string) {
+	fmt.Fprintf(buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+}
+
+// Read a reply: a string, integer, bulk string or array of replies.  Errors
+// sent by the server are returned as permanent errors, since sending the
+// same command again won't help.
+func readRESP(in *bufio.Reader) (interface{}, error) {
+	line, err := in.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed reply %q", line)
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, permanentError{fmt.Errorf("%s", line)}
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(in, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		replies := make([]interface{}, n)
+		for i := range replies {
+			if replies[i], err = readRESP(in); err != nil {
+				return nil, err
+			}
+		}
+		return replies, nil
+	}
+	return nil, fmt.Errorf("malformed reply %q", line)
+}
@@ -0,0 +1,229 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// RelayPollInterval is how often a FileRelay checks its file for new records
+// once it has caught up.
+var RelayPollInterval = time.Second
+
+// FileRelay follows a log file, such as one written by a FileLogWriter, and
+// forwards each record it finds to another LogWriter, typically a
+// SocketLogWriter.  This lets an application log to local files while the
+// records are also shipped elsewhere.
+//
+// The file may be in any of the line-based formats read by LogReader.  When
+// the file is rotated the relay finishes reading the old file before moving
+// on to the new one, and if the file is truncated it starts again from the
+// beginning.
+type FileRelay struct {
+	filename string
+	dest     LogWriter
+
+	stop      chan int
+	completed chan int
+
+	// A text record held until it is known that no lines continue it
+	pending *LogRecord
+
+	// The lines of an XML record seen so far
+	xmlLines []byte
+}
+
+// NewFileRelay starts forwarding records appended to filename to dest.  If
+// fromStart is true, the records already in the file are forwarded too.  The
+// file need not exist yet.
+func NewFileRelay(filename string, dest LogWriter, fromStart bool) *FileRelay {
+	r := &FileRelay{
+		filename:  filename,
+		dest:      dest,
+		stop:      make(chan int),
+		completed: make(chan int),
+	}
+	go r.run(fromStart)
+	return r
+}
+
+// Close stops the relay once it has forwarded the records already read.  The
+// destination writer is not closed.
+func (r *FileRelay) Close() {
+	close(r.stop)
+	<-r.completed
+}
+
+// Wait for the next poll, returning false if the relay has been closed
+func (r *FileRelay) wait() bool {
+	select {
+	case <-r.stop:
+		return false
+	case <-time.After(RelayPollInterval):
+		return true
+	}
+}
+
+func (r *FileRelay) run(fromStart bool) {
+	defer close(r.completed)
+	defer r.flushPending()
+
+	// Wait for the file to appear
+	fd, err := os.Open(r.filename)
+	for err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "FileRelay(%q): %s\n", r.filename, err)
+		}
+		if !r.wait() {
+			return
+		}
+		fd, err = os.Open(r.filename)
+		fromStart = true
+	}
+	defer func() { fd.Close() }()
+
+	if !fromStart {
+		if _, err := fd.Seek(0, io.SeekEnd); err != nil {
+			fmt.Fprintf(os.Stderr, "FileRelay(%q): %s\n", r.filename, err)
+		}
+	}
+
+	in := bufio.NewReader(fd)
+	var partial []byte
+	for {
+		// Forward everything that has been written so far
+		for {
+			line, err := in.ReadBytes('\n')
+			partial = append(partial, line...)
+			if err != nil {
+				break
+			}
+			r.handleLine(partial)
+			partial = nil
+		}
+
+		// Having caught up, nothing more can continue a held record
+		if len(partial) == 0 {
+			r.flushPending()
+		}
+
+		if !r.wait() {
+			return
+		}
+
+		switch current, truncated := r.checkFile(fd); {
+		case current == nil:
+			// Carry on reading the file we have
+
+		case current != fd:
+			// Rotated: read whatever was written before the rename, then
+			// move to the new file
+			for {
+				line, err := in.ReadBytes('\n')
+				partial = append(partial, line...)
+				if err != nil {
+					break
+				}
+				r.handleLine(partial)
+				partial = nil
+			}
+			if len(partial) > 0 {
+				r.handleLine(partial)
+				partial = nil
+			}
+			r.flushPending()
+			fd.Close()
+			fd = current
+			in.Reset(fd)
+
+		case truncated:
+			partial = nil
+			r.flushPending()
+			in.Reset(fd)
+		}
+	}
+}
+
+// Check whether the file has been rotated or truncated.  It returns the file
+// to read from next (and whether it was truncated), or nil if nothing changed.
+func (r *FileRelay) checkFile(fd *os.File) (*os.File, bool) {
+	info, err := os.Stat(r.filename)
+	if err != nil {
+		// Probably mid-rotation; look again next time
+		return nil, false
+	}
+	openInfo, err := fd.Stat()
+	if err != nil {
+		return nil, false
+	}
+
+	if !os.SameFile(info, openInfo) {
+		next, err := os.Open(r.filename)
+		if err != nil {
+			return nil, false
+		}
+		return next, false
+	}
+
+	pos, err := fd.Seek(0, io.SeekCurrent)
+	if err == nil && info.Size() < pos {
+		if _, err := fd.Seek(0, io.SeekStart); err == nil {
+			return fd, true
+		}
+	}
+	return nil, false
+}
+
+// Handle one complete line of the file
+func (r *FileRelay) handleLine(line []byte) {
+	if r.xmlLines != nil {
+		r.xmlLines = append(r.xmlLines, line...)
+		if bytes.Contains(line, []byte("</record>")) {
+			if rec, ok := parseXMLRecord(r.xmlLines); ok {
+				r.dest.LogWrite(rec)
+			}
+			r.xmlLines = nil
+		}
+		return
+	}
+
+	if rec, ok := parseRecordLine(line); ok {
+		r.flushPending()
+		if isTextRecord(line) {
+			r.pending = rec
+		} else {
+			r.dest.LogWrite(rec)
+		}
+		return
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(line), []byte("<record")) {
+		r.flushPending()
+		r.xmlLines = append([]byte(nil), line...)
+		if bytes.Contains(line, []byte("</record>")) {
+			if rec, ok := parseXMLRecord(r.xmlLines); ok {
+				r.dest.LogWrite(rec)
+			}
+			r.xmlLines = nil
+		}
+		return
+	}
+
+	if r.pending != nil {
+		r.pending.Message += "\n" + strings.TrimRight(string(line), "\r\n")
+	}
+}
+
+// Forward the held text record, if any
+func (r *FileRelay) flushPending() {
+	if r.pending != nil {
+		r.dest.LogWrite(r.pending)
+		r.pending = nil
+	}
+}
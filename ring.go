@@ -0,0 +1,116 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"io"
+	"sync"
+)
+
+// RingBufferLogWriter keeps the most recent records in memory, so that a
+// crash handler or debug endpoint can show what led up to a failure,
+// including records at levels no other writer keeps.  Records are stored as
+// they are written, without formatting.
+type RingBufferLogWriter struct {
+	mu      sync.Mutex
+	records []LogRecord
+	next    int  // Where the next record goes
+	full    bool // Whether every slot holds a record
+	enc     Encoder
+}
+
+// NewRingBufferLogWriter creates a LogWriter which keeps the last size
+// records.
+func NewRingBufferLogWriter(size int) *RingBufferLogWriter {
+	if size < 1 {
+		size = 1
+	}
+	return &RingBufferLogWriter{
+		records: make([]LogRecord, size),
+		enc:     NewFormatEncoder(FORMAT_DEFAULT),
+	}
+}
+
+// SetFormat sets the format DumpTo writes records in, FORMAT_DEFAULT by
+// default (chainable).
+func (w *RingBufferLogWriter) SetFormat(format string) *RingBufferLogWriter {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.enc = NewFormatEncoder(format)
+	return w
+}
+
+// SetEncoder sets how DumpTo writes records, in place of a format
+// (chainable).
+func (w *RingBufferLogWriter) SetEncoder(enc Encoder) *RingBufferLogWriter {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.enc = enc
+	return w
+}
+
+// This is the RingBufferLogWriter's output method
+func (w *RingBufferLogWriter) LogWrite(rec *LogRecord) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.records[w.next] = LogRecord{
+		Level:   rec.Level,
+		Created: rec.Created,
+		Source:  rec.Source,
+		Message: rec.Message,
+		Fields:  rec.Fields,
+
+		Goroutine: rec.Goroutine,
+		Stack:     rec.Stack,
+		function:  rec.function,
+		file:      rec.file,
+		line:      rec.line,
+	}
+	if w.next++; w.next == len(w.records) {
+		w.next, w.full = 0, true
+	}
+}
+
+// Snapshot returns copies of the records held, oldest first.
+func (w *RingBufferLogWriter) Snapshot() []LogRecord {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.full {
+		return append([]LogRecord(nil), w.records[:w.next]...)
+	}
+	snapshot := make([]LogRecord, 0, len(w.records))
+	snapshot = append(snapshot, w.records[w.next:]...)
+	return append(snapshot, w.records[:w.next]...)
+}
+
+// DumpTo writes the records held to out, oldest first, in the writer's
+// format.
+func (w *RingBufferLogWriter) DumpTo(out io.Writer) error {
+	w.mu.Lock()
+	enc := w.enc
+	w.mu.Unlock()
+	for _, rec := range w.Snapshot() {
+		buf, err := enc.Encode(&rec)
+		if err == nil {
+			_, err = out.Write(buf)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reset drops the records held.
+func (w *RingBufferLogWriter) Reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for i := range w.records {
+		w.records[i] = LogRecord{}
+	}
+	w.next, w.full = 0, false
+}
+
+// Close does nothing; the records held can still be read.
+func (w *RingBufferLogWriter) Close() {
+}
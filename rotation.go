@@ -0,0 +1,352 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// RotationReason says why a FileLogWriter rotated its file.
+type RotationReason string
+
+const (
+	ROTATE_SIZE      RotationReason = "size"
+	ROTATE_AGE       RotationReason = "age"
+	ROTATE_SPACE     RotationReason = "space"
+	ROTATE_LINES     RotationReason = "lines"
+	ROTATE_DAILY     RotationReason = "daily"
+	ROTATE_HOURLY    RotationReason = "hourly"
+	ROTATE_WEEKLY    RotationReason = "weekly"
+	ROTATE_MONTHLY   RotationReason = "monthly"
+	ROTATE_SCHEDULED RotationReason = "scheduled"
+	ROTATE_MANUAL    RotationReason = "manual"
+	ROTATE_STARTUP   RotationReason = "startup"
+)
+
+// RotateInterval is how often a FileLogWriter rotates its file on time alone.
+type RotateInterval int
+
+const (
+	RotateNever RotateInterval = iota
+	RotateHourly
+	RotateDaily
+	RotateWeekly
+	RotateMonthly
+)
+
+var rotateIntervalStrings = [...]string{"never", "hourly", "daily", "weekly", "monthly"}
+
+func (i RotateInterval) String() string {
+	if i < 0 || int(i) >= len(rotateIntervalStrings) {
+		return "unknown"
+	}
+	return rotateIntervalStrings[i]
+}
+
+// ParseRotateInterval returns the interval with the given name, as returned
+// by String.
+func ParseRotateInterval(name string) (RotateInterval, bool) {
+	for i, s := range rotateIntervalStrings {
+		if s == name {
+			return RotateInterval(i), true
+		}
+	}
+	return RotateNever, false
+}
+
+// The reason recorded for rotations at the end of the interval
+func (i RotateInterval) reason() RotationReason {
+	switch i {
+	case RotateHourly:
+		return ROTATE_HOURLY
+	case RotateWeekly:
+		return ROTATE_WEEKLY
+	case RotateMonthly:
+		return ROTATE_MONTHLY
+	}
+	return ROTATE_DAILY
+}
+
+// The default date suffix layout for files rotated at this interval
+func (i RotateInterval) suffixFormat() string {
+	switch i {
+	case RotateHourly:
+		return HourlySuffixDateFormat
+	case RotateWeekly:
+		return WeeklySuffixDateFormat
+	case RotateMonthly:
+		return MonthlySuffixDateFormat
+	}
+	return SuffixDateFormat
+}
+
+// RotationEvent describes a completed rotation.
+type RotationEvent struct {
+	Reason      RotationReason `json:"reason"`
+	Filename    string         `json:"file"`    // The file being written
+	RotatedName string         `json:"rotated"` // Where it was moved to
+	Time        time.Time      `json:"time"`    // When the rotation happened
+	Lines       int            `json:"lines"`   // Records written to the file since it was opened
+	Bytes       int64          `json:"bytes"`   // Bytes written to the file since it was opened
+}
+
+// OnRotate registers a function to be called after each rotation which keeps
+// the old file (chainable).  It is called from the writer's goroutine, so it
+// should return promptly, and must not call the writer's Set methods.
+func (w *FileLogWriter) OnRotate(f func(RotationEvent)) *FileLogWriter {
+	w.configure(func() {
+		w.onRotate = append(w.onRotate, f)
+	})
+	return w
+}
+
+// SetRotationHook sets a function to be called with the log file's name and
+// the name it was rotated to after each rotation which keeps the old file
+// (chainable), for example to upload it.  Hooks run one at a time on a
+// background goroutine, before the rotated file is compressed or aged off, so
+// they may take their time without holding up logging.  An error returned by
+// the hook, or a panic, is reported as a rotation failure.  A nil hook removes
+// it.
+func (w *FileLogWriter) SetRotationHook(hook func(oldPath, newPath string) error) *FileLogWriter {
+	w.configure(func() {
+		w.rotationHook = hook
+	})
+	return w
+}
+
+// Call the rotation hook for a task on the background goroutine, reporting
+// failures from the writer's goroutine
+func (w *FileLogWriter) runRotationHook(task archiveTask) {
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("Rotation hook panicked: %v", r)
+			}
+		}()
+		return task.hook(task.rotatedFrom, task.filename)
+	}()
+	if err == nil {
+		return
+	}
+
+	// The writer may be waiting to hand over the next task, so report the
+	// failure without waiting for it
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		w.configure(func() {
+			w.handleRotationFailure(err)
+		})
+	}()
+}
+
+// SetRotationMetadata writes a sidecar file next to each rotated file,
+// describing the rotation as JSON (chainable).  The sidecar is named after the
+// rotated file with a .meta extension, e.g. app.log.001.meta, and is removed
+// when the rotated file is aged off.
+func (w *FileLogWriter) SetRotationMetadata(enabled bool) *FileLogWriter {
+	w.configure(func() {
+		w.rotationMetadata = enabled
+	})
+	return w
+}
+
+// Record a rotation
+func (w *FileLogWriter) notifyRotation(ev RotationEvent) {
+	if w.rotationMetadata {
+		if err := writeRotationMetadata(ev); err != nil {
+			fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Couldn't write rotation metadata: %s\n", w.filename, err)
+		}
+	}
+	for _, f := range w.onRotate {
+		f(ev)
+	}
+}
+
+func writeRotationMetadata(ev RotationEvent) error {
+	js, err := json.MarshalIndent(ev, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(rotationMetadataFilename(ev.RotatedName), append(js, '\n'), 0660)
+}
+
+// The sidecar metadata file for a rotated file, which may since have been
+// compressed
+func rotationMetadataFilename(rotatedName string) string {
+	for _, ext := range []string{".gz", ".zip"} {
+		rotatedName = strings.TrimSuffix(rotatedName, ext)
+	}
+	return rotatedName + ".meta"
+}
+
+// SetRotationNameTemplate names rotated files after a template instead of
+// adding a date or integer suffix to the log file's name (chainable).  These
+// tokens are replaced:
+//
+//	%F - The log file's name, e.g. app.log
+//	%B - The log file's name without its extension, e.g. app
+//	%E - The log file's extension, e.g. .log
+//	%D - The time of the rotation, in the date suffix format
+//	%N - A sequence number, the lowest free from 001 (see SetRotationSequence)
+//	%H - The hostname
+//	%P - The process id
+//	%% - A percent sign
+//
+// For example, "%B-%H-%D.%N%E" rotates app.log to app-web1-2010-01-02.001.log.
+// The template must include %D or %N, and if it has no %N a number is added
+// as for date suffixes when the name is taken.  An empty template restores
+// the usual suffixes.
+func (w *FileLogWriter) SetRotationNameTemplate(tpl string) *FileLogWriter {
+	if len(tpl) > 0 {
+		if strings.ContainsAny(tpl, `/\`) {
+			fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Rotation name template %q must not contain a path separator\n", w.filename, tpl)
+			return w
+		}
+		if !nameTemplateHas(tpl, 'D') && !nameTemplateHas(tpl, 'N') {
+			fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): Rotation name template %q must include %%D or %%N\n", w.filename, tpl)
+			return w
+		}
+	}
+	w.configure(func() {
+		w.nameTemplate = tpl
+		if err := w.compileMatcher(); err != nil {
+			fmt.Fprintf(w.errorWriter, "FileLogWriter(%q): %s\n", w.filename, err)
+		}
+	})
+	return w
+}
+
+// Call literal with each run of plain text in a rotation name template, and
+// token with each token's letter
+func walkNameTemplate(tpl string, literal func(string), token func(byte)) {
+	start := 0
+	for i := 0; i < len(tpl)-1; i++ {
+		if tpl[i] != '%' {
+			continue
+		}
+		if start < i {
+			literal(tpl[start:i])
+		}
+		if tpl[i+1] == '%' {
+			literal("%")
+		} else {
+			token(tpl[i+1])
+		}
+		i++
+		start = i + 1
+	}
+	if start < len(tpl) {
+		literal(tpl[start:])
+	}
+}
+
+// Whether a rotation name template uses the given token
+func nameTemplateHas(tpl string, c byte) bool {
+	found := false
+	walkNameTemplate(tpl, func(string) {}, func(t byte) { found = found || t == c })
+	return found
+}
+
+// The values of the tokens in a rotation name template which don't depend on
+// the rotation
+func (w *FileLogWriter) nameTemplateToken(c byte) (string, bool) {
+	base := filepath.Base(w.filename)
+	ext := filepath.Ext(base)
+	switch c {
+	case 'F':
+		return base, true
+	case 'B':
+		return base[:len(base)-len(ext)], true
+	case 'E':
+		return ext, true
+	case 'H':
+		host, _ := os.Hostname()
+		return host, true
+	}
+	return "", false
+}
+
+// The name, without its directory, of the file rotated at t with sequence
+// number seq
+func (w *FileLogWriter) expandNameTemplate(t time.Time, seq int) string {
+	var out bytes.Buffer
+	walkNameTemplate(w.nameTemplate, func(s string) { out.WriteString(s) }, func(c byte) {
+		if value, ok := w.nameTemplateToken(c); ok {
+			out.WriteString(value)
+			return
+		}
+		switch c {
+		case 'D':
+			out.WriteString(formatDateSuffix(t, w.dateSuffixFormat))
+		case 'N':
+			fmt.Fprintf(&out, "%0*d", w.seqWidth, seq)
+		case 'P':
+			fmt.Fprintf(&out, "%d", os.Getpid())
+		default:
+			out.WriteByte('%')
+			out.WriteByte(c)
+		}
+	})
+	return out.String()
+}
+
+// The pattern matching the names of files rotated by the name template, with
+// the date captured as "date"
+func (w *FileLogWriter) nameTemplateRegex() string {
+	var out bytes.Buffer
+	walkNameTemplate(w.nameTemplate, func(s string) { out.WriteString(regexp.QuoteMeta(s)) }, func(c byte) {
+		if value, ok := w.nameTemplateToken(c); ok {
+			out.WriteString(regexp.QuoteMeta(value))
+			return
+		}
+		switch c {
+		case 'D':
+			out.WriteString(`(?P<date>` + strings.TrimPrefix(dateSuffixRegex(w.dateSuffixFormat), `\.`) + `)`)
+		case 'N':
+			fmt.Fprintf(&out, `[0-9]{%d,}`, w.seqWidth)
+		case 'P':
+			// Other processes may have rotated the file before
+			out.WriteString(`[0-9]+`)
+		default:
+			out.WriteString(regexp.QuoteMeta("%" + string(c)))
+		}
+	})
+	if !nameTemplateHas(w.nameTemplate, 'N') {
+		out.WriteString(`(\.[0-9]{4})?`)
+	}
+	return out.String()
+}
+
+// Generate the next filename for rotation from the name template, in the
+// directory of filename
+func (w *FileLogWriter) nextTemplateFilename(filename string, t time.Time) (string, error) {
+	dir := filepath.Dir(filename)
+	if nameTemplateHas(w.nameTemplate, 'N') {
+		if fullName, _, ok := w.nextSequenceFilename(func(seq int) string {
+			return filepath.Join(dir, w.expandNameTemplate(t, seq))
+		}, 0); ok {
+			return fullName, nil
+		}
+	} else {
+		for i := 1; i < 10000; i++ {
+			fullName := filepath.Join(dir, w.expandNameTemplate(t, i))
+			if i > 1 {
+				fullName += fmt.Sprintf(".%04d", i-1)
+			}
+			if w.rotatedNameFree(fullName) {
+				return fullName, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("Rotate: Cannot find free name from template %q to rename %s\n", w.nameTemplate, filename)
+}
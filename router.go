@@ -0,0 +1,46 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"strings"
+)
+
+// RouterLogWriter sends each record to the writer registered for its level.
+// Records at levels with no writer are dropped.
+type RouterLogWriter struct {
+	routes map[Level]LogWriter
+}
+
+// NewRouterLogWriter creates a RouterLogWriter with no routes.
+func NewRouterLogWriter() *RouterLogWriter {
+	return &RouterLogWriter{
+		routes: make(map[Level]LogWriter),
+	}
+}
+
+// Route sends records at lvl to w (chainable).  Must be called before the
+// first log message is written.
+func (w *RouterLogWriter) Route(lvl Level, writer LogWriter) *RouterLogWriter {
+	w.routes[lvl] = writer
+	return w
+}
+
+// This is the RouterLogWriter's output method
+func (w *RouterLogWriter) LogWrite(rec *LogRecord) {
+	if writer, ok := w.routes[rec.Level]; ok {
+		writer.LogWrite(rec)
+	}
+}
+
+// Close closes all of the routed writers.
+func (w *RouterLogWriter) Close() {
+	for _, writer := range w.routes {
+		writer.Close()
+	}
+}
+
+// Insert the level name before the file's extension: app.log -> app.error.log
+func perLevelFilename(filename string, lvl Level) string {
+	return rotatedFilename(filename, strings.ToLower(levelNames[lvl]), true)
+}
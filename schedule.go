@@ -0,0 +1,242 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Schedule is a parsed cron-like specification.  It has the five standard
+// fields (minute, hour, day of month, month, day of week), each of which may be
+// "*", a number, a range ("1-5"), a list ("1,3,5") or a step ("*/15", "0-30/5").
+// The shorthands @hourly, @daily (or @midnight), @weekly, @monthly and @yearly
+// (or @annually) are also understood.
+type Schedule struct {
+	spec string
+
+	minute, hour, dom, month, dow uint64
+
+	// Whether the day-of-month and day-of-week fields were restricted; cron
+	// matches either one when both are
+	domStar, dowStar bool
+}
+
+var scheduleShorthands = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseSchedule parses a cron-like schedule specification.
+func ParseSchedule(spec string) (*Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	expanded := spec
+	if full, ok := scheduleShorthands[spec]; ok {
+		expanded = full
+	}
+
+	fields := strings.Fields(expanded)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("schedule %q: expected 5 fields, found %d", spec, len(fields))
+	}
+
+	s := &Schedule{
+		spec:    spec,
+		domStar: fields[2] == "*",
+		dowStar: fields[4] == "*",
+	}
+	var err error
+	if s.minute, err = parseScheduleField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("schedule %q: minute: %s", spec, err)
+	}
+	if s.hour, err = parseScheduleField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("schedule %q: hour: %s", spec, err)
+	}
+	if s.dom, err = parseScheduleField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("schedule %q: day of month: %s", spec, err)
+	}
+	if s.month, err = parseScheduleField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("schedule %q: month: %s", spec, err)
+	}
+	if s.dow, err = parseScheduleField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("schedule %q: day of week: %s", spec, err)
+	}
+	// Sunday may be written as either 0 or 7
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	if !s.occurs() {
+		return nil, fmt.Errorf("schedule %q: none of the days of the month fall in the months given", spec)
+	}
+	return s, nil
+}
+
+// The most days in each month, counting leap years
+var scheduleMonthDays = [13]uint{0, 31, 29, 31, 30, 31, 30, 31, 31, 30, 31, 30, 31}
+
+// Whether the schedule ever matches.  Every month has each day of the week,
+// but not each day of the month (there is no 30th of February), which only
+// matters when the days of the month aren't matched as an alternative to
+// the days of the week.
+func (s *Schedule) occurs() bool {
+	if s.domStar || !s.dowStar {
+		return true
+	}
+	for month := 1; month <= 12; month++ {
+		days := scheduleMonthDays[month]
+		if s.month&(1<<uint(month)) != 0 && s.dom&(1<<(days+1)-2) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse a single comma-separated schedule field into a bitmask
+func parseScheduleField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+			step = n
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			var err1, err2 error
+			lo, err1 = strconv.Atoi(bounds[0])
+			hi, err2 = strconv.Atoi(bounds[1])
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("bad range %q", part)
+			}
+		default:
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return 0, fmt.Errorf("bad value %q", part)
+			}
+			lo, hi = n, n
+			if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for n := lo; n <= hi; n += step {
+			bits |= 1 << uint(n)
+		}
+	}
+	return bits, nil
+}
+
+// String returns the specification the schedule was parsed from.
+func (s *Schedule) String() string {
+	return s.spec
+}
+
+// Matches reports whether the minute containing t is part of the schedule.
+func (s *Schedule) Matches(t time.Time) bool {
+	if s.minute&(1<<uint(t.Minute())) == 0 ||
+		s.hour&(1<<uint(t.Hour())) == 0 ||
+		s.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	return s.dayMatches(t)
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// Next returns the first scheduled minute strictly after t, in t's location.
+// The zero time is returned if nothing matches within the next eight years
+// (as long as leap days can be apart, around 2100), which ParseSchedule
+// doesn't allow, so only for a Schedule which wasn't made by it.
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(8, 0, 0)
+
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// A timer which fires at the times given by a schedule
+type scheduleTimer struct {
+	schedule *Schedule
+	timer    *time.Timer
+	C        <-chan time.Time
+}
+
+// Switch to a new schedule, if it has changed; nil stops the timer
+func (t *scheduleTimer) follow(schedule *Schedule) {
+	if schedule == t.schedule {
+		return
+	}
+	t.stop()
+	t.schedule = schedule
+	t.reset()
+}
+
+// Arm the timer for the next scheduled time, after it has fired
+func (t *scheduleTimer) reset() {
+	if t.schedule == nil {
+		return
+	}
+	next := t.schedule.Next(time.Now())
+	if next.IsZero() {
+		// Nothing is ever scheduled
+		t.C = nil
+		return
+	}
+	if t.timer == nil {
+		t.timer = time.NewTimer(next.Sub(time.Now()))
+	} else {
+		t.timer.Reset(next.Sub(time.Now()))
+	}
+	t.C = t.timer.C
+}
+
+func (t *scheduleTimer) stop() {
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	t.C = nil
+}
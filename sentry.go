@@ -0,0 +1,350 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// SentryMaxEvents is the most events a SentryLogWriter sends in each
+	// SentryRateInterval; records beyond it are dropped, so that an error
+	// storm doesn't use up the project's quota.
+	SentryMaxEvents    = 100
+	SentryRateInterval = time.Minute
+)
+
+// SentryStats counts what a SentryLogWriter has done with the ERROR and
+// CRITICAL records sent to it since it was created.
+type SentryStats struct {
+	Sent        uint64 // Events Sentry accepted
+	Sampled     uint64 // Records left out by sampling
+	RateLimited uint64 // Records dropped for exceeding SentryMaxEvents
+	Dropped     uint64 // Events which couldn't be sent, or found the queue full
+}
+
+// The counters behind SentryStats (accessed atomically)
+type sentryCounters struct {
+	sent        uint64
+	sampled     uint64
+	rateLimited uint64
+	dropped     uint64
+}
+
+// SentryLogWriter sends ERROR and CRITICAL records to Sentry as events,
+// ignoring any others.  Each event carries the record's message, its source
+// as the culprit and its fields as extra data, and optionally the stack of
+// the goroutine which logged it.  Events are built as records are logged,
+// then wait in a queue of LogBufferLength events to be sent; events which
+// fail are sent again as BatchRetries describes.
+type SentryLogWriter struct {
+	// Counters reported by Stats (first for alignment)
+	counters sentryCounters
+
+	events    chan []byte
+	queue     *queueTracker
+	completed chan int
+
+	store  string
+	auth   string
+	client *http.Client
+	host   string
+
+	stackTrace   bool
+	sampleRate   float64
+	maxEvents    int
+	rateInterval time.Duration
+
+	retries            int
+	retryMin, retryMax time.Duration
+
+	// The current rate interval, and the events sent in it
+	mu           sync.Mutex
+	windowStart  time.Time
+	windowEvents int
+}
+
+// NewSentryLogWriter creates a LogWriter which sends records to the Sentry
+// project identified by dsn, e.g. "https://key@o0.ingest.sentry.io/42".
+func NewSentryLogWriter(dsn string) *SentryLogWriter {
+	u, err := url.Parse(dsn)
+	if err == nil && (len(u.Scheme) == 0 || len(u.Host) == 0 || u.User == nil) {
+		err = fmt.Errorf("should be scheme://key@host/project")
+	}
+	project := ""
+	if err == nil {
+		if project = path.Base(u.Path); project == "." || project == "/" {
+			err = fmt.Errorf("missing project ID")
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "NewSentryLogWriter(%q): Invalid DSN: %s\n", dsn, err)
+		return nil
+	}
+
+	auth := fmt.Sprintf("Sentry sentry_version=7, sentry_client=log4go/%d.%d.%d, sentry_key=%s", L4G_MAJOR, L4G_MINOR, L4G_BUILD, u.User.Username())
+	if secret, ok := u.User.Password(); ok {
+		auth += ", sentry_secret=" + secret
+	}
+	host, _ := os.Hostname()
+
+	w := &SentryLogWriter{
+		events:       make(chan []byte, LogBufferLength),
+		queue:        newQueueTracker(),
+		completed:    make(chan int),
+		store:        fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, strings.TrimSuffix(path.Dir(u.Path), "/"), project),
+		auth:         auth,
+		client:       &http.Client{Timeout: HTTPTimeout},
+		host:         host,
+		sampleRate:   1,
+		maxEvents:    SentryMaxEvents,
+		rateInterval: SentryRateInterval,
+		retries:      BatchRetries,
+		retryMin:     BatchRetryMin,
+		retryMax:     BatchRetryMax,
+	}
+	go w.run()
+	return w
+}
+
+// SetStackTrace sets whether each event carries the stack of the goroutine
+// which logged the record, as far as the caller of the logging method
+// (chainable).  The stack is only meaningful if the writer is given records
+// on that goroutine, as it is by a Logger.  Must be called before the first
+// log message is written.
+func (w *SentryLogWriter) SetStackTrace(stackTrace bool) *SentryLogWriter {
+	w.stackTrace = stackTrace
+	return w
+}
+
+// SetSampleRate sets the fraction of records sent, from 0 to 1, where the
+// rest are left out at random (chainable).  Must be called before the first
+// log message is written.
+func (w *SentryLogWriter) SetSampleRate(rate float64) *SentryLogWriter {
+	w.sampleRate = rate
+	return w
+}
+
+// SetRateLimit sets the most events sent in each interval, in place of
+// SentryMaxEvents and SentryRateInterval, or removes the limit if maxEvents
+// is zero (chainable).  Must be called before the first log message is
+// written.
+func (w *SentryLogWriter) SetRateLimit(maxEvents int, interval time.Duration) *SentryLogWriter {
+	w.maxEvents, w.rateInterval = maxEvents, interval
+	return w
+}
+
+// SetTimeout bounds each request, in place of HTTPTimeout (chainable).  Must
+// be called before the first log message is written.
+func (w *SentryLogWriter) SetTimeout(timeout time.Duration) *SentryLogWriter {
+	w.client.Timeout = timeout
+	return w
+}
+
+// SetRetry sets how many times a failed event is sent again, and the
+// shortest and longest waits before doing so, in place of BatchRetries,
+// BatchRetryMin and BatchRetryMax (chainable).  Must be called before the
+// first log message is written.
+func (w *SentryLogWriter) SetRetry(retries int, min, max time.Duration) *SentryLogWriter {
+	w.retries, w.retryMin, w.retryMax = retries, min, max
+	return w
+}
+
+// This is the SentryLogWriter's output method
+func (w *SentryLogWriter) LogWrite(rec *LogRecord) {
+	if rec.Level < ERROR {
+		return
+	}
+	if w.sampleRate < 1 && mathrand.Float64() >= w.sampleRate {
+		atomic.AddUint64(&w.counters.sampled, 1)
+		return
+	}
+	if !w.allow(time.Now()) {
+		atomic.AddUint64(&w.counters.rateLimited, 1)
+		return
+	}
+
+	event, err := json.Marshal(w.event(rec))
+	if err != nil {
+		atomic.AddUint64(&w.counters.dropped, 1)
+		fmt.Fprintf(os.Stderr, "SentryLogWriter(%q): Dropped record: %s\n", w.store, err)
+		return
+	}
+	token := w.queue.push(time.Now())
+	select {
+	case w.events <- event:
+	default:
+		w.queue.unpush(token)
+		atomic.AddUint64(&w.counters.dropped, 1)
+	}
+}
+
+// QueueStats reports on the events waiting to be sent.
+func (w *SentryLogWriter) QueueStats() QueueStats {
+	return QueueStats{
+		Length:    len(w.events),
+		Capacity:  cap(w.events),
+		OldestAge: w.queue.oldestAge(time.Now()),
+	}
+}
+
+// Stats returns the writer's counters.
+func (w *SentryLogWriter) Stats() SentryStats {
+	return SentryStats{
+		Sent:        atomic.LoadUint64(&w.counters.sent),
+		Sampled:     atomic.LoadUint64(&w.counters.sampled),
+		RateLimited: atomic.LoadUint64(&w.counters.rateLimited),
+		Dropped:     atomic.LoadUint64(&w.counters.dropped),
+	}
+}
+
+// Close sends any queued events.
+func (w *SentryLogWriter) Close() {
+	close(w.events)
+	<-w.completed
+}
+
+// Whether an event may be sent now without exceeding the rate limit
+func (w *SentryLogWriter) allow(now time.Time) bool {
+	if w.maxEvents <= 0 {
+		return true
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if now.Sub(w.windowStart) >= w.rateInterval {
+		w.windowStart, w.windowEvents = now, 0
+	}
+	if w.windowEvents >= w.maxEvents {
+		return false
+	}
+	w.windowEvents++
+	return true
+}
+
+// A frame of a Sentry stack trace
+type sentryFrame struct {
+	Function string `json:"function"`
+	Filename string `json:"filename"`
+	AbsPath  string `json:"abs_path"`
+	Lineno   int    `json:"lineno"`
+}
+
+// The Sentry event for a record
+func (w *SentryLogWriter) event(rec *LogRecord) map[string]interface{} {
+	id := make([]byte, 16)
+	rand.Read(id)
+	level := "error"
+	if rec.Level >= CRITICAL {
+		level = "fatal"
+	}
+	logger := "log4go"
+	if name, ok := rec.Fields["logger"].(string); ok && len(name) > 0 {
+		logger = name
+	}
+
+	event := map[string]interface{}{
+		"event_id":  hex.EncodeToString(id),
+		"timestamp": rec.Created.UTC().Format("2006-01-02T15:04:05.000000Z"),
+		"level":     level,
+		"logger":    logger,
+		"platform":  "go",
+		"message":   rec.Message,
+		"culprit":   rec.Source,
+	}
+	if len(w.host) > 0 {
+		event["server_name"] = w.host
+	}
+	if len(rec.Fields) > 0 {
+		event["extra"] = rec.Fields
+	}
+	if w.stackTrace {
+		if frames := sentryStack(); len(frames) > 0 {
+			event["stacktrace"] = map[string]interface{}{"frames": frames}
+		}
+	}
+	return event
+}
+
+// The current goroutine's stack, outermost frame first, from the caller of
+// the logging method
+func sentryStack() []sentryFrame {
+	callers := callerFrames()
+	frames := make([]sentryFrame, len(callers))
+	for i, frame := range callers {
+		frames[len(frames)-1-i] = sentryFrame{
+			Function: frame.Function,
+			Filename: path.Base(frame.File),
+			AbsPath:  frame.File,
+			Lineno:   frame.Line,
+		}
+	}
+	return frames
+}
+
+func (w *SentryLogWriter) run() {
+	defer close(w.completed)
+	for event := range w.events {
+		w.queue.pop()
+		w.sendWithRetry(event)
+	}
+}
+
+// Send an event, trying again with growing waits while it fails
+func (w *SentryLogWriter) sendWithRetry(event []byte) {
+	wait := w.retryMin
+	for attempt := 0; ; attempt++ {
+		err := w.send(event)
+		if err == nil {
+			atomic.AddUint64(&w.counters.sent, 1)
+			return
+		}
+		if _, permanent := err.(permanentError); permanent || attempt >= w.retries {
+			atomic.AddUint64(&w.counters.dropped, 1)
+			fmt.Fprintf(os.Stderr, "SentryLogWriter(%q): Dropped event: %s\n", w.store, err)
+			return
+		}
+		time.Sleep(wait)
+		if wait *= 2; wait > w.retryMax {
+			wait = w.retryMax
+		}
+	}
+}
+
+func (w *SentryLogWriter) send(event []byte) error {
+	req, err := http.NewRequest("POST", w.store, bytes.NewReader(event))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", w.auth)
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode/100 == 2:
+		return nil
+	case resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests:
+		return permanentError{fmt.Errorf("%s", resp.Status)}
+	}
+	return fmt.Errorf("%s", resp.Status)
+}
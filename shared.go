@@ -0,0 +1,81 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"os"
+)
+
+// SetSharedFile lets several processes append to the same file (chainable),
+// as in prefork and CGI deployments.  Each batch of records goes to the file
+// in a single append, and before each batch the writer reopens the file if
+// another process has rotated it, and takes the file's size as it stands.
+// Rotation happens under a lock on the file named filename+".lock", so only
+// the first process to rotate renames the file; the others just reopen it.
+// Rotating at startup is turned off, since each process would do it.
+func (w *FileLogWriter) SetSharedFile(shared bool) *FileLogWriter {
+	w.configure(func() {
+		w.shared = shared
+		if shared {
+			w.rotateOnStartup = false
+		}
+	})
+	return w
+}
+
+// Follow the file as other processes write to and rotate it
+func (w *FileLogWriter) followSharedFile() {
+	w.detectExternalRotation()
+	if w.file == nil {
+		return
+	}
+	if info, err := w.file.Stat(); err == nil && info.Size() > w.maxsize_cursize {
+		w.maxsize_cursize = info.Size()
+	}
+}
+
+// Lock the file against rotation by other processes, returning the function
+// which unlocks it again
+func (w *FileLogWriter) lockSharedFile() (unlock func(), err error) {
+	lock, err := os.OpenFile(w.filename+".lock", os.O_RDWR|os.O_CREATE, 0660)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(lock); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return func() {
+		unlockFile(lock)
+		lock.Close()
+	}, nil
+}
+
+// Whether the file open is no longer the one at its path, because another
+// process has rotated it
+func (w *FileLogWriter) rotatedElsewhere() bool {
+	if w.file == nil {
+		return false
+	}
+	opened, err := w.file.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(w.filename)
+	return os.IsNotExist(err) || (err == nil && !os.SameFile(opened, current))
+}
+
+// Rotate a shared file under its lock, leaving it to whoever got there first
+func (w *FileLogWriter) rotateShared(rotate func() error) error {
+	unlock, err := w.lockSharedFile()
+	if err != nil {
+		return fmt.Errorf("Rotate: Couldn't lock %s: %s\n", w.filename, err)
+	}
+	defer unlock()
+
+	if w.rotatedElsewhere() {
+		return w.openLogFile()
+	}
+	return rotate()
+}
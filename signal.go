@@ -0,0 +1,109 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+)
+
+// SignalAction is what HandleSignals does to each open FileLogWriter.
+type SignalAction int
+
+const (
+	// Open a new file if the old one has been moved away, as by logrotate
+	SignalReopen SignalAction = iota
+
+	// Rotate the file as Rotate does
+	SignalRotate
+)
+
+// The FileLogWriters which haven't been closed
+var fileWriters = struct {
+	sync.Mutex
+	open map[*FileLogWriter]bool
+}{open: make(map[*FileLogWriter]bool)}
+
+func registerFileWriter(w *FileLogWriter) {
+	fileWriters.Lock()
+	defer fileWriters.Unlock()
+	fileWriters.open[w] = true
+}
+
+func unregisterFileWriter(w *FileLogWriter) {
+	fileWriters.Lock()
+	defer fileWriters.Unlock()
+	delete(fileWriters.open, w)
+}
+
+func openFileWriters() []*FileLogWriter {
+	fileWriters.Lock()
+	defer fileWriters.Unlock()
+	writers := make([]*FileLogWriter, 0, len(fileWriters.open))
+	for w := range fileWriters.open {
+		writers = append(writers, w)
+	}
+	return writers
+}
+
+// ReopenFileWriters makes every open FileLogWriter check whether its file has
+// been moved, removed or truncated, and if so follow it, as
+// SetDetectExternalRotation does before writing.
+func ReopenFileWriters() {
+	for _, w := range openFileWriters() {
+		w.configure(func() {
+			w.detectExternalRotation()
+		})
+	}
+}
+
+// RotateFileWriters rotates every open FileLogWriter.
+func RotateFileWriters() {
+	for _, w := range openFileWriters() {
+		select {
+		case w.rot <- true:
+		case <-w.completed:
+		}
+	}
+}
+
+// HandleSignals applies action to every open FileLogWriter whenever the
+// process receives one of sigs, or SIGHUP if none are given, so that a
+// logrotate postrotate script can send SIGHUP after moving the files.  The
+// returned function stops handling the signals.  On platforms without SIGHUP,
+// such as js and plan9, nothing is handled unless sigs are given.
+func HandleSignals(action SignalAction, sigs ...os.Signal) (stop func()) {
+	if len(sigs) == 0 {
+		sigs = defaultSignals
+	}
+	if len(sigs) == 0 {
+		return func() {}
+	}
+
+	c := make(chan os.Signal, 1)
+	done := make(chan bool)
+	signal.Notify(c, sigs...)
+	go func() {
+		for {
+			select {
+			case <-c:
+				if action == SignalRotate {
+					RotateFileWriters()
+				} else {
+					ReopenFileWriters()
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(c)
+			close(done)
+		})
+	}
+}
@@ -0,0 +1,14 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+//go:build !js && !wasip1 && !plan9
+// +build !js,!wasip1,!plan9
+
+package log4go
+
+import (
+	"os"
+	"syscall"
+)
+
+// The signals HandleSignals handles when none are given
+var defaultSignals = []os.Signal{syscall.SIGHUP}
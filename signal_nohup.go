@@ -0,0 +1,14 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+//go:build js || wasip1 || plan9
+// +build js wasip1 plan9
+
+package log4go
+
+import (
+	"os"
+)
+
+// There is no SIGHUP here, so HandleSignals handles nothing unless it is given
+// signals
+var defaultSignals []os.Signal
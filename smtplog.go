@@ -0,0 +1,355 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// SMTPDigestMax is the most records an SMTPLogWriter puts in one digest;
+// any more logged in the same interval are only counted.
+var SMTPDigestMax = 1000
+
+// SMTPTLSMode is how an SMTPLogWriter secures its connection to the server.
+type SMTPTLSMode int
+
+const (
+	// Upgrade the connection with STARTTLS if the server offers it
+	SMTPStartTLS SMTPTLSMode = iota
+
+	// Connect with TLS from the start, as on port 465
+	SMTPImplicitTLS
+
+	// Never use TLS
+	SMTPNoTLS
+)
+
+var smtpTLSModeNames = []string{"starttls", "tls", "none"}
+
+func (m SMTPTLSMode) String() string {
+	if m >= 0 && int(m) < len(smtpTLSModeNames) {
+		return smtpTLSModeNames[m]
+	}
+	return fmt.Sprintf("SMTPTLSMode(%d)", int(m))
+}
+
+// ParseSMTPTLSMode returns the mode with the given name, as returned by
+// String.
+func ParseSMTPTLSMode(name string) (SMTPTLSMode, bool) {
+	for i, modeName := range smtpTLSModeNames {
+		if strings.EqualFold(name, modeName) {
+			return SMTPTLSMode(i), true
+		}
+	}
+	return 0, false
+}
+
+// SMTPLogWriter emails records at or above a level, ERROR by default.  Each
+// record is sent as it is logged, or if a digest interval is set, the
+// records logged in each interval are sent together in one email.
+type SMTPLogWriter struct {
+	// Records dropped because the queue was full (accessed atomically; first
+	// for alignment)
+	dropped uint64
+
+	records   chan *LogRecord
+	queue     *queueTracker
+	completed chan int
+
+	addr     string
+	host     string
+	from     string
+	to       []string
+	level    Level
+	enc      Encoder
+	subject  string
+	digest   time.Duration
+	auth     smtp.Auth
+	tlsMode  SMTPTLSMode
+	tlsConf  *tls.Config
+	hostname string
+
+	// The records waiting for the next digest, and how many didn't fit
+	pending  []*LogRecord
+	overflow int
+}
+
+// NewSMTPLogWriter creates a LogWriter which emails records from the address
+// from to the addresses to, through the server at addr ("host:port").
+func NewSMTPLogWriter(addr, from string, to []string) *SMTPLogWriter {
+	host, _, err := net.SplitHostPort(addr)
+	if err == nil && len(to) == 0 {
+		err = fmt.Errorf("no recipients")
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "NewSMTPLogWriter(%q): %s\n", addr, err)
+		return nil
+	}
+	hostname, _ := os.Hostname()
+
+	w := &SMTPLogWriter{
+		records:   make(chan *LogRecord, LogBufferLength),
+		queue:     newQueueTracker(),
+		completed: make(chan int),
+		addr:      addr,
+		host:      host,
+		from:      from,
+		to:        to,
+		level:     ERROR,
+		enc:       NewFormatEncoder(FORMAT_DEFAULT),
+		subject:   "[%L] %M",
+		tlsConf:   &tls.Config{ServerName: host},
+		hostname:  hostname,
+	}
+	go w.run()
+	return w
+}
+
+// SetLevel sets the lowest level emailed, ERROR by default (chainable).
+// Must be called before the first log message is written.
+func (w *SMTPLogWriter) SetLevel(lvl Level) *SMTPLogWriter {
+	w.level = lvl
+	return w
+}
+
+// SetFormat sets the format of the records in each email, FORMAT_DEFAULT by
+// default (chainable).  Must be called before the first log message is
+// written.
+func (w *SMTPLogWriter) SetFormat(format string) *SMTPLogWriter {
+	w.enc = NewFormatEncoder(format)
+	return w
+}
+
+// SetEncoder sets how the records in each email are written, in place of a
+// format (chainable).  Must be called before the first log message is
+// written.
+func (w *SMTPLogWriter) SetEncoder(enc Encoder) *SMTPLogWriter {
+	w.enc = enc
+	return w
+}
+
+// SetSubject sets the format of the subject of emails sent for one record,
+// "[%L] %M" by default (chainable).  Digests are titled with the number of
+// records they hold.  Must be called before the first log message is
+// written.
+func (w *SMTPLogWriter) SetSubject(format string) *SMTPLogWriter {
+	w.subject = format
+	return w
+}
+
+// SetDigest collects the records logged in each interval into one email, or
+// sends each record on its own if interval is zero (chainable).  Must be
+// called before the first log message is written.
+func (w *SMTPLogWriter) SetDigest(interval time.Duration) *SMTPLogWriter {
+	w.digest = interval
+	return w
+}
+
+// SetAuth authenticates with PLAIN auth as username (chainable).  Unless the
+// server is on localhost, the connection must use TLS for the password to be
+// sent.  Must be called before the first log message is written.
+func (w *SMTPLogWriter) SetAuth(username, password string) *SMTPLogWriter {
+	w.auth = smtp.PlainAuth("", username, password, w.host)
+	return w
+}
+
+// SetTLS sets how the connection is secured, and the TLS configuration used,
+// or nil to verify the server against the system's CAs (chainable).  Must be
+// called before the first log message is written.
+func (w *SMTPLogWriter) SetTLS(mode SMTPTLSMode, config *tls.Config) *SMTPLogWriter {
+	w.tlsMode = mode
+	if config != nil {
+		if len(config.ServerName) == 0 {
+			config = config.Clone()
+			config.ServerName = w.host
+		}
+		w.tlsConf = config
+	}
+	return w
+}
+
+// This is the SMTPLogWriter's output method
+func (w *SMTPLogWriter) LogWrite(rec *LogRecord) {
+	if rec.Level < w.level {
+		return
+	}
+	token := w.queue.push(time.Now())
+	select {
+	case w.records <- rec:
+	default:
+		w.queue.unpush(token)
+		atomic.AddUint64(&w.dropped, 1)
+	}
+}
+
+// QueueStats reports on the records waiting to be emailed.
+func (w *SMTPLogWriter) QueueStats() QueueStats {
+	return QueueStats{
+		Length:    len(w.records),
+		Capacity:  cap(w.records),
+		OldestAge: w.queue.oldestAge(time.Now()),
+	}
+}
+
+// DroppedRecords returns how many records have been dropped because the
+// queue was full.
+func (w *SMTPLogWriter) DroppedRecords() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
+
+// Close emails any queued records, and the digest being collected.
+func (w *SMTPLogWriter) Close() {
+	close(w.records)
+	<-w.completed
+}
+
+func (w *SMTPLogWriter) run() {
+	defer close(w.completed)
+
+	// Settings take effect with the first record
+	rec, ok := <-w.records
+	if !ok {
+		return
+	}
+	w.queue.pop()
+	if w.digest <= 0 {
+		w.sendRecord(rec)
+		for rec := range w.records {
+			w.queue.pop()
+			w.sendRecord(rec)
+		}
+		return
+	}
+
+	w.collect(rec)
+	ticker := time.NewTicker(w.digest)
+	defer ticker.Stop()
+	for {
+		select {
+		case rec, ok := <-w.records:
+			if !ok {
+				w.sendDigest()
+				return
+			}
+			w.queue.pop()
+			w.collect(rec)
+		case <-ticker.C:
+			w.sendDigest()
+		}
+	}
+}
+
+// Add a record to the next digest
+func (w *SMTPLogWriter) collect(rec *LogRecord) {
+	if len(w.pending) >= SMTPDigestMax {
+		w.overflow++
+		return
+	}
+	w.pending = append(w.pending, rec)
+}
+
+// Email a record on its own
+func (w *SMTPLogWriter) sendRecord(rec *LogRecord) {
+	subject := strings.TrimRight(FormatLogRecord(w.subject, rec), "\n")
+	w.send(subject, encodeText(w.enc, rec))
+}
+
+// Email the records collected since the last digest, if any
+func (w *SMTPLogWriter) sendDigest() {
+	if len(w.pending) == 0 {
+		return
+	}
+	var body bytes.Buffer
+	for _, rec := range w.pending {
+		body.WriteString(encodeText(w.enc, rec))
+	}
+	if w.overflow > 0 {
+		fmt.Fprintf(&body, "\n... and %d more log message(s)\n", w.overflow)
+	}
+	subject := fmt.Sprintf("%d log message(s)", len(w.pending)+w.overflow)
+	if len(w.hostname) > 0 {
+		subject += " from " + w.hostname
+	}
+	w.send(subject, body.String())
+	w.pending, w.overflow = nil, 0
+}
+
+// Send an email, reporting any failure
+func (w *SMTPLogWriter) send(subject, body string) {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\n", w.from)
+	fmt.Fprintf(&msg, "To: %s\n", strings.Join(w.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\nContent-Type: text/plain; charset=utf-8\nContent-Transfer-Encoding: 8bit\n\n")
+	msg.WriteString(body)
+
+	if err := w.deliver(msg.Bytes()); err != nil {
+		fmt.Fprintf(os.Stderr, "SMTPLogWriter(%q): %s\n", w.addr, err)
+	}
+}
+
+// Hand a message to the server
+func (w *SMTPLogWriter) deliver(msg []byte) error {
+	var conn net.Conn
+	var err error
+	if w.tlsMode == SMTPImplicitTLS {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", w.addr, w.tlsConf)
+	} else {
+		conn, err = net.DialTimeout("tcp", w.addr, 30*time.Second)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(time.Minute))
+
+	c, err := smtp.NewClient(conn, w.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if len(w.hostname) > 0 {
+		if err := c.Hello(w.hostname); err != nil {
+			return err
+		}
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok && w.tlsMode == SMTPStartTLS {
+		if err := c.StartTLS(w.tlsConf); err != nil {
+			return err
+		}
+	}
+	if w.auth != nil {
+		if err := c.Auth(w.auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(w.from); err != nil {
+		return err
+	}
+	for _, to := range w.to {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	data, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := data.Write(msg); err != nil {
+		return err
+	}
+	if err := data.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
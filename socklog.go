@@ -3,12 +3,53 @@
 package log4go
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
+var (
+	// SocketMaxDatagramSize is the largest datagram that a SocketLogWriter
+	// using a datagram protocol (udp, unixgram, etc) will send, unless
+	// SetDatagramSize says otherwise.  Larger records are split into
+	// sequenced chunks, using the GELF chunking scheme so that collectors
+	// such as Graylog can reassemble them.
+	SocketMaxDatagramSize = 8192
+
+	// SocketMaxBatch is the most records a SocketLogWriter using a stream
+	// protocol will write (and compress) together.
+	SocketMaxBatch = 64
+
+	// SocketReconnectMin and SocketReconnectMax bound how long a
+	// SocketLogWriter using a stream protocol waits between attempts to
+	// reconnect once its connection fails.  The wait starts at the minimum
+	// and doubles after each failed attempt.
+	SocketReconnectMin = 100 * time.Millisecond
+	SocketReconnectMax = 30 * time.Second
+
+	// SocketReplayLength is how many records a SocketLogWriter holds while
+	// disconnected, to send once it reconnects.  Beyond that the oldest are
+	// dropped.
+	SocketReplayLength = 1024
+)
+
+// GELF chunking: each chunk starts with the magic bytes, an 8-byte message
+// ID, the chunk's sequence number and the total number of chunks
+const (
+	chunkHeaderSize = 12
+	chunkMaxCount   = 128
+)
+
+var chunkMagic = []byte{0x1e, 0x0f}
+
+var chunkMessageID uint64
+
 // This log writer sends output to a socket
 type SocketLogWriter chan *LogRecord
 
@@ -21,37 +62,458 @@ func (w SocketLogWriter) Close() {
 	close(w)
 }
 
+// SocketLogWriterImp is the writer which sends on what a SocketLogWriter is
+// given.  NewSocketLogWriterCompressed returns one, for settings such as
+// compression which a channel can't carry.
+type SocketLogWriterImp struct {
+	// Counters reported by Stats (first for alignment)
+	counters socketCounters
+
+	records   SocketLogWriter
+	queue     *queueTracker
+	cfg       chan func()
+	completed chan int
+
+	proto, hostport string
+	sock            net.Conn
+	datagram        bool
+	enc             Encoder
+
+	// Compression of the stream or of each datagram
+	compression CompressionMethod
+
+	// The largest datagram sent, and what to do with records which won't fit
+	maxDatagram    int
+	datagramPolicy DatagramPolicy
+
+	// Where stream records are written: the connection, or a compressor
+	// writing to it
+	out  io.Writer
+	comp compressor
+
+	// Keepalive, if set, is applied to each connection made
+	keepAlive    time.Duration
+	keepAliveSet bool
+
+	// Reconnection after the stream fails, holding up to replayLength
+	// records meanwhile
+	reconnectMin time.Duration
+	reconnectMax time.Duration
+	replayLength int
+	replay       []*LogRecord
+	dropped      uint64
+}
+
+// This is the SocketLogWriter's output method
+func (w *SocketLogWriterImp) LogWrite(rec *LogRecord) {
+	w.queue.push(time.Now())
+	w.records <- rec
+}
+
+// QueueStats reports on the records waiting to be sent.
+func (w *SocketLogWriterImp) QueueStats() QueueStats {
+	return QueueStats{
+		Length:    len(w.records),
+		Capacity:  cap(w.records),
+		OldestAge: w.queue.oldestAge(time.Now()),
+	}
+}
+
+// Close sends any queued records and closes the connection.
+func (w *SocketLogWriterImp) Close() {
+	close(w.records)
+	<-w.completed
+}
+
+// Apply a configuration change on the writer's goroutine, or directly once
+// the writer has been closed
+func (w *SocketLogWriterImp) configure(change func()) {
+	done := make(chan bool)
+	select {
+	case w.cfg <- func() { change(); close(done) }:
+		<-done
+	case <-w.completed:
+		change()
+	}
+}
+
+// SetKeepAlive enables TCP keepalive probes on the connection with the given
+// period, or disables them if period is zero (chainable).  It has no effect on
+// other protocols.
+func (w *SocketLogWriterImp) SetKeepAlive(period time.Duration) *SocketLogWriterImp {
+	w.configure(func() {
+		w.keepAlive, w.keepAliveSet = period, true
+		w.applyKeepAlive()
+	})
+	return w
+}
+
+// Apply the keepalive setting, if any, to the connection
+func (w *SocketLogWriterImp) applyKeepAlive() {
+	tcp, ok := w.sock.(*net.TCPConn)
+	if !ok || !w.keepAliveSet {
+		return
+	}
+	if err := tcp.SetKeepAlive(w.keepAlive > 0); err != nil {
+		fmt.Fprintf(os.Stderr, "SocketLogWriter(%q): %s\n", w.hostport, err)
+		return
+	}
+	if w.keepAlive > 0 {
+		if err := tcp.SetKeepAlivePeriod(w.keepAlive); err != nil {
+			fmt.Fprintf(os.Stderr, "SocketLogWriter(%q): %s\n", w.hostport, err)
+		}
+	}
+}
+
+// SetReconnect sets how a stream connection is reestablished once it fails
+// (chainable): after waiting min, doubling after each failed attempt up to
+// max, while holding up to replay of the records logged meanwhile.  Records
+// being written when the connection failed are sent again, so the collector
+// may see some twice.
+func (w *SocketLogWriterImp) SetReconnect(min, max time.Duration, replay int) *SocketLogWriterImp {
+	w.configure(func() {
+		w.reconnectMin, w.reconnectMax, w.replayLength = min, max, replay
+	})
+	return w
+}
+
+// NewSocketLogWriter creates a LogWriter which sends each record to hostport
+// as a JSON object.
 func NewSocketLogWriter(proto, hostport string) SocketLogWriter {
+	return NewSocketLogWriterWithEncoder(proto, hostport, nil)
+}
+
+// NewSocketLogWriterWithEncoder creates a LogWriter which sends each record to
+// hostport encoded with enc.
+func NewSocketLogWriterWithEncoder(proto, hostport string, enc Encoder) SocketLogWriter {
+	w := NewSocketLogWriterCompressed(proto, hostport, enc, "")
+	if w == nil {
+		return nil
+	}
+	return w.records
+}
+
+// NewSocketLogWriterCompressed creates a writer which sends each record to
+// hostport encoded with enc, or as a JSON object if enc is nil, compressed
+// with the given method, "gz" or "snappy".  Stream connections are compressed
+// as one continuous stream, flushed after each batch of records; datagrams are
+// compressed individually.  With no method, records are sent as they are.
+func NewSocketLogWriterCompressed(proto, hostport string, enc Encoder, method CompressionMethod) *SocketLogWriterImp {
+	switch method {
+	case "", COMPRESSION_GZIP, COMPRESSION_SNAPPY:
+	default:
+		fmt.Fprintf(os.Stderr, "NewSocketLogWriter(%q): Unknown compression method: %q\n", hostport, method)
+		return nil
+	}
+	if enc == nil {
+		enc = EncoderFunc(func(rec *LogRecord) ([]byte, error) {
+			return json.Marshal(rec)
+		})
+	}
+
 	sock, err := net.Dial(proto, hostport)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "NewSocketLogWriter(%q): %s\n", hostport, err)
 		return nil
 	}
 
-	w := SocketLogWriter(make(chan *LogRecord, LogBufferLength))
+	w := &SocketLogWriterImp{
+		records:   make(SocketLogWriter, LogBufferLength),
+		queue:     newQueueTracker(),
+		cfg:       make(chan func()),
+		completed: make(chan int),
+		proto:     proto,
+		hostport:  hostport,
+		sock:      sock,
+		datagram:  isDatagramProto(proto),
+		enc:       enc,
+
+		compression:  method,
+		maxDatagram:  SocketMaxDatagramSize,
+		reconnectMin: SocketReconnectMin,
+		reconnectMax: SocketReconnectMax,
+		replayLength: SocketReplayLength,
+	}
+	go w.run()
+	return w
+}
+
+func (w *SocketLogWriterImp) run() {
+	defer close(w.completed)
+	defer func() {
+		if w.sock != nil && w.proto == "tcp" {
+			w.sock.Close()
+		}
+	}()
 
-	go func() {
-		defer func() {
-			if sock != nil && proto == "tcp" {
-				sock.Close()
+	if w.datagram {
+		for {
+			select {
+			case change := <-w.cfg:
+				change()
+			case rec, ok := <-w.records:
+				if !ok {
+					return
+				}
+				w.queue.pop()
+				// Datagrams are fire and forget, so the writer carries on
+				if err := w.sendDatagram(rec); err != nil {
+					fmt.Fprintf(os.Stderr, "SocketLogWriter(%q): Dropped record: %s\n", w.hostport, err)
+				}
 			}
-		}()
+		}
+	}
 
-		for rec := range w {
-			// Marshall into JSON
-			js, err := json.Marshal(rec)
-			if err != nil {
-				fmt.Fprint(os.Stderr, "SocketLogWriter(%q): %s", hostport, err)
-				return
+	batch := make([]*LogRecord, 0, SocketMaxBatch)
+	var retry <-chan time.Time
+	var backoff time.Duration
+
+	for {
+		// While disconnected, hold records until the next attempt to reconnect
+		if w.sock == nil {
+			select {
+			case change := <-w.cfg:
+				change()
+			case rec, ok := <-w.records:
+				if !ok {
+					// One last try before giving up on what is held
+					if err := w.reconnect(); err != nil {
+						w.dropped += uint64(len(w.replay))
+						w.reportDropped()
+					} else if w.comp != nil {
+						w.comp.Close()
+					}
+					return
+				}
+				w.queue.pop()
+				w.hold(rec)
+			case <-retry:
+				if err := w.reconnect(); err != nil {
+					if backoff *= 2; backoff > w.reconnectMax {
+						backoff = w.reconnectMax
+					}
+					retry = time.After(backoff)
+				}
 			}
+			continue
+		}
 
-			_, err = sock.Write(js)
-			if err != nil {
-				fmt.Fprint(os.Stderr, "SocketLogWriter(%q): %s", hostport, err)
+		var rec *LogRecord
+		var ok bool
+		select {
+		case change := <-w.cfg:
+			change()
+			continue
+		case rec, ok = <-w.records:
+		}
+		if !ok {
+			if w.comp != nil {
+				w.comp.Close()
+			}
+			return
+		}
+		w.queue.pop()
+
+		// Settings take effect with the first record
+		if w.out == nil {
+			if err := w.connected(w.sock); err != nil {
+				fmt.Fprintf(os.Stderr, "SocketLogWriter(%q): %s\n", w.hostport, err)
 				return
 			}
 		}
-	}()
 
-	return w
+		// Gather up whatever else is already waiting
+		batch = append(batch[:0], rec)
+	gather:
+		for len(batch) < SocketMaxBatch {
+			select {
+			case rec, ok := <-w.records:
+				if !ok {
+					break gather
+				}
+				w.queue.pop()
+				batch = append(batch, rec)
+			default:
+				break gather
+			}
+		}
+
+		if err := w.send(batch); err != nil {
+			fmt.Fprintf(os.Stderr, "SocketLogWriter(%q): %s; reconnecting\n", w.hostport, err)
+			w.disconnect()
+			for _, rec := range batch {
+				w.hold(rec)
+			}
+			backoff = w.reconnectMin
+			retry = time.After(backoff)
+		}
+	}
+}
+
+// Start writing to a new stream connection, compressing what is written to
+// it if configured to
+func (w *SocketLogWriterImp) connected(sock net.Conn) error {
+	w.sock, w.out, w.comp = sock, sock, nil
+	w.applyKeepAlive()
+	if len(w.compression) > 0 {
+		comp, err := newCompressor(sock, w.compression)
+		if err != nil {
+			return err
+		}
+		w.out, w.comp = comp, comp
+	}
+	return nil
+}
+
+// Close a failed stream connection
+func (w *SocketLogWriterImp) disconnect() {
+	w.sock.Close()
+	w.sock, w.out, w.comp = nil, nil, nil
+}
+
+// Dial again, and send the records held while disconnected
+func (w *SocketLogWriterImp) reconnect() error {
+	sock, err := net.Dial(w.proto, w.hostport)
+	if err != nil {
+		return err
+	}
+	if err := w.connected(sock); err != nil {
+		w.disconnect()
+		return err
+	}
+	for len(w.replay) > 0 {
+		n := len(w.replay)
+		if n > SocketMaxBatch {
+			n = SocketMaxBatch
+		}
+		if err := w.send(w.replay[:n]); err != nil {
+			w.disconnect()
+			return err
+		}
+		w.replay = w.replay[n:]
+	}
+	w.replay = nil
+	fmt.Fprintf(os.Stderr, "SocketLogWriter(%q): Reconnected\n", w.hostport)
+	w.reportDropped()
+	return nil
+}
+
+// Hold a record to send once reconnected, dropping the oldest held if there
+// are too many
+func (w *SocketLogWriterImp) hold(rec *LogRecord) {
+	w.replay = append(w.replay, rec)
+	if over := len(w.replay) - w.replayLength; over > 0 {
+		w.replay = w.replay[over:]
+		w.dropped += uint64(over)
+	}
+}
+
+// Note any records dropped while disconnected
+func (w *SocketLogWriterImp) reportDropped() {
+	if w.dropped == 0 {
+		return
+	}
+	if _, err := fmt.Fprintf(os.Stderr, "SocketLogWriter(%q): Dropped %d previous log message(s)\n", w.hostport, w.dropped); err == nil {
+		w.dropped = 0
+	}
+}
+
+// Write a batch of records to the stream, flushing the compressor after it
+func (w *SocketLogWriterImp) send(batch []*LogRecord) error {
+	for _, rec := range batch {
+		js, err := encodeRecord(w.enc, rec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "SocketLogWriter(%q): Dropped record: %s\n", w.hostport, err)
+			continue
+		}
+		if _, err = w.out.Write(js); err != nil {
+			return err
+		}
+	}
+	if w.comp != nil {
+		return w.comp.Flush()
+	}
+	return nil
+}
+
+// Send a record as a datagram, compressing and chunking it as necessary
+func (w *SocketLogWriterImp) sendDatagram(rec *LogRecord) error {
+	js, err := encodeRecord(w.enc, rec)
+	if err != nil {
+		return err
+	}
+	truncate := w.datagramPolicy == DatagramTruncate && len(js) > w.maxDatagram
+	if truncate {
+		js = truncateRecord(js, w.maxDatagram)
+	}
+	if len(w.compression) > 0 {
+		if js, err = compressBytes(js, w.compression); err != nil {
+			return err
+		}
+	}
+
+	if len(js) > w.maxDatagram {
+		// A record too large to send is dropped, but the writer carries on
+		if w.datagramPolicy == DatagramTruncate {
+			err = fmt.Errorf("compressed record of %d bytes is larger than the datagram size %d", len(js), w.maxDatagram)
+		} else {
+			err = writeChunked(w.sock, js, w.maxDatagram)
+		}
+		if err != nil {
+			atomic.AddUint64(&w.counters.oversized, 1)
+			fmt.Fprintf(os.Stderr, "SocketLogWriter(%q): Dropped record: %s\n", w.hostport, err)
+			return nil
+		}
+		atomic.AddUint64(&w.counters.split, 1)
+		atomic.AddUint64(&w.counters.sent, 1)
+		return nil
+	}
+
+	if _, err = w.sock.Write(js); err != nil {
+		return err
+	}
+	if truncate {
+		atomic.AddUint64(&w.counters.truncated, 1)
+	}
+	atomic.AddUint64(&w.counters.sent, 1)
+	return nil
+}
+
+// Whether proto sends discrete datagrams rather than a stream
+func isDatagramProto(proto string) bool {
+	switch proto {
+	case "udp", "udp4", "udp6", "unixgram", "ip", "ip4", "ip6":
+		return true
+	}
+	return strings.HasPrefix(proto, "ip:") || strings.HasPrefix(proto, "ip4:") || strings.HasPrefix(proto, "ip6:")
+}
+
+// Split a message that won't fit in one datagram into GELF-style chunks
+func writeChunked(sock io.Writer, msg []byte, maxSize int) error {
+	payload := maxSize - chunkHeaderSize
+	if payload <= 0 {
+		return fmt.Errorf("datagram size %d too small to chunk", maxSize)
+	}
+	count := (len(msg) + payload - 1) / payload
+	if count > chunkMaxCount {
+		return fmt.Errorf("message of %d bytes needs %d chunks, more than the maximum of %d", len(msg), count, chunkMaxCount)
+	}
+
+	header := make([]byte, chunkHeaderSize, maxSize)
+	copy(header, chunkMagic)
+	id := atomic.AddUint64(&chunkMessageID, 1) ^ uint64(time.Now().UnixNano())
+	binary.BigEndian.PutUint64(header[2:10], id)
+	header[11] = byte(count)
+
+	for seq := 0; seq < count; seq++ {
+		end := (seq + 1) * payload
+		if end > len(msg) {
+			end = len(msg)
+		}
+		header[10] = byte(seq)
+		if _, err := sock.Write(append(header, msg[seq*payload:end]...)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,113 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+// SQLiteDriver is the name of the database/sql driver a SQLiteLogWriter
+// opens its file with.  The package doesn't include one; the program must
+// import a SQLite driver registered under this name, such as
+// github.com/mattn/go-sqlite3, which registers "sqlite3".
+var SQLiteDriver = "sqlite3"
+
+// The table a SQLiteLogWriter creates and inserts into
+const sqliteTable = "logs"
+
+var sqliteSchema = []string{
+	// Only takes effect before the first table is created, letting pruned
+	// pages be handed back to the file system
+	"PRAGMA auto_vacuum = INCREMENTAL",
+	"CREATE TABLE IF NOT EXISTS " + sqliteTable + " (" +
+		"id INTEGER PRIMARY KEY AUTOINCREMENT, " +
+		"time TIMESTAMP NOT NULL, " +
+		"level TEXT NOT NULL, " +
+		"source TEXT, " +
+		"message TEXT, " +
+		"fields TEXT)",
+	"CREATE INDEX IF NOT EXISTS " + sqliteTable + "_time ON " + sqliteTable + " (time)",
+}
+
+// SQLiteLogWriter keeps records in a table named logs in a local SQLite
+// file, with columns id, time (indexed), level, source, message and fields
+// (a JSON object), creating the table if needed.  If a maximum size is set,
+// the oldest tenth of the records is deleted whenever the file grows past
+// it.  Batches are inserted as by DBLogWriter, one at a time.
+type SQLiteLogWriter struct {
+	*DBLogWriter
+
+	filename string
+	maxSize  int64
+
+	// Times the file has been pruned (accessed atomically)
+	prunes uint64
+}
+
+// NewSQLiteLogWriter creates a LogWriter which inserts records into the
+// SQLite file filename, creating it if it doesn't exist.
+func NewSQLiteLogWriter(filename string) *SQLiteLogWriter {
+	db, err := sql.Open(SQLiteDriver, filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "NewSQLiteLogWriter(%q): %s\n", filename, err)
+		return nil
+	}
+	for _, stmt := range sqliteSchema {
+		if _, err := db.Exec(stmt); err != nil {
+			fmt.Fprintf(os.Stderr, "NewSQLiteLogWriter(%q): Could not create table: %s\n", filename, err)
+			db.Close()
+			return nil
+		}
+	}
+
+	dw := NewDBLogWriter(db, sqliteTable)
+	if dw == nil {
+		db.Close()
+		return nil
+	}
+	dw.closeDB = true
+	dw.SetColumns(DBColumns{Time: "time", Level: "level", Source: "source", Message: "message", Fields: "fields"})
+	dw.maxInFlight = 1 // SQLite takes one writer at a time
+
+	w := &SQLiteLogWriter{DBLogWriter: dw, filename: filename}
+	dw.inserted = w.prune
+	return w
+}
+
+// SetMaxSize sets the size in bytes past which the oldest records are
+// deleted, or lets the file grow if it is zero (chainable).  Must be called
+// before the first log message is written.
+func (w *SQLiteLogWriter) SetMaxSize(maxSize int64) *SQLiteLogWriter {
+	w.maxSize = maxSize
+	return w
+}
+
+// Prunes returns how many times the oldest records have been deleted to keep
+// the file under its maximum size.
+func (w *SQLiteLogWriter) Prunes() uint64 {
+	return atomic.LoadUint64(&w.prunes)
+}
+
+// Delete the oldest tenth of the records if the file has grown too large
+func (w *SQLiteLogWriter) prune() error {
+	if w.maxSize <= 0 {
+		return nil
+	}
+	info, err := os.Stat(w.filename)
+	if err != nil || info.Size() <= w.maxSize {
+		return nil
+	}
+
+	if _, err := w.db.Exec("DELETE FROM " + sqliteTable + " WHERE id <= " +
+		"(SELECT MIN(id) FROM " + sqliteTable + ") + (SELECT COUNT(*) FROM " + sqliteTable + ") / 10"); err != nil {
+		return fmt.Errorf("could not prune: %s", err)
+	}
+	if _, err := w.db.Exec("PRAGMA incremental_vacuum"); err != nil {
+		return fmt.Errorf("could not vacuum: %s", err)
+	}
+	atomic.AddUint64(&w.prunes, 1)
+	return nil
+}
@@ -0,0 +1,307 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SyslogFacility is the syslog facility records are logged under.
+type SyslogFacility int
+
+const (
+	SyslogKern SyslogFacility = iota
+	SyslogUser
+	SyslogMail
+	SyslogDaemon
+	SyslogAuth
+	SyslogSyslog
+	SyslogLpr
+	SyslogNews
+	SyslogUucp
+	SyslogCron
+	SyslogAuthpriv
+	SyslogFtp
+	_ // ntp
+	_ // log audit
+	_ // log alert
+	_ // clock
+	SyslogLocal0
+	SyslogLocal1
+	SyslogLocal2
+	SyslogLocal3
+	SyslogLocal4
+	SyslogLocal5
+	SyslogLocal6
+	SyslogLocal7
+)
+
+var syslogFacilityNames = map[string]SyslogFacility{
+	"kern":     SyslogKern,
+	"user":     SyslogUser,
+	"mail":     SyslogMail,
+	"daemon":   SyslogDaemon,
+	"auth":     SyslogAuth,
+	"syslog":   SyslogSyslog,
+	"lpr":      SyslogLpr,
+	"news":     SyslogNews,
+	"uucp":     SyslogUucp,
+	"cron":     SyslogCron,
+	"authpriv": SyslogAuthpriv,
+	"ftp":      SyslogFtp,
+	"local0":   SyslogLocal0,
+	"local1":   SyslogLocal1,
+	"local2":   SyslogLocal2,
+	"local3":   SyslogLocal3,
+	"local4":   SyslogLocal4,
+	"local5":   SyslogLocal5,
+	"local6":   SyslogLocal6,
+	"local7":   SyslogLocal7,
+}
+
+// ParseSyslogFacility returns the facility with the given name, such as
+// "daemon" or "local0".
+func ParseSyslogFacility(name string) (SyslogFacility, bool) {
+	facility, ok := syslogFacilityNames[strings.ToLower(name)]
+	return facility, ok
+}
+
+// SyslogFormat is the layout of the messages a SyslogLogWriter sends.
+type SyslogFormat int
+
+const (
+	// The current syslog protocol, with full timestamps
+	SyslogRFC5424 SyslogFormat = iota
+
+	// The older BSD syslog format, for collectors which predate RFC 5424
+	SyslogRFC3164
+)
+
+// Where the local syslog daemon listens, on the systems that have one
+var syslogLocalPaths = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// SyslogLogWriter sends records to a syslog daemon, local or remote.
+type SyslogLogWriter struct {
+	records   chan *LogRecord
+	queue     *queueTracker
+	completed chan int
+
+	network, raddr string
+	sock           net.Conn
+	datagram       bool
+
+	facility SyslogFacility
+	appName  string
+	hostname string
+	pid      int
+	format   SyslogFormat
+	enc      Encoder
+}
+
+// NewSyslogLogWriter creates a LogWriter which sends each record to the
+// syslog daemon at raddr over network ("unixgram", "udp" or "tcp"), logged
+// under facility as appName.  If network is empty, the local daemon is used.
+// An empty appName is taken from the program's name.
+func NewSyslogLogWriter(network, raddr string, facility SyslogFacility, appName string) *SyslogLogWriter {
+	sock, err := dialSyslog(network, raddr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "NewSyslogLogWriter(%q): %s\n", raddr, err)
+		return nil
+	}
+	return newSyslogLogWriter(sock, network, raddr, facility, appName)
+}
+
+// NewSyslogLogWriterTLS creates a LogWriter which sends each record to the
+// syslog daemon at raddr over TLS, as RFC 5425 describes, so that records
+// can cross untrusted networks.  config gives the certificates to trust and
+// any client certificate to present; if its ServerName is empty, it is taken
+// from raddr.
+func NewSyslogLogWriterTLS(raddr string, config *tls.Config, facility SyslogFacility, appName string) *SyslogLogWriter {
+	sock, err := tls.Dial("tcp", raddr, config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "NewSyslogLogWriterTLS(%q): %s\n", raddr, err)
+		return nil
+	}
+	return newSyslogLogWriter(sock, "tls", raddr, facility, appName)
+}
+
+func newSyslogLogWriter(sock net.Conn, network, raddr string, facility SyslogFacility, appName string) *SyslogLogWriter {
+	if len(appName) == 0 {
+		appName = filepath.Base(os.Args[0])
+	}
+	hostname, _ := os.Hostname()
+	if len(hostname) == 0 {
+		hostname = "-"
+	}
+
+	w := &SyslogLogWriter{
+		records:   make(chan *LogRecord, LogBufferLength),
+		queue:     newQueueTracker(),
+		completed: make(chan int),
+		network:   network,
+		raddr:     raddr,
+		sock:      sock,
+		datagram:  isDatagramProto(sock.RemoteAddr().Network()),
+		facility:  facility,
+		appName:   appName,
+		hostname:  hostname,
+		pid:       os.Getpid(),
+		enc:       NewFormatEncoder("%M"),
+	}
+	go w.run()
+	return w
+}
+
+// Connect to the syslog daemon, looking for the local one if network is empty
+func dialSyslog(network, raddr string) (net.Conn, error) {
+	if len(network) > 0 {
+		return net.Dial(network, raddr)
+	}
+	paths := syslogLocalPaths
+	if len(raddr) > 0 {
+		paths = []string{raddr}
+	}
+	for _, path := range paths {
+		for _, network := range []string{"unixgram", "unix"} {
+			if sock, err := net.Dial(network, path); err == nil {
+				return sock, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no local syslog daemon found")
+}
+
+// Build a TLS configuration trusting the certificates in caFile, or the
+// system's if it is empty, and presenting the client certificate in certFile
+// and keyFile, if given
+func loadTLSConfig(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName}
+	if len(caFile) > 0 {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+	if len(certFile) > 0 || len(keyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// This is the SyslogLogWriter's output method
+func (w *SyslogLogWriter) LogWrite(rec *LogRecord) {
+	w.queue.push(time.Now())
+	w.records <- rec
+}
+
+// QueueStats reports on the records waiting to be sent.
+func (w *SyslogLogWriter) QueueStats() QueueStats {
+	return QueueStats{
+		Length:    len(w.records),
+		Capacity:  cap(w.records),
+		OldestAge: w.queue.oldestAge(time.Now()),
+	}
+}
+
+// Close sends any queued records and closes the connection.
+func (w *SyslogLogWriter) Close() {
+	close(w.records)
+	<-w.completed
+}
+
+// SetSyslogFormat sets the layout of the messages sent, RFC 5424 by default
+// (chainable).  Must be called before the first log message is written.
+func (w *SyslogLogWriter) SetSyslogFormat(format SyslogFormat) *SyslogLogWriter {
+	w.format = format
+	return w
+}
+
+// SetFormat sets the format of the message part of each syslog message, "%M"
+// by default, as for FormatLogRecord (chainable).  The time, level and
+// program are already in the syslog header.  Must be called before the first
+// log message is written.
+func (w *SyslogLogWriter) SetFormat(format string) *SyslogLogWriter {
+	w.enc = NewFormatEncoder(format)
+	return w
+}
+
+// SetEncoder sets how the message part of each syslog message is written, in
+// place of a format (chainable).  A trailing newline is removed.  Must be
+// called before the first log message is written.
+func (w *SyslogLogWriter) SetEncoder(enc Encoder) *SyslogLogWriter {
+	w.enc = enc
+	return w
+}
+
+// SetHostname sets the host name sent with each message, the machine's own
+// by default (chainable).  Must be called before the first log message is
+// written.
+func (w *SyslogLogWriter) SetHostname(hostname string) *SyslogLogWriter {
+	w.hostname = hostname
+	return w
+}
+
+func (w *SyslogLogWriter) run() {
+	defer close(w.completed)
+	defer w.sock.Close()
+
+	for rec := range w.records {
+		w.queue.pop()
+		msg, err := w.message(rec)
+		if err == nil {
+			_, err = w.sock.Write(msg)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "SyslogLogWriter(%q): %s\n", w.raddr, err)
+		}
+	}
+}
+
+// Build the syslog message for a record, framed for the connection
+func (w *SyslogLogWriter) message(rec *LogRecord) ([]byte, error) {
+	body, err := encodeRecord(w.enc, rec)
+	if err != nil {
+		return nil, err
+	}
+	body = bytes.TrimRight(body, "\n")
+
+	pri := int(w.facility)*8 + syslogSeverity(rec.Level)
+	var buf bytes.Buffer
+	switch w.format {
+	case SyslogRFC3164:
+		fmt.Fprintf(&buf, "<%d>%s %s %s[%d]: ", pri, rec.Created.Format(time.Stamp), w.hostname, w.appName, w.pid)
+	default:
+		fmt.Fprintf(&buf, "<%d>1 %s %s %s %d - - ", pri, rec.Created.Format("2006-01-02T15:04:05.000000Z07:00"), w.hostname, w.appName, w.pid)
+	}
+	buf.Write(body)
+
+	if w.datagram {
+		return buf.Bytes(), nil
+	}
+
+	// Streams need each message framed: RFC 5424 messages by their length,
+	// as RFC 6587 has it, and older ones by a newline
+	if w.format == SyslogRFC3164 {
+		buf.WriteByte('\n')
+		return buf.Bytes(), nil
+	}
+	return append([]byte(strconv.Itoa(buf.Len())+" "), buf.Bytes()...), nil
+}
@@ -3,13 +3,70 @@
 package log4go
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"os"
+	"strings"
+	"time"
 )
 
 var stdout io.Writer = os.Stdout
 
+// A ConsolePalette gives the ANSI SGR parameters, such as "31" for red or
+// "1;31" for bold red, that records at each level are colored with.  Levels
+// left out are written uncolored.
+type ConsolePalette map[Level]string
+
+// DefaultConsolePalette dims the most verbose levels and colors warnings and
+// errors.
+var DefaultConsolePalette = ConsolePalette{
+	FINEST:   "2",
+	FINE:     "2",
+	WARNING:  "33",
+	ERROR:    "31",
+	CRITICAL: "1;31",
+}
+
+// ParseConsolePalette reads a palette from a comma-separated list of
+// level=parameters pairs, such as "WARNING=33, ERROR=1;31".
+func ParseConsolePalette(value string) (ConsolePalette, error) {
+	palette := make(ConsolePalette)
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); len(pair) == 0 {
+			continue
+		}
+		eq := strings.Index(pair, "=")
+		if eq <= 0 {
+			return nil, fmt.Errorf("%q should be level=parameters", pair)
+		}
+		lvl, ok := ParseLevel(strings.TrimSpace(pair[:eq]))
+		if !ok {
+			return nil, fmt.Errorf("unknown level %q", pair[:eq])
+		}
+		params := strings.TrimSpace(pair[eq+1:])
+		if strings.Trim(params, "0123456789;") != "" {
+			return nil, fmt.Errorf("%q should be numbers separated by semicolons", params)
+		}
+		palette[lvl] = params
+	}
+	return palette, nil
+}
+
+// Whether colors should be written to out: only to a terminal, and not if
+// NO_COLOR is set (see no-color.org)
+func consoleColorEnabled(out io.Writer) bool {
+	if len(os.Getenv("NO_COLOR")) > 0 {
+		return false
+	}
+	f, ok := out.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
 /* ConsoleLogWriter was previously a channel which would let you do things
 like pass nil values instead. We chagned it to a struct so we could
 dangle some extra attributes on it. So that we don't have to go rework
@@ -24,14 +81,52 @@ type ConsoleLogWriter interface {
 // This is the standard writer that prints to standard output.
 type ConsoleLogWriterImp struct {
 	records   chan *LogRecord
+	queue     *queueTracker
 	completed chan int
+
+	// How records are written, if not in the usual layout
+	enc Encoder
+
+	// Colors for each level, if coloring
+	palette ConsolePalette
 }
 
 // This creates a new ConsoleLogWriter
 func NewConsoleLogWriter() ConsoleLogWriter {
+	return NewConsoleLogWriterWithEncoder(nil)
+}
+
+// NewConsoleLogWriterWithEncoder creates a ConsoleLogWriter which writes
+// records with the given encoder, such as a FormatEncoder or JSONEncoder.  A
+// nil encoder gives the usual layout.
+func NewConsoleLogWriterWithEncoder(enc Encoder) ConsoleLogWriter {
+	writer := ConsoleLogWriterImp{
+		records:   make(chan *LogRecord, LogBufferLength),
+		queue:     newQueueTracker(),
+		completed: make(chan int),
+		enc:       enc,
+	}
+	go writer.run(stdout)
+	return writer
+}
+
+// NewColorConsoleLogWriter creates a ConsoleLogWriter which colors each
+// record by its level from palette, or DefaultConsolePalette if that is nil,
+// and writes it with enc as NewConsoleLogWriterWithEncoder does.  Colors are
+// left out when standard output isn't a terminal or NO_COLOR is set.
+func NewColorConsoleLogWriter(enc Encoder, palette ConsolePalette) ConsoleLogWriter {
+	if palette == nil {
+		palette = DefaultConsolePalette
+	}
+	if !consoleColorEnabled(stdout) {
+		palette = nil
+	}
 	writer := ConsoleLogWriterImp{
 		records:   make(chan *LogRecord, LogBufferLength),
+		queue:     newQueueTracker(),
 		completed: make(chan int),
+		enc:       enc,
+		palette:   palette,
 	}
 	go writer.run(stdout)
 	return writer
@@ -40,12 +135,33 @@ func NewConsoleLogWriter() ConsoleLogWriter {
 func (w ConsoleLogWriterImp) run(out io.Writer) {
 	var timestr string
 	var timestrAt int64
+	var line bytes.Buffer
 
 	for rec := range w.records {
-		if at := rec.Created.UnixNano() / 1e9; at != timestrAt {
-			timestr, timestrAt = rec.Created.Format("01/02/06 15:04:05"), at
+		w.queue.pop()
+		line.Reset()
+		if w.enc != nil {
+			buf, err := encodeRecord(w.enc, rec)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ConsoleLogWriter: %s\n", err)
+				continue
+			}
+			line.Write(buf)
+		} else {
+			if at := rec.Created.UnixNano() / 1e9; at != timestrAt {
+				timestr, timestrAt = rec.Created.Format("01/02/06 15:04:05"), at
+			}
+			fmt.Fprint(&line, "[", timestr, "] [", levelStrings[rec.Level], "] ", rec.Message, "\n")
+		}
+
+		// The color is reset before the newline, so that nothing else on the
+		// terminal picks it up
+		if params := w.palette[rec.Level]; len(params) > 0 {
+			text := bytes.TrimRight(line.Bytes(), "\n")
+			fmt.Fprintf(out, "\x1b[%sm%s\x1b[0m\n", params, text)
+			continue
 		}
-		fmt.Fprint(out, "[", timestr, "] [", levelStrings[rec.Level], "] ", rec.Message, "\n")
+		out.Write(line.Bytes())
 	}
 	close(w.completed)
 }
@@ -53,9 +169,19 @@ func (w ConsoleLogWriterImp) run(out io.Writer) {
 // This is the ConsoleLogWriter's output method.  This will block if the output
 // buffer is full.
 func (w ConsoleLogWriterImp) LogWrite(rec *LogRecord) {
+	w.queue.push(time.Now())
 	w.records <- rec
 }
 
+// QueueStats reports on the records waiting to be written.
+func (w ConsoleLogWriterImp) QueueStats() QueueStats {
+	return QueueStats{
+		Length:    len(w.records),
+		Capacity:  cap(w.records),
+		OldestAge: w.queue.oldestAge(time.Now()),
+	}
+}
+
 // Close stops the logger from sending messages to standard output.  Attempts to
 // send log messages to this logger after a Close have undefined behavior.
 func (w ConsoleLogWriterImp) Close() {
@@ -0,0 +1,108 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TransformLogWriter wraps another LogWriter and runs each record through a
+// chain of Processors before handing it on.  Records are shared between all
+// of a Logger's filters, so the transforms are given a private copy; this lets
+// one Logger feed writers with different requirements (level names, source
+// paths, etc) without them interfering with each other.
+type TransformLogWriter struct {
+	LogWriter
+	transforms []Processor
+}
+
+// NewTransformLogWriter returns a LogWriter which applies the transforms, in
+// order, to a copy of each record before writing it to w.  A transform which
+// returns nil causes the record to be dropped for this writer only.
+func NewTransformLogWriter(w LogWriter, transforms ...Processor) *TransformLogWriter {
+	return &TransformLogWriter{
+		LogWriter:  w,
+		transforms: transforms,
+	}
+}
+
+// Unwrap returns the writer being decorated.
+func (w *TransformLogWriter) Unwrap() LogWriter {
+	return w.LogWriter
+}
+
+// This is the TransformLogWriter's output method
+func (w *TransformLogWriter) LogWrite(rec *LogRecord) {
+	copied := *rec
+	copied.encoded = nil
+	if rec.Fields != nil {
+		copied.Fields = make(Fields, len(rec.Fields))
+		for k, v := range rec.Fields {
+			copied.Fields[k] = v
+		}
+	}
+	out := &copied
+	for _, t := range w.transforms {
+		if out = t.Process(out); out == nil {
+			return
+		}
+	}
+	w.LogWriter.LogWrite(out)
+}
+
+// RemapLevels returns a Processor which changes the level of records according
+// to mapping; levels not in the mapping are left alone.
+func RemapLevels(mapping map[Level]Level) Processor {
+	return ProcessorFunc(func(rec *LogRecord) *LogRecord {
+		if lvl, ok := mapping[rec.Level]; ok {
+			rec.Level = lvl
+		}
+		return rec
+	})
+}
+
+// TrimSourcePrefix returns a Processor which removes prefix from the front of
+// each record's source, e.g. to make source paths repository-relative.
+func TrimSourcePrefix(prefix string) Processor {
+	return ProcessorFunc(func(rec *LogRecord) *LogRecord {
+		rec.Source = strings.TrimPrefix(rec.Source, prefix)
+		return rec
+	})
+}
+
+// StripSource returns a Processor which clears each record's source.
+func StripSource() Processor {
+	return ProcessorFunc(func(rec *LogRecord) *LogRecord {
+		rec.Source = ""
+		return rec
+	})
+}
+
+func init() {
+	RegisterProcessor("remaplevels", func(props map[string]string) (Processor, error) {
+		mapping := make(map[Level]Level)
+		for from, to := range props {
+			fromLvl, ok := levelFromString(from)
+			if !ok {
+				return nil, fmt.Errorf("unknown level %q", from)
+			}
+			toLvl, ok := levelFromString(to)
+			if !ok {
+				return nil, fmt.Errorf("unknown level %q", to)
+			}
+			mapping[fromLvl] = toLvl
+		}
+		return RemapLevels(mapping), nil
+	})
+	RegisterProcessor("trimsource", func(props map[string]string) (Processor, error) {
+		prefix, ok := props["prefix"]
+		if !ok {
+			return nil, fmt.Errorf("required property %q missing", "prefix")
+		}
+		return TrimSourcePrefix(prefix), nil
+	})
+	RegisterProcessor("stripsource", func(props map[string]string) (Processor, error) {
+		return StripSource(), nil
+	})
+}
@@ -0,0 +1,254 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// An Uploader stores rotated log files somewhere else, such as object storage.
+type Uploader interface {
+	// Upload stores size bytes read from r under the name key
+	Upload(key string, r io.Reader, size int64) error
+}
+
+// ArchiveUploader ships the files a FileLogWriter rotates to an Uploader,
+// deleting the local copy once it has been stored.
+type ArchiveUploader struct {
+	uploader Uploader
+	prefix   string
+	keep     bool
+}
+
+// NewArchiveUploader creates an ArchiveUploader storing files with u.
+func NewArchiveUploader(u Uploader) *ArchiveUploader {
+	return &ArchiveUploader{uploader: u}
+}
+
+// SetPrefix puts prefix in front of the name of each uploaded file, which is
+// otherwise stored under its base name, e.g. "logs/web1/" (chainable).
+func (a *ArchiveUploader) SetPrefix(prefix string) *ArchiveUploader {
+	a.prefix = prefix
+	return a
+}
+
+// SetKeepLocal keeps rotated files after they've been uploaded, to be
+// compressed and aged off as usual (chainable).
+func (a *ArchiveUploader) SetKeepLocal(keep bool) *ArchiveUploader {
+	a.keep = keep
+	return a
+}
+
+// Watch makes w upload each file it rotates, replacing any rotation hook w
+// already had (chainable).  Uploads happen on w's background goroutine, and
+// failures are reported as rotation failures, leaving the file in place.
+func (a *ArchiveUploader) Watch(w *FileLogWriter) *FileLogWriter {
+	return w.SetRotationHook(a.Upload)
+}
+
+// Upload stores the file rotated from oldPath to newPath, and unless told to
+// keep it, removes it.  It has the signature of a rotation hook.
+func (a *ArchiveUploader) Upload(oldPath, newPath string) error {
+	file, err := os.Open(newPath)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	err = a.uploader.Upload(a.prefix+filepath.Base(newPath), file, info.Size())
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("Couldn't upload %q: %s", newPath, err)
+	}
+
+	if !a.keep {
+		return os.Remove(newPath)
+	}
+	return nil
+}
+
+// S3Uploader stores files in an Amazon S3 bucket, or any store with the same
+// API, signing requests with AWS Signature Version 4.
+type S3Uploader struct {
+	Bucket string
+	Region string
+
+	// Credentials; SessionToken is only needed for temporary credentials
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	// Endpoint, if set, is the URL of an S3-compatible store, which is
+	// addressed as Endpoint/Bucket/key
+	Endpoint string
+
+	// Client makes the requests, http.DefaultClient if nil
+	Client *http.Client
+}
+
+// Upload stores r in the bucket under key.
+func (s *S3Uploader) Upload(key string, r io.Reader, size int64) error {
+	host := s.Bucket + ".s3." + s.Region + ".amazonaws.com"
+	path := "/" + uriEncode(key)
+	target := "https://" + host + path
+	if len(s.Endpoint) > 0 {
+		u, err := url.Parse(s.Endpoint)
+		if err != nil {
+			return err
+		}
+		host = u.Host
+		path = strings.TrimSuffix(u.Path, "/") + "/" + uriEncode(s.Bucket) + path
+		target = u.Scheme + "://" + host + path
+	}
+
+	req, err := http.NewRequest("PUT", target, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	s.sign(req, host, path, time.Now().UTC())
+	return doUpload(s.Client, req)
+}
+
+// Add an AWS Signature Version 4 authorization to req.  The payload isn't
+// hashed, so that files can be streamed.
+func (s *S3Uploader) sign(req *http.Request, host, path string, now time.Time) {
+	const payloadHash = "UNSIGNED-PAYLOAD"
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if len(s.SessionToken) > 0 {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, "", canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+	scope := day + "/" + s.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretAccessKey), day)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Percent-encode a path as AWS requires: everything but unreserved characters
+// and slashes
+func uriEncode(s string) string {
+	var out bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9'),
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			out.WriteByte(c)
+		default:
+			fmt.Fprintf(&out, "%%%02X", c)
+		}
+	}
+	return out.String()
+}
+
+// GCSUploader stores files in a Google Cloud Storage bucket with the JSON
+// API's simple upload.
+type GCSUploader struct {
+	Bucket string
+
+	// Token returns an OAuth 2.0 access token with permission to write to the
+	// bucket, for example from the metadata server
+	Token func() (string, error)
+
+	// Endpoint, if set, replaces https://storage.googleapis.com
+	Endpoint string
+
+	// Client makes the requests, http.DefaultClient if nil
+	Client *http.Client
+}
+
+// Upload stores r in the bucket under key.
+func (g *GCSUploader) Upload(key string, r io.Reader, size int64) error {
+	endpoint := "https://storage.googleapis.com"
+	if len(g.Endpoint) > 0 {
+		endpoint = strings.TrimSuffix(g.Endpoint, "/")
+	}
+	target := endpoint + "/upload/storage/v1/b/" + url.PathEscape(g.Bucket) +
+		"/o?uploadType=media&name=" + url.QueryEscape(key)
+
+	req, err := http.NewRequest("POST", target, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if g.Token != nil {
+		token, err := g.Token()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return doUpload(g.Client, req)
+}
+
+// Send an upload request, turning unsuccessful responses into errors
+func doUpload(client *http.Client, req *http.Request) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -5,7 +5,6 @@ package log4go
 import (
 	"errors"
 	"fmt"
-	"os"
 	"strings"
 )
 
@@ -27,6 +26,11 @@ func AddFilter(name string, lvl Level, writer LogWriter) {
 	Global.AddFilter(name, lvl, writer)
 }
 
+// Wrapper for (*Logger).SetGlobalFields
+func SetGlobalFields(fields Fields) {
+	Global.SetGlobalFields(fields)
+}
+
 // Wrapper for (*Logger).Close (closes and removes all logwriters)
 func Close() {
 	Global.Close()
@@ -36,12 +40,14 @@ func Crash(args ...interface{}) {
 	if len(args) > 0 {
 		Global.intLogf(CRITICAL, strings.Repeat(" %v", len(args))[1:], args...)
 	}
+	RunShutdownHooks()
 	panic(args)
 }
 
 // Logs the given message and crashes the program
 func Crashf(format string, args ...interface{}) {
 	Global.intLogf(CRITICAL, format, args...)
+	RunShutdownHooks()
 	Global.Close() // so that hopefully the messages get logged
 	panic(fmt.Sprintf(format, args...))
 }
@@ -51,15 +57,17 @@ func Exit(args ...interface{}) {
 	if len(args) > 0 {
 		Global.intLogf(ERROR, strings.Repeat(" %v", len(args))[1:], args...)
 	}
+	RunShutdownHooks()
 	Global.Close() // so that hopefully the messages get logged
-	os.Exit(0)
+	exit(0)
 }
 
 // Compatibility with `log`
 func Exitf(format string, args ...interface{}) {
 	Global.intLogf(ERROR, format, args...)
+	RunShutdownHooks()
 	Global.Close() // so that hopefully the messages get logged
-	os.Exit(0)
+	exit(0)
 }
 
 // Compatibility with `log`
@@ -276,3 +284,25 @@ func Critical(arg0 interface{}, args ...interface{}) error {
 	}
 	return nil
 }
+
+// Logs the given message at the critical level, runs the shutdown hooks and
+// exits the program with status 1
+// Wrapper for (*Logger).Fatal
+func Fatal(arg0 interface{}, args ...interface{}) {
+	var msg string
+	switch first := arg0.(type) {
+	case string:
+		// Use the string as a format string
+		msg = fmt.Sprintf(first, args...)
+	case func() string:
+		// Log the closure (no other arguments used)
+		msg = first()
+	default:
+		// Build a format string so that it will be similar to Sprint
+		msg = fmt.Sprintf(fmt.Sprint(first)+strings.Repeat(" %v", len(args)), args...)
+	}
+	Global.intLogf(CRITICAL, "%s", msg)
+	RunShutdownHooks()
+	Global.Close() // so that hopefully the messages get logged
+	exit(1)
+}
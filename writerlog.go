@@ -0,0 +1,96 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// WriterLogWriter formats records and writes them to any io.Writer, such as
+// a pipe, a network connection or a buffer in a test, on its own goroutine
+// as FileLogWriter does.  If the io.Writer has a Flush method, as a
+// bufio.Writer does, it is flushed whenever the queue empties.
+type WriterLogWriter struct {
+	records   chan *LogRecord
+	queue     *queueTracker
+	completed chan int
+
+	out io.Writer
+	enc Encoder
+}
+
+// NewWriterLog creates a LogWriter which writes records to out in format.
+// out is left open when the writer is closed.
+func NewWriterLog(out io.Writer, format string) *WriterLogWriter {
+	w := &WriterLogWriter{
+		records:   make(chan *LogRecord, LogBufferLength),
+		queue:     newQueueTracker(),
+		completed: make(chan int),
+		out:       out,
+		enc:       NewFormatEncoder(format),
+	}
+	go w.run()
+	return w
+}
+
+// SetEncoder sets how records are written, in place of the format the
+// writer was created with (chainable).  Must be called before the first log
+// message is written.
+func (w *WriterLogWriter) SetEncoder(enc Encoder) *WriterLogWriter {
+	w.enc = enc
+	return w
+}
+
+// This is the WriterLogWriter's output method.  This will block if the
+// output buffer is full.
+func (w *WriterLogWriter) LogWrite(rec *LogRecord) {
+	w.queue.push(time.Now())
+	w.records <- rec
+}
+
+// QueueStats reports on the records waiting to be written.
+func (w *WriterLogWriter) QueueStats() QueueStats {
+	return QueueStats{
+		Length:    len(w.records),
+		Capacity:  cap(w.records),
+		OldestAge: w.queue.oldestAge(time.Now()),
+	}
+}
+
+// Close writes any queued records and flushes the io.Writer.
+func (w *WriterLogWriter) Close() {
+	close(w.records)
+	<-w.completed
+}
+
+func (w *WriterLogWriter) run() {
+	defer close(w.completed)
+	flusher, _ := w.out.(interface {
+		Flush() error
+	})
+
+	// Failures are reported when they start, and not again until writing
+	// has succeeded
+	failing := false
+	report := func(err error) {
+		if err != nil && !failing {
+			fmt.Fprintf(os.Stderr, "WriterLogWriter(%T): %s\n", w.out, err)
+		}
+		failing = err != nil
+	}
+
+	for rec := range w.records {
+		w.queue.pop()
+		buf, err := encodeRecord(w.enc, rec)
+		if err == nil {
+			_, err = w.out.Write(buf)
+		}
+		if err == nil && flusher != nil && len(w.records) == 0 {
+			err = flusher.Flush()
+		}
+		report(err)
+	}
+}